@@ -0,0 +1,152 @@
+package simplemqhttp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// attributesPrefix は、メッセージ属性を含むメッセージの先頭に付与される識別子です。
+// SimpleMQ のメッセージには内容以外の属性がないため、属性を形式に含められないシリアライザでは、属性を内容の先頭に埋め込みます。
+const attributesPrefix = "simplemqhttp-attributes:"
+
+// attributeSerializer は、メッセージ属性を自身の形式の中に含めて運ぶシリアライザです。
+// 内容の先頭に属性を埋め込むと、JSON などの形式の内容として読めなくなり、暗号化するシリアライザでは属性が平文で残るため、
+// これらのシリアライザは属性を形式のフィールドや暗号化する内容に含めます。
+type attributeSerializer interface {
+	serializeWithAttributes(req *http.Request, attributes http.Header) (string, error)
+	deserializeWithAttributes(content string) (*http.Request, http.Header, error)
+}
+
+var (
+	_ attributeSerializer = &EnvelopeSerializer{}
+	_ attributeSerializer = &JSONSerializer{}
+	_ attributeSerializer = &EncryptingSerializer{}
+	_ attributeSerializer = &SerializerRegistry{}
+)
+
+// serializeWithAttributes は、s でリクエストをシリアライズし、メッセージ属性を付与します。
+// s が属性を形式に含められない場合は、内容の先頭に埋め込みます。
+func serializeWithAttributes(s Serializer, req *http.Request, attributes http.Header) (string, error) {
+	if as, ok := s.(attributeSerializer); ok {
+		return as.serializeWithAttributes(req, attributes)
+	}
+	if len(attributes) > 0 && encryptsContent(s) {
+		return "", errors.New("message attributes cannot be sent with a serializer that encrypts content because they are not encrypted")
+	}
+	content, err := s.Serialize(req)
+	if err != nil {
+		return "", err
+	}
+	return encodeAttributes(attributes, content)
+}
+
+// deserializeWithAttributes は、s でメッセージの内容をデシリアライズし、メッセージ属性を取り出します。
+func deserializeWithAttributes(s Serializer, content string) (*http.Request, http.Header, error) {
+	if as, ok := s.(attributeSerializer); ok {
+		return as.deserializeWithAttributes(content)
+	}
+	attributes, rest := decodeAttributes(content)
+	req, err := s.Deserialize(rest)
+	return req, attributes, err
+}
+
+// mergeAttributes は、内容の先頭に埋め込まれていた属性に、形式に含まれていた属性を加えます。
+// 属性を形式に含める前に送信されたメッセージも復元できるよう、両方を受け付けます。
+func mergeAttributes(prefixed, carried http.Header) http.Header {
+	if len(carried) == 0 {
+		return prefixed
+	}
+	if prefixed == nil {
+		prefixed = http.Header{}
+	}
+	for key, values := range carried {
+		prefixed[http.CanonicalHeaderKey(key)] = values
+	}
+	return prefixed
+}
+
+// applyAttributes は、メッセージ属性をリクエストヘッダーに設定します。
+// シリアライザが復元したヘッダーは送信時のリクエストの値であるため、同じ名前のヘッダーがある場合は上書きしません。
+func applyAttributes(header, attributes http.Header) {
+	for key, values := range attributes {
+		key = http.CanonicalHeaderKey(key)
+		if _, ok := header[key]; ok {
+			continue
+		}
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+}
+
+// encodeAttributes は、ヘッダーをメッセージ属性として内容の先頭に埋め込みます。
+// 形式は "simplemqhttp-attributes:<base64 JSON>\n<content>" です。
+func encodeAttributes(header http.Header, content string) (string, error) {
+	if len(header) == 0 {
+		return content, nil
+	}
+	bs, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	return attributesPrefix + base64.StdEncoding.EncodeToString(bs) + "\n" + content, nil
+}
+
+// decodeAttributes は、内容の先頭に埋め込まれたメッセージ属性を取り出します。
+// 属性が含まれない場合は、内容をそのまま返します。
+func decodeAttributes(content string) (http.Header, string) {
+	if !strings.HasPrefix(content, attributesPrefix) {
+		return nil, content
+	}
+	encoded, rest, ok := strings.Cut(strings.TrimPrefix(content, attributesPrefix), "\n")
+	if !ok {
+		return nil, content
+	}
+	bs, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, content
+	}
+	var header http.Header
+	if err := json.Unmarshal(bs, &header); err != nil {
+		return nil, content
+	}
+	return header, rest
+}
+
+// peekAttributes は、メッセージをデシリアライズせずにメッセージ属性を取り出します。
+// 内容の先頭に埋め込まれた属性と、EnvelopeSerializer と JSONSerializer の attributes に格納された属性を読み取ります。
+// SerializerRegistry の形式の識別子は読み飛ばします。暗号化された属性は読み取れないため、nil を返します。
+func peekAttributes(content string) http.Header {
+	if attributes, _ := decodeAttributes(content); attributes != nil {
+		return attributes
+	}
+	if rest, ok := strings.CutPrefix(content, formatPrefix); ok {
+		_, body, ok := strings.Cut(rest, "\n")
+		if !ok {
+			return nil
+		}
+		return peekAttributes(body)
+	}
+	var carrier struct {
+		Attributes http.Header `json:"attributes"`
+	}
+	if err := json.Unmarshal([]byte(content), &carrier); err != nil {
+		return nil
+	}
+	return mergeAttributes(nil, carrier.Attributes)
+}
+
+// allowlistedHeaders は、allowlist に含まれるヘッダーのみを取り出します。
+func allowlistedHeaders(header http.Header, allowlist []string) http.Header {
+	selected := http.Header{}
+	for _, name := range allowlist {
+		key := http.CanonicalHeaderKey(name)
+		if values, ok := header[key]; ok {
+			selected[key] = append([]string(nil), values...)
+		}
+	}
+	return selected
+}
@@ -0,0 +1,39 @@
+package simplemqhttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// maxJSONBodySize は、DecodeJSONBody が読み込むボディの最大サイズです。
+// SimpleMQ のメッセージサイズ上限 (256KB) に合わせています。
+const maxJSONBodySize = maxMessageSize
+
+// DecodeJSONBody は、SimpleMQ メッセージから再構成されたリクエストのボディを JSON として読み込み、v にデコードします。
+// ボディが空の場合や上限サイズを超える場合、JSON として不正な場合はエラーを返します。
+func DecodeJSONBody(r *http.Request, v any) error {
+	if r == nil {
+		return errors.New("request is nil")
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return errors.New("request body is empty")
+	}
+	defer r.Body.Close()
+	bs, err := io.ReadAll(io.LimitReader(r.Body, maxJSONBodySize+1))
+	if err != nil {
+		return fmt.Errorf("failed to read request body: %w", err)
+	}
+	if len(bs) > maxJSONBodySize {
+		return ErrTooLarge
+	}
+	if len(bs) == 0 {
+		return errors.New("request body is empty")
+	}
+	if err := json.Unmarshal(bs, v); err != nil {
+		return fmt.Errorf("failed to decode JSON body: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package simplemqhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeJSONBody(t *testing.T) {
+	serializer := &BodyOnlySerializer{}
+
+	t.Run("Decode JSON message body in handler", func(t *testing.T) {
+		// メッセージ内容からリクエストを再構成
+		src, err := http.NewRequest("POST", "/", strings.NewReader(`{"id":123,"name":"test"}`))
+		require.NoError(t, err)
+		content, err := serializer.Serialize(src)
+		require.NoError(t, err)
+		req, err := serializer.Deserialize(content)
+		require.NoError(t, err)
+
+		var got struct {
+			ID   int    `json:"id"`
+			Name string `json:"name"`
+		}
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := DecodeJSONBody(r, &got); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, 123, got.ID)
+		assert.Equal(t, "test", got.Name)
+	})
+
+	t.Run("Invalid JSON", func(t *testing.T) {
+		req, err := serializer.Deserialize(`{"id":`)
+		require.NoError(t, err)
+
+		var v map[string]any
+		err = DecodeJSONBody(req, &v)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to decode JSON body")
+	})
+
+	t.Run("Empty body", func(t *testing.T) {
+		req, err := http.NewRequest("POST", "/", nil)
+		require.NoError(t, err)
+
+		var v map[string]any
+		err = DecodeJSONBody(req, &v)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "request body is empty")
+	})
+
+	t.Run("Too large body", func(t *testing.T) {
+		large := `"` + strings.Repeat("a", maxJSONBodySize) + `"`
+		req, err := http.NewRequest("POST", "/", strings.NewReader(large))
+		require.NoError(t, err)
+
+		var v string
+		err = DecodeJSONBody(req, &v)
+		assert.ErrorIs(t, err, ErrTooLarge)
+	})
+}
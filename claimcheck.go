@@ -0,0 +1,73 @@
+package simplemqhttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// BodyStore は、リクエストボディをメッセージの外部に保存するためのストレージです。
+// Put は io.Reader からストリーミングで読み込むため、大きなボディでもメモリに保持する必要はありません。
+type BodyStore interface {
+	// Put は、ボディを保存し、取得用のキーを返します。
+	Put(ctx context.Context, body io.Reader) (string, error)
+	// Get は、キーに対応するボディを返します。
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// ClaimCheckSerializer は、リクエストボディを BodyStore に保存し、メッセージにはキーのみを格納するシリアライザです。
+// ボディはストリーミングで BodyStore に渡されるため、256KB を超える大きなボディも送信できます。
+//
+// Serializer.Serialize が受け取る *http.Request の Body は io.Reader のままであり、読み込むかどうかはシリアライザが決めます。
+// ClaimCheckSerializer は Body を読み込まずに BodyStore.Put へそのまま渡し、メッセージにはキーだけを返すため、
+// ストリーミングのために Serializer とは別のインターフェースを設ける必要はありません。
+type ClaimCheckSerializer struct {
+	Store BodyStore
+}
+
+var _ Serializer = &ClaimCheckSerializer{}
+
+func (s *ClaimCheckSerializer) Serialize(req *http.Request) (string, error) {
+	if req == nil {
+		return "", errors.New("request is nil")
+	}
+	if s.Store == nil {
+		return "", errors.New("body store is nil")
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return "", nil
+	}
+	defer req.Body.Close()
+	key, err := s.Store.Put(req.Context(), req.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to put body: %w", err)
+	}
+	if len(key) > maxMessageSize {
+		return "", ErrTooLarge
+	}
+	return key, nil
+}
+
+func (s *ClaimCheckSerializer) Deserialize(content string) (*http.Request, error) {
+	if s.Store == nil {
+		return nil, errors.New("body store is nil")
+	}
+	if content == "" {
+		return http.NewRequest(http.MethodPost, "/", http.NoBody)
+	}
+	if err := rejectFormatMarker(content); err != nil {
+		return nil, err
+	}
+	body, err := s.Store.Get(context.Background(), content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get body: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, "/", body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return req, nil
+}
@@ -0,0 +1,156 @@
+package simplemqhttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// maxKeptBodySize は、hashingBodyStore が内容を保持するボディの最大サイズです。
+const maxKeptBodySize = 64 * 1024
+
+// hashingBodyStore は、ボディのハッシュとサイズを記録するストアです。
+// maxKeptBodySize 以下の小さなボディは内容も保持し、Get で返します。
+type hashingBodyStore struct {
+	mu      sync.Mutex
+	sums    map[string][]byte
+	sizes   map[string]int64
+	bodies  map[string][]byte
+	maxRead int
+}
+
+func (s *hashingBodyStore) Put(_ context.Context, body io.Reader) (string, error) {
+	h := sha256.New()
+	kept := &limitedBuffer{limit: maxKeptBodySize}
+	n, err := io.Copy(&chunkRecorder{w: io.MultiWriter(h, kept), store: s}, body)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sums == nil {
+		s.sums = map[string][]byte{}
+		s.sizes = map[string]int64{}
+		s.bodies = map[string][]byte{}
+	}
+	key := "body-" + strconv.Itoa(len(s.sums))
+	s.sums[key] = h.Sum(nil)
+	s.sizes[key] = n
+	if !kept.overflowed {
+		s.bodies[key] = kept.Bytes()
+	}
+	return key, nil
+}
+
+func (s *hashingBodyStore) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sums[key]; !ok {
+		return nil, errors.New("not found")
+	}
+	body, ok := s.bodies[key]
+	if !ok {
+		return nil, errors.New("body is too large to be kept")
+	}
+	return io.NopCloser(bytes.NewReader(body)), nil
+}
+
+// limitedBuffer は、limit までの内容を保持し、それを超えた場合は保持をやめるバッファです。
+type limitedBuffer struct {
+	bytes.Buffer
+	limit      int
+	overflowed bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.overflowed || b.Len()+len(p) > b.limit {
+		b.overflowed = true
+		b.Reset()
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+type chunkRecorder struct {
+	w     io.Writer
+	store *hashingBodyStore
+}
+
+func (c *chunkRecorder) Write(p []byte) (int, error) {
+	c.store.mu.Lock()
+	if len(p) > c.store.maxRead {
+		c.store.maxRead = len(p)
+	}
+	c.store.mu.Unlock()
+	return c.w.Write(p)
+}
+
+// patternReader は、メモリを確保せずに指定サイズのデータを生成するリーダーです。
+type patternReader struct {
+	remaining int64
+}
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	for i := range p {
+		p[i] = byte('a' + i%26)
+	}
+	r.remaining -= int64(len(p))
+	return len(p), nil
+}
+
+func TestClaimCheckSerializer(t *testing.T) {
+	store := &hashingBodyStore{}
+	serializer := &ClaimCheckSerializer{Store: store}
+
+	t.Run("Stream large body with bounded memory", func(t *testing.T) {
+		const size = 64 * 1024 * 1024
+		req, err := http.NewRequest("POST", "/upload", io.NopCloser(&patternReader{remaining: size}))
+		require.NoError(t, err)
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		key, err := serializer.Serialize(req)
+		require.NoError(t, err)
+		runtime.ReadMemStats(&after)
+
+		assert.Equal(t, int64(size), store.sizes[key])
+		assert.LessOrEqual(t, store.maxRead, 1024*1024, "body should be streamed in chunks")
+		assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(size/8), "body should not be buffered in memory")
+	})
+
+	t.Run("Deserialize fetches body from store", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			payload := fmt.Sprintf(`{"small":"body","index":%d}`, i)
+			req, err := http.NewRequest("POST", "/", strings.NewReader(payload))
+			require.NoError(t, err)
+			key, err := serializer.Serialize(req)
+			require.NoError(t, err)
+
+			// 元のボディがストアから取り出されること
+			deserialized, err := serializer.Deserialize(key)
+			require.NoError(t, err)
+			body, err := io.ReadAll(deserialized.Body)
+			require.NoError(t, err)
+			assert.Equal(t, payload, string(body))
+		}
+	})
+}
@@ -6,7 +6,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"strconv"
@@ -16,6 +18,13 @@ import (
 	"github.com/mashiike/simplemqhttp/simplemq"
 )
 
+// DefaultHeaderPrefix は、Listener.HeaderPrefix および Transport.HeaderPrefix が未指定の場合に使用されるヘッダー名の接頭辞です。
+const DefaultHeaderPrefix = "SimpleMQ-"
+
+// RedeliverAfterHeader は、ハンドラーがメッセージの再配信までの遅延を指定するためのレスポンスヘッダーです。
+// 値には "1500ms" のような time.ParseDuration の形式、または秒数の整数を指定します。
+const RedeliverAfterHeader = "SimpleMQ-Redeliver-After"
+
 // Conn は、SimpleMQ から受信したメッセージを HTTP リクエストに変換するための net.Conn 実装です。
 type Conn struct {
 	addr         net.Addr
@@ -26,12 +35,63 @@ type Conn struct {
 	extendCancel context.CancelFunc
 	extendWg     sync.WaitGroup
 	extendErr    error
-	reqBytes     []byte
+	// reqReader は、req.Write の出力を読み込むパイプです。
+	// 大きなリクエストでも全体をメモリに保持しないよう、Read で読み込まれるたびに書き込まれます。
+	reqReader *io.PipeReader
+	// reqWritten は、req.Write の goroutine が終了したときに閉じられます。
+	reqWritten chan struct{}
+	// reqWriteErr は、req.Write のエラーです。reqWritten が閉じられた後に参照できます。
+	reqWriteErr  error
 	initErr      error
 	logger       *slog.Logger
 	req          *http.Request
 	respBuffer   bytes.Buffer
 	respHandler  ResponseHandler
+	queueWait    time.Duration
+	requestID    string
+	requestIDKey string
+	onClose      func()
+	closeOnce    sync.Once
+	closeErr     error
+	acceptedAt   time.Time
+	attempt      int
+	onDelete     func()
+	// onSuccess は、メッセージを削除すると判断した場合に、削除の前に呼び出されます。
+	onSuccess func()
+	// deadLetter は、ResponseHandler が DeadLetterMessage を返した場合に呼び出されます。
+	deadLetter   func()
+	asyncAck     func(id string, onDeleted func())
+	ctxMu        sync.Mutex
+	respParser   ResponseParser
+	msgMu        sync.Mutex
+	metrics      Metrics
+	headerPrefix string
+	// baseCtx は、可視性タイムアウトの延長に使用するコンテキストです。Listener のベースコンテキストが設定されます。
+	baseCtx context.Context
+	// visibilityTimeout は、延長の際に要求する可視性タイムアウトです。0 の場合はキューの設定が使用されます。
+	visibilityTimeout time.Duration
+	// extendJitter は、延長の時期を早めるランダムなゆらぎの割合です。
+	extendJitter float64
+	// disableExtend が true の場合、可視性タイムアウトを延長する goroutine を開始しません。
+	disableExtend bool
+	// deadlineExtendAttempts と deadlineExtendInterval は、期限の設定時に期限まで延長する際の最大回数と間隔です。
+	deadlineExtendAttempts int
+	deadlineExtendInterval time.Duration
+	// onError は、Close でメッセージの処理に失敗した場合に呼び出されます。
+	onError func(err error)
+	// ackStatus は、レスポンスのステータスコードからメッセージを削除するかどうかを返します。nil の場合は 2xx で削除します。
+	ackStatus func(code int) bool
+	// deadlineMu は、readDeadline と writeDeadline を保護します。
+	deadlineMu    sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// deadlineChanged は、期限が変更されたことを延長の goroutine に通知します。
+	deadlineChanged chan struct{}
+	// extendErrMu は、extendErr を保護します。
+	extendErrMu sync.Mutex
+	// ackMode が AckManual の場合、Close はメッセージを削除せず、ack か nack の呼び出しを待ちます。
+	ackMode   AckMode
+	ackedOnce sync.Once
 }
 
 var _ net.Conn = &Conn{}
@@ -43,140 +103,610 @@ func newConn(addr net.Addr, msg simplemq.Message, serializer Serializer, client
 		serializer: serializer,
 		client:     client,
 		logger:     logger,
+		// 期限の変更は最新の状態を確認させるだけでよいため、通知は1つだけ保持する
+		deadlineChanged:        make(chan struct{}, 1),
+		deadlineExtendAttempts: DefaultDeadlineExtendAttempts,
+		deadlineExtendInterval: DefaultDeadlineExtendInterval,
 	}
-	c.init()
 	return c
 }
 
 func (c *Conn) init() {
-	c.extendCtx, c.extendCancel = context.WithCancel(context.Background())
-	req, err := c.serializer.Deserialize(c.msg.Content)
+	c.extendCtx, c.extendCancel = context.WithCancel(c.baseContext())
+	c.acceptedAt = time.Now()
+	c.queueWait = c.client.Now().Sub(c.msg.CreatedTime())
+	req, attributes, err := deserializeWithAttributes(c.serializer, c.msg.Content)
 	if err != nil {
 		c.initErr = err
 		return
 	}
-	req.Header.Add("SimpleMQ-Message-ID", c.msg.ID)
-	req.Header.Add("SimpleMQ-Message-Created", c.msg.CreatedTime().Format(time.RFC3339))
-	req.Header.Add("SimpleMQ-Message-Visibility-Timeout", c.msg.VisibilityTimeoutTime().Format(time.RFC3339))
-	req.Header.Add("SimpleMQ-Queue-Name", c.client.Queue)
-	c.extendWg.Add(1)
+	applyAttributes(req.Header, attributes)
+	req.Header.Add(c.header("Message-ID"), c.msg.ID)
+	req.Header.Add(c.header("Message-Created"), c.msg.CreatedTime().Format(time.RFC3339))
+	req.Header.Add(c.header("Message-Visibility-Timeout"), c.msg.VisibilityTimeoutTime().Format(time.RFC3339))
+	req.Header.Add(c.header("Queue-Name"), c.client.Queue)
+	req.Header.Add(c.header("Queue-Wait-Ms"), strconv.FormatInt(c.queueWait.Milliseconds(), 10))
+	if c.attempt > 0 {
+		req.Header.Set(c.header("Delivery-Attempt"), strconv.Itoa(c.attempt))
+	}
+	if c.requestID != "" && c.requestIDKey != "" {
+		req.Header.Set(c.requestIDKey, c.requestID)
+	}
+	if !c.disableExtend {
+		c.extendWg.Add(1)
+		go c.extendLoop()
+	}
+	// ResponseHandler からも接続の情報を参照できるようにする
+	c.req = req.WithContext(context.WithValue(req.Context(), connContextKey{}, c))
+	pr, pw := io.Pipe()
+	c.reqReader = pr
+	c.reqWritten = make(chan struct{})
 	go func() {
-		defer func() {
-			c.logger.Debug("end extend visibility timeout", "message_id", c.msg.ID)
-			c.extendWg.Done()
-		}()
-		c.logger.Debug("start extend visibility timeout", "message_id", c.msg.ID)
-		timer := time.NewTimer(time.Duration(float64(time.Until(c.msg.VisibilityTimeoutTime())) * 0.9))
-		for {
-			select {
-			case <-c.extendCtx.Done():
+		defer close(c.reqWritten)
+		err := req.Write(pw)
+		c.reqWriteErr = err
+		pw.CloseWithError(err)
+	}()
+}
+
+// stopRequestWriter は、req.Write の goroutine を終了させ、終了を待ちます。
+// 読み込まれていないリクエストが残っていたために終了させた場合、その書き込みのエラーは報告しません。
+func (c *Conn) stopRequestWriter() {
+	if c.reqReader == nil {
+		return
+	}
+	select {
+	case <-c.reqWritten:
+		c.reqReader.Close()
+		return
+	default:
+	}
+	c.reqReader.Close()
+	<-c.reqWritten
+	c.reqWriteErr = nil
+}
+
+// extendLoop は、レスポンスを書き終えるか接続が閉じられるまで、可視性タイムアウトの期限が切れる前に延長を繰り返します。
+// 読み込みと書き込みの期限が設定されている場合は、可視性タイムアウトがその期限に届いた時点で延長を休止し、
+// 期限が変更されると延長が必要かどうかを判断し直します。
+func (c *Conn) extendLoop() {
+	defer func() {
+		c.logger.Debug("end extend visibility timeout", "message_id", c.msg.ID)
+		c.extendWg.Done()
+	}()
+	c.logger.Debug("start extend visibility timeout", "message_id", c.msg.ID)
+	for {
+		var timer *time.Timer
+		var timerC <-chan time.Time
+		if !c.coversDeadline() {
+			timer = time.NewTimer(c.extendInterval())
+			timerC = timer.C
+		}
+		select {
+		case <-c.extendCtx.Done():
+			if timer != nil {
 				timer.Stop()
-				return
-			case <-timer.C:
 			}
-			// extend visibility timeout
-			extendedMsg, err := c.client.ExtendVisibilityTimeout(c.extendCtx, c.msg.ID)
-			if err != nil {
-				if !errors.Is(err, context.Canceled) {
-					c.extendErr = err
-				}
-				return
+			return
+		case <-c.deadlineChanged:
+			if timer != nil {
+				timer.Stop()
 			}
-			c.logger.Debug("extend visibility timeout", "message_id", c.msg.ID, "visibility_timeout_at", extendedMsg.VisibilityTimeoutTime().Format(time.RFC3339))
-			c.msg.VisibilityTimeoutAt = extendedMsg.VisibilityTimeoutAt
-			timer.Reset(time.Duration(float64(time.Until(c.msg.VisibilityTimeoutTime())) * 0.9))
+			continue
+		case <-timerC:
 		}
-	}()
-	c.req = req
-	var buf bytes.Buffer
-	if err := req.Write(&buf); err != nil {
-		c.initErr = err
-		return
+		if c.coversDeadline() {
+			continue
+		}
+		// extend visibility timeout
+		extendedMsg, err := c.extendVisibilityTimeout(c.extendCtx)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				c.setExtendErr(err)
+			}
+			return
+		}
+		c.logger.Debug("extend visibility timeout", "message_id", c.msg.ID, "visibility_timeout_at", extendedMsg.VisibilityTimeoutTime().Format(time.RFC3339))
+		c.setVisibilityTimeoutAt(extendedMsg.VisibilityTimeoutAt)
+	}
+}
+
+// extendInterval は、次に可視性タイムアウトを延長するまでの時間を返します。
+// 残り時間の 90% を基準に、extendJitter の割合の範囲でランダムに早めます。
+func (c *Conn) extendInterval() time.Duration {
+	factor := 0.9 * (1 - c.extendJitter*rand.Float64())
+	return time.Duration(float64(c.client.Until(c.visibilityTimeoutTime())) * factor)
+}
+
+// baseContext は、可視性タイムアウトの延長に使用するコンテキストを返します。
+// リスナーが閉じられるとキャンセルされ、処理中のリクエストに対する延長も停止します。
+func (c *Conn) baseContext() context.Context {
+	if c.baseCtx != nil {
+		return c.baseCtx
+	}
+	return context.Background()
+}
+
+// header は、メタデータのヘッダー名に HeaderPrefix を付与して返します。
+func (c *Conn) header(name string) string {
+	if c.headerPrefix == "" {
+		return DefaultHeaderPrefix + name
+	}
+	return c.headerPrefix + name
+}
+
+// Message は、この接続の元になった SimpleMQ メッセージのコピーを返します。
+// VisibilityTimeoutAt は、可視性タイムアウトの延長に合わせて更新された値です。
+func (c *Conn) Message() simplemq.Message {
+	c.msgMu.Lock()
+	defer c.msgMu.Unlock()
+	return c.msg
+}
+
+func (c *Conn) visibilityTimeoutTime() time.Time {
+	c.msgMu.Lock()
+	defer c.msgMu.Unlock()
+	return c.msg.VisibilityTimeoutTime()
+}
+
+func (c *Conn) setVisibilityTimeoutAt(v int64) {
+	c.msgMu.Lock()
+	defer c.msgMu.Unlock()
+	c.msg.VisibilityTimeoutAt = v
+}
+
+func (c *Conn) extendVisibilityTimeout(ctx context.Context) (*simplemq.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	msg, err := c.client.ExtendVisibilityTimeoutBy(ctx, c.msg.ID, c.visibilityTimeout)
+	if !errors.Is(err, context.Canceled) {
+		observeOperation(c.metrics, c.client.Queue, OperationExtend, err)
+	}
+	return msg, err
+}
+
+func (c *Conn) deleteMessage(ctx context.Context) error {
+	err := c.client.DeleteMessage(ctx, c.msg.ID)
+	observeOperation(c.metrics, c.client.Queue, OperationDelete, err)
+	return err
+}
+
+// extendNow は、可視性タイムアウトを即座に延長します。
+// レスポンスを書き終えて延長を停止している場合は何もしません。
+func (c *Conn) extendNow(ctx context.Context) error {
+	if c.extendCtx == nil || c.extendCtx.Err() != nil {
+		return nil
+	}
+	extendedMsg, err := c.extendVisibilityTimeout(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to extend visibility timeout of message %s: %w", c.msg.ID, err)
+	}
+	c.setVisibilityTimeoutAt(extendedMsg.VisibilityTimeoutAt)
+	c.logger.Debug("extend visibility timeout immediately", "message_id", c.msg.ID, "visibility_timeout_at", extendedMsg.VisibilityTimeoutTime().Format(time.RFC3339))
+	return nil
+}
+
+// QueueWait は、メッセージが作成されてから受信されるまでにキューで待機した時間を返します。
+func (c *Conn) QueueWait() time.Duration {
+	return c.queueWait
+}
+
+// ProcessingDuration は、メッセージを受け付けてからの経過時間を返します。
+func (c *Conn) ProcessingDuration() time.Duration {
+	return time.Since(c.acceptedAt)
+}
+
+// ErrDeadlineUnreachable は、SetDeadline などで設定した期限まで、延長の最大回数の範囲で可視性タイムアウトを延長できない場合に返されるエラーです。
+// 期限を記録した後に返されるため、延長の goroutine は引き続き期限に向けて延長を続けます。
+var ErrDeadlineUnreachable = errors.New("visibility timeout cannot reach the deadline")
+
+// ErrAlreadyAcknowledged は、AckFromContext で取得した ack か nack が既に呼び出されている場合に返されるエラーです。
+var ErrAlreadyAcknowledged = errors.New("message already acknowledged")
+
+// ack は、AckManual の場合にハンドラーから呼び出され、可視性タイムアウトの延長を止めてメッセージを削除します。
+func (c *Conn) ack() error {
+	err := ErrAlreadyAcknowledged
+	c.ackedOnce.Do(func() {
+		c.stopExtend()
+		if c.onSuccess != nil {
+			c.onSuccess()
+		}
+		c.logger.Debug("deleting message by manual ack", "message_id", c.msg.ID)
+		if err = c.deleteMessage(context.Background()); err != nil {
+			c.logger.Error("failed to delete message", "err", err, "message_id", c.msg.ID)
+			err = fmt.Errorf("failed to delete message: %w", err)
+			return
+		}
+		if c.onDelete != nil {
+			c.onDelete()
+		}
+	})
+	return err
+}
+
+// nack は、AckManual の場合にハンドラーから呼び出され、可視性タイムアウトの延長を止めます。
+// メッセージは削除されず、可視性タイムアウトの経過後に再配信されます。
+func (c *Conn) nack() error {
+	err := ErrAlreadyAcknowledged
+	c.ackedOnce.Do(func() {
+		c.logger.Debug("message is not acknowledged by handler", "message_id", c.msg.ID)
+		c.stopExtend()
+		err = nil
+	})
+	return err
+}
+
+// shouldAck は、ステータスコードのレスポンスでメッセージを削除するかどうかを返します。
+func (c *Conn) shouldAck(statusCode int) bool {
+	if c.ackStatus != nil {
+		return c.ackStatus(statusCode)
 	}
-	c.reqBytes = buf.Bytes()
+	// 2xx系のレスポンスならメッセージを削除
+	return statusCode >= 200 && statusCode < 300
+}
+
+// Err は、バックグラウンドでの可視性タイムアウトの延長が失敗した場合に、そのエラーを返します。
+// 延長に失敗するとそれ以降は延長されないため、処理中にメッセージが再配信される可能性があります。
+// 延長が失敗していない場合や、リスナーが閉じられて延長を止めた場合は nil を返します。
+func (c *Conn) Err() error {
+	c.extendErrMu.Lock()
+	defer c.extendErrMu.Unlock()
+	return c.extendErr
+}
+
+func (c *Conn) setExtendErr(err error) {
+	c.extendErrMu.Lock()
+	defer c.extendErrMu.Unlock()
+	c.extendErr = err
+}
+
+// Attempt は、このメッセージが何回目の配信かを返します。
+// 配信回数は Listener が受信した回数を記録したものです。リクエストの SimpleMQ-Delivery-Attempt ヘッダーにも設定されます。
+// 記録はプロセスごとに保持されるため、別のプロセスで受信した回数や再起動前の回数は含まれません。
+// また、メッセージの削除後や Listener.AttemptTTL の経過後は記録が破棄されるため、回数は目安として使用してください。
+func (c *Conn) Attempt() int {
+	return c.attempt
+}
+
+// RequestID は、このメッセージから再構成されたリクエストのリクエスト ID を返します。
+func (c *Conn) RequestID() string {
+	return c.requestID
+}
+
+// request は、処理中に設定されたコンテキストの値を含むリクエストを返します。
+func (c *Conn) request() *http.Request {
+	c.ctxMu.Lock()
+	defer c.ctxMu.Unlock()
+	return c.req
+}
+
+// setValue は、ResponseHandler に渡されるリクエストのコンテキストに値を設定します。
+func (c *Conn) setValue(key, value any) {
+	c.ctxMu.Lock()
+	defer c.ctxMu.Unlock()
+	c.req = c.req.WithContext(context.WithValue(c.req.Context(), key, value))
 }
 
 // Read implements the net.Conn Read method.
+// リクエストのバイト列をすべて返した後は io.EOF を返します。
+// http.Server は io.EOF をクライアントが次のリクエストを送らずに接続を終えたものとして扱うため、
+// 1つの接続で1つのリクエストとレスポンスだけが処理されます。
 func (c *Conn) Read(b []byte) (n int, err error) {
 	if c.initErr != nil {
 		return 0, fmt.Errorf("failed to initialize connection: %w", c.initErr)
 	}
-	if c.extendErr != nil {
-		return 0, fmt.Errorf("failed to extend visibility timeout: %w", c.extendErr)
+	if err := c.Err(); err != nil {
+		return 0, fmt.Errorf("failed to extend visibility timeout: %w", err)
 	}
-	if len(c.reqBytes) == 0 {
-		return 0, net.ErrClosed
+	n, err = c.reqReader.Read(b)
+	if errors.Is(err, io.ErrClosedPipe) {
+		return n, net.ErrClosed
 	}
-	n = copy(b, c.reqBytes)
-	c.reqBytes = c.reqBytes[n:]
-	return n, nil
+	if err != nil && err != io.EOF {
+		return n, fmt.Errorf("failed to write request: %w", err)
+	}
+	return n, err
 }
 
 // Write implements the net.Conn Write method.
 func (c *Conn) Write(b []byte) (n int, err error) {
-	if c.extendErr != nil {
-		return 0, fmt.Errorf("failed to extend visibility timeout: %w", c.extendErr)
+	if err := c.Err(); err != nil {
+		return 0, fmt.Errorf("failed to extend visibility timeout: %w", err)
 	}
 	if len(b) == 0 {
 		return 0, nil
 	}
-	return c.respBuffer.Write(b)
+	n, err = c.respBuffer.Write(b)
+	if err != nil {
+		return n, err
+	}
+	if c.ackMode != AckManual && c.responseComplete() {
+		// レスポンスを書き終えたら、Close を待たずに可視性タイムアウトの延長を止める
+		c.logger.Debug("response completed, stop extending visibility timeout", "message_id", c.msg.ID)
+		c.stopExtend()
+	}
+	return n, nil
 }
 
-// Close implements the net.Conn Close method.
-func (c *Conn) Close() error {
+func (c *Conn) responseParser() ResponseParser {
+	if c.respParser != nil {
+		return c.respParser
+	}
+	return HTTPResponseParser{}
+}
+
+// stopExtend は、可視性タイムアウトを延長する goroutine を停止します。
+func (c *Conn) stopExtend() {
 	if c.extendCancel != nil {
 		c.extendCancel()
 		c.extendWg.Wait()
 	}
+}
+
+// responseComplete は、書き込まれたレスポンスが完全かどうかを判定します。
+func (c *Conn) responseComplete() bool {
+	if c.respParser != nil {
+		// 独自形式のレスポンスは完了を判定できないため、Close まで待つ
+		return false
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(c.respBuffer.Bytes())), c.request())
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	chunked := len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked"
+	if resp.ContentLength < 0 && !chunked {
+		// 接続の終了でボディの終わりを示すレスポンスは、Close まで完了を判定できない
+		return false
+	}
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return false
+	}
+	return true
+}
+
+// Close implements the net.Conn Close method.
+// 2回目以降の呼び出しでは、最初の呼び出しの結果を返します。
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		// ResponseHandler に渡すリクエストを req.Write と同時に参照しないよう、先に終了させる
+		c.stopRequestWriter()
+		c.closeErr = c.close()
+		// 延長の失敗は、レスポンスが空の場合や処理に成功した場合も報告する
+		if err := c.Err(); err != nil {
+			c.logger.Error("visibility timeout extension failed during processing", "err", err, "message_id", c.msg.ID)
+			c.closeErr = errors.Join(fmt.Errorf("failed to extend visibility timeout: %w", err), c.closeErr)
+		}
+		if c.onError == nil {
+			return
+		}
+		// リクエストに変換できなかった場合、http.Server は 400 のレスポンスを書き込むため Close はエラーにならない
+		if c.initErr != nil {
+			c.onError(fmt.Errorf("failed to initialize connection: %w", c.initErr))
+		}
+		if c.reqWriteErr != nil {
+			c.onError(fmt.Errorf("failed to write request: %w", c.reqWriteErr))
+		}
+		if c.closeErr != nil {
+			c.onError(c.closeErr)
+		}
+	})
+	return c.closeErr
+}
+
+func (c *Conn) close() error {
+	c.stopExtend()
+	if c.onClose != nil {
+		defer c.onClose()
+	}
+	processingClass := "error"
+	if c.metrics != nil {
+		defer func() {
+			c.metrics.ObserveProcessingDuration(c.client.Queue, processingClass, c.ProcessingDuration())
+		}()
+	}
 
 	// レスポンスが空の場合は何もしない
 	if c.respBuffer.Len() == 0 {
 		return nil
 	}
-	resp, err := http.ReadResponse(bufio.NewReader(&c.respBuffer), c.req)
+	resp, err := c.responseParser().ParseResponse(c.respBuffer.Bytes(), c.request())
 	if err != nil {
 		c.logger.Error("failed to serialize response", "err", err, "message_id", c.msg.ID)
 		return fmt.Errorf("failed to serialize response: %w", err)
 	}
+	decompressResponse(resp)
 
 	// ステータスコードをチェック
 	statusCode := resp.StatusCode
+	processingClass = statusClass(statusCode)
 	c.logger.Debug("response status", "status_code", statusCode, "message_id", c.msg.ID)
 
+	disposition := DefaultDisposition
 	if c.respHandler != nil {
-		if err := c.respHandler.HandleResponse(resp, c.req); err != nil {
+		d, err := c.respHandler.HandleResponse(resp, c.request())
+		if err != nil {
 			c.logger.Error("failed to handle response", "err", err, "message_id", c.msg.ID)
 			return fmt.Errorf("failed to handle response: %w", err)
 		}
+		disposition = d
 	}
-	// 2xx系のレスポンスならメッセージを削除
-	if statusCode >= 200 && statusCode < 300 {
-		c.logger.Debug("deleting message due to successful response", "message_id", c.msg.ID)
-		if err := c.client.DeleteMessage(context.Background(), c.msg.ID); err != nil {
+	if c.ackMode == AckManual {
+		// メッセージの削除はハンドラーに任せる
+		c.logger.Debug("manual ack mode, leave message to handler", "message_id", c.msg.ID)
+		return nil
+	}
+	if disposition == DefaultDisposition {
+		if c.shouldAck(statusCode) {
+			disposition = AckMessage
+		} else {
+			disposition = RetryMessage
+		}
+	}
+	c.logger.Debug("message disposition", "disposition", disposition, "message_id", c.msg.ID)
+	if disposition == DeadLetterMessage {
+		if c.deadLetter != nil {
+			c.deadLetter()
+			return nil
+		}
+		c.logger.Warn("dead letter handler is not configured, message will be redelivered", "message_id", c.msg.ID)
+		disposition = RetryMessage
+	}
+	if disposition == AckMessage {
+		if c.onSuccess != nil {
+			c.onSuccess()
+		}
+		if c.asyncAck != nil {
+			c.logger.Debug("enqueue asynchronous delete", "message_id", c.msg.ID)
+			onDeleted := c.onDelete
+			if onDeleted == nil {
+				onDeleted = func() {}
+			}
+			c.asyncAck(c.msg.ID, onDeleted)
+			return nil
+		}
+		c.logger.Debug("deleting message", "message_id", c.msg.ID)
+		if err := c.deleteMessage(context.Background()); err != nil {
 			c.logger.Error("failed to delete message", "err", err, "message_id", c.msg.ID)
 			return fmt.Errorf("failed to delete message: %w", err)
 		}
+		if c.onDelete != nil {
+			c.onDelete()
+		}
+		return nil
+	}
+	if redeliverAfter := resp.Header.Get(RedeliverAfterHeader); redeliverAfter != "" {
+		delay, err := parseRedeliverAfter(redeliverAfter)
+		if err != nil {
+			c.logger.Warn("unexpected "+RedeliverAfterHeader+" header", "err", err, "message_id", c.msg.ID, "header", redeliverAfter)
+			return nil
+		}
+		c.logger.Debug("schedule redelivery due to "+RedeliverAfterHeader+" header", "message_id", c.msg.ID, "delay", delay)
+		go c.scheduleRedelivery(c.client.Now().Add(delay))
 		return nil
 	}
 	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
 		c.logger.Debug("message not deleted due to Retry-After header", "message_id", c.msg.ID)
-		seconds, err := strconv.Atoi(retryAfter)
+		target, err := c.retryAfterTime(retryAfter)
 		if err != nil {
-			c.logger.Warn("unexpected Retry-After header, must be a number of seconds", "message_id", c.msg.ID, "header", retryAfter)
+			c.logger.Warn("unexpected Retry-After header, must be a number of seconds or an HTTP-date", "err", err, "message_id", c.msg.ID, "header", retryAfter)
 			return nil
 		}
-		for time.Until(c.msg.VisibilityTimeoutTime()) < time.Duration(seconds)*time.Second {
-			extendedMsg, err := c.client.ExtendVisibilityTimeout(context.Background(), c.msg.ID)
-			if err != nil {
-				c.logger.Warn("failed to extend visibility timeout for Retry-After", "err", err, "message_id", c.msg.ID, "header", retryAfter)
-				return nil
+		c.extendForRetryAfter(target, retryAfter)
+	}
+	return nil
+}
+
+const (
+	// retryAfterMaxAttempts は、Retry-After の時刻まで続けて可視性タイムアウトを延長する最大の回数です。
+	retryAfterMaxAttempts = 3
+	// retryAfterBackoff は、Retry-After のための延長の間隔の初期値です。延長のたびに倍になります。
+	retryAfterBackoff = 100 * time.Millisecond
+)
+
+// extendForRetryAfter は、メッセージが target 以降に再配信されるよう、可視性タイムアウトを延長します。
+// 延長は retryAfterMaxAttempts 回まで、retryAfterBackoff から倍にしていく間隔を空けて行います。
+// API が可視性タイムアウトを上限に丸めるなどで、待った時間以上に延びない場合は続けて延長しても届かないため、
+// 残りは scheduleRedelivery に引き継ぎ、期限の切れる前に延長を繰り返します。
+func (c *Conn) extendForRetryAfter(target time.Time, header string) {
+	ctx := c.baseContext()
+	backoff := retryAfterBackoff
+	for attempt := 1; c.visibilityTimeoutTime().Before(target); attempt++ {
+		if attempt > retryAfterMaxAttempts {
+			c.logger.Debug("visibility timeout did not reach Retry-After, extending in background", "message_id", c.msg.ID, "header", header)
+			go c.scheduleRedelivery(target)
+			return
+		}
+		var waited time.Duration
+		if attempt > 1 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
 			}
-			c.msg.VisibilityTimeoutAt = extendedMsg.VisibilityTimeoutAt
-			c.logger.Debug("extended visibility timeout for Retry-After", "message_id", c.msg.ID, "visibility_timeout_at", extendedMsg.VisibilityTimeoutTime().Format(time.RFC3339))
+			waited = backoff
+			backoff *= 2
+		}
+		before := c.visibilityTimeoutTime()
+		extendedMsg, err := c.extendVisibilityTimeout(ctx)
+		if err != nil {
+			c.logger.Warn("failed to extend visibility timeout for Retry-After", "err", err, "message_id", c.msg.ID, "header", header)
+			return
+		}
+		c.setVisibilityTimeoutAt(extendedMsg.VisibilityTimeoutAt)
+		c.logger.Debug("extended visibility timeout for Retry-After", "message_id", c.msg.ID, "visibility_timeout_at", extendedMsg.VisibilityTimeoutTime().Format(time.RFC3339))
+		if attempt > 1 && extendedMsg.VisibilityTimeoutTime().Sub(before) <= waited {
+			c.logger.Debug("visibility timeout is capped by the API, extending in background", "message_id", c.msg.ID, "header", header)
+			go c.scheduleRedelivery(target)
+			return
 		}
 	}
-	return nil
+}
+
+// retryAfterTime は、Retry-After ヘッダーの値から、サーバーの時計での再配信の時刻を返します。
+// 値には秒数の整数と HTTP-date のいずれかを指定できます。過去の日時の場合は、現在時刻より前の時刻を返します。
+func (c *Conn) retryAfterTime(v string) (time.Time, error) {
+	if seconds, err := strconv.Atoi(v); err == nil {
+		if seconds < 0 {
+			return time.Time{}, fmt.Errorf("negative delay: %s", v)
+		}
+		return c.client.Now().Add(time.Duration(seconds) * time.Second), nil
+	}
+	date, err := http.ParseTime(v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// HTTP-date はハンドラーの時計での時刻のため、サーバーの時計に補正する
+	return date.Add(c.client.ClockOffset()), nil
+}
+
+func parseRedeliverAfter(v string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(v); err == nil {
+		v = strconv.Itoa(seconds) + "s"
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative delay: %s", v)
+	}
+	return d, nil
+}
+
+// scheduleRedelivery は、メッセージが at 以降に再配信されるよう、可視性タイムアウトを必要な分だけ延長します。
+// SimpleMQ には可視性タイムアウトを任意の時刻に設定する API がないため、期限が切れる直前に延長を繰り返し、
+// at を過ぎる期限になった時点で延長をやめます。そのため、実際の再配信は at から最大で可視性タイムアウト1回分遅れます。
+func (c *Conn) scheduleRedelivery(at time.Time) {
+	ctx := c.baseContext()
+	for {
+		visibilityTimeout := c.visibilityTimeoutTime()
+		if !visibilityTimeout.Before(at) {
+			c.logger.Debug("scheduled redelivery", "message_id", c.msg.ID, "visibility_timeout_at", visibilityTimeout.Format(time.RFC3339))
+			return
+		}
+		timer := time.NewTimer(time.Duration(float64(c.client.Until(visibilityTimeout)) * 0.9))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		extendedMsg, err := c.extendVisibilityTimeout(ctx)
+		if err != nil {
+			c.logger.Warn("failed to extend visibility timeout for scheduled redelivery", "err", err, "message_id", c.msg.ID)
+			return
+		}
+		// 延長しても期限が延びない場合は、延長を繰り返さずに諦める
+		if !extendedMsg.VisibilityTimeoutTime().After(visibilityTimeout) {
+			c.logger.Warn("visibility timeout was not extended, giving up scheduled redelivery", "message_id", c.msg.ID, "visibility_timeout_at", extendedMsg.VisibilityTimeoutTime().Format(time.RFC3339))
+			return
+		}
+		c.setVisibilityTimeoutAt(extendedMsg.VisibilityTimeoutAt)
+	}
 }
 
 // LocalAddr implements the net.Conn LocalAddr method.
@@ -190,65 +720,115 @@ func (c *Conn) RemoteAddr() net.Addr {
 }
 
 // SetDeadline implements the net.Conn SetDeadline method.
+// 読み込みと書き込みの期限の両方を t に設定し、可視性タイムアウトが期限に届いていなければ期限まで延長します。
+// 延長の最大回数の範囲で期限に届かない場合は ErrDeadlineUnreachable を返します。
 func (c *Conn) SetDeadline(t time.Time) error {
-	if c.extendCancel != nil {
-		c.extendCancel()
-		c.extendWg.Wait()
-	}
+	c.setDeadlines(&t, &t)
+	return c.extendToDeadline()
+}
+
+// SetReadDeadline implements the net.Conn SetReadDeadline method.
+// 書き込みの期限は変更しません。期限の延長は SetDeadline と同様です。
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.setDeadlines(&t, nil)
+	return c.extendToDeadline()
+}
+
+// SetWriteDeadline implements the net.Conn SetWriteDeadline method.
+// 読み込みの期限は変更しません。期限の延長は SetDeadline と同様です。
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.setDeadlines(nil, &t)
+	return c.extendToDeadline()
+}
 
-	if t.IsZero() {
+// extendToDeadline は、可視性タイムアウトが読み込みと書き込みの期限に届くまで、deadlineExtendAttempts 回を上限に延長を繰り返します。
+// 延長のたびに API が返した可視性タイムアウトで期限に届いたかを判断し、届いた時点で終了します。
+// 延長しても可視性タイムアウトが延びない場合や、残りの回数では期限に届かない場合は、それ以上 API を呼び出さずに ErrDeadlineUnreachable を返します。
+// 延長を停止している場合は何もしません。
+func (c *Conn) extendToDeadline() error {
+	if c.disableExtend || c.extendCtx == nil || c.extendCtx.Err() != nil {
 		return nil
 	}
-
-	// Extend visibility timeout to the deadline time
-	deadline := time.Until(t)
-	if deadline <= 0 {
-		return nil // 既に期限切れの場合は何もしない
+	deadline := c.deadline()
+	if deadline.IsZero() || !deadline.After(time.Now()) {
+		return nil
 	}
-
-	c.logger.Debug("extending visibility timeout to reach deadline",
-		"message_id", c.msg.ID,
-		"deadline", t.Format(time.RFC3339))
-
-	// 現在のタイムアウト時刻
-	currentTimeout := c.msg.VisibilityTimeoutTime()
-
-	// 目標のタイムアウト時刻に達するまで延長を繰り返す
-	maxAttempts := 10
-	sleepDuration := 200 * time.Millisecond
-	for attempts := 0; currentTimeout.Before(t) && attempts < maxAttempts; attempts++ {
-		extendedMsg, err := c.client.ExtendVisibilityTimeout(context.Background(), c.msg.ID)
+	if c.coversDeadline() {
+		return nil
+	}
+	current := c.visibilityTimeoutTime()
+	for attempts := 1; ; attempts++ {
+		if attempts > 1 {
+			// API の呼び出し頻度を抑えるため、延長の間は待機する
+			wait := time.Duration(float64(c.deadlineExtendInterval) * (1 - c.extendJitter*rand.Float64()))
+			timer := time.NewTimer(wait)
+			select {
+			case <-c.extendCtx.Done():
+				timer.Stop()
+				return nil
+			case <-timer.C:
+			}
+		}
+		extendedMsg, err := c.extendVisibilityTimeout(c.extendCtx)
 		if err != nil {
-			return fmt.Errorf("failed to extend visibility timeout to deadline: %w", err)
+			if errors.Is(err, context.Canceled) {
+				return nil
+			}
+			return fmt.Errorf("failed to extend visibility timeout of message %s to deadline: %w", c.msg.ID, err)
 		}
-
-		// タイムアウト時刻を更新
-		c.msg.VisibilityTimeoutAt = extendedMsg.VisibilityTimeoutAt
-		currentTimeout = c.msg.VisibilityTimeoutTime()
-
-		c.logger.Debug("extended visibility timeout step",
-			"message_id", c.msg.ID,
-			"current_timeout", currentTimeout.Format(time.RFC3339),
-			"target_deadline", t.Format(time.RFC3339))
-
-		// 少し待機して、APIの呼び出し頻度を制限
-		time.Sleep(sleepDuration)
+		extended := extendedMsg.VisibilityTimeoutTime()
+		c.setVisibilityTimeoutAt(extendedMsg.VisibilityTimeoutAt)
+		c.logger.Debug("extend visibility timeout to deadline", "message_id", c.msg.ID, "visibility_timeout_at", extended.Format(time.RFC3339), "deadline", deadline.Format(time.RFC3339), "attempts", attempts)
+		if c.coversDeadline() {
+			return nil
+		}
+		// 延長は要求した時点からの可視性タイムアウトを設定するため、1回の延長で延びるのは待機した時間程度である
+		remaining := time.Duration(c.deadlineExtendAttempts-attempts) * c.deadlineExtendInterval
+		if !extended.After(current) || c.client.Until(extended)+remaining < time.Until(deadline) {
+			return fmt.Errorf("%w: visibility timeout of message %s is %s, deadline is %s after %d attempts",
+				ErrDeadlineUnreachable, c.msg.ID, extended.Format(time.RFC3339), deadline.Format(time.RFC3339), attempts)
+		}
+		current = extended
 	}
+}
 
-	c.logger.Debug("successfully extended visibility timeout to reach deadline",
-		"message_id", c.msg.ID,
-		"deadline", t.Format(time.RFC3339),
-		"visibility_timeout_at", currentTimeout.Format(time.RFC3339))
-
-	return nil
+// setDeadlines は、nil でない期限を更新し、可視性タイムアウトを延長する goroutine に変更を通知します。
+func (c *Conn) setDeadlines(read, write *time.Time) {
+	c.deadlineMu.Lock()
+	if read != nil {
+		c.readDeadline = *read
+	}
+	if write != nil {
+		c.writeDeadline = *write
+	}
+	c.deadlineMu.Unlock()
+	c.logger.Debug("set deadline", "message_id", c.msg.ID, "deadline", c.deadline())
+	select {
+	case c.deadlineChanged <- struct{}{}:
+	default:
+	}
 }
 
-// SetReadDeadline implements the net.Conn SetReadDeadline method.
-func (c *Conn) SetReadDeadline(t time.Time) error {
-	return c.SetDeadline(t)
+// deadline は、読み込みと書き込みの期限のうち遅い方を返します。
+// どちらかに期限がない場合は、期限がないものとしてゼロ値を返します。
+func (c *Conn) deadline() time.Time {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	if c.readDeadline.IsZero() || c.writeDeadline.IsZero() {
+		return time.Time{}
+	}
+	if c.readDeadline.After(c.writeDeadline) {
+		return c.readDeadline
+	}
+	return c.writeDeadline
 }
 
-// SetWriteDeadline implements the net.Conn SetWriteDeadline method.
-func (c *Conn) SetWriteDeadline(t time.Time) error {
-	return c.SetDeadline(t)
+// coversDeadline は、現在の可視性タイムアウトが期限までメッセージを保持できるかどうかを返します。
+// 期限がない場合は、処理が終わるまで延長を続けるため false を返します。
+func (c *Conn) coversDeadline() bool {
+	deadline := c.deadline()
+	if deadline.IsZero() {
+		return false
+	}
+	return c.client.Until(c.visibilityTimeoutTime()) >= time.Until(deadline)
 }
@@ -0,0 +1,1014 @@
+package simplemqhttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+	"github.com/mashiike/simplemqhttp/stub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type extendCountingTransport struct {
+	extends atomic.Int32
+}
+
+func (c *extendCountingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPut {
+		c.extends.Add(1)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestConnStopExtendOnResponseComplete(t *testing.T) {
+	// stubサーバーの作成（延長が頻繁に起きるよう可視性タイムアウトを短くする）
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+	stubServer.SetVisibilityTimeout(300 * time.Millisecond)
+
+	// 延長の回数を数えるclientを作成
+	counter := &extendCountingTransport{}
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	client.HTTPClient = &http.Client{Transport: counter}
+
+	listener := NewListenerWithClient(client)
+	defer listener.Close()
+
+	stubServer.AddMessage("test-queue", `{"extend":"stop"}`)
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+
+	// レスポンスを分割して書き込み、完了するまでは延長が続くこと
+	_, err = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\n"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return counter.extends.Load() > 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// レスポンスを書き終えた後は、Close しなくても延長されないこと
+	_, err = conn.Write([]byte("ok"))
+	require.NoError(t, err)
+	extends := counter.extends.Load()
+	time.Sleep(time.Second)
+	assert.Equal(t, extends, counter.extends.Load())
+
+	require.NoError(t, conn.Close())
+}
+
+// plainTextResponseParser は、"OK" と書き込まれた場合のみ成功として扱う ResponseParser です。
+type plainTextResponseParser struct{}
+
+func (plainTextResponseParser) ParseResponse(b []byte, req *http.Request) (*http.Response, error) {
+	status := http.StatusInternalServerError
+	if strings.TrimSpace(string(b)) == "OK" {
+		status = http.StatusOK
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		Request:    req,
+	}, nil
+}
+
+func TestConnCustomResponseParser(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// テスト用のclientを作成
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	listener := NewListenerWithClient(client)
+	listener.ResponseParser = plainTextResponseParser{}
+	defer listener.Close()
+
+	testCases := []struct {
+		name          string
+		output        string
+		expectDeleted bool
+	}{
+		{
+			name:          "Plain OK acks the message",
+			output:        "OK\n",
+			expectDeleted: true,
+		},
+		{
+			name:          "Other output does not ack the message",
+			output:        "NG\n",
+			expectDeleted: false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := stubServer.AddMessage("test-queue", `{"raw":"protocol"}`)
+			conn, err := listener.Accept()
+			require.NoError(t, err)
+			require.Equal(t, msg.ID, conn.(*Conn).msg.ID)
+
+			_, err = conn.Write([]byte(tc.output))
+			require.NoError(t, err)
+			require.NoError(t, conn.Close())
+			if tc.expectDeleted {
+				assert.Nil(t, stubServer.GetMessage("test-queue", msg.ID))
+			} else {
+				assert.NotNil(t, stubServer.GetMessage("test-queue", msg.ID))
+			}
+		})
+	}
+}
+
+func TestConnClockSkewCompensation(t *testing.T) {
+	// 時計が20秒遅れているstubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+	const skew = -20 * time.Second
+	stubServer.SetClockSkew(skew)
+
+	// テスト用のclientを作成
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	listener := NewListenerWithClient(client)
+	defer listener.Close()
+
+	stubServer.AddMessage("test-queue", `{"clock":"skew"}`)
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// 最初の受信で時計のずれが推定されていること
+	assert.InDelta(t, skew.Seconds(), client.ClockOffset().Seconds(), 2)
+
+	// ずれを補正した可視性タイムアウトまでの時間が、サーバーが設定した時間に近いこと
+	c := conn.(*Conn)
+	remaining := c.client.Until(c.msg.VisibilityTimeoutTime())
+	assert.InDelta(t, stub.DefaultVisibilityTimeout.Seconds(), remaining.Seconds(), 2)
+	// 補正しない場合は、ずれの分だけ短く見積もられる
+	assert.InDelta(t, (stub.DefaultVisibilityTimeout + skew).Seconds(), time.Until(c.msg.VisibilityTimeoutTime()).Seconds(), 2)
+}
+
+func TestConnRedeliverAfter(t *testing.T) {
+	// stubサーバーの作成（可視性タイムアウトを短くして時間の進みを速くする）
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+	stubServer.SetVisibilityTimeout(200 * time.Millisecond)
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	listener := NewListenerWithClient(client)
+	defer listener.Close()
+
+	stubServer.AddMessage("test-queue", `{"redeliver":"after"}`)
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+
+	// ハンドラーが再配信までの遅延を指定したレスポンスを返す
+	_, err = conn.Write([]byte("HTTP/1.1 503 Service Unavailable\r\n" + RedeliverAfterHeader + ": 1s\r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	closedAt := time.Now()
+	require.NoError(t, conn.Close())
+
+	// Close は延長を待たずにすぐに返ること
+	assert.Less(t, time.Since(closedAt), 100*time.Millisecond)
+	// 再配信されたメッセージを先読みしないようリスナーを一時停止する
+	listener.Pause()
+
+	// 指定した遅延の前には再配信されないこと
+	receiver := client.Clone("test-queue")
+	time.Sleep(500 * time.Millisecond)
+	msgs, err := receiver.ReceiveMessages(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	// 指定した遅延の後には再配信されること
+	var redelivered []simplemq.Message
+	require.Eventually(t, func() bool {
+		msgs, err := receiver.ReceiveMessages(context.Background())
+		require.NoError(t, err)
+		redelivered = msgs
+		return len(msgs) > 0
+	}, 2*time.Second, 20*time.Millisecond)
+	assert.GreaterOrEqual(t, time.Since(closedAt), time.Second)
+	assert.Equal(t, `{"redeliver":"after"}`, redelivered[0].Content)
+}
+
+func TestConnStopExtendOnListenerClose(t *testing.T) {
+	// stubサーバーの作成（延長が頻繁に起きるよう可視性タイムアウトを短くする）
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+	stubServer.SetVisibilityTimeout(300 * time.Millisecond)
+
+	// 延長の回数を数えるclientを作成
+	counter := &extendCountingTransport{}
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	client.HTTPClient = &http.Client{Transport: counter}
+
+	listener := NewListenerWithClient(client)
+	stubServer.AddMessage("test-queue", `{"extend":"cancel"}`)
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// 処理中は延長が続くこと
+	require.Eventually(t, func() bool {
+		return counter.extends.Load() > 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// リスナーを閉じると、処理中の接続でも延長が止まること
+	require.NoError(t, listener.Close())
+	time.Sleep(100 * time.Millisecond)
+	extends := counter.extends.Load()
+	time.Sleep(time.Second)
+	assert.Equal(t, extends, counter.extends.Load())
+
+	// 延長を伴う SetDeadline も API を呼び出さないこと
+	_ = conn.SetDeadline(time.Now().Add(time.Minute))
+	assert.Equal(t, extends, counter.extends.Load())
+}
+
+// syncBuffer は、複数の goroutine から書き込まれるログを保持するバッファです。
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestConnServeSingleRequest(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	listener := NewListenerWithClient(client)
+	var errorLog syncBuffer
+	var handled atomic.Int32
+	bodyCh := make(chan string, 2)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handled.Add(1)
+			bs, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			bodyCh <- string(bs)
+			w.WriteHeader(http.StatusOK)
+		}),
+		ErrorLog: log.New(&errorLog, "", 0),
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	// 大きめのボディでも欠けずに読み込めること
+	large := strings.Repeat("x", 64*1024)
+	stubServer.AddMessage("test-queue", base64.StdEncoding.EncodeToString([]byte(large)))
+	select {
+	case body := <-bodyCh:
+		assert.Equal(t, large, body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message should be delivered")
+	}
+
+	// レスポンス後に接続が閉じられてメッセージが削除され、2つ目のリクエストとして扱われないこと
+	require.Eventually(t, func() bool {
+		return stubServer.GetQueueSize("test-queue") == 0
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.EqualValues(t, 1, handled.Load())
+	assert.Empty(t, errorLog.String())
+}
+
+func TestConnRetryAfter(t *testing.T) {
+	cases := []struct {
+		name       string
+		retryAfter func(now time.Time) string
+		// レスポンスを書き込んだ時刻から、可視性タイムアウトの期限までの時間の範囲
+		wantAtLeast time.Duration
+		wantAtMost  time.Duration
+	}{
+		{
+			name:        "seconds",
+			retryAfter:  func(time.Time) string { return "2" },
+			wantAtLeast: 2 * time.Second,
+			wantAtMost:  3 * time.Second,
+		},
+		{
+			name: "HTTP-date",
+			retryAfter: func(now time.Time) string {
+				return now.Add(3 * time.Second).UTC().Format(http.TimeFormat)
+			},
+			// HTTP-date は秒単位のため、切り捨ての分だけ短くなる
+			wantAtLeast: 2 * time.Second,
+			wantAtMost:  4 * time.Second,
+		},
+		{
+			name: "HTTP-date in the past",
+			retryAfter: func(now time.Time) string {
+				return now.Add(-time.Minute).UTC().Format(http.TimeFormat)
+			},
+			wantAtLeast: 0,
+			wantAtMost:  time.Second,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// stubサーバーの作成（可視性タイムアウトを短くして延長の回数を増やす）
+			apiKey := "test-api-key"
+			stubServer := stub.NewServer(apiKey)
+			defer stubServer.Close()
+			stubServer.SetVisibilityTimeout(200 * time.Millisecond)
+
+			client := simplemq.NewClient(apiKey, "test-queue")
+			client.Endpoint = stubServer.URL()
+
+			listener := NewListenerWithClient(client)
+			defer listener.Close()
+
+			msg := stubServer.AddMessage("test-queue", `{"retry":"after"}`)
+			conn, err := listener.Accept()
+			require.NoError(t, err)
+			// 延長後のメッセージを先読みしないようリスナーを一時停止する
+			listener.Pause()
+
+			now := time.Now()
+			_, err = conn.Write([]byte("HTTP/1.1 503 Service Unavailable\r\nRetry-After: " + tc.retryAfter(now) + "\r\nContent-Length: 0\r\n\r\n"))
+			require.NoError(t, err)
+			require.NoError(t, conn.Close())
+
+			// メッセージは削除されず、Retry-After の時刻まで可視性タイムアウトが延長されること
+			// 延長は期限の切れる前にバックグラウンドで繰り返されるため、その間にメッセージが見えるようにならないことも確認する
+			var visibleAfter time.Duration
+			require.Eventually(t, func() bool {
+				stored := stubServer.GetMessage("test-queue", msg.ID)
+				if stored == nil {
+					return false
+				}
+				visibleAfter = stored.VisibilityTimeoutTime().Sub(now)
+				if time.Since(now) < tc.wantAtLeast {
+					assert.True(t, stored.VisibilityTimeoutTime().After(time.Now()), "message must not be visible before Retry-After")
+				}
+				return visibleAfter >= tc.wantAtLeast
+			}, 5*time.Second, 20*time.Millisecond)
+			assert.LessOrEqual(t, visibleAfter, tc.wantAtMost)
+		})
+	}
+
+	t.Run("large Retry-After", func(t *testing.T) {
+		// stubサーバーの作成（API の可視性タイムアウトが Retry-After より大幅に短い場合）
+		apiKey := "test-api-key"
+		stubServer := stub.NewServer(apiKey)
+		defer stubServer.Close()
+		stubServer.SetVisibilityTimeout(300 * time.Millisecond)
+
+		counter := &extendCountingTransport{}
+		client := simplemq.NewClient(apiKey, "test-queue")
+		client.Endpoint = stubServer.URL()
+		client.HTTPClient = &http.Client{Transport: counter}
+		listener := NewListenerWithClient(client)
+		listener.DisableAutoExtend = true
+		defer listener.Close()
+
+		msg := stubServer.AddMessage("test-queue", `{"retry":"large"}`)
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		listener.Pause()
+
+		// Close は延長を繰り返し続けずに返ること
+		_, err = conn.Write([]byte("HTTP/1.1 503 Service Unavailable\r\nRetry-After: 3600\r\nContent-Length: 0\r\n\r\n"))
+		require.NoError(t, err)
+		start := time.Now()
+		require.NoError(t, conn.Close())
+		assert.Less(t, time.Since(start), time.Second)
+		assert.LessOrEqual(t, counter.extends.Load(), int32(retryAfterMaxAttempts))
+
+		// バックグラウンドで期限の切れる前に延長され、メッセージは見えるようにならないこと
+		time.Sleep(time.Second)
+		stored := stubServer.GetMessage("test-queue", msg.ID)
+		require.NotNil(t, stored)
+		assert.True(t, stored.VisibilityTimeoutTime().After(time.Now()))
+		// 延長は可視性タイムアウトごとに1回程度で、API を連続して呼び出さないこと
+		assert.LessOrEqual(t, counter.extends.Load(), int32(retryAfterMaxAttempts+6))
+	})
+}
+
+func TestConnVisibilityTimeout(t *testing.T) {
+	// stubサーバーの作成（既定の可視性タイムアウトは短くする）
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+	stubServer.SetVisibilityTimeout(300 * time.Millisecond)
+
+	// 延長の回数を数えるclientを作成
+	counter := &extendCountingTransport{}
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	client.HTTPClient = &http.Client{Transport: counter}
+
+	listener := NewListenerWithClient(client)
+	listener.VisibilityTimeout = time.Second
+	defer listener.Close()
+	msg := stubServer.AddMessage("test-queue", `{"visibility":"timeout"}`)
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// 受信時に指定した可視性タイムアウトが適用されること
+	stored := stubServer.GetMessage("test-queue", msg.ID)
+	require.NotNil(t, stored)
+	assert.Greater(t, time.Until(stored.VisibilityTimeoutTime()), 500*time.Millisecond)
+
+	// 延長も指定した可視性タイムアウトで行われ、既定の間隔より延長の回数が少ないこと
+	time.Sleep(1200 * time.Millisecond)
+	extends := counter.extends.Load()
+	assert.GreaterOrEqual(t, extends, int32(1))
+	assert.LessOrEqual(t, extends, int32(2))
+	stored = stubServer.GetMessage("test-queue", msg.ID)
+	require.NotNil(t, stored)
+	assert.Greater(t, time.Until(stored.VisibilityTimeoutTime()), 300*time.Millisecond)
+}
+
+func TestConnExtendJitter(t *testing.T) {
+	client := simplemq.NewClient("test-api-key", "test-queue")
+	remaining := 10 * time.Second
+	msg := simplemq.Message{ID: "message", VisibilityTimeoutAt: time.Now().Add(remaining).UnixMilli()}
+
+	intervals := func(jitter float64) (time.Duration, time.Duration) {
+		minInterval, maxInterval := time.Duration(math.MaxInt64), time.Duration(0)
+		for range 100 {
+			conn := newConn(nil, msg, &BodyOnlySerializer{}, client, slog.Default())
+			conn.extendJitter = jitter
+			d := conn.extendInterval()
+			minInterval = min(minInterval, d)
+			maxInterval = max(maxInterval, d)
+		}
+		return minInterval, maxInterval
+	}
+
+	// まとめて受信したメッセージでも、延長の時期がばらけること
+	minInterval, maxInterval := intervals(NewListenerWithClient(client).extendJitter())
+	assert.Greater(t, maxInterval-minInterval, remaining/20)
+	// 延長は 90% の時点より遅れず、ゆらぎの範囲より早まらないこと
+	assert.LessOrEqual(t, maxInterval, remaining*9/10)
+	assert.GreaterOrEqual(t, minInterval, remaining*81/100-100*time.Millisecond)
+
+	// ゆらぎを無効にした場合は、すべて 90% の時点になること
+	listener := NewListenerWithClient(client)
+	listener.ExtendJitter = -1
+	minInterval, maxInterval = intervals(listener.extendJitter())
+	assert.Less(t, maxInterval-minInterval, 50*time.Millisecond)
+}
+
+func TestListenerOnConnError(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	type connError struct {
+		id  string
+		err error
+	}
+	// サブテストごとに別のキューを使用する
+	setup := func(t *testing.T, configure func(l *Listener)) (string, chan connError) {
+		queue := strings.ReplaceAll(t.Name(), "/", "-")
+		client := simplemq.NewClient(apiKey, queue)
+		client.Endpoint = stubServer.URL()
+		listener := NewListenerWithClient(client)
+		listener.PollInterval = 10 * time.Millisecond
+		errCh := make(chan connError, 10)
+		listener.OnConnError = func(msg simplemq.Message, err error) {
+			errCh <- connError{id: msg.ID, err: err}
+		}
+		configure(listener)
+		server := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}),
+		}
+		go server.Serve(listener)
+		t.Cleanup(func() { server.Close() })
+		return queue, errCh
+	}
+	wait := func(t *testing.T, errCh chan connError) connError {
+		select {
+		case e := <-errCh:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("OnConnError should be called")
+			return connError{}
+		}
+	}
+
+	t.Run("Delete error", func(t *testing.T) {
+		queue, errCh := setup(t, func(l *Listener) {})
+		stubServer.InjectError(http.MethodDelete, queue+`/messages/`, http.StatusInternalServerError, simplemq.APIError{Code: 500, Message: "injected"}, 1)
+		msg := stubServer.AddMessage(queue, `{"delete":"error"}`)
+		e := wait(t, errCh)
+		assert.Equal(t, msg.ID, e.id)
+		var apiErr *simplemq.APIError
+		assert.ErrorAs(t, e.err, &apiErr)
+	})
+
+	t.Run("Async delete error", func(t *testing.T) {
+		queue, errCh := setup(t, func(l *Listener) { l.AsyncAck = true })
+		stubServer.InjectError(http.MethodDelete, queue+`/messages/`, http.StatusInternalServerError, simplemq.APIError{Code: 500, Message: "injected"}, 0)
+		msg := stubServer.AddMessage(queue, `{"async":"error"}`)
+		e := wait(t, errCh)
+		assert.Equal(t, msg.ID, e.id)
+		assert.Contains(t, e.err.Error(), "asynchronously")
+	})
+
+	t.Run("Handler error", func(t *testing.T) {
+		errHandler := errors.New("handler failed")
+		queue, errCh := setup(t, func(l *Listener) {
+			l.ResponseHandler = responseHandlerFunc(func(*http.Response, *http.Request) (Disposition, error) {
+				return DefaultDisposition, errHandler
+			})
+		})
+		msg := stubServer.AddMessage(queue, `{"handler":"error"}`)
+		e := wait(t, errCh)
+		assert.Equal(t, msg.ID, e.id)
+		assert.ErrorIs(t, e.err, errHandler)
+	})
+
+	t.Run("Deserialize error", func(t *testing.T) {
+		queue, errCh := setup(t, func(l *Listener) { l.Serializer = &JSONSerializer{} })
+		msg := stubServer.AddMessage(queue, `not json`)
+		e := wait(t, errCh)
+		assert.Equal(t, msg.ID, e.id)
+		assert.Contains(t, e.err.Error(), "failed to initialize connection")
+	})
+}
+
+func TestConnAckStatusCodes(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	// 3xx で削除し、200 では削除しないリスナーを作成
+	listener := NewListenerWithClient(client)
+	listener.AckStatusCodes = func(code int) bool {
+		return code >= 300 && code < 400
+	}
+	defer listener.Close()
+
+	testCases := []struct {
+		name          string
+		status        int
+		expectDeleted bool
+	}{
+		{
+			name:          "3xx acks the message",
+			status:        http.StatusFound,
+			expectDeleted: true,
+		},
+		{
+			name:          "200 does not ack the message",
+			status:        http.StatusOK,
+			expectDeleted: false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := stubServer.AddMessage("test-queue", `{"ack":"status"}`)
+			conn, err := listener.Accept()
+			require.NoError(t, err)
+			require.Equal(t, msg.ID, conn.(*Conn).msg.ID)
+
+			resp := fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Length: 0\r\n\r\n", tc.status, http.StatusText(tc.status))
+			_, err = conn.Write([]byte(resp))
+			require.NoError(t, err)
+			require.NoError(t, conn.Close())
+			if tc.expectDeleted {
+				assert.Nil(t, stubServer.GetMessage("test-queue", msg.ID))
+			} else {
+				assert.NotNil(t, stubServer.GetMessage("test-queue", msg.ID))
+			}
+		})
+	}
+}
+
+func TestConnDeadlines(t *testing.T) {
+	// stubサーバーの作成（延長が頻繁に起きるよう可視性タイムアウトを短くする）
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+	stubServer.SetVisibilityTimeout(300 * time.Millisecond)
+
+	serverCases := []struct {
+		name         string
+		readTimeout  time.Duration
+		writeTimeout time.Duration
+	}{
+		{name: "ReadTimeout", readTimeout: 100 * time.Millisecond},
+		{name: "WriteTimeout", writeTimeout: 5 * time.Second},
+		{name: "ReadTimeout and WriteTimeout", readTimeout: 100 * time.Millisecond, writeTimeout: 5 * time.Second},
+	}
+	for i, tc := range serverCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// タイムアウトを設定した http.Server で、可視性タイムアウトより長い処理が再配信されないこと
+			queue := fmt.Sprintf("server-queue-%d", i)
+			client := simplemq.NewClient(apiKey, queue)
+			client.Endpoint = stubServer.URL()
+			listener := NewListenerWithOptions(client, WithPollInterval(10*time.Millisecond))
+			var handled atomic.Int32
+			server := &http.Server{
+				ReadTimeout:  tc.readTimeout,
+				WriteTimeout: tc.writeTimeout,
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					handled.Add(1)
+					time.Sleep(time.Second)
+					w.WriteHeader(http.StatusOK)
+				}),
+			}
+			go server.Serve(listener)
+			defer server.Close()
+
+			msg := stubServer.AddMessage(queue, `{"deadline":"server"}`)
+			require.True(t, stubServer.WaitForDeletion(queue, msg.ID, 5*time.Second))
+			assert.EqualValues(t, 1, handled.Load())
+		})
+	}
+
+	t.Run("Read and write deadlines", func(t *testing.T) {
+		counter := &extendCountingTransport{}
+		client := simplemq.NewClient(apiKey, "conn-queue")
+		client.Endpoint = stubServer.URL()
+		client.HTTPClient = &http.Client{Transport: counter}
+		listener := NewListenerWithClient(client)
+		defer listener.Close()
+
+		stubServer.AddMessage("conn-queue", `{"deadline":"conn"}`)
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		// 読み込みの期限だけを設定しても、書き込みの期限がないため延長が続くこと
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+		require.Eventually(t, func() bool {
+			return counter.extends.Load() >= 2
+		}, 5*time.Second, 10*time.Millisecond)
+
+		// 両方の期限が過ぎた後は延長が止まること
+		require.NoError(t, conn.SetWriteDeadline(time.Now().Add(50*time.Millisecond)))
+		time.Sleep(400 * time.Millisecond)
+		extends := counter.extends.Load()
+		time.Sleep(600 * time.Millisecond)
+		assert.Equal(t, extends, counter.extends.Load())
+
+		// 期限を延ばすと延長が再開されること（延長の最大回数では届かない期限のためエラーが返る）
+		require.ErrorIs(t, conn.SetDeadline(time.Now().Add(5*time.Second)), ErrDeadlineUnreachable)
+		require.Eventually(t, func() bool {
+			return counter.extends.Load() > extends
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Far-future deadline within the visibility timeout", func(t *testing.T) {
+		counter := &extendCountingTransport{}
+		client := simplemq.NewClient(apiKey, "far-queue")
+		client.Endpoint = stubServer.URL()
+		client.HTTPClient = &http.Client{Transport: counter}
+		listener := NewListenerWithClient(client)
+		listener.VisibilityTimeout = 2 * time.Hour
+		defer listener.Close()
+
+		stubServer.AddMessage("far-queue", `{"deadline":"far"}`)
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		// 可視性タイムアウトが既に期限に届いている場合は、延長しないこと
+		deadline := time.Now().Add(time.Hour)
+		require.NoError(t, conn.SetDeadline(deadline))
+		assert.Zero(t, counter.extends.Load())
+		stored := stubServer.GetMessage("far-queue", conn.(*Conn).Message().ID)
+		require.NotNil(t, stored)
+		assert.False(t, stored.VisibilityTimeoutTime().Before(deadline.Truncate(time.Second)))
+	})
+
+	t.Run("Far-future deadline beyond the attempt budget", func(t *testing.T) {
+		counter := &extendCountingTransport{}
+		client := simplemq.NewClient(apiKey, "unreachable-queue")
+		client.Endpoint = stubServer.URL()
+		client.HTTPClient = &http.Client{Transport: counter}
+		listener := NewListenerWithClient(client)
+		defer listener.Close()
+
+		stubServer.AddMessage("unreachable-queue", `{"deadline":"unreachable"}`)
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		// 残りの回数で届かない期限は、延長を繰り返さずにエラーを返すこと
+		start := time.Now()
+		err = conn.SetDeadline(time.Now().Add(time.Hour))
+		require.ErrorIs(t, err, ErrDeadlineUnreachable)
+		assert.Less(t, time.Since(start), time.Second)
+		assert.LessOrEqual(t, counter.extends.Load(), int32(DefaultDeadlineExtendAttempts))
+
+		// 期限は記録されているため、延長の goroutine は延長を続けること
+		extends := counter.extends.Load()
+		require.Eventually(t, func() bool {
+			return counter.extends.Load() > extends+1
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.NoError(t, conn.(*Conn).Err())
+	})
+
+	t.Run("Deadline reached within the attempt budget", func(t *testing.T) {
+		counter := &extendCountingTransport{}
+		client := simplemq.NewClient(apiKey, "budget-queue")
+		client.Endpoint = stubServer.URL()
+		client.HTTPClient = &http.Client{Transport: counter}
+		listener := NewListenerWithClient(client)
+		listener.DeadlineExtendAttempts = 5
+		listener.DeadlineExtendInterval = 100 * time.Millisecond
+		listener.ExtendJitter = -1
+		defer listener.Close()
+
+		stubServer.AddMessage("budget-queue", `{"deadline":"budget"}`)
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		// 延長を繰り返して期限に届いた時点で終了すること
+		deadline := time.Now().Add(500 * time.Millisecond)
+		require.NoError(t, conn.SetDeadline(deadline))
+		assert.GreaterOrEqual(t, counter.extends.Load(), int32(2))
+		assert.LessOrEqual(t, counter.extends.Load(), int32(5))
+		msg := conn.(*Conn).Message()
+		assert.False(t, msg.VisibilityTimeoutTime().Before(deadline.Truncate(time.Second)))
+	})
+}
+
+func TestConnExtendError(t *testing.T) {
+	// stubサーバーの作成（延長が早く起きるよう可視性タイムアウトを短くする）
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+	stubServer.SetVisibilityTimeout(300 * time.Millisecond)
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	var reported atomic.Value
+	listener := NewListenerWithClient(client)
+	listener.OnConnError = func(msg simplemq.Message, err error) {
+		reported.Store(err)
+	}
+	defer listener.Close()
+
+	stubServer.AddMessage("test-queue", `{"extend":"error"}`)
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	c := conn.(*Conn)
+	assert.NoError(t, c.Err())
+
+	// 処理中に延長を失敗させる
+	stubServer.InjectError(http.MethodPut, `/messages/`, http.StatusInternalServerError, simplemq.APIError{Code: 500, Message: "injected"}, 0)
+	require.Eventually(t, func() bool {
+		return c.Err() != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// レスポンスを書き込まずに閉じた場合も、延長の失敗が報告されること
+	err = conn.Close()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to extend visibility timeout")
+	reportedErr, ok := reported.Load().(error)
+	require.True(t, ok)
+	assert.ErrorIs(t, reportedErr, c.Err())
+}
+
+// bodyErrorSerializer は、ボディの読み込みが途中で失敗するリクエストを返すシリアライザです。
+type bodyErrorSerializer struct {
+	BodyOnlySerializer
+	err error
+}
+
+func (s *bodyErrorSerializer) Deserialize(content string) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, "/", io.MultiReader(strings.NewReader(content), iotest.ErrReader(s.err)))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(content)) + 1
+	return req, nil
+}
+
+func TestConnAttributes(t *testing.T) {
+	client := simplemq.NewClient("test-api-key", "test-queue")
+	// 延長が起きないよう、可視性タイムアウトを十分に長くする
+	msg := simplemq.Message{ID: "message", VisibilityTimeoutAt: time.Now().Add(time.Hour).UnixMilli()}
+
+	// シリアライザが復元したヘッダーは、メッセージ属性で上書きされないこと
+	sent, err := http.NewRequest(http.MethodPost, "/", strings.NewReader("hello"))
+	require.NoError(t, err)
+	content, err := (&JSONSerializer{}).serializeWithAttributes(sent, http.Header{"X-Tenant-Id": {"attribute"}, "X-Source": {"producer"}})
+	require.NoError(t, err)
+	var r jsonRequest
+	require.NoError(t, json.Unmarshal([]byte(content), &r))
+	r.Headers = map[string][]string{"X-Tenant-Id": {"header"}}
+	bs, err := json.Marshal(r)
+	require.NoError(t, err)
+	msg.Content = string(bs)
+
+	conn := newConn(nil, msg, &JSONSerializer{}, client, slog.Default())
+	conn.init()
+	defer conn.Close()
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"header"}, req.Header.Values("X-Tenant-Id"))
+	assert.Equal(t, "producer", req.Header.Get("X-Source"))
+}
+
+func TestConnStreamRequest(t *testing.T) {
+	client := simplemq.NewClient("test-api-key", "test-queue")
+	// 延長が起きないよう、可視性タイムアウトを十分に長くする
+	msg := simplemq.Message{ID: "message", VisibilityTimeoutAt: time.Now().Add(time.Hour).UnixMilli()}
+
+	t.Run("LargeBody", func(t *testing.T) {
+		body := strings.Repeat("0123456789abcdef", 256*1024)
+		msg := msg
+		msg.Content = body
+		conn := newConn(nil, msg, &BodyOnlySerializer{NoBase64: true}, client, slog.Default())
+		conn.init()
+		defer conn.Close()
+
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		require.NoError(t, err)
+		got, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		assert.Equal(t, len(body), len(got))
+		assert.Equal(t, body, string(got))
+	})
+
+	t.Run("WriteError", func(t *testing.T) {
+		// req.Write のエラーが Read と OnConnError に伝わること
+		errBoom := errors.New("boom")
+		msg := msg
+		msg.Content = "partial"
+		conn := newConn(nil, msg, &bodyErrorSerializer{err: errBoom}, client, slog.Default())
+		var reported []error
+		conn.onError = func(err error) {
+			reported = append(reported, err)
+		}
+		conn.init()
+
+		// net/http はボディの読み込みエラーをラップしないため、メッセージで確認する
+		_, err := io.ReadAll(conn)
+		require.ErrorContains(t, err, "failed to write request")
+		assert.ErrorContains(t, err, errBoom.Error())
+		require.NoError(t, conn.Close())
+		require.Len(t, reported, 1)
+		assert.ErrorContains(t, reported[0], errBoom.Error())
+	})
+
+	t.Run("CloseWithoutRead", func(t *testing.T) {
+		// 読み込まれていないリクエストがあっても Close がブロックせず、エラーも報告されないこと
+		msg := msg
+		msg.Content = strings.Repeat("x", 1024*1024)
+		conn := newConn(nil, msg, &BodyOnlySerializer{NoBase64: true}, client, slog.Default())
+		var reported []error
+		conn.onError = func(err error) {
+			reported = append(reported, err)
+		}
+		conn.init()
+
+		buf := make([]byte, 16)
+		_, err := conn.Read(buf)
+		require.NoError(t, err)
+		done := make(chan error, 1)
+		go func() {
+			done <- conn.Close()
+		}()
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Close should not block")
+		}
+		assert.Empty(t, reported)
+		_, err = conn.Read(buf)
+		assert.ErrorIs(t, err, net.ErrClosed)
+	})
+}
+
+func BenchmarkConnRead(b *testing.B) {
+	client := simplemq.NewClient("test-api-key", "test-queue")
+	msg := simplemq.Message{
+		ID:                  "message",
+		Content:             strings.Repeat("0123456789abcdef", 512*1024),
+		VisibilityTimeoutAt: time.Now().Add(time.Hour).UnixMilli(),
+	}
+	serializer := &BodyOnlySerializer{NoBase64: true}
+	buf := make([]byte, 32*1024)
+
+	b.Run("Buffered", func(b *testing.B) {
+		// 比較のため、リクエスト全体をバッファしてから読み込む
+		b.ReportAllocs()
+		for range b.N {
+			req, err := serializer.Deserialize(msg.Content)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var reqBuf bytes.Buffer
+			if err := req.Write(&reqBuf); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.CopyBuffer(io.Discard, struct{ io.Reader }{&reqBuf}, buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Streaming", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			conn := newConn(nil, msg, serializer, client, slog.Default())
+			conn.init()
+			if _, err := io.CopyBuffer(io.Discard, struct{ io.Reader }{conn}, buf); err != nil {
+				b.Fatal(err)
+			}
+			conn.Close()
+		}
+	})
+}
+
+func TestListenerDisableAutoExtend(t *testing.T) {
+	// stubサーバーの作成（延長が早く起きるよう可視性タイムアウトを短くする）
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+	stubServer.SetVisibilityTimeout(300 * time.Millisecond)
+
+	counter := &extendCountingTransport{}
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	client.HTTPClient = &http.Client{Transport: counter}
+	listener := NewListenerWithClient(client)
+	listener.DisableAutoExtend = true
+	defer listener.Close()
+
+	msg := stubServer.AddMessage("test-queue", `{"extend":"disabled"}`)
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+
+	// 可視性タイムアウトを超えても、期限を設定しても延長の API が呼び出されないこと
+	require.NoError(t, conn.SetDeadline(time.Now().Add(time.Hour)))
+	time.Sleep(600 * time.Millisecond)
+	assert.Zero(t, counter.extends.Load())
+	assert.NoError(t, conn.(*Conn).Err())
+
+	// 処理に成功した場合は、通常どおり削除されること
+	_, err = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	assert.True(t, stubServer.WaitForDeletion("test-queue", msg.ID, 5*time.Second))
+	assert.Zero(t, counter.extends.Load())
+}
@@ -0,0 +1,118 @@
+package simplemqhttp
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+)
+
+type connContextKey struct{}
+
+// ConnContext は、http.Server の ConnContext に設定するための関数です。
+// SimpleMQ から受信した接続の情報をリクエストのコンテキストに格納します。
+//
+// http.Server はリクエストごとのコンテキストを接続のコンテキストから作成するため、
+// Conn がリクエストに設定したコンテキストはハンドラーに引き継がれません。
+// MessageFromContext などのアクセサをハンドラーで使用するには、ConnContext を設定してください。
+// ResponseHandler に渡されるリクエストでは、ConnContext の設定に関わらずアクセサを使用できます。
+//
+//	server := &http.Server{
+//		Handler:     handler,
+//		ConnContext: simplemqhttp.ConnContext,
+//	}
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if conn, ok := c.(*Conn); ok {
+		return context.WithValue(ctx, connContextKey{}, conn)
+	}
+	return ctx
+}
+
+func connFromContext(ctx context.Context) (*Conn, bool) {
+	conn, ok := ctx.Value(connContextKey{}).(*Conn)
+	return conn, ok
+}
+
+// MessageFromContext は、コンテキストから受信した SimpleMQ メッセージを取得します。
+// 返されるメッセージはコピーで、VisibilityTimeoutAt は延長に合わせて更新された値です。
+// ConnContext が設定されていない場合は false を返します。
+func MessageFromContext(ctx context.Context) (*simplemq.Message, bool) {
+	conn, ok := connFromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	msg := conn.Message()
+	return &msg, true
+}
+
+// ClientFromContext は、コンテキストからメッセージを受信した SimpleMQ クライアントを取得します。
+// ハンドラーから同じキューに後続のメッセージを送信する場合などに使用します。
+// 返されるクライアントは Listener が使用しているものと同じで、複数の goroutine から同時に使用できますが、
+// フィールドを変更すると Listener の動作に影響するため変更しないでください。別のキューに送信する場合は Clone を使用してください。
+// クライアントはリクエストの処理が終わった後も使用できます。
+// http.Server はリクエストを読み終えた時点でリクエストのコンテキストをキャンセルすることがあるため、
+// 送信には context.WithoutCancel などでキャンセルを引き継がないコンテキストを使用してください。
+// ConnContext が設定されていない場合は false を返します。
+func ClientFromContext(ctx context.Context) (*simplemq.Client, bool) {
+	conn, ok := connFromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	return conn.client, true
+}
+
+// QueueWaitFromContext は、コンテキストからメッセージのキュー待機時間を取得します。
+// ConnContext が設定されていない場合は false を返します。
+func QueueWaitFromContext(ctx context.Context) (time.Duration, bool) {
+	conn, ok := connFromContext(ctx)
+	if !ok {
+		return 0, false
+	}
+	return conn.QueueWait(), true
+}
+
+// RequestIDFromContext は、コンテキストからリクエスト ID を取得します。
+// ConnContext が設定されていない場合は false を返します。
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	conn, ok := connFromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	return conn.RequestID(), true
+}
+
+// AttemptNumber は、コンテキストからメッセージの配信回数を取得します。初回の配信は 1 です。
+// ConnContext が設定されていない場合は 0 を返します。
+func AttemptNumber(ctx context.Context) int {
+	conn, ok := connFromContext(ctx)
+	if !ok {
+		return 0
+	}
+	return conn.Attempt()
+}
+
+// AckFromContext は、Listener.AckMode が AckManual の場合に、メッセージを削除する ack と、
+// 削除せずに再配信させる nack をコンテキストから取得します。
+// ack と nack は合わせて1回だけ呼び出すことができ、2回目以降は ErrAlreadyAcknowledged を返します。
+// どちらも呼び出さない場合の動作は AckManual を参照してください。
+// ConnContext が設定されていない場合や、AckManual でない場合は false を返します。
+func AckFromContext(ctx context.Context) (ack func() error, nack func() error, ok bool) {
+	conn, ok := connFromContext(ctx)
+	if !ok || conn.ackMode != AckManual {
+		return nil, nil, false
+	}
+	return conn.ack, conn.nack, true
+}
+
+// SetProcessingValue は、ResponseHandler に渡されるリクエストのコンテキストに値を設定します。
+// ハンドラーやミドルウェアで設定した値を HandleResponse で参照するために使用します。
+// ConnContext が設定されていない場合は false を返します。
+func SetProcessingValue(ctx context.Context, key, value any) bool {
+	conn, ok := connFromContext(ctx)
+	if !ok {
+		return false
+	}
+	conn.setValue(key, value)
+	return true
+}
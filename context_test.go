@@ -0,0 +1,359 @@
+package simplemqhttp
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+	"github.com/mashiike/simplemqhttp/stub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueueWaitFromContext(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// テスト用のclientを作成
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	// メッセージを追加してから受信までの待機時間を作る
+	stubServer.AddMessage("test-queue", `{"wait":true}`)
+	const waited = 500 * time.Millisecond
+	time.Sleep(waited)
+
+	type result struct {
+		header string
+		wait   time.Duration
+		ok     bool
+	}
+	resultCh := make(chan result, 1)
+	listener := NewListenerWithClient(client)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			wait, ok := QueueWaitFromContext(r.Context())
+			resultCh <- result{
+				header: r.Header.Get("SimpleMQ-Queue-Wait-Ms"),
+				wait:   wait,
+				ok:     ok,
+			}
+			w.WriteHeader(http.StatusOK)
+		}),
+		ConnContext: ConnContext,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	select {
+	case res := <-resultCh:
+		require.True(t, res.ok)
+		assert.GreaterOrEqual(t, res.wait, waited)
+		assert.Less(t, res.wait, waited+5*time.Second)
+
+		ms, err := strconv.ParseInt(res.header, 10, 64)
+		require.NoError(t, err)
+		assert.Equal(t, res.wait.Milliseconds(), ms)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message should be delivered")
+	}
+}
+
+func TestAttemptNumber(t *testing.T) {
+	// stubサーバーの作成（再配信を早めるため可視性タイムアウトを短くする）
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+	stubServer.SetVisibilityTimeout(300 * time.Millisecond)
+
+	// テスト用のclientを作成
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	attemptCh := make(chan int, 3)
+	listener := NewListenerWithClient(client)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempt := AttemptNumber(r.Context())
+			attemptCh <- attempt
+			// 3回目の配信で成功させる
+			if attempt < 3 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}),
+		ConnContext: ConnContext,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	msg := stubServer.AddMessage("test-queue", `{"retry":true}`)
+	for expected := 1; expected <= 3; expected++ {
+		select {
+		case attempt := <-attemptCh:
+			require.Equal(t, expected, attempt)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("attempt %d should be delivered", expected)
+		}
+	}
+	require.True(t, stubServer.WaitForDeletion("test-queue", msg.ID, 5*time.Second))
+}
+
+type tenantKey struct{}
+
+type traceKey struct{}
+
+// tenantSerializer は、デシリアライズ時にテナントIDをコンテキストに設定するシリアライザです。
+type tenantSerializer struct {
+	BodyOnlySerializer
+}
+
+func (s *tenantSerializer) Deserialize(content string) (*http.Request, error) {
+	req, err := s.BodyOnlySerializer.Deserialize(content)
+	if err != nil {
+		return nil, err
+	}
+	return req.WithContext(context.WithValue(req.Context(), tenantKey{}, "tenant-a")), nil
+}
+
+type responseHandlerFunc func(resp *http.Response, req *http.Request) (Disposition, error)
+
+func (f responseHandlerFunc) HandleResponse(resp *http.Response, req *http.Request) (Disposition, error) {
+	return f(resp, req)
+}
+
+func TestResponseHandlerContextValues(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// テスト用のclientを作成
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	type values struct {
+		tenant any
+		trace  any
+	}
+	valuesCh := make(chan values, 1)
+	listener := NewListenerWithClient(client)
+	listener.Serializer = &tenantSerializer{BodyOnlySerializer{NoBase64: true}}
+	listener.ResponseHandler = responseHandlerFunc(func(resp *http.Response, req *http.Request) (Disposition, error) {
+		valuesCh <- values{
+			tenant: req.Context().Value(tenantKey{}),
+			trace:  req.Context().Value(traceKey{}),
+		}
+		return DefaultDisposition, nil
+	})
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			SetProcessingValue(r.Context(), traceKey{}, "trace-1")
+			w.WriteHeader(http.StatusOK)
+		}),
+		ConnContext: ConnContext,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	stubServer.AddMessage("test-queue", `{"tenant":"a"}`)
+	select {
+	case v := <-valuesCh:
+		assert.Equal(t, "tenant-a", v.tenant)
+		assert.Equal(t, "trace-1", v.trace)
+	case <-time.After(5 * time.Second):
+		t.Fatal("response handler should be called")
+	}
+}
+
+func TestMessageFromContext(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// テスト用のclientを作成
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	type result struct {
+		msg    *simplemq.Message
+		ok     bool
+		header string
+	}
+	resultCh := make(chan result, 1)
+	listener := NewListenerWithClient(client)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			msg, ok := MessageFromContext(r.Context())
+			resultCh <- result{
+				msg:    msg,
+				ok:     ok,
+				header: r.Header.Get("SimpleMQ-Message-ID"),
+			}
+			w.WriteHeader(http.StatusOK)
+		}),
+		ConnContext: ConnContext,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	added := stubServer.AddMessage("test-queue", `{"metadata":true}`)
+	select {
+	case res := <-resultCh:
+		require.True(t, res.ok)
+		assert.Equal(t, added.ID, res.msg.ID)
+		assert.Equal(t, added.CreatedAt, res.msg.CreatedAt)
+		assert.NotZero(t, res.msg.AcquiredAt)
+		assert.Greater(t, res.msg.VisibilityTimeoutAt, res.msg.AcquiredAt)
+		// 後方互換のためヘッダーも設定されていること
+		assert.Equal(t, added.ID, res.header)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message should be delivered")
+	}
+
+	// ConnContext を経由しないコンテキストでは取得できないこと
+	_, ok := MessageFromContext(context.Background())
+	assert.False(t, ok)
+}
+
+func TestClientFromContext(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// テスト用のclientを作成
+	client := simplemq.NewClient(apiKey, "chain-queue")
+	client.Endpoint = stubServer.URL()
+
+	bodies := make(chan string, 2)
+	listener := NewListenerWithClient(client)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			bodies <- string(body)
+			if string(body) == "step1" {
+				// 同じキューに後続のメッセージを送信する
+				// リクエストのコンテキストは、リクエストを読み終えた時点でキャンセルされることがあるため、キャンセルを引き継がない
+				c, ok := ClientFromContext(r.Context())
+				if !ok {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				if _, err := c.SendMessage(context.WithoutCancel(r.Context()), base64.StdEncoding.EncodeToString([]byte("step2"))); err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+			}
+			w.WriteHeader(http.StatusOK)
+		}),
+		ConnContext: ConnContext,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	stubServer.AddMessage("chain-queue", base64.StdEncoding.EncodeToString([]byte("step1")))
+	// 後続のメッセージが同じキューから受信されること
+	for _, want := range []string{"step1", "step2"} {
+		select {
+		case got := <-bodies:
+			assert.Equal(t, want, got)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s should be delivered", want)
+		}
+	}
+
+	// ConnContext を経由しないコンテキストでは取得できないこと
+	_, ok := ClientFromContext(context.Background())
+	assert.False(t, ok)
+}
+
+func TestAckFromContext(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	// メッセージの内容に応じて ack と nack を呼び分けるハンドラー
+	listener := NewListenerWithOptions(client, WithPollInterval(10*time.Millisecond))
+	listener.AckMode = AckManual
+	done := make(chan string, 10)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ack, nack, ok := AckFromContext(r.Context())
+			require.True(t, ok)
+			body, _ := io.ReadAll(r.Body)
+			switch string(body) {
+			case "ack":
+				// レスポンスのステータスコードに関わらず削除されること
+				w.WriteHeader(http.StatusInternalServerError)
+				assert.NoError(t, ack())
+				assert.ErrorIs(t, nack(), ErrAlreadyAcknowledged)
+			case "nack":
+				assert.NoError(t, nack())
+				assert.ErrorIs(t, ack(), ErrAlreadyAcknowledged)
+				w.WriteHeader(http.StatusOK)
+			default:
+				w.WriteHeader(http.StatusOK)
+			}
+			done <- string(body)
+		}),
+		ConnContext: ConnContext,
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	acked := stubServer.AddMessage("test-queue", "ack")
+	require.True(t, stubServer.WaitForDeletion("test-queue", acked.ID, 5*time.Second))
+
+	// nack した場合や、どちらも呼び出さなかった場合は 2xx でも削除されないこと
+	nacked := stubServer.AddMessage("test-queue", "nack")
+	ignored := stubServer.AddMessage("test-queue", "none")
+	handled := map[string]bool{}
+	for len(handled) < 3 {
+		select {
+		case body := <-done:
+			handled[body] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("messages should be delivered: %v", handled)
+		}
+	}
+	assert.False(t, stubServer.WaitForDeletion("test-queue", nacked.ID, 200*time.Millisecond))
+	assert.False(t, stubServer.WaitForDeletion("test-queue", ignored.ID, 200*time.Millisecond))
+
+	// AckManual でない場合は取得できないこと
+	_, _, ok := AckFromContext(context.Background())
+	assert.False(t, ok)
+}
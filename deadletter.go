@@ -0,0 +1,33 @@
+package simplemqhttp
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+)
+
+// DeadLetterHandler は、処理に繰り返し失敗したメッセージを受け取るためのインターフェースです。
+// HandleDeadLetter が nil を返した場合、メッセージは元のキューから削除されます。
+type DeadLetterHandler interface {
+	HandleDeadLetter(ctx context.Context, msg simplemq.Message) error
+}
+
+// QueueDeadLetterHandler は、処理に繰り返し失敗したメッセージを別のキューに送信する DeadLetterHandler 実装です。
+type QueueDeadLetterHandler struct {
+	// Client は、デッドレターキューに送信するためのクライアントです。
+	Client *simplemq.Client
+}
+
+var _ DeadLetterHandler = &QueueDeadLetterHandler{}
+
+// HandleDeadLetter は、メッセージの内容をそのままデッドレターキューに送信します。
+func (h *QueueDeadLetterHandler) HandleDeadLetter(ctx context.Context, msg simplemq.Message) error {
+	if h.Client == nil {
+		return fmt.Errorf("dead letter queue client is nil")
+	}
+	if _, err := h.Client.SendMessage(ctx, msg.Content); err != nil {
+		return fmt.Errorf("failed to send message %s to dead letter queue %s: %w", msg.ID, h.Client.Queue, err)
+	}
+	return nil
+}
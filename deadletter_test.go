@@ -0,0 +1,107 @@
+package simplemqhttp
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+	"github.com/mashiike/simplemqhttp/stub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerDeadLetter(t *testing.T) {
+	// stubサーバーの作成（再配信が早く起きるよう可視性タイムアウトを短くする）
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+	stubServer.SetVisibilityTimeout(200 * time.Millisecond)
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	// 2回まで受信し、それを超えたらデッドレターキューに送るListenerを作成
+	listener := NewListenerWithClient(client)
+	listener.MaxReceiveCount = 2
+	listener.DeadLetterHandler = &QueueDeadLetterHandler{Client: client.Clone("dead-letter-queue")}
+
+	// 常に失敗するハンドラー
+	var handled atomic.Int32
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handled.Add(1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}),
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	poison := stubServer.AddMessage("test-queue", `{"poison":"message"}`)
+
+	// 最大受信回数を超えたメッセージがデッドレターキューに移動すること
+	_, ok := stubServer.WaitForMessage("dead-letter-queue", 5*time.Second)
+	require.True(t, ok)
+	require.True(t, stubServer.WaitForDeletion("test-queue", poison.ID, time.Second))
+	_, ok = stubServer.WaitForMessage("test-queue", 50*time.Millisecond)
+	require.False(t, ok)
+	assert.EqualValues(t, 2, handled.Load())
+
+	msgs, err := client.Clone("dead-letter-queue").ReceiveMessages(context.Background())
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, `{"poison":"message"}`, msgs[0].Content)
+}
+
+func TestStubRedrivePolicy(t *testing.T) {
+	// stubサーバーの作成（2回受信されて削除されなかったメッセージをデッドレターキューに移動する）
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+	stubServer.SetRedrivePolicy("test-queue", "dead-letter-queue", 2)
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	ctx := context.Background()
+
+	poison := stubServer.AddMessage("test-queue", "poison")
+	for i := 0; i < 2; i++ {
+		msgs, err := client.ReceiveMessages(ctx)
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		// 時計を進めて可視性タイムアウトを切らす
+		stubServer.SetClockSkew(time.Duration(i+1) * time.Minute)
+	}
+
+	// 3回目の受信ではメッセージが返らず、デッドレターキューに移動していること
+	msgs, err := client.ReceiveMessages(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, msgs)
+	assert.Equal(t, 0, stubServer.GetQueueSize("test-queue"))
+	assert.Equal(t, 1, stubServer.GetQueueSize("dead-letter-queue"))
+	moved := stubServer.GetMessage("dead-letter-queue", poison.ID)
+	require.NotNil(t, moved)
+	assert.Equal(t, "poison", moved.Content)
+
+	// 同じ ID で追加し直したメッセージは受信回数が数え直されること
+	stubServer.AddMessageWithID("test-queue", "retry", "retry")
+	msgs, err = client.ReceiveMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.NoError(t, client.DeleteMessage(ctx, "retry"))
+	stubServer.AddMessageWithID("test-queue", "retry", "retry")
+	for i := 0; i < 2; i++ {
+		stubServer.SetClockSkew(time.Duration(i+3) * time.Minute)
+		msgs, err := client.ReceiveMessages(ctx)
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		assert.Equal(t, "retry", msgs[0].ID)
+	}
+	assert.Equal(t, 1, stubServer.GetQueueSize("dead-letter-queue"))
+}
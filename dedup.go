@@ -0,0 +1,96 @@
+package simplemqhttp
+
+import (
+	"sync"
+	"time"
+)
+
+// maxDedupEntries は、重複排除のために記録するメッセージ ID の最大数です。
+// DedupWindow 内に処理したメッセージがこの数を超えた場合は、古いものから忘れます。
+const maxDedupEntries = 100000
+
+type dedupState int
+
+const (
+	dedupNew dedupState = iota
+	dedupInFlight
+	dedupProcessed
+)
+
+type dedupEntry struct {
+	state dedupState
+	at    time.Time
+}
+
+type dedupItem struct {
+	id string
+	at time.Time
+}
+
+// dedupCache は、最近受信したメッセージ ID を記録し、再配信されたメッセージを検出します。
+// 処理済みの記録は時刻の順に並べて保持し、window を過ぎたものから削除します。
+type dedupCache struct {
+	mu      sync.Mutex
+	window  time.Duration
+	now     func() time.Time
+	entries map[string]dedupEntry
+	order   []dedupItem
+}
+
+func newDedupCache(window time.Duration) *dedupCache {
+	return &dedupCache{
+		window:  window,
+		now:     time.Now,
+		entries: make(map[string]dedupEntry),
+	}
+}
+
+// begin は、メッセージの処理を開始できるかを返します。
+// dedupNew を返した場合は処理中として記録します。
+func (c *dedupCache) begin(id string) dedupState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evictLocked()
+	if entry, ok := c.entries[id]; ok {
+		return entry.state
+	}
+	c.entries[id] = dedupEntry{state: dedupInFlight}
+	return dedupNew
+}
+
+// processed は、メッセージの処理に成功したことを記録します。記録は window の間保持されます。
+func (c *dedupCache) processed(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.entries[id] = dedupEntry{state: dedupProcessed, at: now}
+	c.order = append(c.order, dedupItem{id: id, at: now})
+	c.evictLocked()
+}
+
+// finish は、処理に成功しなかったメッセージの記録を削除し、再配信時に再び処理されるようにします。
+func (c *dedupCache) finish(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[id]; ok && entry.state == dedupInFlight {
+		delete(c.entries, id)
+	}
+}
+
+// evictLocked は、window を過ぎた処理済みの記録と、上限を超えた古い記録を削除します。
+// 処理中の記録は finish または processed が呼ばれるまで保持されます。
+func (c *dedupCache) evictLocked() {
+	now := c.now()
+	n := 0
+	for ; n < len(c.order); n++ {
+		item := c.order[n]
+		if len(c.order)-n <= maxDedupEntries && now.Sub(item.at) < c.window {
+			break
+		}
+		// 再び処理済みとして記録された ID は、新しい位置で削除する
+		if entry, ok := c.entries[item.id]; ok && entry.state == dedupProcessed && entry.at.Equal(item.at) {
+			delete(c.entries, item.id)
+		}
+	}
+	c.order = c.order[n:]
+}
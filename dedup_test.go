@@ -0,0 +1,143 @@
+package simplemqhttp
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+	"github.com/mashiike/simplemqhttp/stub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerDedupWindow(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	listener := NewListenerWithClient(client)
+	listener.DedupWindow = time.Minute
+
+	var handled atomic.Int32
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handled.Add(1)
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	stubServer.AddMessageWithID("test-queue", "duplicated-id", `{"dedup":1}`)
+	require.Eventually(t, func() bool {
+		return handled.Load() == 1 && stubServer.GetQueueSize("test-queue") == 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// 同じ ID のメッセージが再び配信されても、ハンドラーは呼び出されずに削除されること
+	stubServer.AddMessageWithID("test-queue", "duplicated-id", `{"dedup":1}`)
+	require.Eventually(t, func() bool {
+		return stubServer.GetQueueSize("test-queue") == 0
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.EqualValues(t, 1, handled.Load())
+
+	// 異なる ID のメッセージは処理されること
+	stubServer.AddMessageWithID("test-queue", "another-id", `{"dedup":2}`)
+	require.Eventually(t, func() bool {
+		return handled.Load() == 2
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestListenerDedupWindowRetriesFailedMessage(t *testing.T) {
+	// stubサーバーの作成（再配信が早く起きるよう可視性タイムアウトを短くする）
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+	stubServer.SetVisibilityTimeout(200 * time.Millisecond)
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	listener := NewListenerWithClient(client)
+	listener.DedupWindow = time.Minute
+
+	// 1回目は失敗し、2回目は成功するハンドラー
+	var handled atomic.Int32
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if handled.Add(1) == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	// 処理に失敗したメッセージは重複として扱われずに再処理されること
+	stubServer.AddMessage("test-queue", `{"retry":true}`)
+	require.Eventually(t, func() bool {
+		return handled.Load() == 2 && stubServer.GetQueueSize("test-queue") == 0
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestDedupCacheEviction(t *testing.T) {
+	now := time.Unix(0, 0)
+	cache := newDedupCache(time.Minute)
+	cache.now = func() time.Time { return now }
+
+	require.Equal(t, dedupNew, cache.begin("a"))
+	// 処理中のメッセージは処理中として扱われること
+	require.Equal(t, dedupInFlight, cache.begin("a"))
+	cache.processed("a")
+	require.Equal(t, dedupProcessed, cache.begin("a"))
+
+	// 処理に成功しなかったメッセージは記録から削除されること
+	require.Equal(t, dedupNew, cache.begin("b"))
+	cache.finish("b")
+	require.Equal(t, dedupNew, cache.begin("b"))
+	cache.processed("b")
+
+	// 処理済みのメッセージに finish を呼び出しても記録は残ること
+	cache.finish("a")
+	require.Equal(t, dedupProcessed, cache.begin("a"))
+
+	// window を過ぎた記録は削除されること
+	now = now.Add(time.Minute)
+	require.Equal(t, dedupNew, cache.begin("a"))
+	assert.Empty(t, cache.order)
+	_, ok := cache.entries["b"]
+	assert.False(t, ok)
+}
+
+func TestDedupCacheBounded(t *testing.T) {
+	now := time.Unix(0, 0)
+	cache := newDedupCache(time.Hour)
+	cache.now = func() time.Time { return now }
+
+	// 上限を超えた場合は古い記録から削除されること
+	for i := 0; i < maxDedupEntries+10; i++ {
+		id := strconv.Itoa(i)
+		cache.begin(id)
+		cache.processed(id)
+	}
+	assert.Len(t, cache.order, maxDedupEntries)
+	assert.Len(t, cache.entries, maxDedupEntries)
+	assert.Equal(t, dedupNew, cache.begin("0"))
+	assert.Equal(t, dedupProcessed, cache.begin(strconv.Itoa(maxDedupEntries+9)))
+}
@@ -0,0 +1,167 @@
+package simplemqhttp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrDecryptionFailed は、EncryptingSerializer がメッセージを復号できなかったことを表すエラーです。
+// 鍵が一致しない場合や、メッセージが改ざんされている場合に返されます。
+var ErrDecryptionFailed = errors.New("failed to decrypt message")
+
+// encryptedPrefix は、EncryptingSerializer が暗号化したメッセージの接頭辞です。
+const encryptedPrefix = "enc:v1:"
+
+// EncryptionKey は、EncryptingSerializer で使用する鍵です。
+type EncryptionKey struct {
+	// ID は、鍵を識別するための値です。暗号化したメッセージに付与され、復号の際に使用する鍵の選択に使われます。
+	// 空文字列や ":" を含む値は使用できません。
+	ID string
+	// Key は、AES-256 の鍵です。32 バイトである必要があります。
+	Key []byte
+}
+
+// EncryptingSerializer は、別のシリアライザでシリアライズした内容を AES-256-GCM で暗号化するシリアライザです。
+// メッセージは "enc:v1:<鍵 ID>:<base64 エンコードしたノンスと暗号文>" の形式で格納されます。
+//
+// 暗号化には Keys の先頭の鍵を使用します。復号の際は、メッセージに付与された ID の鍵を優先し、
+// 一致しない場合は残りの鍵を順に試します。鍵をローテーションする場合は、新しい鍵を先頭に追加し、
+// 古い鍵で暗号化されたメッセージがなくなるまで古い鍵を残してください。
+type EncryptingSerializer struct {
+	// Serializer は、暗号化する前にリクエストをシリアライズするシリアライザです。
+	// 未指定の場合は、NoBase64 を指定した BodyOnlySerializer が使用されます。
+	Serializer Serializer
+	// Keys は、暗号化と復号に使用する鍵の一覧です。
+	Keys []EncryptionKey
+}
+
+var _ Serializer = &EncryptingSerializer{}
+
+// contentEncryptor は、メッセージの内容を暗号化するシリアライザです。
+// 他のシリアライザを選んで使用するシリアライザは、Serialize で使用するシリアライザが暗号化するかを返します。
+type contentEncryptor interface {
+	encryptsContent() bool
+}
+
+func (s *EncryptingSerializer) encryptsContent() bool {
+	return true
+}
+
+// encryptsContent は、s がメッセージの内容を暗号化するかを返します。
+func encryptsContent(s Serializer) bool {
+	e, ok := s.(contentEncryptor)
+	return ok && e.encryptsContent()
+}
+
+func (s *EncryptingSerializer) serializer() Serializer {
+	if s.Serializer != nil {
+		return s.Serializer
+	}
+	return &BodyOnlySerializer{NoBase64: true}
+}
+
+func newGCM(key EncryptionKey) (cipher.AEAD, error) {
+	if key.ID == "" || strings.Contains(key.ID, ":") {
+		return nil, fmt.Errorf("invalid encryption key ID %q", key.ID)
+	}
+	if len(key.Key) != 32 {
+		return nil, fmt.Errorf("encryption key %q must be 32 bytes, got %d", key.ID, len(key.Key))
+	}
+	block, err := aes.NewCipher(key.Key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *EncryptingSerializer) Serialize(req *http.Request) (string, error) {
+	return s.serializeWithAttributes(req, nil)
+}
+
+// serializeWithAttributes は、メッセージ属性を暗号化する内容に含めてシリアライズします。
+// 属性は Serializer の形式に含めるか、Serializer が含められない場合は内容の先頭に埋め込んでから暗号化するため、平文では残りません。
+func (s *EncryptingSerializer) serializeWithAttributes(req *http.Request, attributes http.Header) (string, error) {
+	if len(s.Keys) == 0 {
+		return "", errors.New("encryption key is not set")
+	}
+	key := s.Keys[0]
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := serializeWithAttributes(s.serializer(), req, attributes)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	content := encryptedPrefix + key.ID + ":" + base64.StdEncoding.EncodeToString(sealed)
+	if len(content) > maxMessageSize {
+		return "", ErrTooLarge
+	}
+	return content, nil
+}
+
+func (s *EncryptingSerializer) Deserialize(content string) (*http.Request, error) {
+	req, _, err := s.deserializeWithAttributes(content)
+	return req, err
+}
+
+// deserializeWithAttributes は、復号した内容からリクエストとメッセージ属性を復元します。
+// 属性を暗号化する前に、暗号文の先頭に属性を埋め込んで送信されたメッセージも復元します。
+func (s *EncryptingSerializer) deserializeWithAttributes(content string) (*http.Request, http.Header, error) {
+	attributes, content := decodeAttributes(content)
+	rest, ok := strings.CutPrefix(content, encryptedPrefix)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: message is not encrypted", ErrDecryptionFailed)
+	}
+	keyID, encoded, ok := strings.Cut(rest, ":")
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: missing key ID", ErrDecryptionFailed)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrDecryptionFailed, err)
+	}
+	plaintext, err := s.open(keyID, sealed)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, carried, err := deserializeWithAttributes(s.serializer(), string(plaintext))
+	return req, mergeAttributes(attributes, carried), err
+}
+
+// open は、keyID の鍵を優先して、残りの鍵を順に試しながら復号します。
+func (s *EncryptingSerializer) open(keyID string, sealed []byte) ([]byte, error) {
+	keys := make([]EncryptionKey, 0, len(s.Keys))
+	for _, key := range s.Keys {
+		if key.ID == keyID {
+			keys = append([]EncryptionKey{key}, keys...)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(sealed) < gcm.NonceSize() {
+			return nil, fmt.Errorf("%w: ciphertext too short", ErrDecryptionFailed)
+		}
+		nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+		if plaintext, err := gcm.Open(nil, nonce, ciphertext, nil); err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no key matched key ID %q", ErrDecryptionFailed, keyID)
+}
@@ -0,0 +1,136 @@
+package simplemqhttp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEncryptionKey(id string, b byte) EncryptionKey {
+	return EncryptionKey{ID: id, Key: bytes.Repeat([]byte{b}, 32)}
+}
+
+func TestEncryptingSerializer(t *testing.T) {
+	const body = `{"email":"user@example.com"}`
+	serializer := &EncryptingSerializer{Keys: []EncryptionKey{testEncryptionKey("k1", 1)}}
+
+	t.Run("Round trip", func(t *testing.T) {
+		req, err := http.NewRequest("POST", "/", strings.NewReader(body))
+		require.NoError(t, err)
+		content, err := serializer.Serialize(req)
+		require.NoError(t, err)
+
+		// 鍵 ID が付与され、平文が含まれないこと
+		assert.True(t, strings.HasPrefix(content, "enc:v1:k1:"))
+		assert.NotContains(t, content, "user@example.com")
+
+		decoded, err := serializer.Deserialize(content)
+		require.NoError(t, err)
+		bs, err := io.ReadAll(decoded.Body)
+		require.NoError(t, err)
+		assert.Equal(t, body, string(bs))
+	})
+
+	t.Run("Random nonce", func(t *testing.T) {
+		// 同じ内容でも暗号文が異なること
+		req1, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+		req2, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+		c1, err := serializer.Serialize(req1)
+		require.NoError(t, err)
+		c2, err := serializer.Serialize(req2)
+		require.NoError(t, err)
+		assert.NotEqual(t, c1, c2)
+	})
+
+	t.Run("Wrapped serializer", func(t *testing.T) {
+		// 内側のシリアライザでメソッドやパスも保持できること
+		s := &EncryptingSerializer{Serializer: &JSONSerializer{}, Keys: serializer.Keys}
+		req, err := http.NewRequest("PUT", "/users/1", strings.NewReader(body))
+		require.NoError(t, err)
+		content, err := s.Serialize(req)
+		require.NoError(t, err)
+		decoded, err := s.Deserialize(content)
+		require.NoError(t, err)
+		assert.Equal(t, "PUT", decoded.Method)
+		assert.Equal(t, "/users/1", decoded.URL.Path)
+	})
+
+	t.Run("Wrong key", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+		content, err := serializer.Serialize(req)
+		require.NoError(t, err)
+
+		// 鍵が一致しない場合は認証に失敗したことを示すエラーを返すこと
+		other := &EncryptingSerializer{Keys: []EncryptionKey{testEncryptionKey("k1", 2)}}
+		_, err = other.Deserialize(content)
+		assert.ErrorIs(t, err, ErrDecryptionFailed)
+	})
+
+	t.Run("Tampered ciphertext", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+		content, err := serializer.Serialize(req)
+		require.NoError(t, err)
+
+		prefix := "enc:v1:k1:"
+		sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(content, prefix))
+		require.NoError(t, err)
+		sealed[len(sealed)-1] ^= 0xff
+		_, err = serializer.Deserialize(prefix + base64.StdEncoding.EncodeToString(sealed))
+		assert.ErrorIs(t, err, ErrDecryptionFailed)
+	})
+
+	t.Run("Not encrypted", func(t *testing.T) {
+		_, err := serializer.Deserialize(body)
+		assert.ErrorIs(t, err, ErrDecryptionFailed)
+	})
+
+	t.Run("Invalid key size", func(t *testing.T) {
+		s := &EncryptingSerializer{Keys: []EncryptionKey{{ID: "short", Key: []byte("short")}}}
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+		_, err := s.Serialize(req)
+		assert.Error(t, err)
+	})
+}
+
+func TestEncryptingSerializerKeyRotation(t *testing.T) {
+	const body = `{"rotate":true}`
+	oldKey := testEncryptionKey("old", 1)
+	newKey := testEncryptionKey("new", 2)
+
+	// 古い鍵で暗号化されたメッセージ
+	before := &EncryptingSerializer{Keys: []EncryptionKey{oldKey}}
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+	oldContent, err := before.Serialize(req)
+	require.NoError(t, err)
+
+	// 新しい鍵を先頭に追加した後は新しい鍵で暗号化し、古い鍵のメッセージも復号できること
+	after := &EncryptingSerializer{Keys: []EncryptionKey{newKey, oldKey}}
+	req, _ = http.NewRequest("POST", "/", strings.NewReader(body))
+	newContent, err := after.Serialize(req)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(newContent, "enc:v1:new:"))
+
+	for _, content := range []string{oldContent, newContent} {
+		decoded, err := after.Deserialize(content)
+		require.NoError(t, err)
+		bs, err := io.ReadAll(decoded.Body)
+		require.NoError(t, err)
+		assert.Equal(t, body, string(bs))
+	}
+
+	// 鍵 ID が変わっていても、残りの鍵を試して復号できること
+	renamed := &EncryptingSerializer{Keys: []EncryptionKey{newKey, {ID: "renamed", Key: oldKey.Key}}}
+	_, err = renamed.Deserialize(oldContent)
+	require.NoError(t, err)
+
+	// 古い鍵を削除した後は復号できないこと
+	removed := &EncryptingSerializer{Keys: []EncryptionKey{newKey}}
+	_, err = removed.Deserialize(oldContent)
+	assert.ErrorIs(t, err, ErrDecryptionFailed)
+}
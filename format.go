@@ -0,0 +1,116 @@
+package simplemqhttp
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrUnknownFormat は、SerializerRegistry がメッセージの形式を判別できなかったことを表すエラーです。
+// 形式の識別子が登録されていない場合や、識別子のないメッセージで Fallback が指定されていない場合に返されます。
+var ErrUnknownFormat = errors.New("unknown message format")
+
+// formatPrefix は、SerializerRegistry がメッセージの先頭に付与する形式の識別子の接頭辞です。
+// 形式は "simplemqhttp-format:<形式の名前>\n<content>" です。
+const formatPrefix = "simplemqhttp-format:"
+
+// SerializerRegistry は、メッセージの先頭に形式の識別子を付与し、デシリアライズの際に識別子に応じたシリアライザを選ぶシリアライザです。
+// シリアライザを移行する間など、異なる形式のメッセージが同じキューに混在する場合に、1つの Listener ですべての形式を扱えます。
+// 識別子がないと、シリアライザは内容から形式を推測するため、異なる形式のメッセージを誤ったリクエストとして復元することがあります。
+//
+//	serializer := &simplemqhttp.SerializerRegistry{
+//		Format: "json",
+//		Serializers: map[string]simplemqhttp.Serializer{
+//			"body": &simplemqhttp.BodyOnlySerializer{},
+//			"json": &simplemqhttp.JSONSerializer{},
+//		},
+//		// 識別子を付与する前に送信されたメッセージ
+//		Fallback: &simplemqhttp.BodyOnlySerializer{},
+//	}
+//
+// 受信側を先に SerializerRegistry に切り替えてから、送信側を切り替えてください。
+// 識別子を付与したメッセージは、SerializerRegistry を使用しない Listener では復元できません。
+// このパッケージのシリアライザは、識別子を付与したメッセージを ErrUnknownFormat のエラーにします。
+// 独自のシリアライザは識別子を判別しないため、誤ったリクエストとして復元することがあります。
+type SerializerRegistry struct {
+	// Format は、Serialize で使用する形式の名前です。Serializers に含まれている必要があります。
+	// 空文字列や改行を含む名前は使用できません。
+	Format string
+	// Serializers は、形式の名前とその形式のシリアライザの対応です。
+	Serializers map[string]Serializer
+	// Fallback は、形式の識別子のないメッセージをデシリアライズするシリアライザです。
+	// nil の場合、識別子のないメッセージは ErrUnknownFormat のエラーになります。
+	Fallback Serializer
+}
+
+func (r *SerializerRegistry) Serialize(req *http.Request) (string, error) {
+	return r.serializeWithAttributes(req, nil)
+}
+
+// serializeWithAttributes は、Format のシリアライザでメッセージ属性とともにシリアライズし、形式の識別子を付与します。
+func (r *SerializerRegistry) serializeWithAttributes(req *http.Request, attributes http.Header) (string, error) {
+	if r.Format == "" || strings.Contains(r.Format, "\n") {
+		return "", fmt.Errorf("invalid message format name: %q", r.Format)
+	}
+	s, ok := r.Serializers[r.Format]
+	if !ok {
+		return "", fmt.Errorf("%w: %q is not registered", ErrUnknownFormat, r.Format)
+	}
+	content, err := serializeWithAttributes(s, req, attributes)
+	if err != nil {
+		return "", err
+	}
+	// 識別子を含めた大きさは、Transport がシリアライザの上限と合わせて確認する
+	return formatPrefix + r.Format + "\n" + content, nil
+}
+
+// maxContentSize は、Serialize で使用するシリアライザの上限を返します。
+func (r *SerializerRegistry) maxContentSize() int {
+	return contentSizeLimit(r.Serializers[r.Format])
+}
+
+// encryptsContent は、Serialize で使用するシリアライザが内容を暗号化するかを返します。
+func (r *SerializerRegistry) encryptsContent() bool {
+	return encryptsContent(r.Serializers[r.Format])
+}
+
+// Deserialize は、メッセージの形式の識別子に応じたシリアライザでデシリアライズします。
+// 識別子が Serializers に登録されていない場合は、ErrUnknownFormat を返します。
+func (r *SerializerRegistry) Deserialize(content string) (*http.Request, error) {
+	req, _, err := r.deserializeWithAttributes(content)
+	return req, err
+}
+
+// deserializeWithAttributes は、形式の識別子に応じたシリアライザでリクエストとメッセージ属性を復元します。
+// 識別子の前に属性を埋め込んで送信されたメッセージも復元します。
+func (r *SerializerRegistry) deserializeWithAttributes(content string) (*http.Request, http.Header, error) {
+	attributes, content := decodeAttributes(content)
+	rest, ok := strings.CutPrefix(content, formatPrefix)
+	if !ok {
+		if r.Fallback == nil {
+			return nil, nil, fmt.Errorf("%w: message has no format marker", ErrUnknownFormat)
+		}
+		req, carried, err := deserializeWithAttributes(r.Fallback, content)
+		return req, mergeAttributes(attributes, carried), err
+	}
+	name, body, ok := strings.Cut(rest, "\n")
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: malformed format marker", ErrUnknownFormat)
+	}
+	s, ok := r.Serializers[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %q", ErrUnknownFormat, name)
+	}
+	req, carried, err := deserializeWithAttributes(s, body)
+	return req, mergeAttributes(attributes, carried), err
+}
+
+// rejectFormatMarker は、内容に SerializerRegistry の形式の識別子が付与されている場合に ErrUnknownFormat を返します。
+// 識別子を判別しないシリアライザが、他の形式のメッセージを誤ったリクエストとして復元しないようにします。
+func rejectFormatMarker(content string) error {
+	if strings.HasPrefix(content, formatPrefix) {
+		return fmt.Errorf("%w: message has a format marker, use SerializerRegistry to deserialize it", ErrUnknownFormat)
+	}
+	return nil
+}
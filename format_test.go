@@ -0,0 +1,114 @@
+package simplemqhttp
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSerializerRegistry(t *testing.T) {
+	serializers := map[string]Serializer{
+		"body": &BodyOnlySerializer{},
+		"json": &JSONSerializer{},
+	}
+	newRequest := func() *http.Request {
+		req, err := http.NewRequest(http.MethodPut, "/items/1", strings.NewReader(`{"name":"test"}`))
+		require.NoError(t, err)
+		return req
+	}
+	readBody := func(t *testing.T, req *http.Request) string {
+		bs, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		return string(bs)
+	}
+
+	// 移行中の Listener は、すべての形式と識別子のない従来のメッセージを扱う
+	listener := &SerializerRegistry{Serializers: serializers, Fallback: &BodyOnlySerializer{}}
+
+	t.Run("Dispatch by marker", func(t *testing.T) {
+		// 形式ごとのシリアライザで復元されること
+		bodyContent, err := (&SerializerRegistry{Format: "body", Serializers: serializers}).Serialize(newRequest())
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(bodyContent, "simplemqhttp-format:body\n"))
+		req, err := listener.Deserialize(bodyContent)
+		require.NoError(t, err)
+		assert.Equal(t, http.MethodPost, req.Method)
+		assert.Equal(t, `{"name":"test"}`, readBody(t, req))
+
+		jsonContent, err := (&SerializerRegistry{Format: "json", Serializers: serializers}).Serialize(newRequest())
+		require.NoError(t, err)
+		req, err = listener.Deserialize(jsonContent)
+		require.NoError(t, err)
+		assert.Equal(t, http.MethodPut, req.Method)
+		assert.Equal(t, "/items/1", req.URL.Path)
+		assert.Equal(t, `{"name":"test"}`, readBody(t, req))
+	})
+
+	t.Run("Fallback", func(t *testing.T) {
+		// 識別子のないメッセージは Fallback で復元されること
+		legacy, err := (&BodyOnlySerializer{}).Serialize(newRequest())
+		require.NoError(t, err)
+		req, err := listener.Deserialize(legacy)
+		require.NoError(t, err)
+		assert.Equal(t, `{"name":"test"}`, readBody(t, req))
+
+		// Fallback がない場合はエラーになること
+		_, err = (&SerializerRegistry{Serializers: serializers}).Deserialize(legacy)
+		assert.ErrorIs(t, err, ErrUnknownFormat)
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		// 登録されていない形式のメッセージは、推測せずにエラーになること
+		jsonContent, err := (&SerializerRegistry{Format: "json", Serializers: serializers}).Serialize(newRequest())
+		require.NoError(t, err)
+		bodyOnly := &SerializerRegistry{Serializers: map[string]Serializer{"body": &BodyOnlySerializer{}}}
+		_, err = bodyOnly.Deserialize(jsonContent)
+		require.ErrorIs(t, err, ErrUnknownFormat)
+		assert.Contains(t, err.Error(), `"json"`)
+
+		_, err = listener.Deserialize("simplemqhttp-format:json")
+		assert.ErrorIs(t, err, ErrUnknownFormat)
+	})
+
+	t.Run("Bare serializer rejects marked content", func(t *testing.T) {
+		// SerializerRegistry を使用しない Listener でも、識別子を付与したメッセージを誤って復元しないこと
+		jsonContent, err := (&SerializerRegistry{Format: "json", Serializers: serializers}).Serialize(newRequest())
+		require.NoError(t, err)
+		bare := map[string]Serializer{
+			"body":              &BodyOnlySerializer{},
+			"body without b64":  &BodyOnlySerializer{NoBase64: true},
+			"method preserving": &MethodPreservingSerializer{},
+			"envelope":          &EnvelopeSerializer{},
+			"json":              &JSONSerializer{},
+			"gob":               &GobSerializer{},
+			"claim check":       &ClaimCheckSerializer{Store: &hashingBodyStore{}},
+		}
+		for name, s := range bare {
+			_, err := s.Deserialize(jsonContent)
+			assert.ErrorIs(t, err, ErrUnknownFormat, name)
+		}
+	})
+
+	t.Run("Size limit", func(t *testing.T) {
+		// 識別子を含めた内容が、形式のシリアライザの上限を超える場合は ErrTooLarge になること
+		registry := &SerializerRegistry{
+			Format:      "body",
+			Serializers: map[string]Serializer{"body": &BodyOnlySerializer{MaxContentSize: 1024}},
+		}
+		req, err := http.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("a", 768)))
+		require.NoError(t, err)
+		_, err = (&Transport{Serializer: registry}).serialize(req)
+		assert.ErrorIs(t, err, ErrTooLarge)
+	})
+
+	t.Run("Invalid format", func(t *testing.T) {
+		_, err := (&SerializerRegistry{Format: "gob", Serializers: serializers}).Serialize(newRequest())
+		assert.ErrorIs(t, err, ErrUnknownFormat)
+		_, err = (&SerializerRegistry{Serializers: serializers}).Serialize(newRequest())
+		assert.Error(t, err)
+	})
+}
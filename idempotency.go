@@ -0,0 +1,119 @@
+package simplemqhttp
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+)
+
+// IdempotencyKeyHeader は、Transport で送信するリクエストの冪等性キーを指定するためのリクエストヘッダーです。
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyEntries は、冪等性キーのために記録する送信結果の最大数です。
+const maxIdempotencyEntries = 10000
+
+type idempotencyEntry struct {
+	// done は、送信が完了したときに閉じられます。
+	done chan struct{}
+	// msg は、送信に成功した場合のメッセージです。送信中または失敗した場合は nil です。
+	msg *simplemq.Message
+	// buffered は、送信に失敗したメッセージをローカルバッファに格納した場合に true です。
+	// バッファから再送信されるため、同じ key のリクエストは送信済みとして扱います。
+	buffered bool
+	at       time.Time
+}
+
+type idempotencyItem struct {
+	key   string
+	entry *idempotencyEntry
+}
+
+// idempotencyCache は、冪等性キーごとに送信に成功したメッセージを記録します。
+// 記録は送信した時刻の順に並べて保持し、window を過ぎたものから削除します。
+type idempotencyCache struct {
+	mu      sync.Mutex
+	window  time.Duration
+	now     func() time.Time
+	entries map[string]*idempotencyEntry
+	order   []idempotencyItem
+}
+
+func newIdempotencyCache(window time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		window:  window,
+		now:     time.Now,
+		entries: make(map[string]*idempotencyEntry),
+	}
+}
+
+// acquire は、key で送信に成功したメッセージがあればそれを返します。
+// ローカルバッファに格納された送信がある場合は、buffered に true を返します。
+// どちらもない場合は、送信の結果を記録するための関数を返します。呼び出し元は送信の後に必ずその関数を呼び出してください。
+// 同じ key の送信中のリクエストがある場合は、その完了を待ちます。
+func (c *idempotencyCache) acquire(ctx context.Context, key string) (msg *simplemq.Message, buffered bool, complete func(msg *simplemq.Message, buffered bool), err error) {
+	for {
+		c.mu.Lock()
+		c.evictLocked()
+		entry, ok := c.entries[key]
+		if !ok {
+			entry = &idempotencyEntry{done: make(chan struct{})}
+			c.entries[key] = entry
+			c.mu.Unlock()
+			return nil, false, func(msg *simplemq.Message, buffered bool) {
+				c.complete(key, entry, msg, buffered)
+			}, nil
+		}
+		c.mu.Unlock()
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return nil, false, nil, ctx.Err()
+		}
+		if entry.msg != nil {
+			msg := *entry.msg
+			return &msg, false, nil, nil
+		}
+		if entry.buffered {
+			return nil, true, nil, nil
+		}
+		// 送信に失敗した場合は記録が削除されているため、改めて送信する
+	}
+}
+
+// complete は、送信の結果を記録します。
+// msg が nil で buffered が false の場合は記録を削除し、次のリクエストで再び送信されるようにします。
+func (c *idempotencyCache) complete(key string, entry *idempotencyEntry, msg *simplemq.Message, buffered bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if msg != nil || buffered {
+		if msg != nil {
+			copied := *msg
+			entry.msg = &copied
+		}
+		entry.buffered = buffered
+		entry.at = c.now()
+		c.order = append(c.order, idempotencyItem{key: key, entry: entry})
+	} else if c.entries[key] == entry {
+		delete(c.entries, key)
+	}
+	close(entry.done)
+	c.evictLocked()
+}
+
+// evictLocked は、window を過ぎた記録と、上限を超えた古い記録を削除します。
+func (c *idempotencyCache) evictLocked() {
+	now := c.now()
+	n := 0
+	for ; n < len(c.order); n++ {
+		item := c.order[n]
+		if len(c.order)-n <= maxIdempotencyEntries && now.Sub(item.entry.at) < c.window {
+			break
+		}
+		if c.entries[item.key] == item.entry {
+			delete(c.entries, item.key)
+		}
+	}
+	c.order = c.order[n:]
+}
@@ -0,0 +1,134 @@
+package simplemqhttp
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+	"github.com/mashiike/simplemqhttp/stub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransportIdempotencyKey(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	transport := NewTransportWithClient(client)
+	transport.IdempotencyWindow = time.Minute
+
+	send := func(key string) *http.Response {
+		req, err := http.NewRequest("POST", "/test", strings.NewReader(`{"idempotent":true}`))
+		require.NoError(t, err)
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("Suppress duplicates", func(t *testing.T) {
+		stubServer.Reset()
+		first := send("key-1")
+		require.Equal(t, http.StatusAccepted, first.StatusCode)
+		// 同じ冪等性キーのリクエストは再送信されず、同じメッセージ ID のレスポンスが返ること
+		second := send("key-1")
+		require.Equal(t, http.StatusAccepted, second.StatusCode)
+		assert.Equal(t, first.Header.Get("SimpleMQ-Message-ID"), second.Header.Get("SimpleMQ-Message-ID"))
+		assert.Equal(t, 1, stubServer.GetQueueSize("test-queue"))
+
+		// 異なる冪等性キーや冪等性キーのないリクエストは送信されること
+		third := send("key-2")
+		assert.NotEqual(t, first.Header.Get("SimpleMQ-Message-ID"), third.Header.Get("SimpleMQ-Message-ID"))
+		send("")
+		send("")
+		assert.Equal(t, 4, stubServer.GetQueueSize("test-queue"))
+	})
+
+	t.Run("Failed sends are not cached", func(t *testing.T) {
+		stubServer.Reset()
+		stubServer.InjectError(http.MethodPost, `/messages$`, http.StatusInternalServerError, simplemq.APIError{Code: 500, Message: "injected"}, 1)
+		failed := send("key-retry")
+		require.Equal(t, http.StatusInternalServerError, failed.StatusCode)
+
+		// 失敗した後の再試行は送信されること
+		retried := send("key-retry")
+		require.Equal(t, http.StatusAccepted, retried.StatusCode)
+		assert.Equal(t, 1, stubServer.GetQueueSize("test-queue"))
+	})
+
+	t.Run("Concurrent requests", func(t *testing.T) {
+		stubServer.Reset()
+		stubServer.InjectLatency(100 * time.Millisecond)
+		defer stubServer.InjectLatency(0)
+
+		// 同じ冪等性キーの同時のリクエストは1回だけ送信されること
+		var wg sync.WaitGroup
+		ids := make([]string, 5)
+		for i := range ids {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				ids[i] = send("key-concurrent").Header.Get("SimpleMQ-Message-ID")
+			}(i)
+		}
+		wg.Wait()
+		for _, id := range ids {
+			assert.Equal(t, ids[0], id)
+		}
+		assert.Equal(t, 1, stubServer.GetQueueSize("test-queue"))
+	})
+}
+
+func TestIdempotencyCacheWindow(t *testing.T) {
+	now := time.Unix(0, 0)
+	cache := newIdempotencyCache(time.Minute)
+	cache.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	msg, _, complete, err := cache.acquire(ctx, "key")
+	require.NoError(t, err)
+	require.Nil(t, msg)
+	complete(&simplemq.Message{ID: "message-1"}, false)
+
+	msg, _, _, err = cache.acquire(ctx, "key")
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+	assert.Equal(t, "message-1", msg.ID)
+
+	// window を過ぎた記録は削除され、再び送信されること
+	now = now.Add(time.Minute)
+	msg, _, complete, err = cache.acquire(ctx, "key")
+	require.NoError(t, err)
+	require.Nil(t, msg)
+	complete(nil, false)
+	assert.Empty(t, cache.entries)
+	assert.Empty(t, cache.order)
+
+	// ローカルバッファに格納した送信は、送信済みとして記録されること
+	_, _, complete, err = cache.acquire(ctx, "buffered")
+	require.NoError(t, err)
+	complete(nil, true)
+	msg, buffered, _, err := cache.acquire(ctx, "buffered")
+	require.NoError(t, err)
+	assert.Nil(t, msg)
+	assert.True(t, buffered)
+
+	// 送信中の記録を待っている間にコンテキストが終了した場合はエラーを返すこと
+	_, _, complete, err = cache.acquire(ctx, "pending")
+	require.NoError(t, err)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, _, err = cache.acquire(canceled, "pending")
+	assert.ErrorIs(t, err, context.Canceled)
+	complete(nil, false)
+}
@@ -1,23 +1,130 @@
 package simplemqhttp
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mashiike/simplemqhttp/simplemq"
 )
 
+// ResponseParser は、ハンドラーが書き込んだバイト列を HTTP レスポンスとして解釈するためのインターフェースです。
+// 解釈したレスポンスのステータスコードによって、メッセージを削除するかどうかが決まります。
+type ResponseParser interface {
+	ParseResponse(b []byte, req *http.Request) (*http.Response, error)
+}
+
+// HTTPResponseParser は、書き込まれたバイト列を http.ReadResponse で読み込む既定の ResponseParser 実装です。
+type HTTPResponseParser struct{}
+
+// ParseResponse は、バイト列を HTTP/1.x のレスポンスとして読み込みます。
+func (HTTPResponseParser) ParseResponse(b []byte, req *http.Request) (*http.Response, error) {
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), req)
+}
+
 // ResponseHandler は、HTTP レスポンスを処理するためのインターフェースです。
+// HandleResponse が返す Disposition に従って、メッセージの削除や再配信が行われます。
+// エラーを返した場合は、Disposition に関わらずメッセージは削除されず、可視性タイムアウトの経過後に再配信されます。
+// 複数のハンドラーを使用する場合は、MultiResponseHandler で組み合わせてください。
+//
+// レスポンスが Content-Encoding: gzip の場合は、http.Transport と同様にボディを展開して渡します。
+// その際、Content-Encoding と Content-Length ヘッダーは削除され、resp.Uncompressed は true になります。
 type ResponseHandler interface {
-	HandleResponse(resp *http.Response, req *http.Request) error
+	HandleResponse(resp *http.Response, req *http.Request) (Disposition, error)
+}
+
+// Disposition は、処理を終えたメッセージの扱いを表します。
+type Disposition int
+
+const (
+	// DefaultDisposition は、レスポンスのステータスコードに従ってメッセージを扱います。
+	// 2xx の場合は AckMessage、それ以外の場合は RetryMessage と同じです。
+	DefaultDisposition Disposition = iota
+	// AckMessage は、ステータスコードに関わらずメッセージを削除します。
+	AckMessage
+	// RetryMessage は、ステータスコードに関わらずメッセージを削除せず、再配信させます。
+	// RedeliverAfterHeader と Retry-After ヘッダーは、通常どおり再配信の時期に反映されます。
+	RetryMessage
+	// DeadLetterMessage は、メッセージを Listener.DeadLetterHandler に渡し、元のキューから削除します。
+	// DeadLetterHandler が未指定の場合は、RetryMessage と同じです。
+	DeadLetterMessage
+)
+
+// String は、Disposition の名前を返します。
+func (d Disposition) String() string {
+	switch d {
+	case DefaultDisposition:
+		return "default"
+	case AckMessage:
+		return "ack"
+	case RetryMessage:
+		return "retry"
+	case DeadLetterMessage:
+		return "dead_letter"
+	default:
+		return "unknown"
+	}
+}
+
+// AckMode は、処理を終えたメッセージを削除する方法を表します。
+type AckMode int
+
+const (
+	// AckAuto は、Conn.Close でレスポンスのステータスコードと ResponseHandler に従ってメッセージを削除します。
+	AckAuto AckMode = iota
+	// AckManual は、ハンドラーが AckFromContext で取得した関数を呼び出した場合にのみメッセージを削除します。
+	// Conn.Close はメッセージを削除せず、ResponseHandler が返した Disposition も無視されます。
+	//
+	// 可視性タイムアウトの延長は、ack か nack が呼び出されるか接続が閉じられるまで続きます。
+	// ハンドラーがどちらも呼び出さずに終了した場合、メッセージは削除されずに可視性タイムアウトの経過後に再配信されます。
+	// ハンドラーの終了後に別の goroutine で処理を続ける場合は延長されないため、可視性タイムアウト内に ack を呼び出してください。
+	AckManual
+)
+
+// DefaultRequestIDHeader は、Listener.RequestIDHeader が未指定の場合に使用されるヘッダー名です。
+const DefaultRequestIDHeader = "X-Request-Id"
+
+// DefaultPollInterval は、Listener.PollInterval が未指定の場合に使用される受信間隔です。
+const DefaultPollInterval = 200 * time.Millisecond
+
+// DefaultMaxPollInterval は、Listener.MaxPollInterval が未指定の場合に使用される受信間隔の上限です。
+const DefaultMaxPollInterval = 5 * time.Second
+
+// DefaultMaxPrefetch は、Listener.MaxPrefetch が未指定の場合に使用される先読みの最大数です。
+const DefaultMaxPrefetch = 10
+
+// DefaultExtendJitter は、Listener.ExtendJitter が未指定の場合に使用される延長の時期のゆらぎの割合です。
+const DefaultExtendJitter = 0.1
+
+// DefaultDeadlineExtendAttempts は、Listener.DeadlineExtendAttempts が未指定の場合に使用される、期限に届かせるための延長の最大回数です。
+const DefaultDeadlineExtendAttempts = 10
+
+// DefaultDeadlineExtendInterval は、Listener.DeadlineExtendInterval が未指定の場合に使用される、期限に届かせるための延長の間隔です。
+const DefaultDeadlineExtendInterval = 200 * time.Millisecond
+
+// DefaultAttemptTTL は、Listener.AttemptTTL が未指定の場合に使用される配信回数の記録の保持期間です。
+const DefaultAttemptTTL = time.Hour
+
+// RateLimiter は、API の呼び出しの頻度を制限するためのインターフェースです。
+// Wait は、呼び出しが許可されるまでブロックし、ctx が終了した場合はエラーを返します。
+// golang.org/x/time/rate の *rate.Limiter はこのインターフェースを満たします。
+type RateLimiter interface {
+	Wait(ctx context.Context) error
 }
 
 // Listener は、SimpleMQ からメッセージを受信して HTTP リクエストに変換するための net.Listener 実装です。
+//
+// 公開フィールドによる設定は、最初の Accept の前に済ませてください。Accept を開始した後に変更した場合の動作は保証されません。
+// NewListenerWithOptions を使用すると、作成時にまとめて設定できます。
 type Listener struct {
 	client           *simplemq.Client
 	mu               sync.Mutex
@@ -26,8 +133,199 @@ type Listener struct {
 	Serializer       Serializer
 	Logger           *slog.Logger
 	ResponseHandler  ResponseHandler
-	baseCtx          context.Context
-	baseCancel       context.CancelFunc
+	// RequestIDHeader は、リクエスト ID を設定するヘッダー名です。
+	// 未指定の場合は、DefaultRequestIDHeader が使用されます。
+	RequestIDHeader string
+	// RequestIDFunc は、メッセージからリクエスト ID を生成する関数です。
+	// 未指定の場合は、メッセージ ID がリクエスト ID として使用されます。
+	RequestIDFunc func(msg simplemq.Message) string
+	baseCtx       context.Context
+	baseCancel    context.CancelFunc
+	pauseMu       sync.Mutex
+	resumeCh      chan struct{}
+	drainMu       sync.Mutex
+	draining      bool
+	drainedCh     chan struct{}
+	// MaxInFlightBytes は、処理中のメッセージの合計バイト数の上限です。
+	// 上限を超える場合、Accept は処理中のメッセージが完了するまでブロックします。
+	// 0 以下の場合は制限しません。
+	MaxInFlightBytes int
+	inFlightMu       sync.Mutex
+	inFlightBytes    int
+	inFlightReleased chan struct{}
+	// PollInterval は、受信の間隔です。
+	// 未指定の場合は、DefaultPollInterval が使用されます。
+	PollInterval time.Duration
+	// VisibilityTimeout は、受信したメッセージと、その可視性タイムアウトを延長する際に要求する可視性タイムアウトです。
+	// 処理に時間のかかるハンドラーで、延長の API 呼び出しを減らす場合に指定します。
+	// 延長の間隔は、API が返した可視性タイムアウトから決まります。API がこの値に対応していない場合は、キューの設定が適用されます。
+	// 未指定の場合は、キューの設定が使用されます。
+	VisibilityTimeout time.Duration
+	// ExtendJitter は、可視性タイムアウトを延長する時期に加えるランダムなゆらぎの割合です。
+	// 延長は残り時間の 90% の時点で行いますが、この割合の範囲でランダムに早めることで、
+	// まとめて受信したメッセージの延長が同時に API を呼び出さないようにします。延長が遅れることはありません。
+	// 未指定の場合は DefaultExtendJitter が使用され、負の値の場合はゆらぎを加えません。1 以上の値は 1 として扱います。
+	ExtendJitter float64
+	// DisableAutoExtend が true の場合、処理中のメッセージの可視性タイムアウトを延長しません。
+	// 常に可視性タイムアウトより十分短い時間で処理を終えるハンドラーで、延長の goroutine と API 呼び出しを省く場合に指定します。
+	// 処理が可視性タイムアウトを超えると、処理中でもメッセージが再配信され、重複して処理される可能性があります。
+	// Conn の SetDeadline などは期限を記録するだけで、延長は行いません。
+	DisableAutoExtend bool
+	// DeadlineExtendAttempts は、Conn の SetDeadline などで設定した期限に可視性タイムアウトを届かせるために、
+	// 期限の設定時に行う延長の最大回数です。延長のたびに API が返した可視性タイムアウトを確認し、期限に届いた時点で終了します。
+	// 残りの回数で期限に届かない場合は、SetDeadline などが ErrDeadlineUnreachable を返します。
+	// 未指定の場合は DefaultDeadlineExtendAttempts が使用されます。
+	DeadlineExtendAttempts int
+	// DeadlineExtendInterval は、期限に届かせるための延長の間隔です。API の呼び出し頻度を抑えるため、
+	// 延長の間はこの時間だけ待機します。待機時間は ExtendJitter の割合の範囲でランダムに短くなります。
+	// 未指定の場合は DefaultDeadlineExtendInterval が使用されます。
+	DeadlineExtendInterval time.Duration
+	// AdaptivePolling が true の場合、空の受信が続くと受信間隔を指数的に延ばし、
+	// 間隔にランダムなゆらぎを加えます。同じキューを複数のリスナーで受信する場合の API 呼び出しを削減します。
+	AdaptivePolling bool
+	// MaxPollInterval は、空の受信が続いた場合の受信間隔の上限です。
+	// 指定した場合は、空の受信が続くと PollInterval から MaxPollInterval まで受信間隔を指数的に延ばし、
+	// メッセージを受信すると PollInterval に戻します。
+	// AdaptivePolling 有効時に未指定の場合は、DefaultMaxPollInterval が使用されます。
+	MaxPollInterval time.Duration
+	emptyPolls      int
+	attemptsMu      sync.Mutex
+	attempts        map[string]attemptRecord
+	attemptsSweptAt time.Time
+	// ReceiveRateLimiter を指定した場合は、受信の API を呼び出す前に Wait を呼び出し、呼び出しの頻度を制限します。
+	// PollInterval は受信の間隔を決めますが、ReceiveRateLimiter は受信が続く場合も含めた全体の頻度の上限を決めます。
+	// Wait がコンテキスト以外のエラーを返した場合は、受信を停止し、Accept がそのエラーを返します。
+	ReceiveRateLimiter RateLimiter
+	// AttemptTTL は、メッセージの配信回数の記録を保持する期間です。最後に配信してからこの期間が過ぎた記録は破棄され、
+	// 次に同じメッセージを受信した場合は1回目の配信として数えます。記録はメッセージを削除した時点でも破棄されます。
+	// 未指定の場合は、DefaultAttemptTTL が使用されます。
+	AttemptTTL time.Duration
+	// AsyncAck が true の場合、2xx レスポンス時のメッセージ削除をバックグラウンドで行い、Conn.Close を即座に返します。
+	// 削除に失敗した場合は数回再試行し、それでも失敗した場合はメッセージが再配信されます。
+	AsyncAck bool
+	ackWg    sync.WaitGroup
+	connWg   sync.WaitGroup
+	// OnRelease は、リスナーが閉じられた場合や AcceptFilter で除外された場合など、
+	// Accept で返されなかった受信済みメッセージごとに呼び出されます。
+	// 解放されたメッセージは削除されず、可視性タイムアウトの経過後に再配信されます。
+	OnRelease func(msg simplemq.Message)
+	// SizeRecorder は、受信したメッセージのサイズを記録します。
+	SizeRecorder MessageSizeRecorder
+	// AcceptFilter は、受信したメッセージを Accept で返すかどうかを判定する関数です。
+	// false を返したメッセージは配信されずに解放され、延長も削除もされません。
+	// SimpleMQ にはメッセージを取得せずに参照する API がないため、判定は受信後に行われ、
+	// 除外されたメッセージは可視性タイムアウトの経過後に再び受信可能になります。
+	AcceptFilter func(msg simplemq.Message) bool
+	// IdleTimeout を指定した場合、Accept はこの時間メッセージを受信できなければ ErrIdleTimeout を返します。
+	// 時間はメッセージを受信するたびに数え直します。キューが空になったら終了するバッチ処理などで使用します。
+	// ErrIdleTimeout を返した後も Listener は閉じられず、再び Accept を呼び出すことができます。
+	// http.Server.Serve は Accept のエラーで終了するため、Serve の戻り値で ErrIdleTimeout を判別できます。
+	// ServeWithReconnect も再接続せずに ErrIdleTimeout を返します。
+	IdleTimeout time.Duration
+	// ResponseParser は、ハンドラーが書き込んだバイト列をレスポンスとして解釈するための ResponseParser です。
+	// 未指定の場合は、HTTPResponseParser が使用されます。
+	ResponseParser ResponseParser
+	// MaxPrefetch は、Accept される前に先読みしてバッファしておくメッセージの最大数です。
+	// バッファが MaxPrefetch 件以上の場合は受信を行いません。1回の受信で複数のメッセージを受け取った場合は、一時的に超えることがあります。
+	// 未指定の場合は、DefaultMaxPrefetch が使用されます。
+	MaxPrefetch int
+	// MaxReceiveCount は、メッセージを DeadLetterHandler に渡すまでの最大受信回数です。
+	// 受信回数がこの値を超えたメッセージは Accept で返されずに DeadLetterHandler に渡され、元のキューから削除されます。
+	// SimpleMQ は受信回数を提供しないため、受信回数はこの Listener のプロセス内で数えます。
+	// 0 または DeadLetterHandler が未指定の場合は、何度でも再配信されます。
+	MaxReceiveCount int
+	// DeadLetterHandler は、受信回数が MaxReceiveCount を超えたメッセージと、ResponseHandler が DeadLetterMessage を返したメッセージを受け取ります。
+	DeadLetterHandler DeadLetterHandler
+	// Metrics は、SimpleMQ の受信・削除・延長の呼び出しと、メッセージの処理時間を記録します。
+	// 未指定の場合は記録しません。
+	Metrics Metrics
+	// MaxConcurrency は、同時に処理するメッセージの最大数です。
+	// 処理中の接続がこの数に達している場合、Accept はいずれかの接続が Close されるまでブロックします。
+	// 先読みしたメッセージはバッファにある間は可視性タイムアウトが延長されないため、
+	// 指定した場合は処理中の数とバッファの合計が MaxConcurrency を超えないよう、空きの分だけ受信します。
+	// 0 以下の場合は制限しません。
+	MaxConcurrency int
+	// HeaderPrefix は、リクエストに付与する SimpleMQ-Message-ID などのメタデータのヘッダー名の接頭辞です。
+	// 未指定の場合は、DefaultHeaderPrefix が使用されます。RedeliverAfterHeader と SourceHeader には適用されません。
+	HeaderPrefix string
+	// DedupWindow は、処理に成功したメッセージの ID を記録しておく期間です。
+	// 指定した場合、削除が間に合わずに再配信されたメッセージのうち、この期間内に処理に成功したものはハンドラーに渡さずに削除し、
+	// 処理中のものはハンドラーに渡さずに解放します。
+	// 記録はこの Listener のプロセス内のみで保持されるため、複数のプロセスで受信する場合の重複は排除できません。
+	// 0 以下の場合は重複を排除しません。
+	DedupWindow time.Duration
+	// OnReceiveError は、メッセージの受信に失敗した場合に呼び出され、受信を再試行するかどうかを返します。
+	// true を返した場合は ReceiveRetryBackoff に従って待機してから再試行し、false を返した場合はエラーを Accept から返します。
+	// 未指定の場合は、ネットワークエラーと 5xx、429 のエラーを再試行し、認証エラーなどそれ以外のエラーを Accept から返します。
+	// 先読みの goroutine から呼び出されます。
+	OnReceiveError func(err error) bool
+	// ReceiveRetryBackoff は、連続した受信の失敗の回数から再試行までの待機時間を返す関数です。
+	// 未指定の場合は、200ミリ秒から10秒までの ExponentialBackoff が使用されます。
+	ReceiveRetryBackoff Backoff
+	// OnConnError は、接続の Close でメッセージの処理に失敗した場合に呼び出されます。
+	// リクエストへの変換やレスポンスの解析の失敗、ResponseHandler のエラー、処理中の可視性タイムアウトの延長の失敗、メッセージの削除の失敗が対象で、
+	// 非同期の削除 (AsyncAck) が再試行の後に失敗した場合も呼び出されます。
+	// http.Server は Close のエラーを無視するため、エラーのメトリクスやアラートに使用します。
+	// 複数の goroutine から同時に呼び出される場合があります。
+	OnConnError func(msg simplemq.Message, err error)
+	// AckStatusCodes は、ハンドラーのレスポンスのステータスコードからメッセージを削除するかどうかを返す関数です。
+	// true を返した場合はメッセージを削除し、false を返した場合は削除せずに可視性タイムアウトの経過後に再配信させます。
+	// ResponseHandler が DefaultDisposition を返した場合にのみ使用されます。
+	// 未指定の場合は、2xx のレスポンスでメッセージを削除します。
+	AckStatusCodes func(code int) bool
+	// AckMode は、処理を終えたメッセージを削除する方法です。未指定の場合は AckAuto です。
+	AckMode AckMode
+	// OrderingKey は、メッセージの順序キーを返す関数です。指定した場合、同じ順序キーのメッセージは同時に1つだけ配信され、
+	// 後から受信したメッセージは先に配信したメッセージの接続が Close されるまで、可視性タイムアウトを延長しながら保留されます。
+	// 順序は SimpleMQ から受信した順に従います。異なる順序キーのメッセージ間の順序や、
+	// 複数のプロセスで同じキューを受信する場合の順序は保証されません。空文字列を返したメッセージは順序を考慮せずに配信します。
+	OrderingKey    func(msg simplemq.Message) string
+	orderingMu     sync.Mutex
+	orderingActive map[string]orderingSlot
+	orderingHeld   map[string][]*heldMessage
+	heldCount      int
+	dedupOnce      sync.Once
+	dedup          *dedupCache
+	active         int
+	prefetching    bool
+	receiveErr     error
+	notifyCh       chan struct{}
+	connsMu        sync.Mutex
+	conns          map[*Conn]struct{}
+	// PingOnStart が true の場合、最初の Accept の前に simplemq.Client.Ping で API キーとキューが有効かを確認します。
+	// 確認に失敗した場合、Accept はそのエラーを返すため、http.Server.Serve はリクエストを処理する前に終了します。
+	// コンテキストの終了による失敗は記録せず、次の Accept で改めて確認します。
+	//
+	// Experimental: simplemq.Client.Ping はキューの統計情報のエンドポイントを使用しており、
+	// API がこのエンドポイントを提供しない場合は存在するキューでも Accept が失敗するため、有効にする前に接続先で動作を確認してください。
+	PingOnStart bool
+	pingMu      sync.Mutex
+	pinged      bool
+	pingErr     error
+	// expiredDropped は、Accept 時に可視性タイムアウトを過ぎていて、延長もできずに配信しなかったメッセージの数です
+	expiredDropped atomic.Int64
+}
+
+// ping は、PingOnStart が true の場合に一度だけ API キーとキューを確認し、その結果を返します。
+func (l *Listener) ping(ctx context.Context) error {
+	if !l.PingOnStart {
+		return nil
+	}
+	l.pingMu.Lock()
+	defer l.pingMu.Unlock()
+	if l.pinged {
+		return l.pingErr
+	}
+	err := l.client.Ping(ctx)
+	if err != nil && (ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+		// コンテキストの終了は API キーやキューの誤りではないため、結果を記録しない
+		return err
+	}
+	if err != nil {
+		l.logger().Error("failed to ping", "err", err, "queue", l.client.Queue)
+	}
+	l.pinged, l.pingErr = true, err
+	return err
 }
 
 // NewListener は、新しい Listener を作成します。
@@ -43,8 +341,63 @@ func NewListenerWithClient(client *simplemq.Client) *Listener {
 	}
 }
 
+// ListenerOption は、NewListenerWithOptions で作成する Listener を設定する関数です。
+type ListenerOption func(*Listener)
+
+// WithSerializer は、Listener.Serializer を設定します。
+func WithSerializer(s Serializer) ListenerOption {
+	return func(l *Listener) {
+		l.Serializer = s
+	}
+}
+
+// WithLogger は、Listener.Logger を設定します。
+func WithLogger(logger *slog.Logger) ListenerOption {
+	return func(l *Listener) {
+		l.Logger = logger
+	}
+}
+
+// WithResponseHandler は、Listener.ResponseHandler を設定します。
+func WithResponseHandler(h ResponseHandler) ListenerOption {
+	return func(l *Listener) {
+		l.ResponseHandler = h
+	}
+}
+
+// WithPollInterval は、Listener.PollInterval を設定します。
+func WithPollInterval(d time.Duration) ListenerOption {
+	return func(l *Listener) {
+		l.PollInterval = d
+	}
+}
+
+// WithMaxPrefetch は、Listener.MaxPrefetch を設定します。
+func WithMaxPrefetch(n int) ListenerOption {
+	return func(l *Listener) {
+		l.MaxPrefetch = n
+	}
+}
+
+// NewListenerWithOptions は、既存の SimpleMQ クライアントを使用して、opts を順に適用した新しい Listener を作成します。
+// 設定は Listener を返す前にすべて適用されるため、Accept の開始後に公開フィールドを変更する必要がありません。
+// ListenerOption のない設定は、返された Listener の公開フィールドに最初の Accept の前に設定してください。
+func NewListenerWithOptions(client *simplemq.Client, opts ...ListenerOption) *Listener {
+	l := NewListenerWithClient(client)
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
 var _ net.Listener = &Listener{}
 
+// Client は、Listener がメッセージの受信に使用する SimpleMQ クライアントを返します。
+// 同じクライアントで QueueStats などの API を呼び出す場合に使用します。
+func (l *Listener) Client() *simplemq.Client {
+	return l.client
+}
+
 func (l *Listener) baseContext() context.Context {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -66,22 +419,548 @@ func (l *Listener) serializer() Serializer {
 	return &BodyOnlySerializer{}
 }
 
-func (l *Listener) accept(ctx context.Context) (*simplemq.Message, error) {
+// attemptRecord は、メッセージの配信回数の記録です。
+type attemptRecord struct {
+	count      int
+	acceptedAt time.Time
+}
+
+func (l *Listener) attemptTTL() time.Duration {
+	if l.AttemptTTL > 0 {
+		return l.AttemptTTL
+	}
+	return DefaultAttemptTTL
+}
+
+// recordAttempt は、メッセージの配信回数を記録し、今回の配信が何回目かを返します。
+// AttemptTTL が過ぎた記録は、AttemptTTL の半分ごとにまとめて破棄します。
+func (l *Listener) recordAttempt(id string) int {
+	l.attemptsMu.Lock()
+	defer l.attemptsMu.Unlock()
+	if l.attempts == nil {
+		l.attempts = make(map[string]attemptRecord)
+	}
+	now := time.Now()
+	ttl := l.attemptTTL()
+	if now.Sub(l.attemptsSweptAt) >= ttl/2 {
+		for key, record := range l.attempts {
+			if now.Sub(record.acceptedAt) >= ttl {
+				delete(l.attempts, key)
+			}
+		}
+		l.attemptsSweptAt = now
+	}
+	record := l.attempts[id]
+	if now.Sub(record.acceptedAt) >= ttl {
+		record.count = 0
+	}
+	record.count++
+	record.acceptedAt = now
+	l.attempts[id] = record
+	return record.count
+}
+
+// dedupCache は、DedupWindow が指定されている場合に重複排除のキャッシュを返します。
+func (l *Listener) dedupCache() *dedupCache {
+	if l.DedupWindow <= 0 {
+		return nil
+	}
+	l.dedupOnce.Do(func() {
+		l.dedup = newDedupCache(l.DedupWindow)
+	})
+	return l.dedup
+}
+
+// skipDuplicate は、DedupWindow 内に受信済みのメッセージであれば配信せずに処理し、true を返します。
+// 処理済みのメッセージは削除し、処理中のメッセージは解放します。
+func (l *Listener) skipDuplicate(ctx context.Context, dedup *dedupCache, msg simplemq.Message) bool {
+	switch dedup.begin(msg.ID) {
+	case dedupProcessed:
+		l.logger().Debug("duplicate message already processed, deleting", "message_id", msg.ID)
+		if err := l.deleteMessage(ctx, msg.ID); err != nil {
+			l.logger().Warn("failed to delete duplicate message", "err", err, "message_id", msg.ID)
+		}
+		return true
+	case dedupInFlight:
+		l.logger().Debug("duplicate message is still in flight, releasing", "message_id", msg.ID)
+		l.releaseMessage(msg)
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *Listener) forgetAttempts(id string) {
+	l.attemptsMu.Lock()
+	defer l.attemptsMu.Unlock()
+	delete(l.attempts, id)
+}
+
+func (l *Listener) deleteMessage(ctx context.Context, id string) error {
+	err := l.client.DeleteMessage(ctx, id)
+	observeOperation(l.Metrics, l.client.Queue, OperationDelete, err)
+	return err
+}
+
+// deadLetter は、メッセージを DeadLetterHandler に渡し、元のキューから削除します。
+// DeadLetterHandler がエラーを返した場合は削除せず、メッセージは可視性タイムアウトの経過後に再配信されます。
+func (l *Listener) deadLetter(ctx context.Context, msg simplemq.Message) {
+	if err := l.DeadLetterHandler.HandleDeadLetter(ctx, msg); err != nil {
+		l.logger().Error("failed to handle dead letter", "err", err, "message_id", msg.ID)
+		return
+	}
+	if err := l.deleteMessage(ctx, msg.ID); err != nil {
+		l.logger().Error("failed to delete dead letter from source queue", "err", err, "message_id", msg.ID)
+		return
+	}
+	l.forgetAttempts(msg.ID)
+}
+
+const (
+	asyncAckMaxAttempts   = 3
+	asyncAckRetryInterval = 500 * time.Millisecond
+)
+
+// enqueueAck は、メッセージの削除をバックグラウンドで行います。
+// 再試行しても削除できなかった場合は onFailed を呼び出します。
+func (l *Listener) enqueueAck(id string, onDeleted func(), onFailed func(err error)) {
+	l.ackWg.Add(1)
+	go func() {
+		defer l.ackWg.Done()
+		var err error
+		for attempt := 1; attempt <= asyncAckMaxAttempts; attempt++ {
+			if err = l.deleteMessage(context.Background(), id); err == nil {
+				l.logger().Debug("message deleted asynchronously", "message_id", id)
+				onDeleted()
+				return
+			}
+			l.logger().Warn("failed to delete message asynchronously", "err", err, "message_id", id, "attempt", attempt)
+			time.Sleep(asyncAckRetryInterval)
+		}
+		l.logger().Error("gave up deleting message asynchronously", "err", err, "message_id", id)
+		onFailed(fmt.Errorf("failed to delete message asynchronously: %w", err))
+	}()
+}
+
+func (l *Listener) maxPollInterval() time.Duration {
+	if l.MaxPollInterval > 0 {
+		return l.MaxPollInterval
+	}
+	return DefaultMaxPollInterval
+}
+
+func (l *Listener) deadlineExtendAttempts() int {
+	if l.DeadlineExtendAttempts > 0 {
+		return l.DeadlineExtendAttempts
+	}
+	return DefaultDeadlineExtendAttempts
+}
+
+func (l *Listener) deadlineExtendInterval() time.Duration {
+	if l.DeadlineExtendInterval > 0 {
+		return l.DeadlineExtendInterval
+	}
+	return DefaultDeadlineExtendInterval
+}
+
+func (l *Listener) extendJitter() float64 {
+	switch {
+	case l.ExtendJitter == 0:
+		return DefaultExtendJitter
+	case l.ExtendJitter < 0:
+		return 0
+	case l.ExtendJitter > 1:
+		return 1
+	}
+	return l.ExtendJitter
+}
+
+// pollInterval は、次の受信までの待機時間を返します。先読みの goroutine からのみ呼び出してください。
+func (l *Listener) pollInterval() time.Duration {
+	interval := DefaultPollInterval
+	if l.PollInterval > 0 {
+		interval = l.PollInterval
+	}
+	if !l.AdaptivePolling && l.MaxPollInterval <= 0 {
+		return interval
+	}
+	maxInterval := l.maxPollInterval()
+	for i := 0; i < l.emptyPolls && interval < maxInterval; i++ {
+		interval *= 2
+	}
+	if interval > maxInterval {
+		interval = maxInterval
+	}
+	if !l.AdaptivePolling {
+		return interval
+	}
+	// 複数のリスナーの受信タイミングが揃わないように、間隔の半分をランダムにする
+	half := interval / 2
+	return half + rand.N(interval-half+1)
+}
+
+func (l *Listener) acquireInFlight(ctx context.Context, size int) error {
+	if l.MaxInFlightBytes <= 0 {
+		return nil
+	}
+	for {
+		l.inFlightMu.Lock()
+		// 処理中のメッセージがない場合は、上限を超えるメッセージでも受け付ける
+		if l.inFlightBytes == 0 || l.inFlightBytes+size <= l.MaxInFlightBytes {
+			l.inFlightBytes += size
+			l.inFlightMu.Unlock()
+			return nil
+		}
+		if l.inFlightReleased == nil {
+			l.inFlightReleased = make(chan struct{})
+		}
+		ch := l.inFlightReleased
+		l.inFlightMu.Unlock()
+		l.logger().Debug("waiting for in-flight bytes to be released", "size", size, "max_in_flight_bytes", l.MaxInFlightBytes)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ch:
+		}
+	}
+}
+
+func (l *Listener) releaseInFlight(size int) {
+	if l.MaxInFlightBytes <= 0 {
+		return
+	}
+	l.inFlightMu.Lock()
+	defer l.inFlightMu.Unlock()
+	l.inFlightBytes -= size
+	if l.inFlightReleased != nil {
+		close(l.inFlightReleased)
+		l.inFlightReleased = nil
+	}
+}
+
+// Pause は、メッセージの受信を一時停止します。
+// 一時停止中は Accept がブロックされ、SimpleMQ からの受信も行われません。
+// 既に Accept 済みのメッセージの処理は継続されます。
+func (l *Listener) Pause() {
+	l.pauseMu.Lock()
+	defer l.pauseMu.Unlock()
+	if l.resumeCh == nil {
+		l.resumeCh = make(chan struct{})
+		l.logger().Debug("listener paused")
+	}
+}
+
+// Resume は、Pause で一時停止したメッセージの受信を再開します。
+func (l *Listener) Resume() {
+	l.pauseMu.Lock()
+	defer l.pauseMu.Unlock()
+	if l.resumeCh != nil {
+		close(l.resumeCh)
+		l.resumeCh = nil
+		l.logger().Debug("listener resumed")
+	}
+}
+
+// Paused は、リスナーが一時停止中かどうかを返します。
+func (l *Listener) Paused() bool {
+	l.pauseMu.Lock()
+	defer l.pauseMu.Unlock()
+	return l.resumeCh != nil
+}
+
+func (l *Listener) waitResumed(ctx context.Context) error {
+	for {
+		l.pauseMu.Lock()
+		ch := l.resumeCh
+		l.pauseMu.Unlock()
+		if ch == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ch:
+		}
+	}
+}
+
+func (l *Listener) accept(ctx context.Context, idle <-chan time.Time) (*simplemq.Message, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	for len(l.acceptedMessages) == 0 {
-		time.Sleep(200 * time.Millisecond)
-		msg, err := l.client.ReceiveMessages(ctx)
-		if err != nil {
+	for {
+		if ctx.Err() != nil {
+			// リスナーが閉じられた場合は、受信済みのメッセージを Accept で返さずに解放する
+			l.releaseBufferedLocked()
+			return nil, ctx.Err()
+		}
+		if l.Paused() {
+			l.mu.Unlock()
+			err := l.waitResumed(ctx)
+			l.mu.Lock()
+			if err != nil {
+				continue
+			}
+		}
+		if len(l.acceptedMessages) > 0 && l.hasSlotLocked() {
+			msg := l.acceptedMessages[0]
+			l.acceptedMessages = l.acceptedMessages[1:]
+			// Shutdown が接続の完了を待てるよう、バッファが空になる前に数えておく
+			// 接続にならなかった場合は Accept で releaseSlot する
+			l.active++
+			l.connWg.Add(1)
+			// バッファに空きができたことを先読みの goroutine に通知する
+			l.broadcastLocked()
+			return &msg, nil
+		}
+		if l.receiveErr != nil {
+			err := l.receiveErr
+			l.receiveErr = nil
 			return nil, err
 		}
-		l.acceptedMessages = append(l.acceptedMessages, msg...)
+		if len(l.acceptedMessages) == 0 && !l.markDrained() && !l.prefetching {
+			// シャットダウン中でなければ、先読みの goroutine を起動する
+			l.prefetching = true
+			go l.prefetch(ctx)
+		}
+		ch := l.notifyLocked()
+		l.mu.Unlock()
+		select {
+		case <-ctx.Done():
+		case <-ch:
+		case <-idle:
+			l.mu.Lock()
+			return nil, ErrIdleTimeout
+		}
+		l.mu.Lock()
+	}
+}
+
+// hasSlotLocked は、MaxConcurrency に空きがあるかを返します。l.mu を保持した状態で呼び出してください。
+func (l *Listener) hasSlotLocked() bool {
+	return l.MaxConcurrency <= 0 || l.active < l.MaxConcurrency
+}
+
+// prefetchCapacityLocked は、先読みしてバッファに追加できるメッセージの数を返します。l.mu を保持した状態で呼び出してください。
+// MaxConcurrency が指定されている場合は、処理中のメッセージの数を差し引いた空きを超えて先読みしません。
+func (l *Listener) prefetchCapacityLocked() int {
+	limit := l.maxPrefetch()
+	if l.MaxConcurrency > 0 {
+		if free := l.MaxConcurrency - l.active; free < limit {
+			limit = free
+		}
+	}
+	return limit - len(l.acceptedMessages) - l.heldCount
+}
+
+// releaseSlot は、Accept でバッファから取り出したメッセージの処理が終わったことを記録します。
+func (l *Listener) releaseSlot() {
+	l.mu.Lock()
+	l.active--
+	// MaxConcurrency の空きを待っている Accept と先読みの goroutine に通知する
+	l.broadcastLocked()
+	l.mu.Unlock()
+	l.connWg.Done()
+}
+
+func (l *Listener) maxPrefetch() int {
+	if l.MaxPrefetch > 0 {
+		return l.MaxPrefetch
+	}
+	return DefaultMaxPrefetch
+}
+
+var defaultReceiveRetryBackoff = ExponentialBackoff(200*time.Millisecond, 10*time.Second)
+
+// retryReceive は、受信のエラーを再試行するかどうかを返します。
+func (l *Listener) retryReceive(err error) bool {
+	if l.OnReceiveError != nil {
+		return l.OnReceiveError(err)
+	}
+	return isRetryableError(err)
+}
+
+func (l *Listener) receiveRetryBackoff(attempt int) time.Duration {
+	if l.ReceiveRetryBackoff != nil {
+		return l.ReceiveRetryBackoff(attempt)
+	}
+	return defaultReceiveRetryBackoff(attempt)
+}
+
+// prefetch は、バッファが MaxPrefetch 件未満の間、SimpleMQ からメッセージを受信してバッファに追加します。
+// 受信に失敗した場合は、再試行するエラーであれば待機してから再試行し、そうでなければエラーを記録して終了します。
+// 終了した場合は、次の Accept で再び起動されます。
+func (l *Listener) prefetch(ctx context.Context) {
+	defer func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.prefetching = false
+		if len(l.acceptedMessages) == 0 {
+			// シャットダウン中に受信を終えた時点でバッファが空であれば、Accept を待たずに完了とする
+			l.markDrained()
+		}
+		l.broadcastLocked()
+	}()
+	failures := 0
+	for {
+		if err := l.waitResumed(ctx); err != nil {
+			return
+		}
+		l.mu.Lock()
+		for l.prefetchCapacityLocked() <= 0 && ctx.Err() == nil {
+			ch := l.notifyLocked()
+			l.mu.Unlock()
+			select {
+			case <-ctx.Done():
+			case <-ch:
+			}
+			l.mu.Lock()
+		}
+		capacity := l.prefetchCapacityLocked()
+		l.mu.Unlock()
+		if ctx.Err() != nil || l.isDraining() {
+			return
+		}
+		timer := time.NewTimer(l.pollInterval())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := l.waitResumed(ctx); err != nil {
+			return
+		}
+		if l.ReceiveRateLimiter != nil {
+			if err := l.ReceiveRateLimiter.Wait(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				l.mu.Lock()
+				l.receiveErr = fmt.Errorf("receive rate limiter: %w", err)
+				l.mu.Unlock()
+				return
+			}
+		}
+		opts := simplemq.ReceiveOptions{VisibilityTimeout: l.VisibilityTimeout}
+		if l.MaxConcurrency > 0 {
+			// 同時に処理できない分まで受信すると、延長されないままバッファで期限切れになるため、空きの分だけ受信する
+			opts.MaxMessages = capacity
+		}
+		msgs, err := l.client.ReceiveMessagesWithOptions(ctx, opts)
+		if !errors.Is(err, context.Canceled) {
+			observeOperation(l.Metrics, l.client.Queue, OperationReceive, err)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			if !l.retryReceive(err) {
+				l.mu.Lock()
+				l.receiveErr = err
+				l.mu.Unlock()
+				return
+			}
+			wait := l.receiveRetryBackoff(failures)
+			l.logger().Warn("failed to receive messages, retrying", "err", err, "attempt", failures, "wait", wait)
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			continue
+		}
+		failures = 0
+		l.mu.Lock()
+		if len(msgs) == 0 {
+			l.emptyPolls++
+		} else {
+			l.emptyPolls = 0
+		}
+		l.acceptedMessages = append(l.acceptedMessages, msgs...)
+		if ctx.Err() != nil {
+			l.releaseBufferedLocked()
+		}
+		l.broadcastLocked()
+		l.mu.Unlock()
 	}
+}
 
-	msg := l.acceptedMessages[0]
-	l.acceptedMessages = l.acceptedMessages[1:]
-	return &msg, nil
+// notifyLocked は、バッファや状態が変化したときに閉じられるチャネルを返します。l.mu を保持した状態で呼び出してください。
+func (l *Listener) notifyLocked() <-chan struct{} {
+	if l.notifyCh == nil {
+		l.notifyCh = make(chan struct{})
+	}
+	return l.notifyCh
+}
+
+// broadcastLocked は、notifyLocked で待機しているすべての goroutine を起こします。l.mu を保持した状態で呼び出してください。
+func (l *Listener) broadcastLocked() {
+	if l.notifyCh != nil {
+		close(l.notifyCh)
+		l.notifyCh = nil
+	}
+}
+
+// releaseBufferedLocked は、バッファ済みのメッセージをすべて解放します。l.mu を保持した状態で呼び出してください。
+func (l *Listener) releaseBufferedLocked() {
+	for _, m := range l.acceptedMessages {
+		l.releaseMessage(m)
+	}
+	l.acceptedMessages = nil
+}
+
+// releaseMessage は、受信済みのメッセージを配信せずに手放します。
+// SimpleMQ にはメッセージを即座に再表示する API がないため、メッセージは可視性タイムアウトの経過後に再配信されます。
+func (l *Listener) releaseMessage(msg simplemq.Message) {
+	l.logger().Debug("release undelivered message", "message_id", msg.ID, "visibility_timeout_at", msg.VisibilityTimeoutTime().Format(time.RFC3339))
+	if l.OnRelease != nil {
+		l.OnRelease(msg)
+	}
+}
+
+// reviveExpired は、Accept 時に可視性タイムアウトを過ぎていたメッセージの可視性タイムアウトを一度だけ延長します。
+// 時計のずれなどで受信直後に期限切れと判定されたメッセージを、再配信を待たずに処理するためのものです。
+// 延長できた場合は msg の可視性タイムアウトを更新して true を返します。
+// 延長に失敗した場合や延長後も期限切れの場合は、配信しなかったメッセージとして数えて false を返します。
+func (l *Listener) reviveExpired(ctx context.Context, msg *simplemq.Message) bool {
+	extended, err := l.client.ExtendVisibilityTimeoutBy(ctx, msg.ID, l.VisibilityTimeout)
+	observeOperation(l.Metrics, l.client.Queue, OperationExtend, err)
+	if err == nil && l.client.Until(extended.VisibilityTimeoutTime()) > 0 {
+		l.logger().Debug("extended visibility timeout of expired message", "message_id", msg.ID, "visibility_timeout_at", extended.VisibilityTimeoutTime().Format(time.RFC3339))
+		msg.VisibilityTimeoutAt = extended.VisibilityTimeoutAt
+		return true
+	}
+	l.expiredDropped.Add(1)
+	if err == nil {
+		err = errors.New("visibility timeout is still expired after extension")
+	}
+	l.logger().Warn("drop expired message", "err", err, "message_id", msg.ID, "visibility_timeout_at", msg.VisibilityTimeoutTime().Format(time.RFC3339))
+	return false
+}
+
+// ExpiredDropped は、Accept 時に可視性タイムアウトを過ぎていて、延長もできずに配信しなかったメッセージの数を返します。
+// 配信しなかったメッセージは、可視性タイムアウトの経過後に再配信されます。
+// この値が増え続ける場合は、SimpleMQ とのあいだの時計のずれや、受信から Accept までの遅延を確認してください。
+func (l *Listener) ExpiredDropped() int64 {
+	return l.expiredDropped.Load()
+}
+
+func (l *Listener) requestIDHeader() string {
+	if l.RequestIDHeader != "" {
+		return l.RequestIDHeader
+	}
+	return DefaultRequestIDHeader
+}
+
+func (l *Listener) requestID(msg simplemq.Message) string {
+	if l.RequestIDFunc != nil {
+		return l.RequestIDFunc(msg)
+	}
+	return msg.ID
 }
 
 func (l *Listener) logger() *slog.Logger {
@@ -91,34 +970,208 @@ func (l *Listener) logger() *slog.Logger {
 	return slog.Default()
 }
 
+// ErrIdleTimeout は、Listener.IdleTimeout の間メッセージを受信できなかった場合に Accept が返すエラーです。
+var ErrIdleTimeout = errors.New("idle timeout")
+
 // Accept は、次の接続を待機して返します。
 func (l *Listener) Accept() (net.Conn, error) {
 	ctx := l.baseContext()
+	if err := l.ping(ctx); err != nil {
+		return nil, err
+	}
 	for {
-		msg, err := l.accept(ctx)
+		// メッセージを受信するたびに、待機の時間を数え直す
+		var idle <-chan time.Time
+		var idleTimer *time.Timer
+		if l.IdleTimeout > 0 {
+			idleTimer = time.NewTimer(l.IdleTimeout)
+			idle = idleTimer.C
+		}
+		msg, err := l.accept(ctx, idle)
+		if idleTimer != nil {
+			idleTimer.Stop()
+		}
 		if err != nil {
-			if errors.Is(err, context.Canceled) {
-				l.logger().Debug("accept canceled")
+			if errors.Is(err, context.Canceled) || ctx.Err() != nil {
+				l.logger().Debug("accept canceled", "err", err)
 				return nil, net.ErrClosed
 			}
 			return nil, err
 		}
-		if time.Until(msg.VisibilityTimeoutTime()) <= 0 {
-			l.logger().Debug("accepted message is expired", "msg", msg)
+		// 同じ順序キーのメッセージを処理中であれば、フィルターなどの判定の前に保留する
+		key := l.orderingKey(*msg)
+		if key != "" && l.holdForOrdering(ctx, key, *msg) {
+			l.releaseSlot()
+			continue
+		}
+		// finishOrdering は、同じ順序キーで保留しているメッセージの配信を再開します。
+		finishOrdering := func() {
+			if key != "" {
+				l.releaseOrdering(key, msg.ID)
+			}
+		}
+		if l.AcceptFilter != nil && !l.AcceptFilter(*msg) {
+			l.logger().Debug("message filtered out", "message_id", msg.ID)
+			l.releaseMessage(*msg)
+			finishOrdering()
+			l.releaseSlot()
+			continue
+		}
+		dedup := l.dedupCache()
+		if dedup != nil && l.skipDuplicate(ctx, dedup, *msg) {
+			finishOrdering()
+			l.releaseSlot()
+			continue
+		}
+		// finishDedup は、配信しなかったメッセージや処理に成功しなかったメッセージを重複排除の記録から削除します。
+		finishDedup := func() {
+			if dedup != nil {
+				dedup.finish(msg.ID)
+			}
+		}
+		attempt := l.recordAttempt(msg.ID)
+		if l.DeadLetterHandler != nil && l.MaxReceiveCount > 0 && attempt > l.MaxReceiveCount {
+			l.logger().Warn("message exceeded max receive count, routing to dead letter handler", "message_id", msg.ID, "attempt", attempt, "max_receive_count", l.MaxReceiveCount)
+			l.deadLetter(ctx, *msg)
+			finishDedup()
+			finishOrdering()
+			l.releaseSlot()
+			continue
+		}
+		size := len(msg.Content)
+		if err := l.acquireInFlight(ctx, size); err != nil {
+			l.releaseMessage(*msg)
+			finishDedup()
+			finishOrdering()
+			l.releaseSlot()
+			if errors.Is(err, context.Canceled) || ctx.Err() != nil {
+				l.logger().Debug("accept canceled", "err", err)
+				return nil, net.ErrClosed
+			}
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			l.releaseInFlight(size)
+			l.releaseMessage(*msg)
+			finishDedup()
+			finishOrdering()
+			l.releaseSlot()
+			l.logger().Debug("accept canceled")
+			return nil, net.ErrClosed
+		}
+		if l.client.Until(msg.VisibilityTimeoutTime()) <= 0 && !l.reviveExpired(ctx, msg) {
+			l.releaseInFlight(size)
+			finishDedup()
+			finishOrdering()
+			l.releaseSlot()
 			continue
 		}
 		l.logger().Debug("accepted message", "msg", msg)
+		if l.SizeRecorder != nil {
+			l.SizeRecorder.RecordMessageSize(size)
+		}
 		conn := newConn(l.Addr(), *msg, l.serializer(), l.client, l.logger())
 		if l.ResponseHandler != nil {
 			conn.respHandler = l.ResponseHandler
 		}
+		conn.respParser = l.ResponseParser
+		conn.metrics = l.Metrics
+		conn.headerPrefix = l.HeaderPrefix
+		conn.baseCtx = ctx
+		conn.visibilityTimeout = l.VisibilityTimeout
+		conn.extendJitter = l.extendJitter()
+		conn.disableExtend = l.DisableAutoExtend
+		conn.deadlineExtendAttempts = l.deadlineExtendAttempts()
+		conn.deadlineExtendInterval = l.deadlineExtendInterval()
+		conn.ackStatus = l.AckStatusCodes
+		conn.ackMode = l.AckMode
+		conn.requestIDKey = l.requestIDHeader()
+		conn.requestID = l.requestID(*msg)
+		conn.onClose = func() {
+			l.releaseInFlight(size)
+			l.untrackConn(conn)
+			finishDedup()
+			finishOrdering()
+			l.releaseSlot()
+		}
+		if l.DeadLetterHandler != nil {
+			conn.deadLetter = func() {
+				// メッセージの削除と同様に、リスナーが閉じられた後も完了させる
+				l.deadLetter(context.Background(), *msg)
+			}
+		}
+		if dedup != nil {
+			conn.onSuccess = func() {
+				dedup.processed(msg.ID)
+			}
+		}
+		conn.attempt = attempt
+		conn.onDelete = func() {
+			l.forgetAttempts(msg.ID)
+		}
+		onError := func(err error) {
+			if l.OnConnError != nil {
+				l.OnConnError(*msg, err)
+			}
+		}
+		conn.onError = onError
+		if l.AsyncAck {
+			conn.asyncAck = func(id string, onDeleted func()) {
+				l.enqueueAck(id, onDeleted, onError)
+			}
+		}
+		conn.init()
+		l.trackConn(conn)
 		return conn, nil
 	}
 }
 
+func (l *Listener) trackConn(c *Conn) {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+	if l.conns == nil {
+		l.conns = make(map[*Conn]struct{})
+	}
+	l.conns[c] = struct{}{}
+}
+
+func (l *Listener) untrackConn(c *Conn) {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+	delete(l.conns, c)
+}
+
+// ExtendAll は、処理中のすべてのメッセージの可視性タイムアウトを即座に延長します。
+// プロセスの一時停止などで定期的な延長が間に合わなかった可能性がある場合に、復旧処理から呼び出すことを想定しています。
+// 延長に失敗したメッセージがある場合は、それらのエラーをまとめて返します。
+func (l *Listener) ExtendAll(ctx context.Context) error {
+	l.connsMu.Lock()
+	conns := make([]*Conn, 0, len(l.conns))
+	for c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.connsMu.Unlock()
+
+	var errs []error
+	for _, c := range conns {
+		if err := c.extendNow(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	l.logger().Debug("extended all in-flight messages", "count", len(conns), "errors", len(errs))
+	return errors.Join(errs...)
+}
+
 // Close はリスナーを閉じます。
 // ブロックされた Accept 操作はすべてブロック解除され、エラーを返します。
+// 受信済みでまだ Accept されていないメッセージは Accept で返されずに解放され、OnRelease が呼び出されます。
 func (l *Listener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.baseCtx == nil {
+		// Accept の前に閉じられた場合も、その後の Accept がメッセージを受信しないようにする
+		l.baseCtx, l.baseCancel = context.WithCancel(context.Background())
+	}
 	if l.baseCancel != nil {
 		l.baseCancel()
 		l.baseCancel = nil
@@ -126,6 +1179,75 @@ func (l *Listener) Close() error {
 	return nil
 }
 
+// Shutdown は、新たなメッセージの受信を停止し、受信済みでまだ Accept されていないメッセージが
+// すべて Accept され、Accept した接続がすべて Close されるのを待ってからリスナーを閉じます。
+// http.Server.Shutdown はリスナーを即座に閉じるため、それより前に呼び出してください。
+// ctx が先に終了した場合は、リスナーを閉じて ctx のエラーを返します。
+// 残ったメッセージは可視性タイムアウトの経過後に再配信されます。
+// AsyncAck が有効な場合は、実行中の非同期削除の完了も待ちます。
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.drainMu.Lock()
+	l.draining = true
+	if l.drainedCh == nil {
+		l.drainedCh = make(chan struct{})
+	}
+	drainedCh := l.drainedCh
+	l.drainMu.Unlock()
+	// 待機中の Accept に状態の変化を通知する
+	l.mu.Lock()
+	if len(l.acceptedMessages) == 0 && !l.prefetching {
+		l.markDrained()
+	}
+	l.broadcastLocked()
+	l.mu.Unlock()
+
+	l.logger().Debug("listener shutting down, draining buffered messages")
+	select {
+	case <-drainedCh:
+		l.logger().Debug("buffered messages drained")
+	case <-ctx.Done():
+		l.logger().Warn("shutdown deadline exceeded before buffered messages were drained")
+		l.Close()
+		return ctx.Err()
+	}
+	// 処理中の接続がすべて閉じられ、非同期の削除が完了するのを待つ
+	done := make(chan struct{})
+	go func() {
+		l.connWg.Wait()
+		l.ackWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return l.Close()
+	case <-ctx.Done():
+		l.logger().Warn("shutdown deadline exceeded before in-flight messages completed")
+		l.Close()
+		return ctx.Err()
+	}
+}
+
+func (l *Listener) isDraining() bool {
+	l.drainMu.Lock()
+	defer l.drainMu.Unlock()
+	return l.draining
+}
+
+// markDrained は、シャットダウン中であればバッファが空になったことを通知し、true を返します。
+func (l *Listener) markDrained() bool {
+	l.drainMu.Lock()
+	defer l.drainMu.Unlock()
+	if !l.draining {
+		return false
+	}
+	select {
+	case <-l.drainedCh:
+	default:
+		close(l.drainedCh)
+	}
+	return true
+}
+
 // Addr はリスナーのネットワークアドレスを返します。
 func (l *Listener) Addr() net.Addr {
 	return Addr(l.client.Queue)
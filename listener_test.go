@@ -1,14 +1,25 @@
 package simplemqhttp
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/mashiike/simplemqhttp/simplemq"
 	"github.com/mashiike/simplemqhttp/stub"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -87,3 +98,1262 @@ func TestListener(t *testing.T) {
 	err := server.Close()
 	require.NoError(t, err)
 }
+
+func TestListenerPauseResume(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// テスト用のclientを作成
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	// 一時停止状態のListenerを作成
+	listener := NewListenerWithClient(client)
+	listener.Pause()
+	require.True(t, listener.Paused())
+
+	handledRequestCh := make(chan []byte, 1)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			bs, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			handledRequestCh <- bs
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	msg := stubServer.AddMessage("test-queue", `{"paused":true}`)
+
+	// 一時停止中はメッセージが配信されず、受信もされないこと
+	select {
+	case <-handledRequestCh:
+		t.Fatal("message should not be delivered while paused")
+	case <-time.After(time.Second):
+	}
+	require.Zero(t, stubServer.GetMessage("test-queue", msg.ID).AcquiredAt)
+
+	// 再開後はメッセージが配信されること
+	listener.Resume()
+	require.False(t, listener.Paused())
+	select {
+	case bs := <-handledRequestCh:
+		require.Equal(t, `{"paused":true}`, string(bs))
+	case <-time.After(5 * time.Second):
+		t.Fatal("message should be delivered after resume")
+	}
+}
+
+func TestListenerRequestID(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// テスト用のclientを作成
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	// リクエストIDの生成方法を指定したListenerを作成
+	listener := NewListenerWithClient(client)
+	listener.RequestIDHeader = "X-Correlation-Id"
+	listener.RequestIDFunc = func(msg simplemq.Message) string {
+		return "req-" + msg.ID
+	}
+
+	type result struct {
+		header string
+		ctxID  string
+	}
+	resultCh := make(chan result, 1)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, _ := RequestIDFromContext(r.Context())
+			resultCh <- result{
+				header: r.Header.Get("X-Correlation-Id"),
+				ctxID:  id,
+			}
+			w.WriteHeader(http.StatusOK)
+		}),
+		ConnContext: ConnContext,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	msg := stubServer.AddMessage("test-queue", `{"id":1}`)
+	select {
+	case res := <-resultCh:
+		require.Equal(t, "req-"+msg.ID, res.header)
+		require.Equal(t, "req-"+msg.ID, res.ctxID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message should be delivered")
+	}
+}
+
+func TestListenerShutdownDrainsBufferedMessages(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// テスト用のclientを作成
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	// 1回の受信で複数のメッセージがバッファされるようにする
+	for i := 0; i < 3; i++ {
+		stubServer.AddMessage("test-queue", `{"index":`+strconv.Itoa(i)+`}`)
+	}
+
+	listener := NewListenerWithClient(client)
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	shutdownErrCh := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErrCh <- listener.Shutdown(ctx)
+	}()
+
+	// バッファ済みのメッセージはシャットダウン中も Accept できること
+	for i := 0; i < 2; i++ {
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	}
+
+	// バッファが空になったらリスナーが閉じられること
+	_, err = listener.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+	select {
+	case err := <-shutdownErrCh:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown should complete after draining")
+	}
+}
+
+func TestListenerMaxInFlightBytes(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// テスト用のclientを作成
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	listener := NewListenerWithClient(client)
+	listener.MaxInFlightBytes = 100
+	defer listener.Close()
+
+	// 上限に近い大きなメッセージを処理中にする
+	stubServer.AddMessage("test-queue", strings.Repeat("a", 80))
+	largeConn, err := listener.Accept()
+	require.NoError(t, err)
+
+	// 追加のメッセージは大きなメッセージの処理が終わるまで Accept されないこと
+	stubServer.AddMessage("test-queue", strings.Repeat("b", 40))
+	acceptedCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Logf("accept error: %v", err)
+			return
+		}
+		acceptedCh <- conn
+	}()
+	select {
+	case <-acceptedCh:
+		t.Fatal("message should not be accepted while in-flight bytes exceed the limit")
+	case <-time.After(time.Second):
+	}
+
+	require.NoError(t, largeConn.Close())
+	select {
+	case conn := <-acceptedCh:
+		require.NoError(t, conn.Close())
+	case <-time.After(5 * time.Second):
+		t.Fatal("message should be accepted after the large message completes")
+	}
+}
+
+func TestListenerRefreshOnReceive(t *testing.T) {
+	// 受信時には期限切れ間近のメッセージを返し、延長時には新しい可視性タイムアウトを返すAPI
+	msg := simplemq.Message{
+		ID:        "near-expiry",
+		Content:   `{"refresh":true}`,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	var extended atomic.Bool
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			received := msg
+			received.VisibilityTimeoutAt = time.Now().Add(500 * time.Millisecond).UnixMilli()
+			json.NewEncoder(w).Encode(map[string]any{"messages": []simplemq.Message{received}})
+		case http.MethodPut:
+			extended.Store(true)
+			refreshed := msg
+			refreshed.VisibilityTimeoutAt = time.Now().Add(30 * time.Second).UnixMilli()
+			json.NewEncoder(w).Encode(map[string]any{"message": refreshed})
+		default:
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(map[string]string{})
+		}
+	}))
+	defer api.Close()
+
+	client := simplemq.NewClient("test-api-key", "test-queue")
+	client.Endpoint = api.URL
+	client.RefreshOnReceive = true
+	client.RefreshThreshold = 5 * time.Second
+
+	listener := NewListenerWithClient(client)
+	defer listener.Close()
+
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Accept で返される前に新しい可視性タイムアウトが設定されていること
+	require.True(t, extended.Load())
+	c := conn.(*Conn)
+	require.Greater(t, time.Until(c.msg.VisibilityTimeoutTime()), 20*time.Second)
+}
+
+type countingTransport struct {
+	receives atomic.Int32
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet {
+		c.receives.Add(1)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestListenerAdaptivePolling(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// 空のキューを複数のリスナーで受信し、受信回数を数える
+	const listeners = 3
+	run := func(adaptive bool) int32 {
+		counter := &countingTransport{}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		var wg sync.WaitGroup
+		for i := 0; i < listeners; i++ {
+			client := simplemq.NewClient(apiKey, "test-queue")
+			client.Endpoint = stubServer.URL()
+			client.HTTPClient = &http.Client{Transport: counter}
+			listener := NewListenerWithClient(client)
+			listener.AdaptivePolling = adaptive
+			if adaptive {
+				listener.MaxPollInterval = time.Second
+			}
+			listener.BaseContext = func() context.Context { return ctx }
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := listener.Accept()
+				assert.Error(t, err)
+			}()
+		}
+		wg.Wait()
+		return counter.receives.Load()
+	}
+
+	var fixed, adaptive int32
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		fixed = run(false)
+	}()
+	go func() {
+		defer wg.Done()
+		adaptive = run(true)
+	}()
+	wg.Wait()
+	t.Logf("receive calls: fixed=%d adaptive=%d", fixed, adaptive)
+	require.Less(t, adaptive, fixed)
+}
+
+type slowDeleteTransport struct {
+	delay time.Duration
+}
+
+func (s *slowDeleteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodDelete {
+		time.Sleep(s.delay)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestListenerAsyncAck(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// 削除に時間がかかるclientを作成
+	const deleteDelay = time.Second
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	client.HTTPClient = &http.Client{Transport: &slowDeleteTransport{delay: deleteDelay}}
+
+	listener := NewListenerWithClient(client)
+	listener.AsyncAck = true
+	defer listener.Close()
+
+	msg := stubServer.AddMessage("test-queue", `{"ack":"async"}`)
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+
+	// 2xx レスポンスを書き込んで Close する
+	_, err = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	start := time.Now()
+	require.NoError(t, conn.Close())
+	assert.Less(t, time.Since(start), deleteDelay, "Close should return before the delete completes")
+	assert.NotNil(t, stubServer.GetMessage("test-queue", msg.ID))
+
+	// 最終的にメッセージが削除されること
+	require.True(t, stubServer.WaitForDeletion("test-queue", msg.ID, 5*time.Second))
+}
+
+func TestListenerCloseReleasesPendingMessages(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// テスト用のclientを作成
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	for i := 0; i < 3; i++ {
+		stubServer.AddMessage("test-queue", `{"index":`+strconv.Itoa(i)+`}`)
+	}
+
+	var mu sync.Mutex
+	released := map[string]bool{}
+	listener := NewListenerWithClient(client)
+	listener.OnRelease = func(msg simplemq.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		released[msg.ID] = true
+	}
+
+	// 1件目を Accept し、残りはバッファされた状態にする
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	delivered := conn.(*Conn).msg.ID
+
+	// Close と Accept を競合させる
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		assert.NoError(t, listener.Close())
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				assert.ErrorIs(t, err, net.ErrClosed)
+				return
+			}
+			// Close より前に Accept されたメッセージは配信済みとして扱う
+			mu.Lock()
+			released[conn.(*Conn).msg.ID] = true
+			mu.Unlock()
+			conn.Close()
+		}
+	}()
+	wg.Wait()
+
+	// 配信されなかったメッセージはすべて解放され、キューに残っていること
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, released, 2)
+	assert.NotContains(t, released, delivered)
+	require.NoError(t, conn.Close())
+	assert.Equal(t, 3, stubServer.GetQueueSize("test-queue"))
+}
+
+func TestListenerAcceptFilter(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// 延長と削除の回数を数えるclientを作成
+	counter := &extendCountingTransport{}
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	client.HTTPClient = &http.Client{Transport: counter}
+
+	skipped := stubServer.AddMessage("test-queue", `{"type":"skip"}`)
+
+	var mu sync.Mutex
+	var released []string
+	listener := NewListenerWithClient(client)
+	listener.AcceptFilter = func(msg simplemq.Message) bool {
+		return msg.Content == `{"type":"wanted"}`
+	}
+	listener.OnRelease = func(msg simplemq.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		released = append(released, msg.ID)
+	}
+	defer listener.Close()
+
+	connCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Logf("accept error: %v", err)
+			return
+		}
+		connCh <- conn
+	}()
+
+	// 除外されたメッセージは解放されること
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(released) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	wanted := stubServer.AddMessage("test-queue", `{"type":"wanted"}`)
+
+	// 条件に一致するメッセージのみが Accept されること
+	var conn net.Conn
+	select {
+	case conn = <-connCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wanted message should be accepted")
+	}
+	assert.Equal(t, wanted.ID, conn.(*Conn).msg.ID)
+	_, err := conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	// 除外されたメッセージは延長も削除もされずにキューに残ること
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{skipped.ID}, released)
+	assert.Zero(t, counter.extends.Load())
+	assert.NotNil(t, stubServer.GetMessage("test-queue", skipped.ID))
+	assert.Nil(t, stubServer.GetMessage("test-queue", wanted.ID))
+}
+
+func TestListenerConcurrentProcessing(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// テスト用のclientを作成
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	const (
+		messages    = 5
+		handlerTime = 500 * time.Millisecond
+	)
+	listener := NewListenerWithClient(client)
+	listener.MaxPrefetch = messages
+
+	var running, maxRunning atomic.Int32
+	doneCh := make(chan struct{}, messages)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := running.Add(1)
+			for {
+				m := maxRunning.Load()
+				if n <= m || maxRunning.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(handlerTime)
+			running.Add(-1)
+			w.WriteHeader(http.StatusOK)
+			doneCh <- struct{}{}
+		}),
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	start := time.Now()
+	for i := 0; i < messages; i++ {
+		stubServer.AddMessage("test-queue", `{"index":`+strconv.Itoa(i)+`}`)
+	}
+	for i := 0; i < messages; i++ {
+		select {
+		case <-doneCh:
+		case <-time.After(5 * time.Second):
+			t.Fatal("messages should be processed")
+		}
+	}
+
+	// メッセージが並行して処理されていること
+	assert.Greater(t, maxRunning.Load(), int32(1))
+	assert.Less(t, time.Since(start), messages*handlerTime)
+}
+
+func TestListenerPollInterval(t *testing.T) {
+	t.Run("Back off on empty receives", func(t *testing.T) {
+		listener := &Listener{
+			PollInterval:    10 * time.Millisecond,
+			MaxPollInterval: 80 * time.Millisecond,
+		}
+		expected := []time.Duration{10, 20, 40, 80, 80}
+		for i, e := range expected {
+			listener.emptyPolls = i
+			assert.Equal(t, e*time.Millisecond, listener.pollInterval())
+		}
+		// メッセージを受信したら基本の間隔に戻ること
+		listener.emptyPolls = 0
+		assert.Equal(t, 10*time.Millisecond, listener.pollInterval())
+	})
+
+	t.Run("Fixed interval without MaxPollInterval", func(t *testing.T) {
+		listener := &Listener{PollInterval: 50 * time.Millisecond, emptyPolls: 3}
+		assert.Equal(t, 50*time.Millisecond, listener.pollInterval())
+		assert.Equal(t, DefaultPollInterval, (&Listener{}).pollInterval())
+	})
+
+	t.Run("Close returns promptly during a long poll interval", func(t *testing.T) {
+		// stubサーバーの作成
+		apiKey := "test-api-key"
+		stubServer := stub.NewServer(apiKey)
+		defer stubServer.Close()
+
+		// テスト用のclientを作成
+		client := simplemq.NewClient(apiKey, "test-queue")
+		client.Endpoint = stubServer.URL()
+
+		listener := NewListenerWithClient(client)
+		listener.PollInterval = 10 * time.Second
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := listener.Accept()
+			errCh <- err
+		}()
+		time.Sleep(100 * time.Millisecond)
+		require.NoError(t, listener.Close())
+		select {
+		case err := <-errCh:
+			assert.ErrorIs(t, err, net.ErrClosed)
+		case <-time.After(time.Second):
+			t.Fatal("Accept should return promptly after Close")
+		}
+	})
+}
+
+func TestListenerExtendAll(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// 延長の回数を数えるclientを作成
+	counter := &extendCountingTransport{}
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	client.HTTPClient = &http.Client{Transport: counter}
+
+	listener := NewListenerWithClient(client)
+	defer listener.Close()
+
+	// 処理中のメッセージを3件作る
+	conns := make([]*Conn, 0, 3)
+	for i := 0; i < 3; i++ {
+		stubServer.AddMessage("test-queue", `{"id":`+strconv.Itoa(i)+`}`)
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+		conns = append(conns, conn.(*Conn))
+	}
+	before := make([]int64, len(conns))
+	for i, c := range conns {
+		before[i] = c.Message().VisibilityTimeoutAt
+	}
+
+	// 可視性タイムアウトの時刻が進むよう少し待ってから一括延長する
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, listener.ExtendAll(context.Background()))
+
+	// 1回の呼び出しですべてのメッセージが延長されること
+	assert.EqualValues(t, 3, counter.extends.Load())
+	for i, c := range conns {
+		assert.Greater(t, c.Message().VisibilityTimeoutAt, before[i])
+	}
+
+	// Close したメッセージは延長の対象外になること
+	require.NoError(t, conns[0].Close())
+	require.NoError(t, listener.ExtendAll(context.Background()))
+	assert.EqualValues(t, 5, counter.extends.Load())
+}
+
+func TestListenerAcceptInjectedError(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// 受信を常に失敗させる
+	stubServer.InjectError(http.MethodGet, `/messages$`, http.StatusInternalServerError, simplemq.APIError{Code: 500, Message: "injected"}, 0)
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	listener := NewListenerWithClient(client)
+	// 再試行せずにエラーを返す
+	listener.OnReceiveError = func(error) bool { return false }
+	defer listener.Close()
+
+	// 受信のエラーが Accept に伝わること
+	_, err := listener.Accept()
+	var apiErr *simplemq.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusInternalServerError, apiErr.Code)
+	assert.Equal(t, "injected", apiErr.Message)
+}
+
+func TestListenerShutdownWaitsForInFlightConns(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// テスト用のclientを作成
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	t.Run("Wait until conn is closed", func(t *testing.T) {
+		listener := NewListenerWithClient(client)
+		stubServer.AddMessage("test-queue", `{"shutdown":"wait"}`)
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+
+		shutdownErrCh := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			shutdownErrCh <- listener.Shutdown(ctx)
+		}()
+
+		// 処理中の接続がある間は完了しないこと
+		select {
+		case <-shutdownErrCh:
+			t.Fatal("shutdown should wait for in-flight conn")
+		case <-time.After(300 * time.Millisecond):
+		}
+
+		// 接続を閉じると完了すること
+		_, err = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+		select {
+		case err := <-shutdownErrCh:
+			require.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("shutdown should complete after conn is closed")
+		}
+		assert.Equal(t, 0, stubServer.GetQueueSize("test-queue"))
+	})
+
+	t.Run("Deadline exceeded", func(t *testing.T) {
+		listener := NewListenerWithClient(client)
+		stubServer.AddMessage("test-queue", `{"shutdown":"deadline"}`)
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		// 接続が閉じられないまま期限を過ぎた場合は ctx のエラーを返すこと
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		err = listener.Shutdown(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestListenerMaxConcurrency(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// テスト用のclientを作成
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	listener := NewListenerWithClient(client)
+	listener.MaxConcurrency = 2
+	defer listener.Close()
+
+	ids := make([]string, 0, 5)
+	for i := 0; i < 5; i++ {
+		msg := stubServer.AddMessage("test-queue", `{"index":`+strconv.Itoa(i)+`}`)
+		ids = append(ids, msg.ID)
+	}
+
+	// 上限まで Accept できること
+	conns := make([]net.Conn, 0, 2)
+	for i := 0; i < 2; i++ {
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		conns = append(conns, conn)
+	}
+
+	// 上限に達している間は Accept がブロックすること
+	acceptedCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		acceptedCh <- conn
+	}()
+	select {
+	case <-acceptedCh:
+		t.Fatal("accept should block while max concurrency is reached")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// 処理できない分のメッセージは先読みされず、キューに残っていること
+	acquired := 0
+	for _, id := range ids {
+		if msg := stubServer.GetMessage("test-queue", id); msg != nil && msg.AcquiredAt != 0 {
+			acquired++
+		}
+	}
+	assert.Equal(t, 2, acquired)
+
+	// 接続を閉じると次の Accept が返ること
+	require.NoError(t, conns[0].Close())
+	select {
+	case conn := <-acceptedCh:
+		require.NoError(t, conn.Close())
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept should return after a conn is closed")
+	}
+	require.NoError(t, conns[1].Close())
+}
+
+func TestListenerResponseHandlerDisposition(t *testing.T) {
+	cases := []struct {
+		name        string
+		status      int
+		disposition Disposition
+		// 処理後に元のキューとデッドレターキューに残るメッセージ数
+		wantQueue      int
+		wantDeadLetter int
+	}{
+		{name: "default 2xx", status: http.StatusOK, disposition: DefaultDisposition, wantQueue: 0},
+		{name: "default 5xx", status: http.StatusInternalServerError, disposition: DefaultDisposition, wantQueue: 1},
+		{name: "ack 422", status: http.StatusUnprocessableEntity, disposition: AckMessage, wantQueue: 0},
+		{name: "retry 200", status: http.StatusOK, disposition: RetryMessage, wantQueue: 1},
+		{name: "dead letter", status: http.StatusBadRequest, disposition: DeadLetterMessage, wantQueue: 0, wantDeadLetter: 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// stubサーバーの作成
+			apiKey := "test-api-key"
+			stubServer := stub.NewServer(apiKey)
+			defer stubServer.Close()
+
+			client := simplemq.NewClient(apiKey, "test-queue")
+			client.Endpoint = stubServer.URL()
+
+			handledCh := make(chan Disposition, 1)
+			listener := NewListenerWithClient(client)
+			listener.DeadLetterHandler = &QueueDeadLetterHandler{Client: client.Clone("dead-letter-queue")}
+			listener.ResponseHandler = responseHandlerFunc(func(resp *http.Response, req *http.Request) (Disposition, error) {
+				defer func() { handledCh <- tc.disposition }()
+				return tc.disposition, nil
+			})
+			server := &http.Server{
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(tc.status)
+				}),
+			}
+			go func() {
+				if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+					t.Logf("HTTP server error: %v", err)
+				}
+			}()
+
+			stubServer.AddMessage("test-queue", `{"disposition":true}`)
+			select {
+			case <-handledCh:
+			case <-time.After(5 * time.Second):
+				t.Fatal("message should be handled")
+			}
+			// 接続が閉じられ、削除などの処理が完了するまで待つ
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			require.NoError(t, server.Shutdown(ctx))
+
+			assert.Equal(t, tc.wantQueue, stubServer.GetQueueSize("test-queue"))
+			assert.Equal(t, tc.wantDeadLetter, stubServer.GetQueueSize("dead-letter-queue"))
+		})
+	}
+}
+
+func TestListenerReceiveRetry(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	t.Run("Recover from transient errors", func(t *testing.T) {
+		stubServer.Reset()
+		// 受信を2回だけ失敗させる
+		stubServer.InjectError(http.MethodGet, `/messages$`, http.StatusServiceUnavailable, simplemq.APIError{Code: 503, Message: "unavailable"}, 2)
+
+		client := simplemq.NewClient(apiKey, "test-queue")
+		client.Endpoint = stubServer.URL()
+		listener := NewListenerWithClient(client)
+		listener.ReceiveRetryBackoff = ExponentialBackoff(10*time.Millisecond, 50*time.Millisecond)
+		var receiveErrors atomic.Int32
+		listener.OnReceiveError = func(err error) bool {
+			receiveErrors.Add(1)
+			return isRetryableError(err)
+		}
+		defer listener.Close()
+
+		stubServer.AddMessage("test-queue", `{"after":"retry"}`)
+		// 一時的なエラーは Accept に伝わらず、回復後にメッセージを受け取れること
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+		assert.Equal(t, `{"after":"retry"}`, conn.(*Conn).Message().Content)
+		assert.EqualValues(t, 2, receiveErrors.Load())
+	})
+
+	t.Run("Surface permanent errors", func(t *testing.T) {
+		stubServer.Reset()
+		client := simplemq.NewClient("invalid-api-key", "test-queue")
+		client.Endpoint = stubServer.URL()
+		listener := NewListenerWithClient(client)
+		defer listener.Close()
+
+		// 認証エラーは再試行せずに Accept から返すこと
+		_, err := listener.Accept()
+		require.Error(t, err)
+		assert.True(t, IsPermanentError(err))
+	})
+}
+
+func TestListenerAcceptReturnsOnClose(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	t.Run("Close", func(t *testing.T) {
+		// 受信の間隔を長くして、待機中に閉じられるようにする
+		listener := NewListenerWithClient(client)
+		listener.PollInterval = 10 * time.Second
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := listener.Accept()
+			errCh <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		// 受信の待機中でも Close の直後に net.ErrClosed を返すこと
+		closedAt := time.Now()
+		require.NoError(t, listener.Close())
+		select {
+		case err := <-errCh:
+			assert.ErrorIs(t, err, net.ErrClosed)
+			assert.Less(t, time.Since(closedAt), 50*time.Millisecond)
+		case <-time.After(time.Second):
+			t.Fatal("accept should return after close")
+		}
+	})
+
+	t.Run("BaseContext deadline", func(t *testing.T) {
+		// ベースコンテキストの期限切れでも net.ErrClosed を返すこと
+		listener := NewListenerWithClient(client)
+		listener.PollInterval = 10 * time.Second
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		listener.BaseContext = func() context.Context { return ctx }
+		defer listener.Close()
+
+		start := time.Now()
+		_, err := listener.Accept()
+		assert.ErrorIs(t, err, net.ErrClosed)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+}
+
+func TestListenerPingOnStart(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+	stubServer.SetQueues("test-queue", "retry-queue")
+
+	// 存在しないキューの場合は、リクエストを処理する前に Serve がエラーで終了すること
+	client := simplemq.NewClient(apiKey, "missing-queue")
+	client.Endpoint = stubServer.URL()
+	listener := NewListenerWithClient(client)
+	listener.PingOnStart = true
+	defer listener.Close()
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	err := server.Serve(listener)
+	require.ErrorIs(t, err, simplemq.ErrQueueNotFound)
+
+	// 有効なキューの場合は受信できること
+	client = simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	listener = NewListenerWithClient(client)
+	listener.PingOnStart = true
+	defer listener.Close()
+	stubServer.AddMessage("test-queue", `{"ping":"ok"}`)
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	// タイムアウトで確認に失敗した場合は記録されず、次の Accept で改めて確認されること
+	client = simplemq.NewClient(apiKey, "retry-queue")
+	client.Endpoint = stubServer.URL()
+	pingTransport := &pingTimeoutTransport{}
+	pingTransport.failures.Store(1)
+	client.HTTPClient = &http.Client{Transport: pingTransport}
+	listener = NewListenerWithClient(client)
+	listener.PingOnStart = true
+	defer listener.Close()
+	_, err = listener.Accept()
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	stubServer.AddMessage("retry-queue", `{"ping":"retry"}`)
+	conn, err = listener.Accept()
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+}
+
+// pingTimeoutTransport は、指定回数のキューの統計情報の取得をタイムアウトで失敗させるトランスポートです。
+type pingTimeoutTransport struct {
+	failures atomic.Int32
+}
+
+func (f *pingTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet && !strings.HasSuffix(req.URL.Path, "/messages") && f.failures.Add(-1) >= 0 {
+		return nil, context.DeadlineExceeded
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestListenerReviveExpired(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	listener := NewListenerWithClient(client)
+	ctx := context.Background()
+
+	receive := func(content string) *simplemq.Message {
+		stubServer.AddMessage("test-queue", content)
+		msgs, err := client.ReceiveMessages(ctx)
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		msg := msgs[0]
+		// 時計のずれで、可視性タイムアウトがわずかに過ぎているものとする
+		msg.VisibilityTimeoutAt = client.Now().Add(-100 * time.Millisecond).UnixMilli()
+		return &msg
+	}
+
+	t.Run("Extended", func(t *testing.T) {
+		// 延長できたメッセージは、可視性タイムアウトを更新して配信されること
+		msg := receive("expired")
+		require.True(t, listener.reviveExpired(ctx, msg))
+		assert.Greater(t, client.Until(msg.VisibilityTimeoutTime()), time.Duration(0))
+		assert.EqualValues(t, 0, listener.ExpiredDropped())
+		require.NoError(t, client.DeleteMessage(ctx, msg.ID))
+	})
+
+	t.Run("Dropped", func(t *testing.T) {
+		// 延長できなかったメッセージは配信されず、数えられること
+		msg := receive("deleted")
+		require.NoError(t, client.DeleteMessage(ctx, msg.ID))
+		require.False(t, listener.reviveExpired(ctx, msg))
+		assert.EqualValues(t, 1, listener.ExpiredDropped())
+	})
+}
+
+func TestNewListenerWithOptions(t *testing.T) {
+	client := simplemq.NewClient("test-api-key", "test-queue")
+	serializer := &JSONSerializer{}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	handler := &ReplyResponseHandler{Client: client}
+
+	// 指定したオプションがすべて適用されること
+	listener := NewListenerWithOptions(client,
+		WithSerializer(serializer),
+		WithLogger(logger),
+		WithResponseHandler(handler),
+		WithPollInterval(50*time.Millisecond),
+		WithMaxPrefetch(3),
+	)
+	assert.Same(t, client, listener.Client())
+	assert.Same(t, serializer, listener.Serializer)
+	assert.Same(t, logger, listener.Logger)
+	assert.Same(t, handler, listener.ResponseHandler)
+	assert.Equal(t, 50*time.Millisecond, listener.PollInterval)
+	assert.Equal(t, 3, listener.MaxPrefetch)
+
+	// オプションを指定しない場合は NewListenerWithClient と同じであること
+	assert.Equal(t, NewListenerWithClient(client), NewListenerWithOptions(client))
+}
+
+func TestListenerDeliveryAttempt(t *testing.T) {
+	// stubサーバーの作成（再配信が早く起きるよう可視性タイムアウトを短くする）
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+	stubServer.SetVisibilityTimeout(200 * time.Millisecond)
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	listener := NewListenerWithOptions(client, WithPollInterval(10*time.Millisecond))
+
+	// 1回目は失敗し、2回目に成功するハンドラー
+	var mu sync.Mutex
+	var attempts []string
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			attempts = append(attempts, r.Header.Get("SimpleMQ-Delivery-Attempt"))
+			n := len(attempts)
+			mu.Unlock()
+			if n == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	// 再配信されたメッセージの配信回数が増えること
+	msg := stubServer.AddMessage("test-queue", "retry")
+	require.True(t, stubServer.WaitForDeletion("test-queue", msg.ID, 5*time.Second))
+	mu.Lock()
+	assert.Equal(t, []string{"1", "2"}, attempts)
+	mu.Unlock()
+
+	// 削除したメッセージの記録は破棄されること
+	assert.Eventually(t, func() bool {
+		listener.attemptsMu.Lock()
+		defer listener.attemptsMu.Unlock()
+		_, ok := listener.attempts[msg.ID]
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestListenerAttemptTTL(t *testing.T) {
+	listener := NewListenerWithClient(simplemq.NewClient("test-api-key", "test-queue"))
+	listener.AttemptTTL = 50 * time.Millisecond
+
+	assert.Equal(t, 1, listener.recordAttempt("a"))
+	assert.Equal(t, 2, listener.recordAttempt("a"))
+	assert.Equal(t, 1, listener.recordAttempt("b"))
+
+	// AttemptTTL が過ぎた記録は破棄され、1回目として数え直されること
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, 1, listener.recordAttempt("a"))
+	listener.attemptsMu.Lock()
+	assert.NotContains(t, listener.attempts, "b")
+	listener.attemptsMu.Unlock()
+}
+
+// intervalLimiter は、呼び出しの間隔を interval 以上に制限する RateLimiter です。
+type intervalLimiter struct {
+	interval time.Duration
+	mu       sync.Mutex
+	next     time.Time
+	err      error
+}
+
+func (l *intervalLimiter) Wait(ctx context.Context) error {
+	if l.err != nil {
+		return l.err
+	}
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	l.mu.Unlock()
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// receiveRecordingTransport は、受信の API が呼び出された時刻を記録します。
+type receiveRecordingTransport struct {
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func (r *receiveRecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet {
+		r.mu.Lock()
+		r.times = append(r.times, time.Now())
+		r.mu.Unlock()
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestListenerReceiveRateLimiter(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	t.Run("Spacing", func(t *testing.T) {
+		// 受信間隔が短くても、受信の呼び出しが制限の間隔以上空くこと
+		recorder := &receiveRecordingTransport{}
+		client := simplemq.NewClient(apiKey, "spacing-queue")
+		client.Endpoint = stubServer.URL()
+		client.HTTPClient = &http.Client{Transport: recorder}
+		listener := NewListenerWithOptions(client, WithPollInterval(time.Millisecond))
+		listener.ReceiveRateLimiter = &intervalLimiter{interval: 100 * time.Millisecond}
+
+		go listener.Accept()
+		time.Sleep(550 * time.Millisecond)
+		require.NoError(t, listener.Close())
+
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
+		require.GreaterOrEqual(t, len(recorder.times), 3)
+		assert.LessOrEqual(t, len(recorder.times), 7)
+		for i := 1; i < len(recorder.times); i++ {
+			assert.GreaterOrEqual(t, recorder.times[i].Sub(recorder.times[i-1]), 90*time.Millisecond)
+		}
+	})
+
+	t.Run("Close while waiting", func(t *testing.T) {
+		// 制限で待っている間でも Close で Accept がすぐに返ること
+		client := simplemq.NewClient(apiKey, "wait-queue")
+		client.Endpoint = stubServer.URL()
+		listener := NewListenerWithOptions(client, WithPollInterval(time.Millisecond))
+		listener.ReceiveRateLimiter = &intervalLimiter{interval: time.Hour, next: time.Now().Add(time.Hour)}
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := listener.Accept()
+			errCh <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		require.NoError(t, listener.Close())
+		select {
+		case err := <-errCh:
+			assert.ErrorIs(t, err, net.ErrClosed)
+		case <-time.After(time.Second):
+			t.Fatal("Accept should return promptly after Close")
+		}
+	})
+
+	t.Run("Limiter error", func(t *testing.T) {
+		// Wait のエラーは Accept から返ること
+		errLimit := errors.New("exceeds limiter's burst")
+		client := simplemq.NewClient(apiKey, "error-queue")
+		client.Endpoint = stubServer.URL()
+		listener := NewListenerWithOptions(client, WithPollInterval(time.Millisecond))
+		listener.ReceiveRateLimiter = &intervalLimiter{err: errLimit}
+		defer listener.Close()
+		_, err := listener.Accept()
+		assert.ErrorIs(t, err, errLimit)
+	})
+}
+
+func TestListenerIdleTimeout(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "idle-queue")
+	client.Endpoint = stubServer.URL()
+	listener := NewListenerWithOptions(client, WithPollInterval(10*time.Millisecond))
+	listener.IdleTimeout = 200 * time.Millisecond
+	defer listener.Close()
+
+	// 空のキューでは、IdleTimeout の経過後に ErrIdleTimeout を返すこと
+	start := time.Now()
+	_, err := listener.Accept()
+	require.ErrorIs(t, err, ErrIdleTimeout)
+	assert.NotErrorIs(t, err, net.ErrClosed)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// ErrIdleTimeout の後も、メッセージを受信できること
+	msg := stubServer.AddMessage("idle-queue", "aGVsbG8=")
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	assert.Equal(t, msg.ID, conn.(*Conn).Message().ID)
+	require.NoError(t, conn.Close())
+
+	// http.Server.Serve は ErrIdleTimeout で終了すること
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(listener)
+	}()
+	select {
+	case err := <-errCh:
+		assert.ErrorIs(t, err, ErrIdleTimeout)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve should return after IdleTimeout")
+	}
+}
@@ -0,0 +1,172 @@
+package simplemqhttp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+)
+
+// DefaultBufferSize は、Transport.BufferSize が未指定の場合に使用されるローカルバッファの最大数です。
+const DefaultBufferSize = 1000
+
+// bufferedMessage は、ローカルバッファに格納した送信前のメッセージです。
+type bufferedMessage struct {
+	content string
+	opts    simplemq.SendOptions
+}
+
+// localBuffer は、送信に失敗したメッセージを保持し、バックグラウンドで再送信するためのバッファです。
+type localBuffer struct {
+	mu    sync.Mutex
+	items []bufferedMessage
+	// idle は、バッファが空になり再送信の goroutine が終了したときに閉じられます。再送信していない場合は nil です。
+	idle chan struct{}
+	// kick は、再試行の待機を打ち切って即座に再送信させるための通知です。
+	kick chan struct{}
+	// ctx は、再送信に使用するコンテキストです。Transport.Close でキャンセルされます。
+	ctx    context.Context
+	cancel context.CancelFunc
+	closed bool
+}
+
+// initLocked は、再送信に使用するコンテキストを作成します。b.mu を保持した状態で呼び出してください。
+func (b *localBuffer) initLocked() {
+	if b.ctx == nil {
+		b.ctx, b.cancel = context.WithCancel(context.Background())
+		b.kick = make(chan struct{}, 1)
+	}
+}
+
+func (t *Transport) bufferSize() int {
+	if t.BufferSize > 0 {
+		return t.BufferSize
+	}
+	return DefaultBufferSize
+}
+
+// bufferMessage は、メッセージをローカルバッファに格納し、再送信の goroutine が動いていなければ開始します。
+// バッファが一杯の場合や、Close の後は false を返します。
+func (t *Transport) bufferMessage(content string, opts simplemq.SendOptions) bool {
+	b := &t.localBuffer
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || len(b.items) >= t.bufferSize() {
+		return false
+	}
+	b.initLocked()
+	b.items = append(b.items, bufferedMessage{content: content, opts: opts})
+	if b.idle == nil {
+		b.idle = make(chan struct{})
+		go t.resendBuffered()
+	}
+	return true
+}
+
+// resendBuffered は、ローカルバッファのメッセージを格納した順に再送信し、バッファが空になるか Close されると終了します。
+// 一時的なエラーの場合は RetryBackoff に従って待機してから同じメッセージを再送信し、
+// それ以外のエラーの場合はメッセージを破棄して次のメッセージに進みます。
+func (t *Transport) resendBuffered() {
+	b := &t.localBuffer
+	b.mu.Lock()
+	ctx := b.ctx
+	b.mu.Unlock()
+	attempt := 1
+	for {
+		b.mu.Lock()
+		if len(b.items) == 0 || ctx.Err() != nil {
+			close(b.idle)
+			b.idle = nil
+			b.mu.Unlock()
+			return
+		}
+		item := b.items[0]
+		b.mu.Unlock()
+
+		msg, err := t.client.SendMessageWithOptions(ctx, item.content, item.opts)
+		if ctx.Err() != nil {
+			continue
+		}
+		observeOperation(t.Metrics, t.client.Queue, OperationSend, err)
+		if err == nil || !isRetryableError(err) {
+			if err != nil {
+				t.logger().Error("failed to resend buffered message, dropping", "err", err, "queue", t.client.Queue)
+			} else {
+				t.logger().Debug("buffered message sent", "message_id", msg.ID, "queue", t.client.Queue)
+			}
+			b.mu.Lock()
+			// Close でバッファが空にされている場合がある
+			if len(b.items) > 0 {
+				b.items = b.items[1:]
+			}
+			b.mu.Unlock()
+			attempt = 1
+			continue
+		}
+		wait := t.retryBackoff(attempt)
+		attempt++
+		t.logger().Warn("failed to resend buffered message, retrying", "err", err, "queue", t.client.Queue, "wait", wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-b.kick:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+}
+
+// Flush は、ローカルバッファのメッセージの再送信を即座に試み、バッファが空になるまで待ちます。
+// 送信できないメッセージが残っている間に ctx が終了した場合は、ctx のエラーを返します。
+// ローカルバッファが空の場合は、すぐに nil を返します。
+func (t *Transport) Flush(ctx context.Context) error {
+	b := &t.localBuffer
+	b.mu.Lock()
+	idle, kick := b.idle, b.kick
+	b.mu.Unlock()
+	if idle == nil {
+		return nil
+	}
+	select {
+	case kick <- struct{}{}:
+	default:
+	}
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close は、ローカルバッファの再送信を停止し、バックグラウンドの goroutine の終了を待ちます。
+// バッファに残っていたメッセージは破棄され、その件数をエラーとして返します。
+// 再送信の途中だったメッセージは、API に届いていても破棄した件数に含まれます。
+// 終了の前にバッファのメッセージを送信するには、先に Flush を呼び出してください。
+// Close の後に送信に失敗したメッセージはバッファに格納されず、RoundTrip はエラーを返します。
+func (t *Transport) Close() error {
+	b := &t.localBuffer
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.initLocked()
+	b.cancel()
+	dropped := len(b.items)
+	b.items = nil
+	idle := b.idle
+	b.mu.Unlock()
+	if idle != nil {
+		<-idle
+	}
+	if dropped > 0 {
+		t.logger().Warn("discarded buffered messages on close", "count", dropped, "queue", t.client.Queue)
+		return fmt.Errorf("%d buffered messages were not sent", dropped)
+	}
+	return nil
+}
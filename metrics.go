@@ -0,0 +1,61 @@
+package simplemqhttp
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+)
+
+// SimpleMQ の操作を表す Metrics のラベル値です。
+const (
+	OperationSend    = "send"
+	OperationReceive = "receive"
+	OperationDelete  = "delete"
+	OperationExtend  = "extend"
+)
+
+// Metrics は、SimpleMQ の操作に関するメトリクスを記録するためのインターフェースです。
+// Prometheus などのメトリクスライブラリへの依存を避けるため、記録先は利用者が実装します。
+//
+// 各メソッドの引数は、そのままラベルとして使用することを想定しています。
+//   - queue: キュー名
+//   - operation: OperationSend, OperationReceive, OperationDelete, OperationExtend のいずれか
+//   - statusClass: API のレスポンスのステータスクラス ("2xx", "4xx", "5xx")。ネットワークエラーなどレスポンスがない場合は "error"
+type Metrics interface {
+	// ObserveOperation は、SimpleMQ API の呼び出しを1回記録します。
+	// statusClass が "2xx" 以外の場合はエラーとして数えることを想定しています。
+	ObserveOperation(queue, operation, statusClass string)
+	// ObserveProcessingDuration は、メッセージを Accept してから Conn.Close されるまでの時間を記録します。
+	// statusClass はハンドラーが返したレスポンスのステータスクラスで、レスポンスがない場合は "error" です。
+	ObserveProcessingDuration(queue, statusClass string, d time.Duration)
+}
+
+// statusClassOf は、SimpleMQ API の呼び出し結果のステータスクラスを返します。
+func statusClassOf(err error) string {
+	if err == nil {
+		return "2xx"
+	}
+	var apiErr *simplemq.APIError
+	if errors.As(err, &apiErr) {
+		return statusClass(apiErr.Code)
+	}
+	return "error"
+}
+
+// statusClass は、HTTP ステータスコードのステータスクラスを返します。
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "error"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// observeOperation は、m が nil でない場合に SimpleMQ API の呼び出しを記録します。
+func observeOperation(m Metrics, queue, operation string, err error) {
+	if m == nil {
+		return
+	}
+	m.ObserveOperation(queue, operation, statusClassOf(err))
+}
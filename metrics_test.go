@@ -0,0 +1,137 @@
+package simplemqhttp
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+	"github.com/mashiike/simplemqhttp/stub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingMetrics は、記録されたメトリクスを保持する Metrics 実装です。
+type recordingMetrics struct {
+	mu         sync.Mutex
+	operations map[string]int
+	durations  map[string][]time.Duration
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{
+		operations: make(map[string]int),
+		durations:  make(map[string][]time.Duration),
+	}
+}
+
+func (m *recordingMetrics) ObserveOperation(queue, operation, statusClass string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.operations[queue+"/"+operation+"/"+statusClass]++
+}
+
+func (m *recordingMetrics) ObserveProcessingDuration(queue, statusClass string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.durations[queue+"/"+statusClass] = append(m.durations[queue+"/"+statusClass], d)
+}
+
+func (m *recordingMetrics) operation(key string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.operations[key]
+}
+
+func (m *recordingMetrics) duration(key string) []time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]time.Duration(nil), m.durations[key]...)
+}
+
+func TestMetrics(t *testing.T) {
+	// stubサーバーの作成（延長が起きるよう可視性タイムアウトを短くする）
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+	stubServer.SetVisibilityTimeout(300 * time.Millisecond)
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	metrics := newRecordingMetrics()
+
+	// 1回目の削除を失敗させる
+	stubServer.InjectError(http.MethodDelete, `/messages/`, http.StatusInternalServerError, simplemq.APIError{Code: 500, Message: "injected"}, 1)
+
+	// Transportで送信
+	transport := NewTransportWithClient(client)
+	transport.Metrics = metrics
+	for _, body := range []string{`{"n":1}`, `{"n":2}`} {
+		req, err := http.NewRequest("POST", "/test", strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	}
+	assert.Equal(t, 2, metrics.operation("test-queue/send/2xx"))
+
+	// Listenerで処理
+	listener := NewListenerWithClient(client)
+	listener.Metrics = metrics
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(50 * time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	// 削除の成功と失敗がそれぞれ記録されること
+	require.Eventually(t, func() bool {
+		return metrics.operation("test-queue/delete/5xx") == 1 && metrics.operation("test-queue/delete/2xx") >= 1
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Positive(t, metrics.operation("test-queue/receive/2xx"))
+
+	// 処理時間がレスポンスのステータスクラスごとに記録されること
+	durations := metrics.duration("test-queue/2xx")
+	require.GreaterOrEqual(t, len(durations), 2)
+	for _, d := range durations {
+		assert.GreaterOrEqual(t, d, 50*time.Millisecond)
+	}
+}
+
+func TestMetricsExtend(t *testing.T) {
+	// stubサーバーの作成（延長が頻繁に起きるよう可視性タイムアウトを短くする）
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+	stubServer.SetVisibilityTimeout(300 * time.Millisecond)
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	metrics := newRecordingMetrics()
+
+	listener := NewListenerWithClient(client)
+	listener.Metrics = metrics
+	defer listener.Close()
+
+	stubServer.AddMessage("test-queue", `{"metrics":"extend"}`)
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+
+	// 処理中の延長が記録されること
+	require.Eventually(t, func() bool {
+		return metrics.operation("test-queue/extend/2xx") > 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// レスポンスを返さずに閉じた場合は "error" として処理時間が記録されること
+	require.NoError(t, conn.Close())
+	assert.Len(t, metrics.duration("test-queue/error"), 1)
+}
@@ -0,0 +1,159 @@
+package simplemqhttp
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+)
+
+// acceptResult は、Listener.Accept の結果です。
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// MultiListener は、複数のキューからメッセージを受信して、1つの Accept にまとめる net.Listener 実装です。
+// 1つの http.Server で複数のキューのメッセージを処理する場合に使用します。
+//
+// キューごとに Listener を作成し、それぞれの Accept の結果をラウンドロビンで返します。
+// 複数のキューの接続を受け付けられる場合は、前回返したキューの次のキューの接続を優先するため、
+// メッセージの多いキューがあっても他のキューのメッセージが待たされ続けることはありません。
+// 接続がどのキューのものかは、Conn.LocalAddr や http.Request.RemoteAddr のキュー名で判別できます。
+type MultiListener struct {
+	listeners []*Listener
+	results   []chan acceptResult
+	done      chan struct{}
+	startOnce sync.Once
+	closeOnce sync.Once
+	closeErr  error
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	next      int
+}
+
+var _ net.Listener = &MultiListener{}
+
+// NewMultiListener は、clients のキューからメッセージを受信する MultiListener を作成します。
+// opts は、キューごとに作成するすべての Listener に適用されます。
+func NewMultiListener(clients []*simplemq.Client, opts ...ListenerOption) *MultiListener {
+	m := &MultiListener{
+		listeners: make([]*Listener, 0, len(clients)),
+		results:   make([]chan acceptResult, 0, len(clients)),
+		done:      make(chan struct{}),
+	}
+	for _, client := range clients {
+		m.listeners = append(m.listeners, NewListenerWithOptions(client, opts...))
+		m.results = append(m.results, make(chan acceptResult))
+	}
+	return m
+}
+
+// Listeners は、キューごとの Listener を NewMultiListener に渡したクライアントの順に返します。
+// ListenerOption のない設定は、最初の Accept の前にそれぞれの Listener に設定してください。
+func (m *MultiListener) Listeners() []*Listener {
+	return m.listeners
+}
+
+// start は、キューごとに Accept を繰り返す goroutine を開始します。
+func (m *MultiListener) start() {
+	m.startOnce.Do(func() {
+		for i, l := range m.listeners {
+			m.wg.Add(1)
+			go m.acceptLoop(l, m.results[i])
+		}
+	})
+}
+
+// acceptLoop は、l の Accept の結果を results に渡します。Accept がエラーを返した場合は終了します。
+// MultiListener が閉じられた場合、受け渡せなかった接続はレスポンスなしで閉じられ、メッセージは可視性タイムアウトの経過後に再配信されます。
+func (m *MultiListener) acceptLoop(l *Listener, results chan acceptResult) {
+	defer m.wg.Done()
+	for {
+		conn, err := l.Accept()
+		select {
+		case results <- acceptResult{conn: conn, err: err}:
+		case <-m.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Accept は、いずれかのキューのメッセージの接続を返します。
+// いずれかの Listener の Accept がエラーを返した場合は、そのエラーを返します。
+func (m *MultiListener) Accept() (net.Conn, error) {
+	select {
+	case <-m.done:
+		return nil, net.ErrClosed
+	default:
+	}
+	m.start()
+	n := len(m.results)
+	m.mu.Lock()
+	first := m.next
+	m.mu.Unlock()
+	// 前回返したキューの次のキューから順に、受け付けられる接続を探す
+	for k := 0; k < n; k++ {
+		i := (first + k) % n
+		select {
+		case r := <-m.results[i]:
+			return m.accepted(i, r)
+		default:
+		}
+	}
+	cases := make([]reflect.SelectCase, 0, n+1)
+	for _, ch := range m.results {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)})
+	}
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(m.done)})
+	chosen, value, _ := reflect.Select(cases)
+	if chosen == n {
+		return nil, net.ErrClosed
+	}
+	return m.accepted(chosen, value.Interface().(acceptResult))
+}
+
+// accepted は、i 番目のキューの次のキューを次回の Accept で優先するようにして、r を返します。
+func (m *MultiListener) accepted(i int, r acceptResult) (net.Conn, error) {
+	m.mu.Lock()
+	m.next = (i + 1) % len(m.results)
+	m.mu.Unlock()
+	return r.conn, r.err
+}
+
+// Close は、すべての Listener を閉じて、受信を停止します。
+// ブロックされた Accept 操作はすべてブロック解除され、エラーを返します。
+func (m *MultiListener) Close() error {
+	m.closeOnce.Do(func() {
+		// Close の後に Accept が呼び出されても goroutine を開始しない
+		m.startOnce.Do(func() {})
+		close(m.done)
+		var errs []error
+		for _, l := range m.listeners {
+			if err := l.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		m.wg.Wait()
+		m.closeErr = errors.Join(errs...)
+	})
+	return m.closeErr
+}
+
+// Addr は、すべてのキュー名をカンマで区切ったアドレスを返します。
+func (m *MultiListener) Addr() net.Addr {
+	queues := make([]string, 0, len(m.listeners))
+	for _, l := range m.listeners {
+		queues = append(queues, l.client.Queue)
+	}
+	return Addr(strings.Join(queues, ","))
+}
@@ -0,0 +1,106 @@
+package simplemqhttp
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+	"github.com/mashiike/simplemqhttp/stub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiListener(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "queue-a")
+	client.Endpoint = stubServer.URL()
+	clients := []*simplemq.Client{client, client.Clone("queue-b")}
+
+	t.Run("Serve", func(t *testing.T) {
+		// 1つの http.Server で、すべてのキューのメッセージを処理できること
+		listener := NewMultiListener(clients, WithPollInterval(10*time.Millisecond))
+		assert.Equal(t, "queue-a,queue-b", listener.Addr().String())
+		var mu sync.Mutex
+		handled := map[string]int{}
+		server := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				handled[r.RemoteAddr]++
+				mu.Unlock()
+				w.WriteHeader(http.StatusOK)
+			}),
+		}
+		go server.Serve(listener)
+		defer server.Close()
+
+		a := stubServer.AddMessage("queue-a", "a")
+		b := stubServer.AddMessage("queue-b", "b")
+		require.True(t, stubServer.WaitForDeletion("queue-a", a.ID, 5*time.Second))
+		require.True(t, stubServer.WaitForDeletion("queue-b", b.ID, 5*time.Second))
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, map[string]int{"queue-a": 1, "queue-b": 1}, handled)
+	})
+
+	t.Run("RoundRobin", func(t *testing.T) {
+		// 両方のキューに接続がある場合は、交互に返されること
+		stubServer.Reset()
+		for i := 0; i < 3; i++ {
+			stubServer.AddMessage("queue-a", "a")
+			stubServer.AddMessage("queue-b", "b")
+		}
+		listener := NewMultiListener(clients, WithPollInterval(10*time.Millisecond))
+		defer listener.Close()
+
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		queues := []string{conn.LocalAddr().String()}
+		defer conn.Close()
+		for i := 0; i < 3; i++ {
+			// 返したキューの次の接続が受け付けられるまで待つ
+			time.Sleep(100 * time.Millisecond)
+			conn, err := listener.Accept()
+			require.NoError(t, err)
+			defer conn.Close()
+			queues = append(queues, conn.LocalAddr().String())
+		}
+		for i := 1; i < len(queues); i++ {
+			assert.NotEqual(t, queues[i-1], queues[i], "queues: %v", queues)
+		}
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		// Close でブロックされた Accept が解除され、受信が停止すること
+		stubServer.Reset()
+		listener := NewMultiListener(clients, WithPollInterval(10*time.Millisecond))
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := listener.Accept()
+			errCh <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		require.NoError(t, listener.Close())
+		select {
+		case err := <-errCh:
+			require.ErrorIs(t, err, net.ErrClosed)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Accept did not return after Close")
+		}
+		_, err := listener.Accept()
+		require.ErrorIs(t, err, net.ErrClosed)
+
+		// 閉じた後に追加したメッセージは受信されないこと
+		// Close は実行中の受信の完了を待たないため、その受信が終わるまで待ってから追加する
+		time.Sleep(50 * time.Millisecond)
+		msg := stubServer.AddMessage("queue-a", "after close")
+		time.Sleep(100 * time.Millisecond)
+		assert.Zero(t, stubServer.GetMessage("queue-a", msg.ID).AcquiredAt)
+	})
+}
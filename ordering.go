@@ -0,0 +1,140 @@
+package simplemqhttp
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+)
+
+// minHeldExtendInterval は、保留しているメッセージの可視性タイムアウトを延長する間隔の最小値です。
+const minHeldExtendInterval = 10 * time.Millisecond
+
+// orderingSlot は、順序キーごとに配信中または配信を予約したメッセージです。
+type orderingSlot struct {
+	id string
+	// dispatched は、メッセージが Accept で処理されたかどうかです。
+	// false の場合は、保留から戻したメッセージのために順序キーを予約しています。
+	dispatched bool
+}
+
+// heldMessage は、同じ順序キーのメッセージの処理が終わるまで配信を保留しているメッセージです。
+type heldMessage struct {
+	msg  simplemq.Message
+	stop chan struct{}
+	done chan struct{}
+}
+
+// orderingKey は、OrderingKey が指定されている場合にメッセージの順序キーを返します。
+func (l *Listener) orderingKey(msg simplemq.Message) string {
+	if l.OrderingKey == nil {
+		return ""
+	}
+	return l.OrderingKey(msg)
+}
+
+// OrderingKeyFromHeader は、Transport がメッセージ属性として送信したヘッダー name の値を順序キーとする、
+// Listener.OrderingKey に指定するための関数を返します。name には Transport.GroupIDHeader と同じ名前を指定します。
+// ヘッダーがないメッセージには空文字列を返すため、順序を考慮せずに配信されます。
+// EncryptingSerializer はメッセージ属性も暗号化するため、暗号化したメッセージからは順序キーを読み取れず、順序を考慮せずに配信されます。
+func OrderingKeyFromHeader(name string) func(msg simplemq.Message) string {
+	return func(msg simplemq.Message) string {
+		return peekAttributes(msg.Content).Get(name)
+	}
+}
+
+// holdForOrdering は、同じ順序キーのメッセージを処理中であれば msg の配信を保留して true を返します。
+// 保留しない場合は、msg をその順序キーで処理中のメッセージとして記録します。
+// 処理中のメッセージ自体が再配信された場合も、処理が終わるまで保留します。
+func (l *Listener) holdForOrdering(ctx context.Context, key string, msg simplemq.Message) bool {
+	l.orderingMu.Lock()
+	defer l.orderingMu.Unlock()
+	if l.orderingActive == nil {
+		l.orderingActive = make(map[string]orderingSlot)
+		l.orderingHeld = make(map[string][]*heldMessage)
+	}
+	active, ok := l.orderingActive[key]
+	if !ok || (active.id == msg.ID && !active.dispatched) {
+		l.orderingActive[key] = orderingSlot{id: msg.ID, dispatched: true}
+		return false
+	}
+	h := &heldMessage{
+		msg:  msg,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	l.orderingHeld[key] = append(l.orderingHeld[key], h)
+	l.mu.Lock()
+	l.heldCount++
+	l.mu.Unlock()
+	l.logger().Debug("hold message until the previous message with the same ordering key completes", "message_id", msg.ID, "ordering_key", key, "active_message_id", active.id)
+	go l.extendHeld(ctx, h)
+	return true
+}
+
+// releaseOrdering は、順序キーで処理中のメッセージ id の処理が終わったことを記録します。
+// 保留しているメッセージがあれば、次に Accept で返されるようバッファの先頭に戻します。
+func (l *Listener) releaseOrdering(key, id string) {
+	l.orderingMu.Lock()
+	if active := l.orderingActive[key]; active.id != id || !active.dispatched {
+		l.orderingMu.Unlock()
+		return
+	}
+	held := l.orderingHeld[key]
+	if len(held) == 0 {
+		delete(l.orderingActive, key)
+		delete(l.orderingHeld, key)
+		l.orderingMu.Unlock()
+		return
+	}
+	next := held[0]
+	l.orderingHeld[key] = held[1:]
+	// 戻したメッセージより先に、後から受信した同じ順序キーのメッセージが配信されないよう予約しておく
+	l.orderingActive[key] = orderingSlot{id: next.msg.ID}
+	l.orderingMu.Unlock()
+
+	close(next.stop)
+	<-next.done
+	l.mu.Lock()
+	l.heldCount--
+	l.acceptedMessages = append([]simplemq.Message{next.msg}, l.acceptedMessages...)
+	l.broadcastLocked()
+	l.mu.Unlock()
+}
+
+// extendHeld は、保留しているメッセージが再配信されないよう、配信されるまで可視性タイムアウトを延長します。
+// 延長に失敗した場合やリスナーが閉じられた場合は延長をやめ、メッセージは可視性タイムアウトの経過後に再配信されます。
+func (l *Listener) extendHeld(ctx context.Context, h *heldMessage) {
+	defer close(h.done)
+	for {
+		wait := l.client.Until(h.msg.VisibilityTimeoutTime()) / 2
+		if wait < minHeldExtendInterval {
+			wait = minHeldExtendInterval
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-h.stop:
+			timer.Stop()
+			return
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		extended, err := l.client.ExtendVisibilityTimeoutBy(ctx, h.msg.ID, l.VisibilityTimeout)
+		if !errors.Is(err, context.Canceled) {
+			observeOperation(l.Metrics, l.client.Queue, OperationExtend, err)
+		}
+		if err != nil {
+			l.logger().Warn("failed to extend visibility timeout of held message", "err", err, "message_id", h.msg.ID)
+			// stop を待ってから終了し、releaseOrdering がメッセージを取り出せるようにする
+			select {
+			case <-h.stop:
+			case <-ctx.Done():
+			}
+			return
+		}
+		h.msg.VisibilityTimeoutAt = extended.VisibilityTimeoutAt
+	}
+}
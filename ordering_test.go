@@ -0,0 +1,198 @@
+package simplemqhttp
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+	"github.com/mashiike/simplemqhttp/stub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerOrderingKey(t *testing.T) {
+	// stubサーバーの作成（保留中の延長を確認するため可視性タイムアウトを短くする）
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+	stubServer.SetVisibilityTimeout(200 * time.Millisecond)
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	type event struct {
+		Key string `json:"key"`
+		Seq int    `json:"seq"`
+	}
+	listener := NewListenerWithClient(client)
+	listener.PollInterval = 10 * time.Millisecond
+	listener.Serializer = &BodyOnlySerializer{NoBase64: true}
+	listener.OrderingKey = func(msg simplemq.Message) string {
+		var e event
+		if err := json.Unmarshal([]byte(msg.Content), &e); err != nil {
+			return ""
+		}
+		return e.Key
+	}
+
+	var (
+		mu        sync.Mutex
+		active    = map[string]int{}
+		maxActive = map[string]int{}
+		handled   []event
+	)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var e event
+			bs, _ := io.ReadAll(r.Body)
+			require.NoError(t, json.Unmarshal(bs, &e))
+			mu.Lock()
+			active[e.Key]++
+			if active[e.Key] > maxActive[e.Key] {
+				maxActive[e.Key] = active[e.Key]
+			}
+			handled = append(handled, e)
+			mu.Unlock()
+			if e.Key == "a" {
+				time.Sleep(150 * time.Millisecond)
+			}
+			mu.Lock()
+			active[e.Key]--
+			mu.Unlock()
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	add := func(e event) {
+		bs, err := json.Marshal(e)
+		require.NoError(t, err)
+		stubServer.AddMessage("test-queue", string(bs))
+		// 受信の順序を確定させるため、受信されるまで待つ
+		time.Sleep(40 * time.Millisecond)
+	}
+	add(event{Key: "a", Seq: 1})
+	add(event{Key: "a", Seq: 2})
+	add(event{Key: "a", Seq: 3})
+	add(event{Key: "b", Seq: 1})
+
+	require.Eventually(t, func() bool {
+		return stubServer.GetQueueSize("test-queue") == 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	// 同じ順序キーのメッセージは同時に1つだけ、受信した順に処理されること
+	assert.Equal(t, 1, maxActive["a"])
+	var seqs []int
+	bIndex := -1
+	for i, e := range handled {
+		if e.Key == "a" {
+			seqs = append(seqs, e.Seq)
+		} else {
+			bIndex = i
+		}
+	}
+	// a3 は可視性タイムアウトより長く保留されるが、延長されるため再配信されないこと
+	assert.Equal(t, []int{1, 2, 3}, seqs)
+	// 異なる順序キーのメッセージは保留されないこと
+	assert.Equal(t, 1, bIndex)
+}
+
+func TestTransportGroupIDHeader(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "group-queue")
+	client.Endpoint = stubServer.URL()
+
+	transport := NewTransportWithClient(client)
+	transport.GroupIDHeader = DefaultGroupIDHeader
+	listener := NewListenerWithClient(client)
+	listener.PollInterval = 10 * time.Millisecond
+	listener.OrderingKey = OrderingKeyFromHeader(DefaultGroupIDHeader)
+
+	var (
+		mu        sync.Mutex
+		active    int
+		maxActive int
+		handled   []string
+		groups    []string
+	)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			bs, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			active++
+			maxActive = max(maxActive, active)
+			handled = append(handled, string(bs))
+			groups = append(groups, r.Header.Get(DefaultGroupIDHeader))
+			mu.Unlock()
+			if string(bs) == "first" {
+				time.Sleep(150 * time.Millisecond)
+			}
+			mu.Lock()
+			active--
+			mu.Unlock()
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	httpClient := &http.Client{Transport: transport}
+	send := func(body string) {
+		req, err := http.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set(DefaultGroupIDHeader, "order-1")
+		resp, err := httpClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+		// 受信の順序を確定させるため、受信されるまで待つ
+		time.Sleep(40 * time.Millisecond)
+	}
+	send("first")
+	send("second")
+
+	require.Eventually(t, func() bool {
+		return stubServer.GetQueueSize("group-queue") == 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	// 同じグループ ID のメッセージは同時に1つだけ、送信した順に処理されること
+	assert.Equal(t, 1, maxActive)
+	assert.Equal(t, []string{"first", "second"}, handled)
+	// グループ ID はリクエストヘッダーとしても参照できること
+	assert.Equal(t, []string{"order-1", "order-1"}, groups)
+
+	// ヘッダーのないメッセージの順序キーは空になること
+	assert.Empty(t, OrderingKeyFromHeader(DefaultGroupIDHeader)(simplemq.Message{Content: "plain"}))
+
+	// 形式に属性を含めるシリアライザでも、デシリアライズせずに順序キーを読み取れること
+	attributes := http.Header{}
+	attributes.Set(DefaultGroupIDHeader, "order-2")
+	registry := &SerializerRegistry{Format: "json", Serializers: map[string]Serializer{"json": &JSONSerializer{}}}
+	req, err := http.NewRequest(http.MethodPost, "/", strings.NewReader("third"))
+	require.NoError(t, err)
+	content, err := registry.serializeWithAttributes(req, attributes)
+	require.NoError(t, err)
+	assert.Equal(t, "order-2", OrderingKeyFromHeader(DefaultGroupIDHeader)(simplemq.Message{Content: content}))
+}
@@ -0,0 +1,59 @@
+// Package otelsimplemqhttp は、simplemqhttp で OpenTelemetry のトレースコンテキストを伝搬するためのパッケージです。
+// OpenTelemetry への依存をこのパッケージに閉じ込めるため、simplemqhttp 本体とは別のモジュールとして提供しています。
+package otelsimplemqhttp
+
+import (
+	"net/http"
+
+	"github.com/mashiike/simplemqhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Serializer は、リクエストのトレースコンテキストを simplemqhttp.EnvelopeSerializer のエンベロープに格納して伝搬するシリアライザです。
+//
+// Serialize ではリクエストのコンテキストから traceparent/tracestate などのヘッダーを注入し、
+// Deserialize ではエンベロープから復元したヘッダーからトレースコンテキストを取り出して、再構成したリクエストのコンテキストに設定します。
+// 復元したヘッダーはリクエストにも残るため、Listener 経由で http.Server のハンドラーに届くリクエストからも
+// otelhttp などのミドルウェアでトレースコンテキストを取り出せます。
+type Serializer struct {
+	// Propagator は、トレースコンテキストの注入と取り出しに使用するプロパゲーターです。
+	// 未指定の場合は、otel.GetTextMapPropagator() が使用されます。
+	Propagator propagation.TextMapPropagator
+	// HeaderAllowlist は、トレースコンテキスト以外にエンベロープに格納するリクエストヘッダーの一覧です。
+	HeaderAllowlist []string
+}
+
+var _ simplemqhttp.Serializer = &Serializer{}
+
+func (s *Serializer) propagator() propagation.TextMapPropagator {
+	if s.Propagator != nil {
+		return s.Propagator
+	}
+	return otel.GetTextMapPropagator()
+}
+
+func (s *Serializer) envelope() *simplemqhttp.EnvelopeSerializer {
+	allowlist := append([]string(nil), s.HeaderAllowlist...)
+	allowlist = append(allowlist, s.propagator().Fields()...)
+	return &simplemqhttp.EnvelopeSerializer{HeaderAllowlist: allowlist}
+}
+
+func (s *Serializer) Serialize(req *http.Request) (string, error) {
+	if req == nil {
+		return s.envelope().Serialize(req)
+	}
+	// 呼び出し元のリクエストのヘッダーを書き換えないよう、複製に注入する
+	injected := req.Clone(req.Context())
+	s.propagator().Inject(req.Context(), propagation.HeaderCarrier(injected.Header))
+	return s.envelope().Serialize(injected)
+}
+
+func (s *Serializer) Deserialize(content string) (*http.Request, error) {
+	req, err := s.envelope().Deserialize(content)
+	if err != nil {
+		return nil, err
+	}
+	ctx := s.propagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	return req.WithContext(ctx), nil
+}
@@ -0,0 +1,111 @@
+package otelsimplemqhttp_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mashiike/simplemqhttp"
+	"github.com/mashiike/simplemqhttp/otelsimplemqhttp"
+	"github.com/mashiike/simplemqhttp/simplemq"
+	"github.com/mashiike/simplemqhttp/stub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newSpanContext(t *testing.T) trace.SpanContext {
+	t.Helper()
+	traceID, err := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	require.NoError(t, err)
+	spanID, err := trace.SpanIDFromHex("00f067aa0ba902b7")
+	require.NoError(t, err)
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+}
+
+func TestSerializer(t *testing.T) {
+	serializer := &otelsimplemqhttp.Serializer{
+		Propagator:      propagation.TraceContext{},
+		HeaderAllowlist: []string{"X-Tenant-Id"},
+	}
+	sc := newSpanContext(t)
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+
+	src, err := http.NewRequestWithContext(ctx, "POST", "/", strings.NewReader(`{"trace":"propagation"}`))
+	require.NoError(t, err)
+	src.Header.Set("X-Tenant-Id", "tenant-a")
+
+	content, err := serializer.Serialize(src)
+	require.NoError(t, err)
+	// 呼び出し元のリクエストのヘッダーは書き換えないこと
+	assert.Empty(t, src.Header.Get("traceparent"))
+
+	req, err := serializer.Deserialize(content)
+	require.NoError(t, err)
+	// トレースコンテキストがリクエストのコンテキストに復元されること
+	got := trace.SpanContextFromContext(req.Context())
+	assert.Equal(t, sc.TraceID(), got.TraceID())
+	assert.Equal(t, sc.SpanID(), got.SpanID())
+	assert.True(t, got.IsRemote())
+	assert.NotEmpty(t, req.Header.Get("traceparent"))
+	assert.Equal(t, "tenant-a", req.Header.Get("X-Tenant-Id"))
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"trace":"propagation"}`, string(body))
+}
+
+func TestSerializerAcrossQueue(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	serializer := &otelsimplemqhttp.Serializer{Propagator: propagation.TraceContext{}}
+
+	// トレースコンテキスト付きのリクエストを Transport で送信
+	transport := simplemqhttp.NewTransportWithClient(client)
+	transport.Serializer = serializer
+	sc := newSpanContext(t)
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+	req, err := http.NewRequestWithContext(ctx, "POST", "/", strings.NewReader(`{"across":"queue"}`))
+	require.NoError(t, err)
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	// Listener 経由のハンドラーでトレースコンテキストを取り出せること
+	traceIDCh := make(chan trace.TraceID, 1)
+	listener := simplemqhttp.NewListenerWithClient(client)
+	listener.Serializer = serializer
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := propagation.TraceContext{}.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			traceIDCh <- trace.SpanContextFromContext(ctx).TraceID()
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	select {
+	case traceID := <-traceIDCh:
+		assert.Equal(t, sc.TraceID(), traceID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message should be delivered")
+	}
+}
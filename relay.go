@@ -0,0 +1,117 @@
+package simplemqhttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+)
+
+// ResponseSerializer は、HTTP レスポンスを SimpleMQ メッセージとしてシリアライズするためのシリアライザです。
+// リクエスト用の Serializer とは逆に、レスポンス全体 (ステータス行、ヘッダー、ボディ) をダンプして格納します。
+type ResponseSerializer struct {
+	NoBase64 bool
+}
+
+// Serialize は、レスポンスをメッセージの内容にシリアライズします。
+func (s *ResponseSerializer) Serialize(resp *http.Response) (string, error) {
+	if resp == nil {
+		return "", errors.New("response is nil")
+	}
+	dump, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		return "", err
+	}
+	if s.NoBase64 {
+		if len(dump) > maxMessageSize {
+			return "", ErrTooLarge
+		}
+		return string(dump), nil
+	}
+	encoded := base64.StdEncoding.EncodeToString(dump)
+	if len(encoded) > maxMessageSize {
+		return "", ErrTooLarge
+	}
+	return encoded, nil
+}
+
+// Deserialize は、メッセージの内容からレスポンスを復元します。
+func (s *ResponseSerializer) Deserialize(content string) (*http.Response, error) {
+	if !s.NoBase64 {
+		decoded, err := base64.StdEncoding.DecodeString(content)
+		if err == nil {
+			content = string(decoded)
+		}
+	}
+	return readResponseDump([]byte(content))
+}
+
+func readResponseDump(dump []byte) (*http.Response, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(dump)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response dump: %w", err)
+	}
+	return resp, nil
+}
+
+// RelayResponseHandler は、処理結果のレスポンスを別のキューに送信する ResponseHandler 実装です。
+// 送信されたレスポンスは、RelayHandler を使用するリスナーで受信して再送できます。
+type RelayResponseHandler struct {
+	// Client は、レスポンスを送信するキューのクライアントです。
+	Client *simplemq.Client
+	// Serializer は、レスポンスをシリアライズするためのシリアライザです。
+	// 未指定の場合は、ResponseSerializer の既定値が使用されます。
+	Serializer *ResponseSerializer
+}
+
+var _ ResponseHandler = &RelayResponseHandler{}
+
+func (h *RelayResponseHandler) serializer() *ResponseSerializer {
+	if h.Serializer != nil {
+		return h.Serializer
+	}
+	return &ResponseSerializer{}
+}
+
+// HandleResponse は、レスポンスをシリアライズしてキューに送信します。
+func (h *RelayResponseHandler) HandleResponse(resp *http.Response, _ *http.Request) (Disposition, error) {
+	content, err := h.serializer().Serialize(resp)
+	if err != nil {
+		return DefaultDisposition, fmt.Errorf("failed to serialize response: %w", err)
+	}
+	if _, err := h.Client.SendMessage(context.Background(), content); err != nil {
+		return DefaultDisposition, fmt.Errorf("failed to relay response: %w", err)
+	}
+	return DefaultDisposition, nil
+}
+
+// RelayHandler は、メッセージの内容を HTTP レスポンスのダンプとして読み込み、forward に渡す http.Handler を返します。
+// Listener の Serializer には BodyOnlySerializer を使用してください。
+// forward がエラーを返した場合は 502 Bad Gateway を返し、メッセージは再配信されます。
+func RelayHandler(forward func(resp *http.Response) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dump, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp, err := readResponseDump(dump)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer resp.Body.Close()
+		if err := forward(resp); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,106 @@
+package simplemqhttp
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+	"github.com/mashiike/simplemqhttp/stub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseSerializer(t *testing.T) {
+	serializer := &ResponseSerializer{}
+
+	resp := &http.Response{
+		StatusCode:    http.StatusCreated,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(strings.NewReader(`{"created":true}`)),
+		ContentLength: int64(len(`{"created":true}`)),
+	}
+	content, err := serializer.Serialize(resp)
+	require.NoError(t, err)
+
+	restored, err := serializer.Deserialize(content)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, restored.StatusCode)
+	assert.Equal(t, "application/json", restored.Header.Get("Content-Type"))
+	body, err := io.ReadAll(restored.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"created":true}`, string(body))
+}
+
+func TestRelay(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// レスポンスを送信するキューのclientを作成
+	client := simplemq.NewClient(apiKey, "relay-queue")
+	client.Endpoint = stubServer.URL()
+
+	// レスポンスをキューに送信
+	relay := &RelayResponseHandler{Client: client}
+	resp := &http.Response{
+		StatusCode:    http.StatusAccepted,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"X-Relay": []string{"yes"}},
+		Body:          io.NopCloser(strings.NewReader("relayed body")),
+		ContentLength: int64(len("relayed body")),
+	}
+	req, err := http.NewRequest("POST", "/", nil)
+	require.NoError(t, err)
+	disposition, err := relay.HandleResponse(resp, req)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultDisposition, disposition)
+	require.Equal(t, 1, stubServer.GetQueueSize("relay-queue"))
+
+	// リレー用のリスナーで受信して再送する
+	type forwarded struct {
+		status int
+		header string
+		body   string
+	}
+	forwardedCh := make(chan forwarded, 1)
+	listener := NewListenerWithClient(client)
+	server := &http.Server{
+		Handler: RelayHandler(func(resp *http.Response) error {
+			bs, err := io.ReadAll(resp.Body)
+			if err != nil {
+				return err
+			}
+			forwardedCh <- forwarded{
+				status: resp.StatusCode,
+				header: resp.Header.Get("X-Relay"),
+				body:   string(bs),
+			}
+			return nil
+		}),
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	select {
+	case f := <-forwardedCh:
+		assert.Equal(t, http.StatusAccepted, f.status)
+		assert.Equal(t, "yes", f.header)
+		assert.Equal(t, "relayed body", f.body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("response should be relayed")
+	}
+	require.Eventually(t, func() bool {
+		return stubServer.GetQueueSize("relay-queue") == 0
+	}, 5*time.Second, 100*time.Millisecond)
+}
@@ -0,0 +1,182 @@
+package simplemqhttp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mashiike/simplemqhttp/simplemq"
+)
+
+// CorrelationIDHeader は、リクエストとその処理結果のレスポンスを対応付けるための相関 ID のヘッダーです。
+// Transport.ReplyQueue が指定されている場合、Transport はリクエストごとに相関 ID を生成してメッセージ属性として送信します。
+// Listener 側ではリクエストのヘッダーとして参照でき、ReplyResponseHandler はこの値を付けてレスポンスを応答キューに送信します。
+const CorrelationIDHeader = "SimpleMQ-Correlation-ID"
+
+// DefaultReplyTimeout は、Transport.ReplyTimeout の既定値です。
+const DefaultReplyTimeout = 30 * time.Second
+
+// replyPollInterval は、応答キューにメッセージがなかった場合に次に受信するまでの間隔です。
+const replyPollInterval = 100 * time.Millisecond
+
+// replyWaiters は、応答を待っているリクエストの相関 ID ごとに、応答を受け取るチャネルを保持します。
+// 応答キューから受信した応答が別のリクエストのものである場合は、そのリクエストに渡します。
+type replyWaiters struct {
+	mu      sync.Mutex
+	waiters map[string]chan string
+}
+
+func (w *replyWaiters) register(id string) chan string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.waiters == nil {
+		w.waiters = make(map[string]chan string)
+	}
+	ch := make(chan string, 1)
+	w.waiters[id] = ch
+	return ch
+}
+
+func (w *replyWaiters) unregister(id string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.waiters, id)
+}
+
+// deliver は、相関 ID が id のリクエストに応答を渡します。待っているリクエストがない場合は false を返します。
+func (w *replyWaiters) deliver(id, content string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ch, ok := w.waiters[id]
+	if !ok {
+		return false
+	}
+	delete(w.waiters, id)
+	ch <- content
+	return true
+}
+
+func (t *Transport) replyTimeout() time.Duration {
+	if t.ReplyTimeout > 0 {
+		return t.ReplyTimeout
+	}
+	return DefaultReplyTimeout
+}
+
+// withCorrelationID は、新しい相関 ID を付けたリクエストを返します。
+func withCorrelationID(req *http.Request) (*http.Request, string) {
+	id := uuid.New().String()
+	req = req.Clone(req.Context())
+	req.Header.Set(CorrelationIDHeader, id)
+	return req, id
+}
+
+// waitReply は、相関 ID が id の応答を応答キューから受信して、Listener 側で処理した結果のレスポンスを返します。
+// ReplyTimeout までに応答がない場合は、504 Gateway Timeout のレスポンスを返します。
+func (t *Transport) waitReply(req *http.Request, msg *simplemq.Message, id string, ch chan string) (*http.Response, error) {
+	defer t.replies.unregister(id)
+	ctx, cancel := context.WithTimeout(req.Context(), t.replyTimeout())
+	defer cancel()
+	for {
+		select {
+		case content := <-ch:
+			return t.replyResponse(req, msg, content)
+		default:
+		}
+		msgs, err := t.ReplyQueue.ReceiveMessagesWithOptions(ctx, simplemq.ReceiveOptions{WaitSeconds: 1})
+		if err == nil && len(msgs) > 0 {
+			t.dispatchReplies(msgs)
+			continue
+		}
+		if err != nil && ctx.Err() == nil {
+			t.logger().Warn("failed to receive reply", "err", err, "queue", t.ReplyQueue.Queue)
+		}
+		timer := time.NewTimer(replyPollInterval)
+		select {
+		case content := <-ch:
+			timer.Stop()
+			return t.replyResponse(req, msg, content)
+		case <-ctx.Done():
+			timer.Stop()
+			if err := req.Context().Err(); err != nil {
+				return nil, err
+			}
+			t.logger().Warn("timed out waiting for reply", "message_id", msg.ID, "queue", t.client.Queue, "correlation_id", id)
+			resp, err := t.response(req, msg, &simplemq.APIError{
+				Code:    http.StatusGatewayTimeout,
+				Message: fmt.Sprintf("no reply for message %s within %s", msg.ID, t.replyTimeout()),
+			})
+			if err != nil {
+				return nil, err
+			}
+			resp.Header.Set(t.header("Message-ID"), msg.ID)
+			return resp, nil
+		case <-timer.C:
+		}
+	}
+}
+
+// dispatchReplies は、受信した応答を相関 ID が一致するリクエストに渡し、応答キューから削除します。
+// 待っているリクエストのない応答は、タイムアウトした後に届いたものとして破棄します。
+func (t *Transport) dispatchReplies(msgs []simplemq.Message) {
+	for _, m := range msgs {
+		attributes, content := decodeAttributes(m.Content)
+		id := attributes.Get(CorrelationIDHeader)
+		if !t.replies.deliver(id, content) {
+			t.logger().Debug("discard reply without waiting request", "message_id", m.ID, "queue", t.ReplyQueue.Queue, "correlation_id", id)
+		}
+		if err := t.ReplyQueue.DeleteMessage(context.Background(), m.ID); err != nil {
+			t.logger().Warn("failed to delete reply", "err", err, "message_id", m.ID, "queue", t.ReplyQueue.Queue)
+		}
+	}
+}
+
+// replyResponse は、応答の内容から Listener 側で処理した結果のレスポンスを復元します。
+func (t *Transport) replyResponse(req *http.Request, msg *simplemq.Message, content string) (*http.Response, error) {
+	resp, err := (&ResponseSerializer{}).Deserialize(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to deserialize reply: %w", err)
+	}
+	resp.Request = req
+	resp.Header.Set(t.header("Queue-Name"), t.client.Queue)
+	resp.Header.Set(t.header("Message-ID"), msg.ID)
+	return resp, nil
+}
+
+// ReplyResponseHandler は、Transport.ReplyQueue で応答を待っているリクエストに処理結果のレスポンスを返す ResponseHandler 実装です。
+// リクエストに CorrelationIDHeader がある場合、レスポンスをシリアライズして相関 ID とともに応答キューに送信します。
+// CorrelationIDHeader のないリクエストの場合は何もしません。
+type ReplyResponseHandler struct {
+	// Client は、応答キューのクライアントです。Transport.ReplyQueue と同じキューを指定してください。
+	Client *simplemq.Client
+}
+
+var _ ResponseHandler = &ReplyResponseHandler{}
+
+// HandleResponse は、レスポンスを応答キューに送信します。
+func (h *ReplyResponseHandler) HandleResponse(resp *http.Response, req *http.Request) (Disposition, error) {
+	id := req.Header.Get(CorrelationIDHeader)
+	if id == "" {
+		return DefaultDisposition, nil
+	}
+	content, err := (&ResponseSerializer{}).Serialize(resp)
+	if err != nil {
+		return DefaultDisposition, fmt.Errorf("failed to serialize response: %w", err)
+	}
+	attributes := http.Header{}
+	attributes.Set(CorrelationIDHeader, id)
+	content, err = encodeAttributes(attributes, content)
+	if err != nil {
+		return DefaultDisposition, err
+	}
+	if len(content) > maxMessageSize {
+		return DefaultDisposition, fmt.Errorf("failed to serialize response: %w", ErrTooLarge)
+	}
+	if _, err := h.Client.SendMessage(context.Background(), content); err != nil {
+		return DefaultDisposition, fmt.Errorf("failed to send reply: %w", err)
+	}
+	return DefaultDisposition, nil
+}
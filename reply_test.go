@@ -0,0 +1,84 @@
+package simplemqhttp
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+	"github.com/mashiike/simplemqhttp/stub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransportReplyQueue(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "request-queue")
+	client.Endpoint = stubServer.URL()
+	replyClient := client.Clone("reply-queue")
+
+	transport := NewTransportWithClient(client)
+	transport.ReplyQueue = replyClient
+	transport.ReplyTimeout = 5 * time.Second
+
+	// 処理結果を応答キューに送信するリスナー
+	listener := NewListenerWithClient(client)
+	listener.PollInterval = 10 * time.Millisecond
+	listener.ResponseHandler = &ReplyResponseHandler{Client: replyClient}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("X-Correlation", r.Header.Get(CorrelationIDHeader))
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("processed: " + string(body)))
+		}),
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	t.Run("Reply", func(t *testing.T) {
+		// 同時に送信したリクエストに、それぞれのリクエストの処理結果が返ること
+		var wg sync.WaitGroup
+		for _, body := range []string{"a", "b", "c"} {
+			wg.Add(1)
+			go func(body string) {
+				defer wg.Done()
+				req, err := http.NewRequest("POST", "/test", strings.NewReader(body))
+				require.NoError(t, err)
+				resp, err := transport.RoundTrip(req)
+				require.NoError(t, err)
+				defer resp.Body.Close()
+				assert.Equal(t, http.StatusCreated, resp.StatusCode)
+				assert.NotEmpty(t, resp.Header.Get("X-Correlation"))
+				assert.NotEmpty(t, resp.Header.Get("SimpleMQ-Message-ID"))
+				bs, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.Equal(t, "processed: "+body, string(bs))
+			}(body)
+		}
+		wg.Wait()
+		assert.Equal(t, 0, stubServer.GetQueueSize("reply-queue"))
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		// 応答がない場合は 504 Gateway Timeout が返ること
+		noReply := NewTransportWithClient(client.Clone("no-listener-queue"))
+		noReply.ReplyQueue = client.Clone("no-reply-queue")
+		noReply.ReplyTimeout = 200 * time.Millisecond
+		req, err := http.NewRequest("POST", "/test", strings.NewReader("timeout"))
+		require.NoError(t, err)
+		resp, err := noReply.RoundTrip(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get("SimpleMQ-Message-ID"))
+		assert.Equal(t, 1, stubServer.GetQueueSize("no-listener-queue"))
+	})
+}
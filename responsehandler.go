@@ -0,0 +1,91 @@
+package simplemqhttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// decompressResponse は、resp が Content-Encoding: gzip の場合に、ボディを展開して読み込めるようにします。
+// http.Transport と同様に、Content-Encoding と Content-Length ヘッダーを削除し、resp.Uncompressed を true にします。
+func decompressResponse(resp *http.Response) {
+	if resp.Body == nil || !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return
+	}
+	resp.Body = &gzipReader{body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+}
+
+// gzipReader は、最初の Read で gzip.Reader を作成し、ボディを展開しながら読み込みます。
+// gzip のヘッダーが不正な場合は、Read でエラーを返します。
+type gzipReader struct {
+	body io.ReadCloser
+	zr   *gzip.Reader
+	err  error
+}
+
+func (g *gzipReader) Read(p []byte) (int, error) {
+	if g.zr == nil && g.err == nil {
+		g.zr, g.err = gzip.NewReader(g.body)
+	}
+	if g.err != nil {
+		return 0, g.err
+	}
+	return g.zr.Read(p)
+}
+
+func (g *gzipReader) Close() error {
+	return g.body.Close()
+}
+
+// multiResponseHandler は、複数の ResponseHandler を順に呼び出す ResponseHandler 実装です。
+type multiResponseHandler []ResponseHandler
+
+// MultiResponseHandler は、handlers を指定した順にすべて呼び出す ResponseHandler を返します。
+// メトリクスの記録や監査ログなど、独立した複数の処理をレスポンスごとに行う場合に使用します。
+//
+// 各ハンドラーには、同じ内容を最初から読めるボディを持つレスポンスのコピーが渡されます。
+// Disposition は、DefaultDisposition 以外を返した最初のハンドラーのものが採用されます。
+// そのため、メッセージの扱いを決めるハンドラーは先に指定してください。
+// いずれかのハンドラーがエラーを返した場合も残りのハンドラーは呼び出され、エラーはすべてまとめて返されます。
+// nil のハンドラーは無視されます。
+func MultiResponseHandler(handlers ...ResponseHandler) ResponseHandler {
+	return multiResponseHandler(handlers)
+}
+
+// HandleResponse は、各ハンドラーを順に呼び出します。
+func (m multiResponseHandler) HandleResponse(resp *http.Response, req *http.Request) (Disposition, error) {
+	var body []byte
+	if resp.Body != nil {
+		var err error
+		body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return DefaultDisposition, err
+		}
+	}
+	disposition := DefaultDisposition
+	var errs []error
+	for _, h := range m {
+		if h == nil {
+			continue
+		}
+		copied := *resp
+		copied.Body = io.NopCloser(bytes.NewReader(body))
+		d, err := h.HandleResponse(&copied, req)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if disposition == DefaultDisposition {
+			disposition = d
+		}
+	}
+	return disposition, errors.Join(errs...)
+}
@@ -0,0 +1,137 @@
+package simplemqhttp
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+	"github.com/mashiike/simplemqhttp/stub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiResponseHandler(t *testing.T) {
+	newResponse := func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("response body")),
+		}
+	}
+	req, err := http.NewRequest("POST", "/", nil)
+	require.NoError(t, err)
+
+	// 各ハンドラーが順に呼び出され、それぞれボディを最初から読めること
+	var calls []string
+	recorder := func(name string, d Disposition, err error) ResponseHandler {
+		return responseHandlerFunc(func(resp *http.Response, _ *http.Request) (Disposition, error) {
+			body, readErr := io.ReadAll(resp.Body)
+			require.NoError(t, readErr)
+			calls = append(calls, name+":"+string(body))
+			return d, err
+		})
+	}
+
+	t.Run("First non-default disposition wins", func(t *testing.T) {
+		calls = nil
+		h := MultiResponseHandler(
+			recorder("metrics", DefaultDisposition, nil),
+			nil,
+			recorder("audit", RetryMessage, nil),
+			recorder("alert", AckMessage, nil),
+		)
+		disposition, err := h.HandleResponse(newResponse(), req)
+		require.NoError(t, err)
+		assert.Equal(t, RetryMessage, disposition)
+		assert.Equal(t, []string{"metrics:response body", "audit:response body", "alert:response body"}, calls)
+	})
+
+	t.Run("Errors are aggregated", func(t *testing.T) {
+		calls = nil
+		errAudit := errors.New("audit failed")
+		errAlert := errors.New("alert failed")
+		h := MultiResponseHandler(
+			recorder("audit", AckMessage, errAudit),
+			recorder("metrics", DefaultDisposition, nil),
+			recorder("alert", DeadLetterMessage, errAlert),
+		)
+		_, err := h.HandleResponse(newResponse(), req)
+		require.Error(t, err)
+		// エラーを返したハンドラーの後のハンドラーも呼び出されること
+		assert.Len(t, calls, 3)
+		assert.ErrorIs(t, err, errAudit)
+		assert.ErrorIs(t, err, errAlert)
+	})
+}
+
+func TestResponseHandlerGzip(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	type result struct {
+		body            string
+		contentEncoding string
+		uncompressed    bool
+	}
+	resultCh := make(chan result, 1)
+	listener := NewListenerWithOptions(client,
+		WithPollInterval(10*time.Millisecond),
+		WithResponseHandler(responseHandlerFunc(func(resp *http.Response, req *http.Request) (Disposition, error) {
+			bs, err := io.ReadAll(resp.Body)
+			if err != nil {
+				return DefaultDisposition, err
+			}
+			resultCh <- result{
+				body:            string(bs),
+				contentEncoding: resp.Header.Get("Content-Encoding"),
+				uncompressed:    resp.Uncompressed,
+			}
+			return DefaultDisposition, nil
+		})),
+	)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// gzip で圧縮したボディを返すハンドラー
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WriteHeader(http.StatusOK)
+			zw := gzip.NewWriter(w)
+			zw.Write([]byte("plain response"))
+			zw.Close()
+		}),
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	msg := stubServer.AddMessage("test-queue", "aGVsbG8=")
+	select {
+	case res := <-resultCh:
+		// ResponseHandler は展開されたボディを読めること
+		assert.Equal(t, "plain response", res.body)
+		assert.Empty(t, res.contentEncoding)
+		assert.True(t, res.uncompressed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("response handler should be called")
+	}
+	assert.True(t, stubServer.WaitForDeletion("test-queue", msg.ID, 5*time.Second))
+
+	t.Run("Invalid gzip", func(t *testing.T) {
+		// gzip として不正なボディは、読み込み時にエラーになること
+		resp := &http.Response{
+			Header: http.Header{"Content-Encoding": []string{"gzip"}},
+			Body:   io.NopCloser(strings.NewReader("this is not gzip data")),
+		}
+		decompressResponse(resp)
+		_, err := io.ReadAll(resp.Body)
+		assert.ErrorIs(t, err, gzip.ErrHeader)
+	})
+}
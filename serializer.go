@@ -1,10 +1,16 @@
 package simplemqhttp
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
 )
 
@@ -17,47 +23,662 @@ type Serializer interface {
 
 type BodyOnlySerializer struct {
 	NoBase64 bool
+	// MaxContentSize は、シリアライズ後のメッセージ内容の最大サイズです。
+	// base64 エンコードする場合は、エンコード後の長さに対して適用されます。
+	// 0 の場合は、SimpleMQ の上限である 256KB が使用されます。
+	MaxContentSize int
+	// PreservePath が true の場合は、HTTP のリクエスト行と同様に "<METHOD> <リクエスト URI>" の1行をボディの前に付加し、
+	// Deserialize でメソッド、パス、クエリ文字列を復元します。ヘッダーは保持されません。
+	// リクエスト行のないメッセージは、PreservePath が false の場合と同様に POST / として復元されます。
+	PreservePath bool
+	// ContentType を指定した場合、Deserialize で復元したリクエストに Content-Type ヘッダーとして設定します。
+	// ボディのみのメッセージには Content-Type が含まれないため、ハンドラーが Content-Type でボディの形式を判別する場合に、
+	// Listener 側で送信側と同じ値を指定します。リクエストごとに異なる Content-Type は保持できません。
+	ContentType string
 }
 
 var ErrTooLarge = errors.New("body too large")
 
+// maxMessageSize は、SimpleMQ のメッセージ内容の最大サイズです。
+const maxMessageSize = 256 * 1024
+
+// sizeLimitedSerializer は、MaxContentSize でメッセージ内容の最大サイズを指定できるシリアライザです。
+type sizeLimitedSerializer interface {
+	maxContentSize() int
+}
+
+// contentSizeLimit は、s がシリアライズするメッセージ内容の最大サイズを返します。
+// s が上限を指定できない場合や、上限が SimpleMQ の上限を超える場合は、SimpleMQ の上限を返します。
+func contentSizeLimit(s Serializer) int {
+	if l, ok := s.(sizeLimitedSerializer); ok {
+		return min(l.maxContentSize(), maxMessageSize)
+	}
+	return maxMessageSize
+}
+
+func (s *BodyOnlySerializer) maxContentSize() int {
+	if s.MaxContentSize > 0 {
+		return s.MaxContentSize
+	}
+	return maxMessageSize
+}
+
 func (s *BodyOnlySerializer) Serialize(req *http.Request) (string, error) {
 	if req == nil {
 		return "", errors.New("request is nil")
 	}
-	if req.Body == nil {
+	var prefix string
+	if s.PreservePath {
+		prefix = requestLine(req)
+	} else if req.Body == nil {
 		return "", nil
 	}
-	bs, err := io.ReadAll(req.Body)
-	if err != nil {
-		return "", err
+	if req.Body != nil {
+		defer req.Body.Close()
 	}
-	req.Body.Close()
-
-	if s.NoBase64 {
-		// over 256KB
-		if len(bs) > 256*1024 {
+	// 上限を超えるボディは全体を読み込む前に打ち切る
+	maxSize := s.maxContentSize()
+	limit := maxSize
+	if !s.NoBase64 {
+		limit = base64.StdEncoding.DecodedLen(maxSize)
+	}
+	limit -= len(prefix)
+	if limit < 0 {
+		return "", ErrTooLarge
+	}
+	// Content-Length が分かっている場合は、読み込まずにエラーにする
+	if req.ContentLength > int64(limit) {
+		return "", ErrTooLarge
+	}
+	var bs []byte
+	if req.Body != nil {
+		var err error
+		bs, err = io.ReadAll(io.LimitReader(req.Body, int64(limit)+1))
+		if err != nil {
+			return "", err
+		}
+		if len(bs) > limit {
 			return "", ErrTooLarge
 		}
+	}
+	bs = append([]byte(prefix), bs...)
+
+	if s.NoBase64 {
 		return string(bs), nil
 	}
 	encoded := base64.StdEncoding.EncodeToString(bs)
-	if len(encoded) > 256*1024 {
+	if len(encoded) > maxSize {
 		return "", ErrTooLarge
 	}
 	return encoded, nil
 }
 
+// Deserialize は、メッセージの内容をボディとする POST リクエストを返します。
+// NoBase64 が true の場合は、内容が base64 として有効であってもデコードせず、そのままボディとします。
+// NoBase64 が false の場合は base64 としてデコードし、デコードできない内容はそのままボディとします。
+// PreservePath が true で、内容がリクエスト行で始まる場合は、そのメソッドとリクエスト URI のリクエストを返します。
+// ContentType が指定されている場合は、その値を Content-Type ヘッダーに設定します。
 func (s *BodyOnlySerializer) Deserialize(content string) (*http.Request, error) {
+	if err := rejectFormatMarker(content); err != nil {
+		return nil, err
+	}
 	if !s.NoBase64 {
 		decoded, err := base64.StdEncoding.DecodeString(content)
 		if err == nil {
 			content = string(decoded)
 		}
 	}
-	req, err := http.NewRequest(http.MethodPost, "/", strings.NewReader(content))
+	method, target := http.MethodPost, "/"
+	if s.PreservePath {
+		if m, uri, body, ok := parseRequestLine(content); ok {
+			method, target, content = m, uri, body
+		}
+	}
+	req, err := http.NewRequest(method, target, strings.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	if s.ContentType != "" {
+		req.Header.Set("Content-Type", s.ContentType)
+	}
+	return req, nil
+}
+
+// requestLine は、req のメソッドとリクエスト URI を "<METHOD> <リクエスト URI>\n" の形式で返します。
+func requestLine(req *http.Request) string {
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	uri := "/"
+	if req.URL != nil {
+		uri = req.URL.RequestURI()
+	}
+	return method + " " + uri + "\n"
+}
+
+// parseRequestLine は、content の先頭のリクエスト行を解析し、メソッド、リクエスト URI、残りのボディを返します。
+// 先頭の行がリクエスト行でない場合は ok に false を返します。
+func parseRequestLine(content string) (method, uri, body string, ok bool) {
+	line, body, found := strings.Cut(content, "\n")
+	if !found {
+		return "", "", "", false
+	}
+	method, uri, found = strings.Cut(line, " ")
+	if !found || !validMethod(method) || !strings.HasPrefix(uri, "/") || strings.ContainsAny(uri, " \r") {
+		return "", "", "", false
+	}
+	if _, err := url.ParseRequestURI(uri); err != nil {
+		return "", "", "", false
+	}
+	return method, uri, body, true
+}
+
+// methodPrefix は、MethodPreservingSerializer がメッセージの先頭に付与するメソッドの識別子の接頭辞です。
+// 形式は "simplemqhttp-method:<METHOD>\n<body>" です。
+const methodPrefix = "simplemqhttp-method:"
+
+// MethodPreservingSerializer は、BodyOnlySerializer のボディに加えて HTTP メソッドを保持するシリアライザです。
+// メッセージは "simplemqhttp-method:<METHOD>\n<body>" の形式でエンコードされるため、ボディのない GET リクエストも GET として復元されます。
+// 識別子のないメッセージは BodyOnlySerializer と同様に POST として復元します。
+// NoBase64 が false の場合は、以前の "<METHOD> <base64 エンコードしたボディ>" の形式のメッセージも復元します。
+// NoBase64 が true の場合、以前の形式は "POST hello" のような生のボディと区別できないため、ボディとして扱います。
+type MethodPreservingSerializer struct {
+	NoBase64 bool
+	// MaxContentSize は、メソッドの識別子を含めたシリアライズ後のメッセージ内容の最大サイズです。
+	// 0 の場合は、SimpleMQ の上限である 256KB が使用されます。
+	MaxContentSize int
+}
+
+func (s *MethodPreservingSerializer) maxContentSize() int {
+	if s.MaxContentSize > 0 {
+		return s.MaxContentSize
+	}
+	return maxMessageSize
+}
+
+func (s *MethodPreservingSerializer) body() *BodyOnlySerializer {
+	return &BodyOnlySerializer{NoBase64: s.NoBase64}
+}
+
+func (s *MethodPreservingSerializer) Serialize(req *http.Request) (string, error) {
+	if req == nil {
+		return "", errors.New("request is nil")
+	}
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	prefix := methodPrefix + method + "\n"
+	maxSize := s.maxContentSize()
+	if len(prefix) >= maxSize {
+		return "", ErrTooLarge
+	}
+	// 識別子の分を除いた大きさで、上限を超えるボディを全体を読み込む前に打ち切る
+	body := s.body()
+	body.MaxContentSize = maxSize - len(prefix)
+	content, err := body.Serialize(req)
+	if err != nil {
+		return "", err
+	}
+	content = prefix + content
+	if len(content) > maxSize {
+		return "", ErrTooLarge
+	}
+	return content, nil
+}
+
+func (s *MethodPreservingSerializer) Deserialize(content string) (*http.Request, error) {
+	if err := rejectFormatMarker(content); err != nil {
+		return nil, err
+	}
+	method, body, ok := s.cutMethod(content)
+	if !ok {
+		// 識別子のないメッセージは BodyOnlySerializer と同様に扱う
+		return s.body().Deserialize(content)
+	}
+	req, err := s.body().Deserialize(body)
+	if err != nil {
+		return nil, err
+	}
+	req.Method = method
+	return req, nil
+}
+
+// cutMethod は、content の先頭のメソッドの識別子を取り除き、メソッドと残りのボディを返します。
+// NoBase64 が false の場合は、ボディが base64 として有効な以前の "<METHOD> <body>" の形式も受け付けます。
+func (s *MethodPreservingSerializer) cutMethod(content string) (method, body string, ok bool) {
+	if rest, found := strings.CutPrefix(content, methodPrefix); found {
+		method, body, ok = strings.Cut(rest, "\n")
+		return method, body, ok && validMethod(method)
+	}
+	if s.NoBase64 {
+		return "", "", false
+	}
+	method, body, ok = strings.Cut(content, " ")
+	if !ok || !validMethod(method) {
+		return "", "", false
+	}
+	if _, err := base64.StdEncoding.DecodeString(body); err != nil {
+		return "", "", false
+	}
+	return method, body, true
+}
+
+func validMethod(method string) bool {
+	if method == "" {
+		return false
+	}
+	for _, r := range method {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// EnvelopeVersion は、EnvelopeSerializer が出力するエンベロープの形式のバージョンです。
+const EnvelopeVersion = 1
+
+// EnvelopeSerializer は、ボディに加えて指定したリクエストヘッダーとトレーラーを JSON のエンベロープに格納するシリアライザです。
+//
+// エンベロープの形式は次のとおりです。
+//
+//	{"version":1,"headers":{"Set-Cookie":["a=1","b=2"]},"trailers":{"X-Checksum":["..."]},"body":"<base64 encoded body>"}
+//
+// headers と trailers は値の配列を持つオブジェクトで、同じ名前のヘッダーが複数ある場合もすべての値を順に保持します。
+// trailers は、ボディを読み終えた時点の Request.Trailer の値です。空の場合は省略されます。
+// client は、IncludeClientInfo が true の場合に格納される {"host":"...","real_ip":"...","remote_addr":"..."} 形式の呼び出し元の情報です。
+// attributes は、Transport が送信するメッセージ属性で、headers と同じ形式です。属性がない場合は省略されます。
+//
+// version は形式のバージョンで、以前の Deserialize で読めなくなる変更をする場合に増やします。
+// trailers のような省略可能なフィールドは、バージョンを変えずに追加します。以前の Deserialize はこれを無視します。
+// Deserialize は、エンベロープでない内容を BodyOnlySerializer と同様に扱い、未対応のバージョンの場合はエラーを返します。
+type EnvelopeSerializer struct {
+	// HeaderAllowlist は、エンベロープに格納するリクエストヘッダーとトレーラーの一覧です。
+	HeaderAllowlist []string
+	// IncludeClientInfo が true の場合、元のリクエストのホスト、X-Real-IP ヘッダー、RemoteAddr をエンベロープの client に格納します。
+	// Deserialize は、これらをそれぞれ X-Forwarded-Host、X-Real-IP、X-Forwarded-For ヘッダーとして復元します。
+	// 監査ログなどで元の呼び出し元を参照するための参考情報で、送信側が自由に設定できるため、認証や認可の判断には使用しないでください。
+	IncludeClientInfo bool
+}
+
+type envelope struct {
+	Version    int             `json:"version"`
+	Headers    http.Header     `json:"headers,omitempty"`
+	Trailers   http.Header     `json:"trailers,omitempty"`
+	Client     *envelopeClient `json:"client,omitempty"`
+	Attributes http.Header     `json:"attributes,omitempty"`
+	Body       string          `json:"body"`
+}
+
+// envelopeClient は、エンベロープに格納する元のリクエストの呼び出し元の情報です。
+type envelopeClient struct {
+	Host       string `json:"host,omitempty"`
+	RealIP     string `json:"real_ip,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+}
+
+// clientInfo は、リクエストの呼び出し元の情報を返します。情報がない場合は nil を返します。
+func clientInfo(req *http.Request) *envelopeClient {
+	client := envelopeClient{
+		Host:       req.Host,
+		RealIP:     req.Header.Get("X-Real-IP"),
+		RemoteAddr: req.RemoteAddr,
+	}
+	if client.Host == "" && req.URL != nil {
+		client.Host = req.URL.Host
+	}
+	if client == (envelopeClient{}) {
+		return nil
+	}
+	return &client
+}
+
+// setClientHeaders は、呼び出し元の情報をリクエストヘッダーとして復元します。
+func setClientHeaders(req *http.Request, client *envelopeClient) {
+	if client.Host != "" {
+		req.Header.Set("X-Forwarded-Host", client.Host)
+	}
+	if client.RealIP != "" {
+		req.Header.Set("X-Real-IP", client.RealIP)
+	}
+	if client.RemoteAddr != "" {
+		ip := client.RemoteAddr
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		req.Header.Add("X-Forwarded-For", ip)
+	}
+}
+
+func (s *EnvelopeSerializer) Serialize(req *http.Request) (string, error) {
+	return s.serializeWithAttributes(req, nil)
+}
+
+// serializeWithAttributes は、メッセージ属性をエンベロープの attributes に格納してシリアライズします。
+func (s *EnvelopeSerializer) serializeWithAttributes(req *http.Request, attributes http.Header) (string, error) {
+	if req == nil {
+		return "", errors.New("request is nil")
+	}
+	body, err := (&BodyOnlySerializer{}).Serialize(req)
+	if err != nil {
+		return "", err
+	}
+	env := envelope{
+		Version: EnvelopeVersion,
+		Body:    body,
+	}
+	if headers := allowlistedHeaders(req.Header, s.HeaderAllowlist); len(headers) > 0 {
+		env.Headers = headers
+	}
+	// トレーラーはボディを読み終えた後に値が設定されるため、ボディのシリアライズの後に取り出す
+	if trailers := allowlistedHeaders(req.Trailer, s.HeaderAllowlist); len(trailers) > 0 {
+		for key, values := range trailers {
+			if len(values) == 0 {
+				delete(trailers, key)
+			}
+		}
+		if len(trailers) > 0 {
+			env.Trailers = trailers
+		}
+	}
+	if s.IncludeClientInfo {
+		env.Client = clientInfo(req)
+	}
+	if len(attributes) > 0 {
+		env.Attributes = attributes
+	}
+	bs, err := json.Marshal(env)
+	if err != nil {
+		return "", err
+	}
+	if len(bs) > maxMessageSize {
+		return "", ErrTooLarge
+	}
+	return string(bs), nil
+}
+
+func (s *EnvelopeSerializer) Deserialize(content string) (*http.Request, error) {
+	req, _, err := s.deserializeWithAttributes(content)
+	return req, err
+}
+
+// deserializeWithAttributes は、エンベロープからリクエストとメッセージ属性を復元します。
+// 属性をエンベロープに格納する前に、内容の先頭に属性を埋め込んで送信されたメッセージも復元します。
+func (s *EnvelopeSerializer) deserializeWithAttributes(content string) (*http.Request, http.Header, error) {
+	attributes, content := decodeAttributes(content)
+	var env envelope
+	if err := json.Unmarshal([]byte(content), &env); err != nil || env.Version == 0 {
+		// エンベロープのないメッセージは BodyOnlySerializer と同様に扱う
+		req, err := (&BodyOnlySerializer{}).Deserialize(content)
+		return req, attributes, err
+	}
+	if env.Version > EnvelopeVersion {
+		return nil, nil, fmt.Errorf("unsupported envelope version: %d", env.Version)
+	}
+	body, err := base64.StdEncoding.DecodeString(env.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode envelope body: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for key, values := range env.Headers {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if env.Client != nil {
+		setClientHeaders(req, env.Client)
+	}
+	if len(env.Trailers) > 0 {
+		// Request.Write がトレーラーを書き出すよう、チャンク転送のリクエストとして復元する
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+		req.Trailer = http.Header{}
+		for key, values := range env.Trailers {
+			for _, value := range values {
+				req.Trailer.Add(key, value)
+			}
+		}
+	}
+	return req, mergeAttributes(attributes, env.Attributes), nil
+}
+
+// JSONSerializerVersion は、JSONSerializer が出力する JSON の形式のバージョンです。
+const JSONSerializerVersion = 1
+
+// JSONSerializer は、リクエストのメソッド、パス、クエリ、ヘッダー、ボディを構造化された JSON としてエンコードするシリアライザです。
+// Go 以外の言語で書かれたワーカーからもメッセージを読めるよう、形式は次のとおり固定されています。
+//
+//	{
+//	  "v": 1,
+//	  "method": "POST",
+//	  "path": "/orders",
+//	  "query": {"page": ["1"]},
+//	  "headers": {"Content-Type": ["application/json"]},
+//	  "attributes": {"Simplemq-Source": ["worker-1"]},
+//	  "body_base64": "<base64 encoded body>"
+//	}
+//
+// query と headers は、値の配列を持つオブジェクトです。空の場合は省略されます。
+// attributes は、Transport が送信するメッセージ属性で、headers と同じ形式です。属性がない場合は省略されます。
+// v は形式のバージョンで、Deserialize は JSONSerializerVersion 以外のバージョンをエラーとして扱います。
+//
+// ボディはストリームから読み込みながら大きさを確認し、MaxContentSize に収まらないことが分かった時点で
+// 全体を読み込まずに ErrTooLarge を返します。チャンク転送などで Content-Length が不明なボディも同様です。
+type JSONSerializer struct {
+	// MaxContentSize は、シリアライズ後のメッセージ内容の最大サイズです。
+	// ボディは base64 エンコード後の長さがこの値を超える時点で読み込みを打ち切ります。
+	// 0 の場合は、SimpleMQ の上限である 256KB が使用されます。
+	MaxContentSize int
+}
+
+func (s *JSONSerializer) maxContentSize() int {
+	if s.MaxContentSize > 0 {
+		return s.MaxContentSize
+	}
+	return maxMessageSize
+}
+
+type jsonRequest struct {
+	Version    int                 `json:"v"`
+	Method     string              `json:"method"`
+	Path       string              `json:"path"`
+	Query      map[string][]string `json:"query,omitempty"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	Attributes map[string][]string `json:"attributes,omitempty"`
+	BodyBase64 string              `json:"body_base64"`
+}
+
+func (s *JSONSerializer) Serialize(req *http.Request) (string, error) {
+	return s.serializeWithAttributes(req, nil)
+}
+
+// serializeWithAttributes は、メッセージ属性を attributes に格納してシリアライズします。
+func (s *JSONSerializer) serializeWithAttributes(req *http.Request, attributes http.Header) (string, error) {
+	if req == nil {
+		return "", errors.New("request is nil")
+	}
+	body, err := (&BodyOnlySerializer{MaxContentSize: s.maxContentSize()}).Serialize(req)
+	if err != nil {
+		return "", err
+	}
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	r := jsonRequest{
+		Version:    JSONSerializerVersion,
+		Method:     method,
+		Path:       "/",
+		BodyBase64: body,
+	}
+	if req.URL != nil {
+		if req.URL.Path != "" {
+			r.Path = req.URL.Path
+		}
+		if query := req.URL.Query(); len(query) > 0 {
+			r.Query = query
+		}
+	}
+	if len(req.Header) > 0 {
+		r.Headers = req.Header
+	}
+	if len(attributes) > 0 {
+		r.Attributes = attributes
+	}
+	bs, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	if len(bs) > s.maxContentSize() {
+		return "", ErrTooLarge
+	}
+	return string(bs), nil
+}
+
+func (s *JSONSerializer) Deserialize(content string) (*http.Request, error) {
+	req, _, err := s.deserializeWithAttributes(content)
+	return req, err
+}
+
+// deserializeWithAttributes は、JSON からリクエストとメッセージ属性を復元します。
+// 属性を attributes に格納する前に、内容の先頭に属性を埋め込んで送信されたメッセージも復元します。
+func (s *JSONSerializer) deserializeWithAttributes(content string) (*http.Request, http.Header, error) {
+	if err := rejectFormatMarker(content); err != nil {
+		return nil, nil, err
+	}
+	attributes, content := decodeAttributes(content)
+	var r jsonRequest
+	if err := json.Unmarshal([]byte(content), &r); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode JSON request: %w", err)
+	}
+	if r.Version != JSONSerializerVersion {
+		return nil, nil, fmt.Errorf("unsupported JSON request version: %d", r.Version)
+	}
+	if !validMethod(r.Method) {
+		return nil, nil, fmt.Errorf("invalid method: %q", r.Method)
+	}
+	body, err := base64.StdEncoding.DecodeString(r.BodyBase64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode request body: %w", err)
+	}
+	u := &url.URL{Path: r.Path, RawQuery: url.Values(r.Query).Encode()}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	req, err := http.NewRequest(r.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for key, values := range r.Headers {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	return req, mergeAttributes(attributes, r.Attributes), nil
+}
+
+// GobSerializer は、リクエストのメソッド、URL、ヘッダー、ボディを encoding/gob でエンコードし、base64 で包むシリアライザです。
+// 送信側と受信側がどちらも Go で書かれたサービス間で、メソッドや URL、ヘッダーを保持したままリクエストを受け渡せます。
+//
+// gob はメッセージごとに型の情報を含むため、BodyOnlySerializer と比べて、ヘッダーの大きさに加えて 200 バイト程度の固定のオーバーヘッドがあります。
+// リクエスト全体をダンプする場合と比べても小さくなるとは限らないため、メッセージの大きさが問題になる場合は BodyOnlySerializer を使用してください。
+//
+// コンテキストや TLS の状態など、シリアライズできないリクエストの情報は含まれません。
+// Go 以外の言語で書かれたワーカーとメッセージをやり取りする場合は、JSONSerializer を使用してください。
+type GobSerializer struct {
+	// MaxContentSize は、シリアライズ後のメッセージ内容の最大サイズです。
+	// 0 の場合は、SimpleMQ の上限である 256KB が使用されます。
+	MaxContentSize int
+}
+
+func (s *GobSerializer) maxContentSize() int {
+	if s.MaxContentSize > 0 {
+		return s.MaxContentSize
+	}
+	return maxMessageSize
+}
+
+type gobRequest struct {
+	Method string
+	URL    string
+	Header http.Header
+	Body   []byte
+}
+
+func (s *GobSerializer) Serialize(req *http.Request) (string, error) {
+	if req == nil {
+		return "", errors.New("request is nil")
+	}
+	maxSize := s.maxContentSize()
+	r := gobRequest{
+		Method: req.Method,
+		URL:    "/",
+		Header: req.Header,
+	}
+	if r.Method == "" {
+		r.Method = http.MethodGet
+	}
+	if req.URL != nil {
+		r.URL = req.URL.RequestURI()
+	}
+	if req.Body != nil {
+		defer req.Body.Close()
+		// 上限を超えるボディは全体を読み込む前に打ち切る
+		limit := base64.StdEncoding.DecodedLen(maxSize)
+		if req.ContentLength > int64(limit) {
+			return "", ErrTooLarge
+		}
+		bs, err := io.ReadAll(io.LimitReader(req.Body, int64(limit)+1))
+		if err != nil {
+			return "", err
+		}
+		if len(bs) > limit {
+			return "", ErrTooLarge
+		}
+		r.Body = bs
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(r); err != nil {
+		return "", fmt.Errorf("failed to encode gob request: %w", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(buf.Bytes())
+	if len(encoded) > maxSize {
+		return "", ErrTooLarge
+	}
+	return encoded, nil
+}
+
+func (s *GobSerializer) Deserialize(content string) (*http.Request, error) {
+	if err := rejectFormatMarker(content); err != nil {
+		return nil, err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode gob request: %w", err)
+	}
+	var r gobRequest
+	if err := gob.NewDecoder(bytes.NewReader(decoded)).Decode(&r); err != nil {
+		return nil, fmt.Errorf("failed to decode gob request: %w", err)
+	}
+	if !validMethod(r.Method) {
+		return nil, fmt.Errorf("invalid method: %q", r.Method)
+	}
+	if r.URL == "" {
+		r.URL = "/"
+	}
+	req, err := http.NewRequest(r.Method, r.URL, bytes.NewReader(r.Body))
 	if err != nil {
 		return nil, err
 	}
+	for key, values := range r.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
 	return req, nil
 }
@@ -2,11 +2,18 @@ package simplemqhttp
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/mashiike/simplemqhttp/simplemq"
+	"github.com/mashiike/simplemqhttp/stub"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -69,3 +76,553 @@ func TestBodyOnlySerializer(t *testing.T) {
 		assert.JSONEq(t, `{"name":"test item","price":100}`, string(body))
 	})
 }
+
+func TestMethodPreservingSerializer(t *testing.T) {
+	serializer := &MethodPreservingSerializer{}
+
+	t.Run("GET roundtrip without body", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "/api/users", nil)
+		require.NoError(t, err)
+
+		serialized, err := serializer.Serialize(req)
+		require.NoError(t, err)
+		assert.NotEmpty(t, serialized)
+
+		deserializedReq, err := serializer.Deserialize(serialized)
+		require.NoError(t, err)
+		assert.Equal(t, "GET", deserializedReq.Method)
+
+		body, err := io.ReadAll(deserializedReq.Body)
+		require.NoError(t, err)
+		assert.Empty(t, body)
+	})
+
+	t.Run("PUT roundtrip with body", func(t *testing.T) {
+		req, err := http.NewRequest("PUT", "/api/items", strings.NewReader(`{"name":"test item"}`))
+		require.NoError(t, err)
+
+		serialized, err := serializer.Serialize(req)
+		require.NoError(t, err)
+
+		deserializedReq, err := serializer.Deserialize(serialized)
+		require.NoError(t, err)
+		assert.Equal(t, "PUT", deserializedReq.Method)
+
+		body, err := io.ReadAll(deserializedReq.Body)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"name":"test item"}`, string(body))
+	})
+
+	t.Run("Roundtrip with repeated headers and trailers", func(t *testing.T) {
+		serializer := &EnvelopeSerializer{HeaderAllowlist: []string{"Set-Cookie", "X-Checksum"}}
+		src, err := http.NewRequest("POST", "/", strings.NewReader(`{"hello":"trailers"}`))
+		require.NoError(t, err)
+		src.Header.Add("Set-Cookie", "session=abc; Path=/")
+		src.Header.Add("Set-Cookie", "theme=dark; Path=/")
+		src.Trailer = http.Header{"X-Checksum": []string{"sha256=deadbeef"}, "X-Other": []string{"dropped"}}
+
+		content, err := serializer.Serialize(src)
+		require.NoError(t, err)
+		req, err := serializer.Deserialize(content)
+		require.NoError(t, err)
+
+		// 繰り返しのヘッダーはすべての値が順に復元されること
+		assert.Equal(t, []string{"session=abc; Path=/", "theme=dark; Path=/"}, req.Header.Values("Set-Cookie"))
+		// 許可したトレーラーが復元されること
+		assert.Equal(t, "sha256=deadbeef", req.Trailer.Get("X-Checksum"))
+		assert.Empty(t, req.Trailer.Get("X-Other"))
+	})
+
+	t.Run("Deserialize content without envelope", func(t *testing.T) {
+		serializer := &MethodPreservingSerializer{NoBase64: true}
+		req, err := serializer.Deserialize(`{"id":123}`)
+		require.NoError(t, err)
+		assert.Equal(t, "POST", req.Method)
+
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		assert.Equal(t, `{"id":123}`, string(body))
+	})
+
+	t.Run("Raw body starting with a method", func(t *testing.T) {
+		// メソッドの識別子のない生のボディは、メソッドで始まっていてもボディとして復元すること
+		serializer := &MethodPreservingSerializer{NoBase64: true}
+		req, err := serializer.Deserialize("DELETE hello")
+		require.NoError(t, err)
+		assert.Equal(t, "POST", req.Method)
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "DELETE hello", string(body))
+
+		// 同じ内容のボディも、識別子を付けて往復できること
+		src, err := http.NewRequest("PATCH", "/", strings.NewReader("DELETE hello"))
+		require.NoError(t, err)
+		content, err := serializer.Serialize(src)
+		require.NoError(t, err)
+		assert.Equal(t, "simplemqhttp-method:PATCH\nDELETE hello", content)
+		req, err = serializer.Deserialize(content)
+		require.NoError(t, err)
+		assert.Equal(t, "PATCH", req.Method)
+		body, err = io.ReadAll(req.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "DELETE hello", string(body))
+	})
+
+	t.Run("Deserialize previous format", func(t *testing.T) {
+		// 以前の "<METHOD> <base64 エンコードしたボディ>" の形式も復元すること
+		req, err := serializer.Deserialize("PUT " + base64.StdEncoding.EncodeToString([]byte("legacy")))
+		require.NoError(t, err)
+		assert.Equal(t, "PUT", req.Method)
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "legacy", string(body))
+	})
+
+	t.Run("MaxContentSize", func(t *testing.T) {
+		// メソッドの識別子を含めた大きさが MaxContentSize を超える場合は ErrTooLarge になること
+		serializer := &MethodPreservingSerializer{NoBase64: true, MaxContentSize: 64}
+		fits := strings.Repeat("a", 64-len("simplemqhttp-method:POST\n"))
+		src, err := http.NewRequest("POST", "/", strings.NewReader(fits))
+		require.NoError(t, err)
+		content, err := serializer.Serialize(src)
+		require.NoError(t, err)
+		assert.Len(t, content, 64)
+
+		src, err = http.NewRequest("POST", "/", strings.NewReader(fits+"a"))
+		require.NoError(t, err)
+		_, err = serializer.Serialize(src)
+		assert.ErrorIs(t, err, ErrTooLarge)
+		assert.Equal(t, 64, contentSizeLimit(serializer))
+	})
+}
+
+type countingReader struct {
+	r    io.Reader
+	read int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += n
+	return n, err
+}
+
+func TestBodyOnlySerializerFailFast(t *testing.T) {
+	const bodySize = 16 * 1024 * 1024
+	for _, noBase64 := range []bool{false, true} {
+		serializer := &BodyOnlySerializer{NoBase64: noBase64}
+		body := &countingReader{r: strings.NewReader(strings.Repeat("a", bodySize))}
+		req, err := http.NewRequest("POST", "/", body)
+		require.NoError(t, err)
+
+		_, err = serializer.Serialize(req)
+		assert.ErrorIs(t, err, ErrTooLarge)
+		// 上限を少し超えた時点で読み込みを打ち切っていること
+		assert.LessOrEqual(t, body.read, 256*1024+1, "NoBase64=%v", noBase64)
+	}
+}
+
+func TestJSONSerializerMaxContentSize(t *testing.T) {
+	const bodySize = 16 * 1024 * 1024
+	serializer := &JSONSerializer{MaxContentSize: 1024}
+
+	// Content-Length が不明なストリームのボディでも、上限を超えた時点で読み込みを打ち切ること
+	body := &countingReader{r: strings.NewReader(strings.Repeat("a", bodySize))}
+	req, err := http.NewRequest("POST", "/upload", io.NopCloser(body))
+	require.NoError(t, err)
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	_, err = serializer.Serialize(req)
+	assert.ErrorIs(t, err, ErrTooLarge)
+	assert.LessOrEqual(t, body.read, 1024)
+
+	// Content-Length が上限を超える場合は、ボディを読み込まないこと
+	body = &countingReader{r: strings.NewReader(strings.Repeat("a", bodySize))}
+	req, err = http.NewRequest("POST", "/upload", io.NopCloser(body))
+	require.NoError(t, err)
+	req.ContentLength = bodySize
+	_, err = serializer.Serialize(req)
+	assert.ErrorIs(t, err, ErrTooLarge)
+	assert.Zero(t, body.read)
+
+	// 上限に収まるリクエストはシリアライズできること
+	req, err = http.NewRequest("POST", "/upload", strings.NewReader("small"))
+	require.NoError(t, err)
+	content, err := serializer.Serialize(req)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, len(content), 1024)
+}
+
+func TestBodyOnlySerializerMaxContentSize(t *testing.T) {
+	serialize := func(s *BodyOnlySerializer, body string) (string, error) {
+		req, err := http.NewRequest("POST", "/", strings.NewReader(body))
+		require.NoError(t, err)
+		return s.Serialize(req)
+	}
+
+	t.Run("NoBase64", func(t *testing.T) {
+		serializer := &BodyOnlySerializer{NoBase64: true, MaxContentSize: 10}
+
+		// 上限ちょうどのボディはシリアライズできること
+		content, err := serialize(serializer, strings.Repeat("a", 10))
+		require.NoError(t, err)
+		assert.Len(t, content, 10)
+
+		// 上限を超えるボディはエラーになること
+		_, err = serialize(serializer, strings.Repeat("a", 11))
+		assert.ErrorIs(t, err, ErrTooLarge)
+	})
+
+	t.Run("Base64", func(t *testing.T) {
+		serializer := &BodyOnlySerializer{MaxContentSize: 12}
+
+		// エンコード後の長さが上限ちょうどのボディはシリアライズできること
+		content, err := serialize(serializer, strings.Repeat("a", 9))
+		require.NoError(t, err)
+		assert.Len(t, content, 12)
+
+		// エンコード後の長さが上限を超えるボディはエラーになること
+		_, err = serialize(serializer, strings.Repeat("a", 10))
+		assert.ErrorIs(t, err, ErrTooLarge)
+	})
+
+	t.Run("Zero uses default limit", func(t *testing.T) {
+		serializer := &BodyOnlySerializer{NoBase64: true}
+		_, err := serialize(serializer, strings.Repeat("a", 256*1024))
+		require.NoError(t, err)
+		_, err = serialize(serializer, strings.Repeat("a", 256*1024+1))
+		assert.ErrorIs(t, err, ErrTooLarge)
+	})
+}
+
+func TestBodyOnlySerializerNoBase64Roundtrip(t *testing.T) {
+	// 偶然 base64 として有効な生のボディ
+	const body = "dGVzdA=="
+	_, err := base64.StdEncoding.DecodeString(body)
+	require.NoError(t, err)
+
+	for _, serializer := range []Serializer{
+		&BodyOnlySerializer{NoBase64: true},
+		&MethodPreservingSerializer{NoBase64: true},
+	} {
+		src, err := http.NewRequest("POST", "/", strings.NewReader(body))
+		require.NoError(t, err)
+		content, err := serializer.Serialize(src)
+		require.NoError(t, err)
+
+		// NoBase64 の場合は base64 としてデコードせず、そのまま復元すること
+		req, err := serializer.Deserialize(content)
+		require.NoError(t, err)
+		bs, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		assert.Equal(t, body, string(bs), "%T", serializer)
+	}
+}
+
+func TestBodyOnlySerializerPreservePath(t *testing.T) {
+	for _, noBase64 := range []bool{false, true} {
+		serializer := &BodyOnlySerializer{NoBase64: noBase64, PreservePath: true}
+		t.Run(fmt.Sprintf("NoBase64=%v", noBase64), func(t *testing.T) {
+			// メソッド、パス、クエリ文字列が復元されること
+			req, err := http.NewRequest(http.MethodPut, "http://example.com/api/items/1?force=true&tag=a%20b", strings.NewReader("line1\nline2"))
+			require.NoError(t, err)
+			serialized, err := serializer.Serialize(req)
+			require.NoError(t, err)
+			restored, err := serializer.Deserialize(serialized)
+			require.NoError(t, err)
+			assert.Equal(t, http.MethodPut, restored.Method)
+			assert.Equal(t, "/api/items/1", restored.URL.Path)
+			assert.Equal(t, "force=true&tag=a%20b", restored.URL.RawQuery)
+			body, err := io.ReadAll(restored.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "line1\nline2", string(body))
+
+			// ボディのないリクエストもリクエスト行が保持されること
+			req, err = http.NewRequest(http.MethodGet, "/search?q=simplemq", nil)
+			require.NoError(t, err)
+			serialized, err = serializer.Serialize(req)
+			require.NoError(t, err)
+			restored, err = serializer.Deserialize(serialized)
+			require.NoError(t, err)
+			assert.Equal(t, http.MethodGet, restored.Method)
+			assert.Equal(t, "/search?q=simplemq", restored.URL.RequestURI())
+		})
+	}
+
+	t.Run("LegacyMessage", func(t *testing.T) {
+		// リクエスト行のない従来のメッセージは POST / として復元されること
+		serializer := &BodyOnlySerializer{PreservePath: true}
+		legacy, err := (&BodyOnlySerializer{}).Serialize(httptest.NewRequest(http.MethodPost, "/ignored", strings.NewReader(`{"id":1}`)))
+		require.NoError(t, err)
+		restored, err := serializer.Deserialize(legacy)
+		require.NoError(t, err)
+		assert.Equal(t, http.MethodPost, restored.Method)
+		assert.Equal(t, "/", restored.URL.Path)
+		body, err := io.ReadAll(restored.Body)
+		require.NoError(t, err)
+		assert.Equal(t, `{"id":1}`, string(body))
+	})
+
+	t.Run("MaxContentSize", func(t *testing.T) {
+		// リクエスト行も上限に含まれること
+		serializer := &BodyOnlySerializer{NoBase64: true, PreservePath: true, MaxContentSize: 16}
+		req, err := http.NewRequest(http.MethodPost, "/path", strings.NewReader("0123456789"))
+		require.NoError(t, err)
+		_, err = serializer.Serialize(req)
+		require.ErrorIs(t, err, ErrTooLarge)
+	})
+}
+
+func TestEnvelopeSerializer(t *testing.T) {
+	serializer := &EnvelopeSerializer{HeaderAllowlist: []string{"X-Trace-Id", "x-tenant-id"}}
+
+	t.Run("Roundtrip with allowlisted headers", func(t *testing.T) {
+		src, err := http.NewRequest("POST", "/", strings.NewReader(`{"hello":"envelope"}`))
+		require.NoError(t, err)
+		src.Header.Set("X-Trace-Id", "trace-1")
+		src.Header.Set("X-Tenant-Id", "tenant-a")
+		src.Header.Set("Authorization", "Bearer secret")
+
+		content, err := serializer.Serialize(src)
+		require.NoError(t, err)
+		// バージョン付きのエンベロープになっていること
+		var env map[string]any
+		require.NoError(t, json.Unmarshal([]byte(content), &env))
+		assert.EqualValues(t, EnvelopeVersion, env["version"])
+
+		req, err := serializer.Deserialize(content)
+		require.NoError(t, err)
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		assert.Equal(t, `{"hello":"envelope"}`, string(body))
+		assert.Equal(t, "trace-1", req.Header.Get("X-Trace-Id"))
+		assert.Equal(t, "tenant-a", req.Header.Get("X-Tenant-Id"))
+		// 許可していないヘッダーは含まれないこと
+		assert.Empty(t, req.Header.Get("Authorization"))
+	})
+
+	t.Run("Deserialize content without envelope", func(t *testing.T) {
+		req, err := serializer.Deserialize(base64.StdEncoding.EncodeToString([]byte(`{"legacy":true}`)))
+		require.NoError(t, err)
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		assert.Equal(t, `{"legacy":true}`, string(body))
+	})
+
+	t.Run("Client info", func(t *testing.T) {
+		newRequest := func() *http.Request {
+			req, err := http.NewRequest("POST", "http://api.example.com/orders", strings.NewReader(`{"client":"info"}`))
+			require.NoError(t, err)
+			req.Header.Set("X-Real-IP", "203.0.113.10")
+			req.RemoteAddr = "198.51.100.20:54321"
+			return req
+		}
+
+		// 既定では呼び出し元の情報を含まないこと
+		content, err := serializer.Serialize(newRequest())
+		require.NoError(t, err)
+		req, err := serializer.Deserialize(content)
+		require.NoError(t, err)
+		assert.Empty(t, req.Header.Get("X-Forwarded-Host"))
+		assert.Empty(t, req.Header.Get("X-Real-IP"))
+
+		// IncludeClientInfo を指定すると、呼び出し元の情報がヘッダーとして復元されること
+		withClient := &EnvelopeSerializer{IncludeClientInfo: true}
+		content, err = withClient.Serialize(newRequest())
+		require.NoError(t, err)
+		req, err = withClient.Deserialize(content)
+		require.NoError(t, err)
+		assert.Equal(t, "api.example.com", req.Header.Get("X-Forwarded-Host"))
+		assert.Equal(t, "203.0.113.10", req.Header.Get("X-Real-IP"))
+		assert.Equal(t, "198.51.100.20", req.Header.Get("X-Forwarded-For"))
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		assert.Equal(t, `{"client":"info"}`, string(body))
+	})
+
+	t.Run("Unsupported version", func(t *testing.T) {
+		_, err := serializer.Deserialize(`{"version":99,"body":""}`)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "unsupported envelope version")
+	})
+}
+
+func TestJSONSerializer(t *testing.T) {
+	serializer := &JSONSerializer{}
+
+	t.Run("Roundtrip", func(t *testing.T) {
+		src, err := http.NewRequest("PUT", "http://example.com/orders/1?page=2&tag=a&tag=b", strings.NewReader(`{"json":"serializer"}`))
+		require.NoError(t, err)
+		src.Header.Set("Content-Type", "application/json")
+		src.Header.Set("X-Trace-Id", "trace-1")
+
+		content, err := serializer.Serialize(src)
+		require.NoError(t, err)
+
+		// Go 以外からも読めるよう、文書化された形式で出力されること
+		var raw map[string]any
+		require.NoError(t, json.Unmarshal([]byte(content), &raw))
+		assert.EqualValues(t, 1, raw["v"])
+		assert.Equal(t, "PUT", raw["method"])
+		assert.Equal(t, "/orders/1", raw["path"])
+		assert.Equal(t, map[string]any{"page": []any{"2"}, "tag": []any{"a", "b"}}, raw["query"])
+		assert.Equal(t, base64.StdEncoding.EncodeToString([]byte(`{"json":"serializer"}`)), raw["body_base64"])
+
+		req, err := serializer.Deserialize(content)
+		require.NoError(t, err)
+		assert.Equal(t, "PUT", req.Method)
+		assert.Equal(t, "/orders/1", req.URL.Path)
+		assert.Equal(t, []string{"a", "b"}, req.URL.Query()["tag"])
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		assert.Equal(t, "trace-1", req.Header.Get("X-Trace-Id"))
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		assert.Equal(t, `{"json":"serializer"}`, string(body))
+	})
+
+	t.Run("Deserialize content written by other languages", func(t *testing.T) {
+		req, err := serializer.Deserialize(`{"v":1,"method":"GET","path":"/health","body_base64":""}`)
+		require.NoError(t, err)
+		assert.Equal(t, "GET", req.Method)
+		assert.Equal(t, "/health", req.URL.Path)
+	})
+
+	t.Run("Unknown version", func(t *testing.T) {
+		_, err := serializer.Deserialize(`{"v":2,"method":"GET","path":"/","body_base64":""}`)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "unsupported JSON request version")
+
+		_, err = serializer.Deserialize(`{"method":"GET","path":"/","body_base64":""}`)
+		require.Error(t, err)
+	})
+}
+
+func TestGobSerializer(t *testing.T) {
+	serializer := &GobSerializer{}
+
+	t.Run("Roundtrip", func(t *testing.T) {
+		src, err := http.NewRequest("PATCH", "http://example.com/orders/1?page=2&tag=a&tag=b", strings.NewReader(`{"gob":"serializer"}`))
+		require.NoError(t, err)
+		src.Header.Set("Content-Type", "application/json")
+		src.Header.Add("X-Tag", "a")
+		src.Header.Add("X-Tag", "b")
+
+		content, err := serializer.Serialize(src)
+		require.NoError(t, err)
+
+		req, err := serializer.Deserialize(content)
+		require.NoError(t, err)
+		assert.Equal(t, "PATCH", req.Method)
+		assert.Equal(t, "/orders/1", req.URL.Path)
+		assert.Equal(t, []string{"a", "b"}, req.URL.Query()["tag"])
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		assert.Equal(t, []string{"a", "b"}, req.Header.Values("X-Tag"))
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		assert.Equal(t, `{"gob":"serializer"}`, string(body))
+	})
+
+	t.Run("Without body", func(t *testing.T) {
+		src, err := http.NewRequest("GET", "http://example.com/health", nil)
+		require.NoError(t, err)
+		content, err := serializer.Serialize(src)
+		require.NoError(t, err)
+		req, err := serializer.Deserialize(content)
+		require.NoError(t, err)
+		assert.Equal(t, "GET", req.Method)
+		assert.Equal(t, "/health", req.URL.Path)
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		assert.Empty(t, body)
+	})
+
+	t.Run("Size", func(t *testing.T) {
+		newRequest := func() *http.Request {
+			req, err := http.NewRequest("POST", "http://example.com/orders", strings.NewReader(strings.Repeat("x", 4096)))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			return req
+		}
+		content, err := serializer.Serialize(newRequest())
+		require.NoError(t, err)
+		bodyOnly, err := (&BodyOnlySerializer{}).Serialize(newRequest())
+		require.NoError(t, err)
+		dump, err := httputil.DumpRequest(newRequest(), true)
+		require.NoError(t, err)
+		dumped := base64.StdEncoding.EncodeToString(dump)
+		t.Logf("gob: %d bytes, body only: %d bytes, dump: %d bytes", len(content), len(bodyOnly), len(dumped))
+
+		// メソッドや URL、ヘッダーを含めても、ボディのみの場合からの増加は固定のオーバーヘッド程度であること
+		assert.Less(t, len(content)-len(bodyOnly), 256)
+		assert.Less(t, len(content)-len(dumped), 256)
+	})
+
+	t.Run("Too large", func(t *testing.T) {
+		src, err := http.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", 1024)))
+		require.NoError(t, err)
+		_, err = (&GobSerializer{MaxContentSize: 512}).Serialize(src)
+		require.ErrorIs(t, err, ErrTooLarge)
+	})
+
+	t.Run("Invalid content", func(t *testing.T) {
+		_, err := serializer.Deserialize("not gob")
+		require.Error(t, err)
+	})
+}
+
+func TestBodyOnlySerializerContentType(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	transport := NewTransportWithClient(client)
+	listener := NewListenerWithOptions(client,
+		WithPollInterval(10*time.Millisecond),
+		WithSerializer(&BodyOnlySerializer{ContentType: "application/json"}),
+	)
+	type result struct {
+		contentType string
+		name        string
+	}
+	resultCh := make(chan result, 1)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Content-Type でボディの形式を判別するハンドラー
+			var res result
+			res.contentType = r.Header.Get("Content-Type")
+			if res.contentType == "application/json" {
+				var v struct {
+					Name string `json:"name"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&v); err == nil {
+					res.name = v.Name
+				}
+			}
+			resultCh <- res
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	resp, err := (&http.Client{Transport: transport}).Post("/", "application/json", strings.NewReader(`{"name":"test"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	select {
+	case res := <-resultCh:
+		assert.Equal(t, "application/json", res.contentType)
+		assert.Equal(t, "test", res.name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message should be delivered")
+	}
+
+	// ContentType が未指定の場合は、従来どおり Content-Type を設定しないこと
+	req, err := (&BodyOnlySerializer{}).Deserialize(base64.StdEncoding.EncodeToString([]byte(`{}`)))
+	require.NoError(t, err)
+	assert.Empty(t, req.Header.Get("Content-Type"))
+}
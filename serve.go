@@ -0,0 +1,106 @@
+package simplemqhttp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+)
+
+// Backoff は、連続した失敗の回数 (1 始まり) から次の再試行までの待機時間を返す関数です。
+type Backoff func(attempt int) time.Duration
+
+// ExponentialBackoff は、base から始まり max を上限として倍々に増える Backoff を返します。
+func ExponentialBackoff(base, max time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		d := base
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+// IsPermanentError は、再試行しても回復しないエラーかどうかを返します。
+// 認証・認可のエラーは恒久的なエラーとして扱います。
+func IsPermanentError(err error) bool {
+	var apiErr *simplemq.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden
+	}
+	return false
+}
+
+// reconnectListener は、http.Server.Serve の終了時に Listener が閉じられないようにするためのラッパーです。
+type reconnectListener struct {
+	*Listener
+}
+
+func (l reconnectListener) Close() error {
+	return nil
+}
+
+// reconnectResetAfter は、この時間以上 Serve が継続した場合に失敗の回数をリセットするための閾値です。
+const reconnectResetAfter = 30 * time.Second
+
+// ServeWithReconnect は、Listener からのリクエストを h で処理します。
+// API の一時的な障害で Accept がエラーを返した場合は、backoff に従って待機してから処理を再開します。
+// 既定では一時的な受信のエラーは Listener の内部で再試行されるため、Accept がエラーを返すのは
+// Listener.OnReceiveError が false を返した場合などに限られます。
+// 認証エラーなどの恒久的なエラーの場合は、そのエラーを返します。
+// Listener.IdleTimeout の間メッセージを受信できなかった場合は、再接続せずに処理中のリクエストの完了を待ってから ErrIdleTimeout を返します。
+// ctx が終了した場合は、処理中のリクエストの完了を待ってから nil を返します。
+// backoff が nil の場合は、1秒から30秒までの ExponentialBackoff が使用されます。
+func ServeWithReconnect(ctx context.Context, l *Listener, h http.Handler, backoff Backoff) error {
+	if backoff == nil {
+		backoff = ExponentialBackoff(time.Second, 30*time.Second)
+	}
+	server := &http.Server{
+		Handler:     h,
+		ConnContext: ConnContext,
+	}
+	// Accept のブロックを解除するため、ctx の終了時に Listener を閉じる
+	stop := context.AfterFunc(ctx, func() {
+		l.Close()
+	})
+	defer stop()
+
+	attempt := 0
+	for {
+		start := time.Now()
+		err := server.Serve(reconnectListener{l})
+		if ctx.Err() != nil || errors.Is(err, http.ErrServerClosed) || errors.Is(err, net.ErrClosed) {
+			// 処理中のリクエストの完了を待つ
+			return server.Shutdown(context.Background())
+		}
+		if IsPermanentError(err) {
+			l.logger().Error("serve stopped due to permanent error", "err", err)
+			return err
+		}
+		if errors.Is(err, ErrIdleTimeout) {
+			// キューが空になったことによる終了のため、再接続しない
+			l.logger().Info("serve stopped due to idle timeout", "idle_timeout", l.IdleTimeout)
+			if err := server.Shutdown(context.Background()); err != nil {
+				return err
+			}
+			return ErrIdleTimeout
+		}
+		if time.Since(start) >= reconnectResetAfter {
+			attempt = 0
+		}
+		attempt++
+		wait := backoff(attempt)
+		l.logger().Warn("serve interrupted, reconnecting", "err", err, "attempt", attempt, "backoff", wait)
+		select {
+		case <-ctx.Done():
+			return server.Shutdown(context.Background())
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package simplemqhttp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+	"github.com/mashiike/simplemqhttp/stub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// outageTransport は、指定回数の受信を 503 で失敗させるトランスポートです。
+type outageTransport struct {
+	failures atomic.Int32
+}
+
+func (o *outageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet && o.failures.Add(-1) >= 0 {
+		body := `{"code":503,"message":"service unavailable"}`
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestServeWithReconnect(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	t.Run("Resume after transient outage", func(t *testing.T) {
+		outage := &outageTransport{}
+		outage.failures.Store(3)
+		client := simplemq.NewClient(apiKey, "test-queue")
+		client.Endpoint = stubServer.URL()
+		client.HTTPClient = &http.Client{Transport: outage}
+
+		handledCh := make(chan string, 1)
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			bs, _ := io.ReadAll(r.Body)
+			handledCh <- string(bs)
+			w.WriteHeader(http.StatusOK)
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- ServeWithReconnect(ctx, NewListenerWithClient(client), handler, ExponentialBackoff(10*time.Millisecond, 50*time.Millisecond))
+		}()
+
+		stubServer.AddMessage("test-queue", `{"after":"outage"}`)
+		select {
+		case body := <-handledCh:
+			assert.Equal(t, `{"after":"outage"}`, body)
+		case <-time.After(5 * time.Second):
+			t.Fatal("message should be handled after the outage")
+		}
+		assert.Less(t, outage.failures.Load(), int32(0))
+
+		cancel()
+		select {
+		case err := <-errCh:
+			require.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("serve should stop after context is canceled")
+		}
+	})
+
+	t.Run("Stop on idle timeout", func(t *testing.T) {
+		client := simplemq.NewClient(apiKey, "idle-queue")
+		client.Endpoint = stubServer.URL()
+		listener := NewListenerWithClient(client)
+		listener.PollInterval = 10 * time.Millisecond
+		listener.IdleTimeout = 200 * time.Millisecond
+		defer listener.Close()
+
+		var handled atomic.Int32
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handled.Add(1)
+			w.WriteHeader(http.StatusOK)
+		})
+		stubServer.AddMessage("idle-queue", `{"before":"idle"}`)
+
+		// IdleTimeout は再接続せず、処理中のリクエストを終えてから ErrIdleTimeout を返すこと
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- ServeWithReconnect(context.Background(), listener, handler, ExponentialBackoff(time.Hour, time.Hour))
+		}()
+		select {
+		case err := <-errCh:
+			assert.ErrorIs(t, err, ErrIdleTimeout)
+		case <-time.After(5 * time.Second):
+			t.Fatal("serve should stop on idle timeout")
+		}
+		assert.EqualValues(t, 1, handled.Load())
+		assert.Equal(t, 0, stubServer.GetQueueSize("idle-queue"))
+	})
+
+	t.Run("Give up on auth failure", func(t *testing.T) {
+		client := simplemq.NewClient("invalid-api-key", "test-queue")
+		client.Endpoint = stubServer.URL()
+
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- ServeWithReconnect(context.Background(), NewListenerWithClient(client), handler, ExponentialBackoff(10*time.Millisecond, 50*time.Millisecond))
+		}()
+		select {
+		case err := <-errCh:
+			require.Error(t, err)
+			assert.True(t, IsPermanentError(err))
+		case <-time.After(5 * time.Second):
+			t.Fatal("serve should give up on auth failure")
+		}
+	})
+}
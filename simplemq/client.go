@@ -4,10 +4,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Client struct {
@@ -15,13 +20,128 @@ type Client struct {
 	APIKey     string
 	Queue      string
 	HTTPClient *http.Client
+	// RefreshOnReceive extends the visibility timeout of received messages
+	// whose remaining window is shorter than RefreshThreshold.
+	RefreshOnReceive bool
+	// RefreshThreshold is the remaining visibility window below which a received message is refreshed.
+	// If zero, DefaultRefreshThreshold is used.
+	RefreshThreshold time.Duration
+	// SendConcurrency is the maximum number of concurrent requests made by SendMessages.
+	// If zero, DefaultSendConcurrency is used.
+	SendConcurrency int
+	// RequestTimeout is the timeout applied to each API request, in addition to the deadline of the caller's context.
+	// The shorter of the two takes effect. For long-polling receives, the wait time is added to the timeout.
+	// If zero, DefaultRequestTimeout is used. If negative, no timeout is applied.
+	RequestTimeout time.Duration
+	// RequireHTTPS rejects Endpoint values that do not use https.
+	// Endpoint is validated on the first request after it is set; it must be an absolute http or https URL with a host
+	// and without user info, query or fragment. Plain http is accepted unless RequireHTTPS is true.
+	// NewClientForRegion sets RequireHTTPS.
+	RequireHTTPS bool
+
+	// validatedEndpoint holds the last validatedEndpoint that passed validation, so that Endpoint is validated only once.
+	validatedEndpoint atomic.Value
+
+	// clockOffset is the difference between the server clock and the local clock in nanoseconds,
+	// estimated from the Date header of the first ReceiveMessages response.
+	clockOffset    int64
+	clockOffsetSet int32
+}
+
+// DefaultRefreshThreshold is the default value of Client.RefreshThreshold.
+const DefaultRefreshThreshold = 10 * time.Second
+
+// DefaultSendConcurrency is the default value of Client.SendConcurrency.
+const DefaultSendConcurrency = 8
+
+// DefaultRequestTimeout is the default value of Client.RequestTimeout.
+const DefaultRequestTimeout = 30 * time.Second
+
+// ClientOption configures a Client created by NewClient.
+type ClientOption func(*Client)
+
+// WithHTTPClient sets the HTTP client used to call the API.
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *Client) {
+		c.HTTPClient = httpClient
+	}
 }
 
-func NewClient(apiKey, queue string) *Client {
-	return &Client{
+// WithRequestTimeout sets the timeout applied to each API request.
+func WithRequestTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.RequestTimeout = d
+	}
+}
+
+func NewClient(apiKey, queue string, opts ...ClientOption) *Client {
+	c := &Client{
 		APIKey: apiKey,
 		Queue:  queue,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Clone returns a shallow copy of the client targeting the given queue.
+// The copy shares the HTTP client and all other settings with the original.
+// It is safe to call Clone while the original is in use; the estimated clock offset is copied atomically.
+func (c *Client) Clone(queue string) *Client {
+	clone := &Client{
+		Endpoint:         c.Endpoint,
+		APIKey:           c.APIKey,
+		Queue:            queue,
+		HTTPClient:       c.HTTPClient,
+		RefreshOnReceive: c.RefreshOnReceive,
+		RefreshThreshold: c.RefreshThreshold,
+		SendConcurrency:  c.SendConcurrency,
+		RequestTimeout:   c.RequestTimeout,
+		RequireHTTPS:     c.RequireHTTPS,
+	}
+	if v := c.validatedEndpoint.Load(); v != nil {
+		clone.validatedEndpoint.Store(v)
+	}
+	atomic.StoreInt64(&clone.clockOffset, atomic.LoadInt64(&c.clockOffset))
+	atomic.StoreInt32(&clone.clockOffsetSet, atomic.LoadInt32(&c.clockOffsetSet))
+	return clone
+}
+
+// ClockOffset returns the estimated difference between the server clock and the local clock.
+// It is estimated from the Date header of the first successful ReceiveMessages response,
+// and is zero until then. Because the Date header has one-second resolution, offsets under a second are ignored.
+func (c *Client) ClockOffset() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.clockOffset))
+}
+
+// Now returns the current time adjusted to the server clock.
+func (c *Client) Now() time.Time {
+	return time.Now().Add(c.ClockOffset())
+}
+
+// Until returns the duration until t, where t is a time on the server clock.
+func (c *Client) Until(t time.Time) time.Duration {
+	return t.Sub(c.Now())
+}
+
+// observeDate records the clock offset from the Date header on first contact.
+func (c *Client) observeDate(resp *http.Response) {
+	if atomic.LoadInt32(&c.clockOffsetSet) != 0 {
+		return
+	}
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&c.clockOffsetSet, 0, 1) {
+		return
+	}
+	offset := time.Until(date)
+	if offset > -time.Second && offset < time.Second {
+		return
+	}
+	atomic.StoreInt64(&c.clockOffset, int64(offset))
 }
 
 func (c *Client) httpClient() *http.Client {
@@ -34,21 +154,65 @@ func (c *Client) httpClient() *http.Client {
 type APIError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
+	// RetryAfter is the delay indicated by the Retry-After response header, if any.
+	RetryAfter time.Duration `json:"-"`
+}
+
+// retryAfter parses the Retry-After header of resp as either delay seconds or an HTTP date.
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
 }
 
 func (e *APIError) Error() string {
 	return fmt.Sprintf("API error %d: %s", e.Code, e.Message)
 }
 
+func (c *Client) requestTimeout() time.Duration {
+	if c.RequestTimeout != 0 {
+		return c.RequestTimeout
+	}
+	return DefaultRequestTimeout
+}
+
+// cancelOnClose cancels the request context when the response body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
 // doRequest handles common HTTP request operations
-func (c *Client) doRequest(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
-	url, err := c.endpointURL(path)
+// wait is added to the request timeout for requests that are expected to block on the server, such as long polling.
+func (c *Client) doRequest(ctx context.Context, method, path string, query url.Values, body io.Reader, wait time.Duration) (*http.Response, error) {
+	url, err := c.endpointURL(path, query)
 	if err != nil {
 		return nil, err
 	}
 
+	cancel := context.CancelFunc(func() {})
+	if timeout := c.requestTimeout(); timeout > 0 {
+		// context.WithTimeout keeps the caller's deadline if it is earlier
+		ctx, cancel = context.WithTimeout(ctx, timeout+wait)
+	}
 	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("request creation failed: %w", err)
 	}
 
@@ -59,45 +223,187 @@ func (c *Client) doRequest(ctx context.Context, method, path string, body io.Rea
 
 	resp, err := c.httpClient().Do(req)
 	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("request failed: %w", err)
 	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
 
 	return resp, nil
 }
 
+// SendOptions are the options for SendMessageWithOptions.
+type SendOptions struct {
+	// TTL is how long the message is kept in the queue before it expires. If zero, the queue default is used.
+	TTL time.Duration
+	// ExpiresAt is the time the message expires. It takes precedence over TTL if both are set.
+	ExpiresAt time.Time
+}
+
+// expiresAt returns the expiration time in Unix milliseconds on the server clock, or zero if not set.
+func (c *Client) expiresAt(opts SendOptions) int64 {
+	switch {
+	case !opts.ExpiresAt.IsZero():
+		return opts.ExpiresAt.Add(c.ClockOffset()).UnixMilli()
+	case opts.TTL > 0:
+		return c.Now().Add(opts.TTL).UnixMilli()
+	default:
+		return 0
+	}
+}
+
 // SendMessage sends a message to the queue.
 func (c *Client) SendMessage(ctx context.Context, content string) (*Message, error) {
-	message := map[string]string{"content": content}
+	return c.SendMessageWithOptions(ctx, content, SendOptions{})
+}
+
+// SendMessageRaw sends a message to the queue like SendMessage, and also returns the raw JSON body of the response.
+// It allows reading response fields that Message does not have yet.
+func (c *Client) SendMessageRaw(ctx context.Context, content string) (*Message, json.RawMessage, error) {
+	return c.sendMessage(ctx, content, SendOptions{})
+}
+
+// SendMessageWithOptions sends a message to the queue with the given options.
+// The expiration is sent as expires_at in the request body. If the API ignores the field,
+// the message is kept for the queue's default retention period; the ExpiresAt of the returned message
+// reflects what the API actually stored.
+func (c *Client) SendMessageWithOptions(ctx context.Context, content string, opts SendOptions) (*Message, error) {
+	msg, _, err := c.sendMessage(ctx, content, opts)
+	return msg, err
+}
+
+// sendMessage sends a message and returns the parsed message along with the raw response body.
+func (c *Client) sendMessage(ctx context.Context, content string, opts SendOptions) (*Message, json.RawMessage, error) {
+	message := struct {
+		Content   string `json:"content"`
+		ExpiresAt int64  `json:"expires_at,omitempty"`
+	}{
+		Content:   content,
+		ExpiresAt: c.expiresAt(opts),
+	}
 	body, err := json.Marshal(message)
 	if err != nil {
-		return nil, fmt.Errorf("marshal error: %w", err)
+		return nil, nil, fmt.Errorf("marshal error: %w", err)
 	}
 
-	resp, err := c.doRequest(ctx, http.MethodPost, "/v1/queues/"+c.Queue+"/messages", bytes.NewReader(body))
+	resp, err := c.doRequest(ctx, http.MethodPost, "/v1/queues/"+c.Queue+"/messages", nil, bytes.NewReader(body), 0)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 	dec := json.NewDecoder(resp.Body)
 	if resp.StatusCode != http.StatusOK {
 		var apiErr APIError
 		if err := dec.Decode(&apiErr); err != nil {
-			return nil, fmt.Errorf("decode error: %w", err)
+			return nil, nil, fmt.Errorf("decode error: %w", err)
 		}
-		return nil, &apiErr
+		apiErr.RetryAfter = retryAfter(resp)
+		return nil, nil, &apiErr
+	}
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return nil, nil, fmt.Errorf("decode error: %w", err)
 	}
 	var result struct {
 		Message Message `json:"message"`
 	}
-	if err := dec.Decode(&result); err != nil {
-		return nil, fmt.Errorf("decode error: %w", err)
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return nil, nil, fmt.Errorf("decode error: %w", err)
 	}
-	return &result.Message, nil
+	return &result.Message, raw, nil
+}
+
+func (c *Client) sendConcurrency() int {
+	if c.SendConcurrency > 0 {
+		return c.SendConcurrency
+	}
+	return DefaultSendConcurrency
+}
+
+// SendMessages sends multiple messages to the queue.
+// The SimpleMQ API has no batch endpoint, so the messages are sent by parallel SendMessage calls,
+// with at most SendConcurrency requests in flight.
+//
+// The returned slice has the same length and order as contents. Messages that failed to be sent
+// are left as zero values, and their errors are joined with errors.Join, each wrapped with the index of the content.
+// A failure does not stop the other sends, so the messages may be partially sent even if an error is returned.
+func (c *Client) SendMessages(ctx context.Context, contents []string) ([]Message, error) {
+	msgs := make([]Message, len(contents))
+	errs := make([]error, len(contents))
+	sem := make(chan struct{}, c.sendConcurrency())
+	var wg sync.WaitGroup
+	for i, content := range contents {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = fmt.Errorf("message %d: %w", i, ctx.Err())
+			continue
+		}
+		wg.Add(1)
+		go func(i int, content string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			msg, err := c.SendMessage(ctx, content)
+			if err != nil {
+				errs[i] = fmt.Errorf("message %d: %w", i, err)
+				return
+			}
+			msgs[i] = *msg
+		}(i, content)
+	}
+	wg.Wait()
+	return msgs, errors.Join(errs...)
+}
+
+// ReceiveOptions configures a receive request.
+type ReceiveOptions struct {
+	// WaitSeconds is the maximum number of seconds the API waits for a message to become available
+	// before returning an empty result. If zero, the API returns immediately.
+	WaitSeconds int
+	// MaxMessages is the maximum number of messages returned by a single call.
+	// If zero, the API default is used.
+	MaxMessages int
+	// VisibilityTimeout is how long received messages stay hidden from other receivers.
+	// It is rounded up to whole seconds. If zero, the visibility timeout configured on the queue is used.
+	// The parameter is an assumption about the SimpleMQ API and is implemented by the stub server;
+	// if the API ignores it, the returned Message.VisibilityTimeoutAt reflects the queue setting.
+	VisibilityTimeout time.Duration
+}
+
+func (o ReceiveOptions) query() url.Values {
+	query := url.Values{}
+	if o.WaitSeconds > 0 {
+		query.Set("wait_seconds", strconv.Itoa(o.WaitSeconds))
+	}
+	if o.MaxMessages > 0 {
+		query.Set("max_messages", strconv.Itoa(o.MaxMessages))
+	}
+	setVisibilityTimeout(query, o.VisibilityTimeout)
+	return query
+}
+
+// visibilityTimeoutQuery is the query parameter that requests a visibility timeout in seconds on receive and extend.
+const visibilityTimeoutQuery = "visibility_timeout_seconds"
+
+// setVisibilityTimeout sets the visibility timeout query parameter, rounding d up to whole seconds.
+func setVisibilityTimeout(query url.Values, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	seconds := (d + time.Second - 1) / time.Second
+	query.Set(visibilityTimeoutQuery, strconv.FormatInt(int64(seconds), 10))
 }
 
 // ReceiveMessage receives a single message from the queue.
 func (c *Client) ReceiveMessages(ctx context.Context) ([]Message, error) {
-	resp, err := c.doRequest(ctx, http.MethodGet, "/v1/queues/"+c.Queue+"/messages", nil)
+	return c.ReceiveMessagesWithOptions(ctx, ReceiveOptions{})
+}
+
+// ReceiveMessagesWithOptions receives messages from the queue with the given options.
+// When opts.WaitSeconds is set, the call long-polls until a message is available or the wait elapses.
+func (c *Client) ReceiveMessagesWithOptions(ctx context.Context, opts ReceiveOptions) ([]Message, error) {
+	resp, err := c.doRequest(ctx, http.MethodGet, "/v1/queues/"+c.Queue+"/messages", opts.query(), nil, time.Duration(opts.WaitSeconds)*time.Second)
 	if err != nil {
 		return nil, err
 	}
@@ -109,9 +415,11 @@ func (c *Client) ReceiveMessages(ctx context.Context) ([]Message, error) {
 		if err := dec.Decode(&apiErr); err != nil {
 			return nil, fmt.Errorf("decode error: %w", err)
 		}
+		apiErr.RetryAfter = retryAfter(resp)
 		return nil, &apiErr
 	}
 
+	c.observeDate(resp)
 	var result struct {
 		Messages []Message `json:"messages"`
 	}
@@ -122,12 +430,38 @@ func (c *Client) ReceiveMessages(ctx context.Context) ([]Message, error) {
 	if len(result.Messages) == 0 {
 		return []Message{}, nil
 	}
+	if c.RefreshOnReceive {
+		c.refreshMessages(ctx, result.Messages)
+	}
 	return result.Messages, nil
 }
 
+func (c *Client) refreshThreshold() time.Duration {
+	if c.RefreshThreshold > 0 {
+		return c.RefreshThreshold
+	}
+	return DefaultRefreshThreshold
+}
+
+// refreshMessages extends the visibility timeout of messages that are close to expiry.
+// Messages that fail to be extended are returned as is.
+func (c *Client) refreshMessages(ctx context.Context, msgs []Message) {
+	threshold := c.refreshThreshold()
+	for i := range msgs {
+		if c.Until(msgs[i].VisibilityTimeoutTime()) >= threshold {
+			continue
+		}
+		extended, err := c.ExtendVisibilityTimeout(ctx, msgs[i].ID)
+		if err != nil {
+			continue
+		}
+		msgs[i].VisibilityTimeoutAt = extended.VisibilityTimeoutAt
+	}
+}
+
 // DeleteMessage deletes (acknowledges) a message from the queue.
 func (c *Client) DeleteMessage(ctx context.Context, id string) error {
-	resp, err := c.doRequest(ctx, http.MethodDelete, "/v1/queues/"+c.Queue+"/messages/"+id, nil)
+	resp, err := c.doRequest(ctx, http.MethodDelete, "/v1/queues/"+c.Queue+"/messages/"+id, nil, nil, 0)
 	if err != nil {
 		return err
 	}
@@ -138,14 +472,26 @@ func (c *Client) DeleteMessage(ctx context.Context, id string) error {
 		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
 			return fmt.Errorf("decode error: %w", err)
 		}
+		apiErr.RetryAfter = retryAfter(resp)
 		return &apiErr
 	}
 
 	return nil
 }
 
+// ExtendVisibilityTimeout extends the visibility timeout of a message by the visibility timeout configured on the queue.
 func (c *Client) ExtendVisibilityTimeout(ctx context.Context, id string) (*Message, error) {
-	resp, err := c.doRequest(ctx, http.MethodPut, "/v1/queues/"+c.Queue+"/messages/"+id, nil)
+	return c.ExtendVisibilityTimeoutBy(ctx, id, 0)
+}
+
+// ExtendVisibilityTimeoutBy extends the visibility timeout of a message to d from now, rounded up to whole seconds.
+// If d is zero, the visibility timeout configured on the queue is used.
+// As with ReceiveOptions.VisibilityTimeout, the duration parameter is an assumption about the SimpleMQ API;
+// callers should rely on the VisibilityTimeoutAt of the returned message rather than on d.
+func (c *Client) ExtendVisibilityTimeoutBy(ctx context.Context, id string, d time.Duration) (*Message, error) {
+	query := url.Values{}
+	setVisibilityTimeout(query, d)
+	resp, err := c.doRequest(ctx, http.MethodPut, "/v1/queues/"+c.Queue+"/messages/"+id, query, nil, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -156,6 +502,7 @@ func (c *Client) ExtendVisibilityTimeout(ctx context.Context, id string) (*Messa
 		if err := dec.Decode(&apiErr); err != nil {
 			return nil, fmt.Errorf("decode error: %w", err)
 		}
+		apiErr.RetryAfter = retryAfter(resp)
 		return nil, &apiErr
 	}
 	var result struct {
@@ -167,18 +514,177 @@ func (c *Client) ExtendVisibilityTimeout(ctx context.Context, id string) (*Messa
 	return &result.Message, nil
 }
 
+// QueueStats is a snapshot of the approximate number of messages in a queue.
+type QueueStats struct {
+	// MessageCount is the approximate number of messages waiting to be received.
+	MessageCount int `json:"message_count"`
+	// InFlightCount is the approximate number of messages that have been received but not yet deleted,
+	// and whose visibility timeout has not yet elapsed.
+	InFlightCount int `json:"in_flight_count"`
+	// OldestMessageCreatedAt is the creation time of the oldest message in Unix milliseconds, or zero if the queue is empty.
+	OldestMessageCreatedAt int64 `json:"oldest_message_created_at,omitempty"`
+	// OldestMessageAge is the age of the oldest message at the time of the call, or zero if the queue is empty.
+	// It is computed by the client from OldestMessageCreatedAt using the server clock.
+	OldestMessageAge time.Duration `json:"-"`
+}
+
+// QueueStats returns the approximate statistics of the queue without receiving any messages.
+// It calls GET /v1/queues/{queue}; the statistics endpoint and its response format are assumptions
+// about the SimpleMQ API and are implemented by the stub server. If the API does not provide it,
+// an APIError (typically 404) is returned.
+func (c *Client) QueueStats(ctx context.Context) (*QueueStats, error) {
+	resp, err := c.doRequest(ctx, http.MethodGet, "/v1/queues/"+c.Queue, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		var apiErr APIError
+		if err := dec.Decode(&apiErr); err != nil {
+			return nil, fmt.Errorf("decode error: %w", err)
+		}
+		apiErr.RetryAfter = retryAfter(resp)
+		return nil, &apiErr
+	}
+	var result struct {
+		Stats QueueStats `json:"stats"`
+	}
+	if err := dec.Decode(&result); err != nil {
+		return nil, fmt.Errorf("decode error: %w", err)
+	}
+	stats := &result.Stats
+	if stats.OldestMessageCreatedAt != 0 {
+		if age := c.Now().Sub(time.UnixMilli(stats.OldestMessageCreatedAt)); age > 0 {
+			stats.OldestMessageAge = age
+		}
+	}
+	return stats, nil
+}
+
+// ErrUnauthorized is returned by Ping when the API rejects the API key.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// ErrQueueNotFound is returned by Ping when the queue does not exist.
+var ErrQueueNotFound = errors.New("queue not found")
+
+// Ping verifies that the API key and the queue are valid by making a lightweight authenticated request.
+// It does not receive or modify any messages.
+// It returns an error wrapping ErrUnauthorized for 401 and 403 responses, and ErrQueueNotFound for 404 responses;
+// the APIError is also wrapped and can be retrieved with errors.As. Other errors, such as network errors, are returned as is.
+//
+// Experimental: Ping calls the queue statistics endpoint used by QueueStats, which is implemented by the stub server
+// but is not part of the documented SimpleMQ API. If the API does not provide it, Ping reports ErrQueueNotFound even for an existing queue.
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.QueueStats(ctx)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return fmt.Errorf("%w: %w", ErrUnauthorized, err)
+		case http.StatusNotFound:
+			return fmt.Errorf("%w: %s: %w", ErrQueueNotFound, c.Queue, err)
+		}
+	}
+	return err
+}
+
 const DefaultEndpoint = "https://simplemq.tk1b.api.sacloud.jp"
 
-// endpointURL joins base endpoint with a path.
-func (c *Client) endpointURL(p string) (string, error) {
+// DefaultRegion is the region whose endpoint is DefaultEndpoint.
+const DefaultRegion = "tk1b"
+
+// regionEndpoints maps the known region identifiers to their API endpoints.
+// SimpleMQ is currently offered only in the tk1b (Tokyo) region; new regions are added here as they become available.
+var regionEndpoints = map[string]string{
+	DefaultRegion: DefaultEndpoint,
+}
+
+// ErrUnknownRegion is returned when a region identifier has no known endpoint.
+var ErrUnknownRegion = errors.New("unknown region")
+
+// ErrInvalidEndpoint is returned when Client.Endpoint is not a valid API endpoint.
+var ErrInvalidEndpoint = errors.New("invalid endpoint")
+
+// RegionEndpoint returns the API endpoint of the given region.
+func RegionEndpoint(region string) (string, error) {
+	e, ok := regionEndpoints[region]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnknownRegion, region)
+	}
+	return e, nil
+}
+
+// NewClientForRegion creates a client whose Endpoint is the API endpoint of the given region.
+// It returns an error wrapping ErrUnknownRegion if the region is not known.
+func NewClientForRegion(apiKey, queue, region string, opts ...ClientOption) (*Client, error) {
+	e, err := RegionEndpoint(region)
+	if err != nil {
+		return nil, err
+	}
+	c := NewClient(apiKey, queue, opts...)
+	c.Endpoint = e
+	c.RequireHTTPS = true
+	return c, nil
+}
+
+// ValidateEndpoint reports whether endpoint can be used as Client.Endpoint.
+// The endpoint must be an absolute https URL with a host and without user info, query or fragment.
+// Client accepts plain http as well unless Client.RequireHTTPS is true.
+func ValidateEndpoint(endpoint string) error {
+	return validateEndpoint(endpoint, false)
+}
+
+func validateEndpoint(endpoint string, allowInsecure bool) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidEndpoint, err)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("%w: %q has no host", ErrInvalidEndpoint, endpoint)
+	}
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !allowInsecure {
+			return fmt.Errorf("%w: %q must use https", ErrInvalidEndpoint, endpoint)
+		}
+	default:
+		return fmt.Errorf("%w: %q must use https", ErrInvalidEndpoint, endpoint)
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("%w: %q must not contain user info, query or fragment", ErrInvalidEndpoint, endpoint)
+	}
+	return nil
+}
+
+// validatedEndpoint is an endpoint and whether plain http was allowed when it was validated.
+type validatedEndpoint struct {
+	endpoint      string
+	allowInsecure bool
+}
+
+// endpointURL joins base endpoint with a path and appends the query parameters, if any.
+func (c *Client) endpointURL(p string, query url.Values) (string, error) {
 	e := c.Endpoint
 	if e == "" {
 		e = DefaultEndpoint
 	}
+	key := validatedEndpoint{endpoint: e, allowInsecure: !c.RequireHTTPS}
+	if validated, _ := c.validatedEndpoint.Load().(validatedEndpoint); validated != key {
+		if err := validateEndpoint(e, key.allowInsecure); err != nil {
+			return "", err
+		}
+		c.validatedEndpoint.Store(key)
+	}
 	u, err := url.Parse(e)
 	if err != nil {
 		return "", fmt.Errorf("invalid endpoint URL: %w", err)
 	}
 
-	return u.JoinPath(p).String(), nil
+	u = u.JoinPath(p)
+	if len(query) > 0 {
+		u.RawQuery = query.Encode()
+	}
+	return u.String(), nil
 }
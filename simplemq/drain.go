@@ -0,0 +1,98 @@
+package simplemq
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DrainOptions are the options for DrainWithOptions.
+type DrainOptions struct {
+	// DeleteOnSuccess deletes each message after the callback returns nil.
+	// If false, messages are left in the queue and become visible again after their visibility timeout.
+	DeleteOnSuccess bool
+	// ExtendVisibility keeps extending the visibility timeout of a message while the callback is running,
+	// so that slow callbacks do not let the message be redelivered during the drain.
+	ExtendVisibility bool
+	// MaxMessages is the maximum number of messages received by a single call. If zero, the API default is used.
+	MaxMessages int
+}
+
+// Drain receives all pending messages and invokes fn for each of them, without deleting them.
+// See DrainWithOptions for details.
+func (c *Client) Drain(ctx context.Context, fn func(Message) error) error {
+	return c.DrainWithOptions(ctx, fn, DrainOptions{})
+}
+
+// DrainWithOptions repeatedly receives messages and invokes fn for each of them, until a receive returns no messages.
+// It is a maintenance utility, e.g. to dump the queue into a file while consumers are paused.
+//
+// Received messages stay hidden for their visibility timeout, so each pending message is passed to fn once
+// as long as the drain completes within the visibility timeout. Messages are deleted only if opts.DeleteOnSuccess is set.
+// If fn returns an error, the drain stops and the error is returned; the message and the rest of the batch
+// are not deleted and become visible again after their visibility timeout.
+func (c *Client) DrainWithOptions(ctx context.Context, fn func(Message) error, opts DrainOptions) error {
+	for {
+		msgs, err := c.ReceiveMessagesWithOptions(ctx, ReceiveOptions{MaxMessages: opts.MaxMessages})
+		if err != nil {
+			return err
+		}
+		if len(msgs) == 0 {
+			return nil
+		}
+		for _, msg := range msgs {
+			if err := c.drainMessage(ctx, msg, fn, opts); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// drainMessage invokes fn for a message, extending its visibility timeout and deleting it as configured.
+func (c *Client) drainMessage(ctx context.Context, msg Message, fn func(Message) error, opts DrainOptions) error {
+	if opts.ExtendVisibility {
+		stop := c.keepVisibility(ctx, msg)
+		defer stop()
+	}
+	if err := fn(msg); err != nil {
+		return err
+	}
+	if !opts.DeleteOnSuccess {
+		return nil
+	}
+	if err := c.DeleteMessage(ctx, msg.ID); err != nil {
+		return fmt.Errorf("failed to delete message %s: %w", msg.ID, err)
+	}
+	return nil
+}
+
+// keepVisibility extends the visibility timeout of msg in the background until the returned function is called.
+// Extension stops at the first failure; the message may then be redelivered after its visibility timeout.
+func (c *Client) keepVisibility(ctx context.Context, msg Message) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		visibilityTimeoutAt := msg.VisibilityTimeoutTime()
+		for {
+			timer := time.NewTimer(time.Duration(float64(c.Until(visibilityTimeoutAt)) * 0.9))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			extended, err := c.ExtendVisibilityTimeout(ctx, msg.ID)
+			if err != nil {
+				return
+			}
+			visibilityTimeoutAt = extended.VisibilityTimeoutTime()
+		}
+	}()
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
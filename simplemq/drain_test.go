@@ -0,0 +1,87 @@
+package simplemq_test
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+	"github.com/mashiike/simplemqhttp/stub"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientDrain(t *testing.T) {
+	// スタブサーバーの作成
+	server := stub.NewServer("test-api-key")
+	defer server.Close()
+
+	client := simplemq.NewClient("test-api-key", "test-queue")
+	client.Endpoint = server.URL()
+	ctx := context.Background()
+
+	add := func(contents ...string) {
+		server.Reset()
+		for _, content := range contents {
+			server.AddMessage("test-queue", content)
+		}
+	}
+
+	t.Run("Without delete", func(t *testing.T) {
+		add("a", "b", "c")
+		var drained []string
+		err := client.Drain(ctx, func(msg simplemq.Message) error {
+			drained = append(drained, msg.Content)
+			return nil
+		})
+		require.NoError(t, err)
+		sort.Strings(drained)
+		require.Equal(t, []string{"a", "b", "c"}, drained)
+		// 削除されずにキューに残ること
+		require.Equal(t, 3, server.GetQueueSize("test-queue"))
+	})
+
+	t.Run("DeleteOnSuccess", func(t *testing.T) {
+		add("a", "b", "c")
+		var count int
+		err := client.DrainWithOptions(ctx, func(msg simplemq.Message) error {
+			count++
+			return nil
+		}, simplemq.DrainOptions{DeleteOnSuccess: true, MaxMessages: 1})
+		require.NoError(t, err)
+		require.Equal(t, 3, count)
+		require.Equal(t, 0, server.GetQueueSize("test-queue"))
+	})
+
+	t.Run("Stop on callback error", func(t *testing.T) {
+		add("a", "b", "c")
+		errStop := errors.New("stop")
+		var count int
+		err := client.DrainWithOptions(ctx, func(msg simplemq.Message) error {
+			count++
+			if count == 2 {
+				return errStop
+			}
+			return nil
+		}, simplemq.DrainOptions{DeleteOnSuccess: true, MaxMessages: 1})
+		require.ErrorIs(t, err, errStop)
+		// 失敗したメッセージと未処理のメッセージは削除されないこと
+		require.Equal(t, 2, server.GetQueueSize("test-queue"))
+	})
+
+	t.Run("ExtendVisibility", func(t *testing.T) {
+		server.SetVisibilityTimeout(200 * time.Millisecond)
+		defer server.SetVisibilityTimeout(stub.DefaultVisibilityTimeout)
+		add("slow")
+		var count int
+		err := client.DrainWithOptions(ctx, func(msg simplemq.Message) error {
+			count++
+			// 可視性タイムアウトより長く処理しても、延長されるため再受信されないこと
+			time.Sleep(500 * time.Millisecond)
+			return nil
+		}, simplemq.DrainOptions{ExtendVisibility: true})
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+	})
+}
@@ -0,0 +1,91 @@
+package simplemqhttp
+
+import (
+	"sort"
+	"sync"
+)
+
+// MessageSizeRecorder は、送受信したメッセージのサイズを記録するためのインターフェースです。
+// Transport.SizeRecorder と Listener.SizeRecorder に設定して使用します。
+type MessageSizeRecorder interface {
+	RecordMessageSize(size int)
+}
+
+// DefaultSizeBuckets は、SizeHistogram の既定のバケットの上限 (バイト) です。
+var DefaultSizeBuckets = []int{1024, 4 * 1024, 16 * 1024, 64 * 1024, 128 * 1024, 256 * 1024}
+
+// SizeBucket は、SizeHistogram の1つのバケットです。
+// UpperBound が -1 のバケットは、最大のバケットを超えるサイズを表します。
+type SizeBucket struct {
+	UpperBound int
+	Count      int64
+}
+
+// SizeHistogram は、メッセージサイズの分布を記録する MessageSizeRecorder 実装です。
+type SizeHistogram struct {
+	// Buckets は、バケットの上限 (バイト) の一覧です。
+	// 未指定の場合は、DefaultSizeBuckets が使用されます。
+	Buckets []int
+
+	mu     sync.Mutex
+	bounds []int
+	counts []int64
+	total  int64
+	sum    int64
+}
+
+var _ MessageSizeRecorder = &SizeHistogram{}
+
+func (h *SizeHistogram) initLocked() {
+	if h.bounds != nil {
+		return
+	}
+	buckets := h.Buckets
+	if len(buckets) == 0 {
+		buckets = DefaultSizeBuckets
+	}
+	h.bounds = append([]int(nil), buckets...)
+	sort.Ints(h.bounds)
+	h.counts = make([]int64, len(h.bounds)+1)
+}
+
+// RecordMessageSize は、メッセージサイズを記録します。
+func (h *SizeHistogram) RecordMessageSize(size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.initLocked()
+	i := sort.SearchInts(h.bounds, size)
+	h.counts[i]++
+	h.total++
+	h.sum += int64(size)
+}
+
+// Snapshot は、現在のバケットごとの記録数を返します。
+func (h *SizeHistogram) Snapshot() []SizeBucket {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.initLocked()
+	buckets := make([]SizeBucket, 0, len(h.counts))
+	for i, count := range h.counts {
+		upper := -1
+		if i < len(h.bounds) {
+			upper = h.bounds[i]
+		}
+		buckets = append(buckets, SizeBucket{UpperBound: upper, Count: count})
+	}
+	return buckets
+}
+
+// Count は、記録したメッセージの数を返します。
+func (h *SizeHistogram) Count() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.total
+}
+
+// Sum は、記録したメッセージサイズの合計を返します。
+func (h *SizeHistogram) Sum() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sum
+}
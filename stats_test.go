@@ -0,0 +1,74 @@
+package simplemqhttp
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+	"github.com/mashiike/simplemqhttp/stub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bucketCount(t *testing.T, h *SizeHistogram, upperBound int) int64 {
+	t.Helper()
+	for _, b := range h.Snapshot() {
+		if b.UpperBound == upperBound {
+			return b.Count
+		}
+	}
+	t.Fatalf("bucket %d not found", upperBound)
+	return 0
+}
+
+func TestSizeHistogram(t *testing.T) {
+	h := &SizeHistogram{}
+	h.RecordMessageSize(100)
+	h.RecordMessageSize(1024)
+	h.RecordMessageSize(3000)
+	h.RecordMessageSize(300 * 1024)
+
+	assert.Equal(t, int64(2), bucketCount(t, h, 1024))
+	assert.Equal(t, int64(1), bucketCount(t, h, 4*1024))
+	assert.Equal(t, int64(0), bucketCount(t, h, 16*1024))
+	assert.Equal(t, int64(1), bucketCount(t, h, -1))
+	assert.Equal(t, int64(4), h.Count())
+	assert.Equal(t, int64(100+1024+3000+300*1024), h.Sum())
+}
+
+func TestMessageSizeRecording(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// テスト用のclientを作成
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	// 送信側でサイズを記録
+	sent := &SizeHistogram{}
+	transport := NewTransportWithClient(client)
+	transport.SizeRecorder = sent
+	transport.Serializer = &BodyOnlySerializer{NoBase64: true}
+
+	req, err := http.NewRequest("POST", "/", strings.NewReader(strings.Repeat("a", 3000)))
+	require.NoError(t, err)
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, int64(1), bucketCount(t, sent, 4*1024))
+
+	// 受信側でサイズを記録
+	received := &SizeHistogram{}
+	listener := NewListenerWithClient(client)
+	listener.SizeRecorder = received
+	defer listener.Close()
+
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	assert.Equal(t, int64(1), bucketCount(t, received, 4*1024))
+	assert.Equal(t, int64(3000), received.Sum())
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"regexp"
+	"strconv"
 	"sync"
 	"time"
 
@@ -13,26 +14,64 @@ import (
 	"github.com/mashiike/simplemqhttp/simplemq"
 )
 
+// DefaultVisibilityTimeout is the visibility timeout applied by the stub server on receive and extend.
+const DefaultVisibilityTimeout = 30 * time.Second
+
 // Server represents a stub server for testing
 type Server struct {
 	server   *httptest.Server
 	messages map[string]map[string]*simplemq.Message // queue -> message_id -> message
 	counter  int
 	mu       sync.Mutex
-	apiKey   string
+	// changed は、メッセージの追加や削除を WaitForMessage と WaitForDeletion に通知します
+	changed *sync.Cond
+	apiKey  string
+	// sendContentFilter は、送信されたメッセージの内容を保存前に書き換えるための関数です
+	sendContentFilter func(content string) string
+	// visibilityTimeout は、受信・延長時に設定される可視性タイムアウトです
+	visibilityTimeout time.Duration
+	// clockSkew は、スタブサーバーの時計をずらす量です
+	clockSkew time.Duration
+	// injectedErrors は、リクエストに対して返す注入されたエラーの一覧です
+	injectedErrors []*injectedError
+	// latency は、すべてのリクエストに加える遅延です
+	latency time.Duration
+	// queues は、存在するキューの一覧です。nil の場合はすべてのキューが存在するものとして扱います
+	queues map[string]bool
+	// redrivePolicies は、キューごとのデッドレターキューへの移動の設定です
+	redrivePolicies map[string]redrivePolicy
+	// receiveCounts は、キューのメッセージごとの受信された回数です
+	receiveCounts map[string]map[string]int
+}
+
+// redrivePolicy is the dead-letter configuration of a queue set by SetRedrivePolicy.
+type redrivePolicy struct {
+	deadLetterQueue string
+	maxReceive      int
+}
+
+// injectedError is an error response injected by InjectError.
+type injectedError struct {
+	method    string
+	pattern   *regexp.Regexp
+	status    int
+	body      simplemq.APIError
+	remaining int // 0 means persistent
 }
 
 // NewServer creates a new stub server
 func NewServer(apiKey string) *Server {
 	s := &Server{
-		messages: make(map[string]map[string]*simplemq.Message),
-		apiKey:   apiKey,
+		messages:          make(map[string]map[string]*simplemq.Message),
+		apiKey:            apiKey,
+		visibilityTimeout: DefaultVisibilityTimeout,
 	}
+	s.changed = sync.NewCond(&s.mu)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/v1/queues/", s.handleRequests)
 
-	s.server = httptest.NewServer(http.HandlerFunc(s.authMiddleware(mux)))
+	s.server = httptest.NewServer(http.HandlerFunc(s.authMiddleware(s.faultMiddleware(mux))))
 
 	return s
 }
@@ -54,10 +93,145 @@ func (s *Server) Reset() {
 
 	s.messages = make(map[string]map[string]*simplemq.Message)
 	s.counter = 0
+	s.injectedErrors = nil
+	s.latency = 0
+	s.queues = nil
+	s.redrivePolicies = nil
+	s.receiveCounts = nil
+	s.changed.Broadcast()
+}
+
+// InjectError makes requests matching method and pathPattern fail with the given status and body.
+// pathPattern is a regular expression matched against the request path, e.g. `/messages$` for send and receive.
+// An empty method matches any method. The error is returned for the next count matching requests,
+// or for every matching request if count is zero or negative.
+// Injected errors are evaluated in the order they were added.
+func (s *Server) InjectError(method, pathPattern string, status int, body simplemq.APIError, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if count < 0 {
+		count = 0
+	}
+	s.injectedErrors = append(s.injectedErrors, &injectedError{
+		method:    method,
+		pattern:   regexp.MustCompile(pathPattern),
+		status:    status,
+		body:      body,
+		remaining: count,
+	})
+}
+
+// SetQueues restricts the queues that exist on the server to the given names.
+// Requests to other queues fail with 404 Not Found, which is useful to test misconfigured queue names.
+// Calling it without arguments makes every queue exist again, which is the default.
+func (s *Server) SetQueues(queues ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(queues) == 0 {
+		s.queues = nil
+		return
+	}
+	s.queues = make(map[string]bool, len(queues))
+	for _, queue := range queues {
+		s.queues[queue] = true
+	}
+}
+
+// SetRedrivePolicy makes messages in queue move to the dead-letter queue dlq
+// once they have been received maxReceive times without being deleted.
+// The message is moved, keeping its ID and content, on the next receive after the last allowed delivery.
+// Passing a maxReceive of zero or less removes the policy of the queue.
+func (s *Server) SetRedrivePolicy(queue, dlq string, maxReceive int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if maxReceive <= 0 {
+		delete(s.redrivePolicies, queue)
+		return
+	}
+	if s.redrivePolicies == nil {
+		s.redrivePolicies = make(map[string]redrivePolicy)
+	}
+	s.redrivePolicies[queue] = redrivePolicy{deadLetterQueue: dlq, maxReceive: maxReceive}
+}
+
+// queueExists reports whether the queue exists on the server.
+func (s *Server) queueExists(queue string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queues == nil || s.queues[queue]
+}
+
+// InjectLatency delays every authenticated request by d. Passing zero disables the delay.
+func (s *Server) InjectLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// takeInjectedError returns the injected error matching the request, consuming it if it is not persistent.
+func (s *Server) takeInjectedError(r *http.Request) *injectedError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, e := range s.injectedErrors {
+		if e.method != "" && e.method != r.Method {
+			continue
+		}
+		if !e.pattern.MatchString(r.URL.Path) {
+			continue
+		}
+		if e.remaining > 0 {
+			e.remaining--
+			if e.remaining == 0 {
+				s.injectedErrors = append(s.injectedErrors[:i:i], s.injectedErrors[i+1:]...)
+			}
+		}
+		return e
+	}
+	return nil
+}
+
+// SetSendContentFilter sets a function that rewrites message content before it is stored on send.
+// It is useful to simulate corrupted writes. Passing nil disables the filter.
+func (s *Server) SetSendContentFilter(f func(content string) string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sendContentFilter = f
+}
+
+// SetVisibilityTimeout sets the default visibility timeout applied on receive and extend.
+// Requests with the visibility_timeout_seconds query parameter use the requested value instead.
+func (s *Server) SetVisibilityTimeout(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.visibilityTimeout = d
+}
+
+// SetClockSkew shifts the stub server clock by d.
+// Message timestamps and the Date response header are computed from the shifted clock.
+func (s *Server) SetClockSkew(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clockSkew = d
+}
+
+// now returns the current time on the stub server clock. s.mu must be held.
+func (s *Server) now() time.Time {
+	return time.Now().Add(s.clockSkew)
 }
 
 // AddMessage adds a message to a queue for testing
 func (s *Server) AddMessage(queue, content string) *simplemq.Message {
+	return s.addMessage(queue, uuid.New().String(), content, 0)
+}
+
+// AddMessageWithID adds a message with the given ID to a queue for testing.
+// It can be used to simulate a redelivery of a message that was already deleted.
+func (s *Server) AddMessageWithID(queue, id, content string) *simplemq.Message {
+	return s.addMessage(queue, id, content, 0)
+}
+
+// addMessage adds a message that expires at expiresAt in Unix milliseconds, or never if zero.
+func (s *Server) addMessage(queue, id, content string, expiresAt int64) *simplemq.Message {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -66,26 +240,29 @@ func (s *Server) AddMessage(queue, content string) *simplemq.Message {
 	}
 
 	s.counter++
-	now := time.Now().UnixMilli()
-	id := uuid.New().String()
+	now := s.now().UnixMilli()
 	msg := &simplemq.Message{
 		ID:        id,
 		Content:   content,
 		CreatedAt: now,
 		UpdatedAt: now,
+		ExpiresAt: expiresAt,
 	}
 
 	s.messages[queue][id] = msg
+	delete(s.receiveCounts[queue], id)
+	s.changed.Broadcast()
 	return msg
 }
 
-// GetMessage gets a message by ID and queue
+// GetMessage gets a copy of a message by ID and queue, or nil if it does not exist
 func (s *Server) GetMessage(queue, id string) *simplemq.Message {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if queueMsgs, ok := s.messages[queue]; ok {
-		return queueMsgs[id]
+	if msg, ok := s.messages[queue][id]; ok {
+		copied := *msg
+		return &copied
 	}
 	return nil
 }
@@ -101,9 +278,68 @@ func (s *Server) GetQueueSize(queue string) int {
 	return 0
 }
 
+// WaitForMessage blocks until the queue has a message or the timeout elapses.
+// It returns a copy of the oldest message in the queue, regardless of its visibility,
+// and false if no message was added before the timeout.
+func (s *Server) WaitForMessage(queue string, timeout time.Duration) (*simplemq.Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var found *simplemq.Message
+	ok := s.waitLocked(timeout, func() bool {
+		for _, msg := range s.messages[queue] {
+			if found == nil || msg.CreatedAt < found.CreatedAt {
+				found = msg
+			}
+		}
+		return found != nil
+	})
+	if !ok {
+		return nil, false
+	}
+	copied := *found
+	return &copied, true
+}
+
+// WaitForDeletion blocks until the message with the given ID is no longer in the queue or the timeout elapses.
+// It returns false if the message still exists after the timeout.
+func (s *Server) WaitForDeletion(queue, id string, timeout time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.waitLocked(timeout, func() bool {
+		_, exists := s.messages[queue][id]
+		return !exists
+	})
+}
+
+// waitLocked waits on s.changed until cond returns true or the timeout elapses.
+// s.mu must be held by the caller, and cond is evaluated with s.mu held.
+func (s *Server) waitLocked(timeout time.Duration, cond func() bool) bool {
+	timedOut := false
+	timer := time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		timedOut = true
+		s.changed.Broadcast()
+	})
+	defer timer.Stop()
+	for !cond() {
+		if timedOut {
+			return false
+		}
+		s.changed.Wait()
+	}
+	return true
+}
+
 // authMiddleware verifies API key
 func (s *Server) authMiddleware(next http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		w.Header().Set("Date", s.now().UTC().Format(http.TimeFormat))
+		s.mu.Unlock()
+
 		authHeader := r.Header.Get("Authorization")
 		expected := "Bearer " + s.apiKey
 
@@ -120,14 +356,60 @@ func (s *Server) authMiddleware(next http.Handler) http.HandlerFunc {
 	}
 }
 
+// faultMiddleware applies injected latency and errors
+func (s *Server) faultMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		latency := s.latency
+		s.mu.Unlock()
+		if latency > 0 {
+			select {
+			case <-time.After(latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if e := s.takeInjectedError(r); e != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(e.status)
+			json.NewEncoder(w).Encode(e.body)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 // handleRequests routes the request to the appropriate handler based on the URL path and method
 func (s *Server) handleRequests(w http.ResponseWriter, r *http.Request) {
 	// URL patterns to extract parameters
 	queueMessagesPattern := regexp.MustCompile(`^/v1/queues/([^/]+)/messages$`)
 	queueMessageIDPattern := regexp.MustCompile(`^/v1/queues/([^/]+)/messages/([^/]+)$`)
+	queuePattern := regexp.MustCompile(`^/v1/queues/([^/]+)$`)
+	queuePrefixPattern := regexp.MustCompile(`^/v1/queues/([^/]+)`)
 
 	path := r.URL.Path
 
+	if matches := queuePrefixPattern.FindStringSubmatch(path); matches != nil && !s.queueExists(matches[1]) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(simplemq.APIError{
+			Code:    404,
+			Message: "Queue not found",
+		})
+		return
+	}
+
+	if queuePattern.MatchString(path) {
+		queue := queuePattern.FindStringSubmatch(path)[1]
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleQueueStats(w, r, queue)
+		return
+	}
+
 	// Route to the appropriate handler
 	if queueMessagesPattern.MatchString(path) {
 		matches := queueMessagesPattern.FindStringSubmatch(path)
@@ -163,10 +445,42 @@ func (s *Server) handleRequests(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 }
 
+// handleQueueStats handles GET /v1/queues/{queue}
+// Expired messages are not counted.
+func (s *Server) handleQueueStats(w http.ResponseWriter, _ *http.Request, queue string) {
+	s.mu.Lock()
+	var stats simplemq.QueueStats
+	now := s.now().UnixMilli()
+	for _, msg := range s.messages[queue] {
+		if msg.ExpiresAt != 0 && msg.ExpiresAt <= now {
+			continue
+		}
+		if msg.VisibilityTimeoutAt < now {
+			stats.MessageCount++
+		} else {
+			stats.InFlightCount++
+		}
+		if stats.OldestMessageCreatedAt == 0 || msg.CreatedAt < stats.OldestMessageCreatedAt {
+			stats.OldestMessageCreatedAt = msg.CreatedAt
+		}
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Result string              `json:"result"`
+		Stats  simplemq.QueueStats `json:"stats"`
+	}{
+		Result: "success",
+		Stats:  stats,
+	})
+}
+
 // handleSendMessage handles POST /v1/queues/{queue}/messages
 func (s *Server) handleSendMessage(w http.ResponseWriter, r *http.Request, queue string) {
 	var reqBody struct {
-		Content string `json:"content"`
+		Content   string `json:"content"`
+		ExpiresAt int64  `json:"expires_at"`
 	}
 
 	body, err := io.ReadAll(r.Body)
@@ -188,32 +502,66 @@ func (s *Server) handleSendMessage(w http.ResponseWriter, r *http.Request, queue
 		return
 	}
 
-	msg := s.AddMessage(queue, reqBody.Content)
+	s.mu.Lock()
+	filter := s.sendContentFilter
+	s.mu.Unlock()
+	content := reqBody.Content
+	if filter != nil {
+		content = filter(content)
+	}
+	msg := s.addMessage(queue, uuid.New().String(), content, reqBody.ExpiresAt)
+	// 受信によって更新される前にレスポンスの内容を確定させる
+	s.mu.Lock()
+	copied := *msg
+	s.mu.Unlock()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(struct {
 		Message *simplemq.Message `json:"message"`
 	}{
-		Message: msg,
+		Message: &copied,
 	})
 }
 
-// handleReceiveMessages handles GET /v1/queues/{queue}/messages
-func (s *Server) handleReceiveMessages(w http.ResponseWriter, _ *http.Request, queue string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// receivePollInterval is how often a long-polling receive checks for visible messages.
+const receivePollInterval = 20 * time.Millisecond
 
-	messages := []*simplemq.Message{}
-	now := time.Now().UnixMilli()
+// requestedVisibilityTimeout returns the visibility timeout requested by the visibility_timeout_seconds query parameter,
+// or zero if the parameter is absent or invalid.
+func requestedVisibilityTimeout(r *http.Request) time.Duration {
+	if seconds, err := strconv.Atoi(r.URL.Query().Get("visibility_timeout_seconds")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return 0
+}
 
-	if queueMsgs, ok := s.messages[queue]; ok {
-		for _, msg := range queueMsgs {
-			if msg.VisibilityTimeoutAt < now {
-				messages = append(messages, msg)
-				msg.VisibilityTimeoutAt = now + 30000
-				msg.AcquiredAt = now
-			}
+// visibilityTimeoutOr returns requested if it is positive, or the server default otherwise.
+// It must be called with s.mu held.
+func (s *Server) visibilityTimeoutOr(requested time.Duration) time.Duration {
+	if requested > 0 {
+		return requested
+	}
+	return s.visibilityTimeout
+}
+
+// handleReceiveMessages handles GET /v1/queues/{queue}/messages
+// The optional wait_seconds query parameter long-polls for visible messages,
+// max_messages limits the number of messages returned,
+// and visibility_timeout_seconds overrides the visibility timeout of the received messages.
+func (s *Server) handleReceiveMessages(w http.ResponseWriter, r *http.Request, queue string) {
+	waitSeconds, _ := strconv.Atoi(r.URL.Query().Get("wait_seconds"))
+	maxMessages, _ := strconv.Atoi(r.URL.Query().Get("max_messages"))
+	visibilityTimeout := requestedVisibilityTimeout(r)
+	deadline := time.Now().Add(time.Duration(waitSeconds) * time.Second)
+
+	messages := s.receiveVisibleMessages(queue, maxMessages, visibilityTimeout)
+	for len(messages) == 0 && time.Now().Before(deadline) {
+		select {
+		case <-time.After(receivePollInterval):
+		case <-r.Context().Done():
+			return
 		}
+		messages = s.receiveVisibleMessages(queue, maxMessages, visibilityTimeout)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -226,6 +574,74 @@ func (s *Server) handleReceiveMessages(w http.ResponseWriter, _ *http.Request, q
 	})
 }
 
+// receiveVisibleMessages acquires up to max visible messages (all if max is zero) and hides them for the visibility timeout.
+// If visibilityTimeout is zero, the server default is used.
+// Expired messages are removed from the queue instead of being returned.
+func (s *Server) receiveVisibleMessages(queue string, max int, visibilityTimeout time.Duration) []*simplemq.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := []*simplemq.Message{}
+	now := s.now().UnixMilli()
+	visibilityTimeout = s.visibilityTimeoutOr(visibilityTimeout)
+
+	if queueMsgs, ok := s.messages[queue]; ok {
+		for id, msg := range queueMsgs {
+			if max > 0 && len(messages) >= max {
+				break
+			}
+			if msg.ExpiresAt != 0 && msg.ExpiresAt <= now {
+				delete(queueMsgs, id)
+				delete(s.receiveCounts[queue], id)
+				s.changed.Broadcast()
+				continue
+			}
+			if msg.VisibilityTimeoutAt < now {
+				if s.moveToDeadLetterLocked(queue, msg) {
+					continue
+				}
+				msg.VisibilityTimeoutAt = now + visibilityTimeout.Milliseconds()
+				msg.AcquiredAt = now
+				copied := *msg
+				messages = append(messages, &copied)
+			}
+		}
+	}
+	return messages
+}
+
+// moveToDeadLetterLocked counts a receive of msg and, if it has already been received as many times as
+// the redrive policy of the queue allows, moves it to the dead-letter queue instead and returns true.
+// It must be called with s.mu held.
+func (s *Server) moveToDeadLetterLocked(queue string, msg *simplemq.Message) bool {
+	policy, ok := s.redrivePolicies[queue]
+	if !ok {
+		return false
+	}
+	if s.receiveCounts == nil {
+		s.receiveCounts = make(map[string]map[string]int)
+	}
+	if s.receiveCounts[queue] == nil {
+		s.receiveCounts[queue] = make(map[string]int)
+	}
+	if s.receiveCounts[queue][msg.ID] < policy.maxReceive {
+		s.receiveCounts[queue][msg.ID]++
+		return false
+	}
+	delete(s.messages[queue], msg.ID)
+	delete(s.receiveCounts[queue], msg.ID)
+	if _, ok := s.messages[policy.deadLetterQueue]; !ok {
+		s.messages[policy.deadLetterQueue] = make(map[string]*simplemq.Message)
+	}
+	moved := *msg
+	moved.VisibilityTimeoutAt = 0
+	moved.AcquiredAt = 0
+	moved.UpdatedAt = s.now().UnixMilli()
+	s.messages[policy.deadLetterQueue][msg.ID] = &moved
+	s.changed.Broadcast()
+	return true
+}
+
 // handleDeleteMessage handles DELETE /v1/queues/{queue}/messages/{id}
 func (s *Server) handleDeleteMessage(w http.ResponseWriter, _ *http.Request, queue, id string) {
 	s.mu.Lock()
@@ -234,6 +650,8 @@ func (s *Server) handleDeleteMessage(w http.ResponseWriter, _ *http.Request, que
 	if queueMsgs, ok := s.messages[queue]; ok {
 		if _, exists := queueMsgs[id]; exists {
 			delete(queueMsgs, id)
+			delete(s.receiveCounts[queue], id)
+			s.changed.Broadcast()
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusOK)
 			json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
@@ -249,21 +667,18 @@ func (s *Server) handleDeleteMessage(w http.ResponseWriter, _ *http.Request, que
 }
 
 // handleExtendVisibility handles PUT /v1/queues/{queue}/messages/{id}
-func (s *Server) handleExtendVisibility(w http.ResponseWriter, _ *http.Request, queue, id string) {
+// The optional visibility_timeout_seconds query parameter overrides the extended visibility timeout.
+// The visibility timeout is set to the timeout from now rather than added to the current deadline,
+// so repeated extensions by a consumer holding the message do not accumulate.
+// Extending a message that is currently acquired is the normal case for a consumer that is still processing it,
+// so it is accepted instead of being rejected with 409 Conflict.
+func (s *Server) handleExtendVisibility(w http.ResponseWriter, r *http.Request, queue, id string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if queueMsgs, ok := s.messages[queue]; ok {
 		if msg, exists := queueMsgs[id]; exists {
-			if msg.VisibilityTimeoutAt > time.Now().UnixMilli() {
-				w.WriteHeader(http.StatusConflict)
-				json.NewEncoder(w).Encode(simplemq.APIError{
-					Code:    409,
-					Message: "Message is already acquired",
-				})
-				return
-			}
-			msg.VisibilityTimeoutAt += 30000
+			msg.VisibilityTimeoutAt = s.now().UnixMilli() + s.visibilityTimeoutOr(requestedVisibilityTimeout(r)).Milliseconds()
 			s.messages[queue][id] = msg
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(struct {
@@ -0,0 +1,35 @@
+// Package stubtest provides helpers for testing code built on simplemqhttp against the stub server.
+//
+// It lives in a separate package from stub because it depends on simplemqhttp,
+// whose own tests import stub.
+package stubtest
+
+import (
+	"testing"
+
+	"github.com/mashiike/simplemqhttp"
+	"github.com/mashiike/simplemqhttp/simplemq"
+	"github.com/mashiike/simplemqhttp/stub"
+)
+
+// APIKey is the API key accepted by the stub server created by NewListener.
+const APIKey = "stubtest-api-key"
+
+// NewListener starts a stub server and returns a Listener that receives messages from queue on it,
+// together with the server. Messages added with Server.AddMessage are delivered to the Listener.
+// The Listener and the server are closed by t.Cleanup when the test finishes.
+//
+// Fields of the Listener must be set before the first Accept, as with any Listener.
+func NewListener(t testing.TB, queue string) (*simplemqhttp.Listener, *stub.Server) {
+	t.Helper()
+	server := stub.NewServer(APIKey)
+	t.Cleanup(server.Close)
+	client := simplemq.NewClient(APIKey, queue)
+	client.Endpoint = server.URL()
+	listener := simplemqhttp.NewListenerWithClient(client)
+	// Cleanup functions run in reverse order, so the listener is closed before the server
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	return listener, server
+}
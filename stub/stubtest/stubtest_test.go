@@ -0,0 +1,38 @@
+package stubtest_test
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/stub/stubtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewListener(t *testing.T) {
+	listener, server := stubtest.NewListener(t, "test-queue")
+	received := make(chan string, 1)
+	httpServer := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			received <- string(body)
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go httpServer.Serve(listener)
+	t.Cleanup(func() {
+		httpServer.Close()
+	})
+
+	// 追加したメッセージがハンドラーに届き、処理後に削除されること
+	msg := server.AddMessage("test-queue", "aGVsbG8=")
+	select {
+	case body := <-received:
+		assert.Equal(t, "hello", body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message should be delivered")
+	}
+	require.True(t, server.WaitForDeletion("test-queue", msg.ID, 5*time.Second))
+}
@@ -2,11 +2,17 @@ package simplemqhttp
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
+	"math/rand/v2"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mashiike/simplemqhttp/simplemq"
@@ -18,6 +24,106 @@ type Transport struct {
 	// Serializer は、リクエストをシリアライズするためのインターフェースです。
 	// 未指定の場合は、BodyOnlySerializer が使用されます。
 	Serializer Serializer
+	// ConfirmWrites が true の場合、送信後に API が返したメッセージの内容が送信した内容と一致するかを検証します。
+	// 一致しない場合は ErrWriteConfirmationFailed をラップした 502 Bad Gateway のレスポンスを返します。
+	// 既に保存されたメッセージを重複させないよう、この場合は再試行もローカルバッファへの格納も行いません。
+	ConfirmWrites bool
+	// ErrorResponseContentType は、API エラー時に返すレスポンスボディの形式です。
+	// "application/json" の場合は simplemq.APIError を JSON で返します。
+	// 未指定の場合は "text/plain" でエラーメッセージのみを返します。
+	ErrorResponseContentType string
+	// HeaderAllowlist は、メッセージ属性として送信するリクエストヘッダーの一覧です。
+	// 指定されたヘッダーはメッセージ属性として送信され、Listener がリクエストを再構成する際に、同じ名前のヘッダーがなければ復元されます。
+	// EnvelopeSerializer と JSONSerializer は属性を形式の attributes フィールドに含め、EncryptingSerializer は属性も暗号化します。
+	// それ以外のシリアライザでは、属性を "simplemqhttp-attributes:<base64 JSON>" の1行としてメッセージの先頭に付与します。
+	HeaderAllowlist []string
+	// SizeRecorder は、送信するメッセージのサイズを記録します。
+	SizeRecorder MessageSizeRecorder
+	// SourceID は、メッセージを送信したホストやプロセスを識別するための値です。
+	// 指定された場合はメッセージ属性として送信され、Listener 側では SimpleMQ-Source ヘッダーとして参照できます。
+	// 空の場合は付与しません。ホスト名などを付与したい場合は DefaultSourceID の値を設定してください。
+	SourceID string
+	// GroupIDHeader は、メッセージのグループ ID を読み取るリクエストヘッダーの名前です。
+	// 指定した場合、リクエストのこのヘッダーの値を同じ名前のメッセージ属性として送信します。
+	// Listener の OrderingKey に同じ名前で OrderingKeyFromHeader を指定すると、同じグループ ID のメッセージを順に処理できます。
+	// 通常は DefaultGroupIDHeader を指定します。空の場合は付与しません。
+	GroupIDHeader string
+	// RawTooLargeError が true の場合、リクエストがメッセージの最大サイズを超えるときに
+	// 413 Request Entity Too Large のレスポンスではなく ErrTooLarge のエラーを返します。
+	RawTooLargeError bool
+	// MaxRetries は、一時的なエラーでメッセージの送信に失敗した場合に再試行する最大回数です。
+	// ネットワークエラーと 5xx、429 のエラーが再試行の対象で、それ以外の 4xx のエラーは再試行しません。
+	// 0 の場合は再試行しません。
+	MaxRetries int
+	// RetryBackoff は、再試行の回数 (1 始まり) から再試行までの待機時間を返す関数です。
+	// 未指定の場合は、100ミリ秒から5秒までの ExponentialBackoff にジッターを加えた値が使用されます。
+	// 429 のレスポンスに Retry-After ヘッダーがある場合は、その値が優先されます。
+	RetryBackoff Backoff
+	// Metrics は、SimpleMQ への送信の呼び出しを記録します。再試行した場合は、それぞれの呼び出しが記録されます。
+	// 未指定の場合は記録しません。
+	Metrics Metrics
+	// HeaderPrefix は、レスポンスに付与する SimpleMQ-Message-ID などのヘッダー名の接頭辞です。
+	// Listener.HeaderPrefix と同じ値を指定してください。未指定の場合は、DefaultHeaderPrefix が使用されます。
+	HeaderPrefix string
+	// Logger は、シリアライズやメッセージの送信の結果を記録するロガーです。
+	// 未指定の場合は、slog.Default() が使用されます。
+	Logger *slog.Logger
+	// IdempotencyWindow は、IdempotencyKeyHeader が同じリクエストの送信結果を記録しておく期間です。
+	// 指定した場合、この期間内に送信に成功したリクエストと同じ冪等性キーのリクエストは、再送信せずに前回と同じ内容のレスポンスを返します。
+	// SimpleMQ には冪等性キーによる重複排除の機能がないため、記録はこの Transport のプロセス内のみで保持されます。
+	// 送信に失敗したリクエストは記録されず、再試行すると再び送信されます。
+	// 0 以下の場合は重複を排除しません。
+	IdempotencyWindow time.Duration
+	idempotencyOnce   sync.Once
+	idempotency       *idempotencyCache
+	// ReplyQueue は、Listener 側で処理した結果のレスポンスを受け取る応答キューのクライアントです。
+	// 指定した場合、RoundTrip はメッセージを送信した後に CorrelationIDHeader の相関 ID が一致する応答を応答キューから受信し、
+	// 202 Accepted の代わりに Listener 側のハンドラーが返したレスポンスを返します。
+	// Listener 側では、ResponseHandler に同じキューを指定した ReplyResponseHandler を使用してください。
+	// 応答キューは Transport ごとに専用のキューを使用してください。待っているリクエストのない応答は破棄されます。
+	ReplyQueue *simplemq.Client
+	// ReplyTimeout は、ReplyQueue が指定されている場合に応答を待つ最大時間です。
+	// 応答がない場合は 504 Gateway Timeout のレスポンスを返しますが、メッセージはキューに残り、その後に処理される可能性があります。
+	// 未指定の場合は、DefaultReplyTimeout が使用されます。
+	ReplyTimeout time.Duration
+	replies      replyWaiters
+	// EnableLocalBuffer が true の場合、MaxRetries の再試行の後もネットワークエラーや 5xx、429 のエラーで送信できなかったメッセージを
+	// プロセス内のバッファに格納し、RoundTrip は送信できたものとして 202 Accepted のレスポンスを返します。
+	// このレスポンスには SimpleMQ-Message-ID の代わりに SimpleMQ-Message-Buffered ヘッダーが付与されます。
+	// バッファのメッセージはバックグラウンドで RetryBackoff に従って再送信され、Flush で送信の完了を待つことができます。
+	//
+	// バッファはメモリ上にのみ保持されるため、プロセスが終了するとバッファのメッセージは失われます。
+	// 終了する前に Flush で送信の完了を待ち、Close で再送信の goroutine を停止してください。
+	// ReplyQueue が指定されている場合は使用されません。
+	EnableLocalBuffer bool
+	// BufferSize は、ローカルバッファに格納するメッセージの最大数です。バッファが一杯の場合は、送信のエラーをそのまま返します。
+	// 未指定の場合は、DefaultBufferSize が使用されます。
+	BufferSize  int
+	localBuffer localBuffer
+}
+
+// SourceHeader は、メッセージを送信したホストやプロセスの識別子を表すヘッダーです。
+const SourceHeader = "SimpleMQ-Source"
+
+// DefaultGroupIDHeader は、Transport.GroupIDHeader と OrderingKeyFromHeader に指定するヘッダー名の慣例です。
+const DefaultGroupIDHeader = "SimpleMQ-Group-ID"
+
+// MessageTTLHeader は、Transport で送信するメッセージの有効期限をリクエストごとに指定するためのリクエストヘッダーです。
+// 値には "10m" のような time.ParseDuration の形式、または秒数の整数を指定します。
+// このヘッダーはメッセージの内容には含まれません。また、HeaderPrefix は適用されません。
+const MessageTTLHeader = "SimpleMQ-Message-TTL"
+
+// DefaultSourceID は、Transport.SourceID の既定値を返します。
+// 環境変数 POD_NAME が設定されている場合はその値を、そうでない場合はホスト名を返します。
+func DefaultSourceID() string {
+	if podName := os.Getenv("POD_NAME"); podName != "" {
+		return podName
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return hostname
 }
 
 // NewTransport は、新しい Transport を作成します。
@@ -35,6 +141,52 @@ func NewTransportWithClient(client *simplemq.Client) *Transport {
 
 var _ http.RoundTripper = &Transport{}
 
+// Client は、Transport がメッセージの送信に使用する SimpleMQ クライアントを返します。
+// 同じクライアントで QueueStats などの API を呼び出す場合に使用します。
+func (t *Transport) Client() *simplemq.Client {
+	return t.client
+}
+
+func (t *Transport) errorResponseBody(apiErr *simplemq.APIError) (string, string, error) {
+	switch t.ErrorResponseContentType {
+	case "", "text/plain":
+		return "text/plain", apiErr.Message, nil
+	case "application/json":
+		bs, err := json.Marshal(apiErr)
+		if err != nil {
+			return "", "", err
+		}
+		return "application/json", string(bs), nil
+	default:
+		return "", "", fmt.Errorf("unsupported error response content type: %s", t.ErrorResponseContentType)
+	}
+}
+
+func (t *Transport) header(name string) string {
+	if t.HeaderPrefix == "" {
+		return DefaultHeaderPrefix + name
+	}
+	return t.HeaderPrefix + name
+}
+
+func (t *Transport) logger() *slog.Logger {
+	if t.Logger != nil {
+		return t.Logger
+	}
+	return slog.Default()
+}
+
+// idempotencyCache は、IdempotencyWindow が指定されている場合に冪等性キーのキャッシュを返します。
+func (t *Transport) idempotencyCache() *idempotencyCache {
+	if t.IdempotencyWindow <= 0 {
+		return nil
+	}
+	t.idempotencyOnce.Do(func() {
+		t.idempotency = newIdempotencyCache(t.IdempotencyWindow)
+	})
+	return t.idempotency
+}
+
 func (t *Transport) serializer() Serializer {
 	if t.Serializer != nil {
 		return t.Serializer
@@ -42,37 +194,248 @@ func (t *Transport) serializer() Serializer {
 	return &BodyOnlySerializer{}
 }
 
+var defaultRetryBackoff = ExponentialBackoff(100*time.Millisecond, 5*time.Second)
+
+func (t *Transport) retryBackoff(attempt int) time.Duration {
+	if t.RetryBackoff != nil {
+		return t.RetryBackoff(attempt)
+	}
+	d := defaultRetryBackoff(attempt)
+	half := d / 2
+	return half + rand.N(d-half+1)
+}
+
+// ErrWriteConfirmationFailed は、ConfirmWrites が有効な場合に、API が保存したメッセージの内容が送信した内容と一致しないときのエラーです。
+var ErrWriteConfirmationFailed = errors.New("write confirmation failed")
+
+// isRetryableError は、API の呼び出しを再試行すべきエラーかどうかを返します。
+// ネットワークエラーと 5xx、429 のエラーを再試行の対象とします。
+// 書き込みの確認に失敗した場合は、メッセージが既に保存されているため対象としません。
+func isRetryableError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, ErrWriteConfirmationFailed) {
+		return false
+	}
+	var apiErr *simplemq.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code >= 500 || apiErr.Code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// sendMessage は、MaxRetries と RetryBackoff に従って再試行しながらメッセージを送信します。
+func (t *Transport) sendMessage(ctx context.Context, content string, opts simplemq.SendOptions) (*simplemq.Message, error) {
+	for attempt := 1; ; attempt++ {
+		msg, err := t.client.SendMessageWithOptions(ctx, content, opts)
+		if !errors.Is(err, context.Canceled) {
+			observeOperation(t.Metrics, t.client.Queue, OperationSend, err)
+		}
+		if err == nil || attempt > t.MaxRetries || !isRetryableError(err) {
+			return msg, err
+		}
+		wait := t.retryBackoff(attempt)
+		var apiErr *simplemq.APIError
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusTooManyRequests && apiErr.RetryAfter > 0 {
+			wait = apiErr.RetryAfter
+		}
+		t.logger().Warn("failed to send message, retrying", "err", err, "queue", t.client.Queue, "attempt", attempt, "wait", wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// sendOptions は、MessageTTLHeader からメッセージの送信オプションを取得し、ヘッダーを取り除いたリクエストを返します。
+func (t *Transport) sendOptions(req *http.Request) (simplemq.SendOptions, *http.Request, error) {
+	var opts simplemq.SendOptions
+	v := req.Header.Get(MessageTTLHeader)
+	if v == "" {
+		return opts, req, nil
+	}
+	ttl, err := parseRedeliverAfter(v)
+	if err != nil {
+		return opts, nil, fmt.Errorf("invalid %s header: %w", MessageTTLHeader, err)
+	}
+	opts.TTL = ttl
+	req = req.Clone(req.Context())
+	req.Header.Del(MessageTTLHeader)
+	return opts, req, nil
+}
+
 // RoundTrip は HTTP リクエストを SimpleMQ メッセージとして送信し、その結果を HTTP レスポンスとして返します。
+// リクエストに MessageTTLHeader がある場合は、その値をメッセージの有効期限として送信します。
+// API が有効期限に対応していない場合、メッセージはキューの既定の保持期間まで残ります。
+// API が受け付けた有効期限は、レスポンスの SimpleMQ-Message-Expires ヘッダーで確認できます。
+// IdempotencyWindow が指定されている場合、IdempotencyKeyHeader が同じリクエストの再送信を抑制します。
+// 冪等性キーのヘッダーは他のヘッダーと同様に扱われ、HeaderAllowlist や JSONSerializer でメッセージに含めることができます。
+//
+// ReplyQueue が指定されている場合は、Listener 側の処理が終わるまで応答を待ちます。
+// 応答までの時間には、Listener がメッセージを受信するまでの時間と応答キューのポーリングの間隔が加わるため、
+// 直接 HTTP リクエストを送信する場合よりも大きく遅延します。
+// 再送信を抑制したリクエストの場合は、応答を待たずに 202 Accepted のレスポンスを返します。
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
-	serializer := t.serializer()
-	content, err := serializer.Serialize(req)
+	opts, req, err := t.sendOptions(req)
 	if err != nil {
 		return nil, err
 	}
-	msg, err := t.client.SendMessage(req.Context(), content)
+	var (
+		correlationID string
+		replyCh       chan string
+	)
+	if t.ReplyQueue != nil {
+		req, correlationID = withCorrelationID(req)
+		replyCh = t.replies.register(correlationID)
+	}
+	cache, key := t.idempotencyCache(), req.Header.Get(IdempotencyKeyHeader)
+	var msg *simplemq.Message
+	if cache == nil || key == "" {
+		msg, err = t.send(req, opts)
+	} else {
+		var (
+			buffered bool
+			complete func(msg *simplemq.Message, buffered bool)
+		)
+		msg, buffered, complete, err = cache.acquire(req.Context(), key)
+		if err != nil {
+			t.replies.unregister(correlationID)
+			return nil, err
+		}
+		if msg != nil || buffered {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			t.replies.unregister(correlationID)
+			if msg != nil {
+				t.logger().Debug("duplicate request suppressed by idempotency key", "message_id", msg.ID, "queue", t.client.Queue, "idempotency_key", key)
+			} else {
+				t.logger().Debug("duplicate request suppressed by idempotency key", "buffered", true, "queue", t.client.Queue, "idempotency_key", key)
+			}
+			return t.response(req, msg, nil)
+		}
+		msg, err = t.send(req, opts)
+		// send はメッセージをローカルバッファに格納した場合に msg と err の両方に nil を返す
+		complete(msg, msg == nil && err == nil)
+	}
+	if err != nil || replyCh == nil {
+		t.replies.unregister(correlationID)
+		return t.response(req, msg, err)
+	}
+	return t.waitReply(req, msg, correlationID, replyCh)
+}
+
+// send は、リクエストをシリアライズして送信し、送信したメッセージを返します。
+// メッセージをローカルバッファに格納した場合は、メッセージとエラーの両方に nil を返します。
+// リクエストがメッセージの最大サイズを超える場合は、RawTooLargeError が false であれば 413 の simplemq.APIError を返します。
+func (t *Transport) send(req *http.Request, opts simplemq.SendOptions) (*simplemq.Message, error) {
+	content, err := t.serialize(req)
+	if err != nil {
+		t.logger().Debug("failed to serialize request", "err", err, "queue", t.client.Queue, "method", req.Method, "url", req.URL.String())
+		if errors.Is(err, ErrTooLarge) && !t.RawTooLargeError {
+			return nil, &simplemq.APIError{
+				Code:    http.StatusRequestEntityTooLarge,
+				Message: err.Error(),
+			}
+		}
+		return nil, err
+	}
+	t.logger().Debug("serialized request", "queue", t.client.Queue, "method", req.Method, "url", req.URL.String(), "size", len(content))
+	if t.SizeRecorder != nil {
+		t.SizeRecorder.RecordMessageSize(len(content))
+	}
+	msg, err := t.sendMessage(req.Context(), content, opts)
+	if err == nil && t.ConfirmWrites && msg.Content != content {
+		err = fmt.Errorf("%w: %w", ErrWriteConfirmationFailed, &simplemq.APIError{
+			Code:    http.StatusBadGateway,
+			Message: fmt.Sprintf("write confirmation failed: stored content of message %s does not match sent content", msg.ID),
+		})
+	}
+	if err != nil && t.EnableLocalBuffer && t.ReplyQueue == nil && isRetryableError(err) {
+		if t.bufferMessage(content, opts) {
+			t.logger().Warn("failed to send message, buffered locally", "err", err, "queue", t.client.Queue)
+			return nil, nil
+		}
+		t.logger().Warn("local buffer is full", "queue", t.client.Queue, "buffer_size", t.bufferSize())
+	}
+	if err != nil {
+		t.logger().Error("failed to send message", "err", err, "queue", t.client.Queue)
+		return nil, err
+	}
+	t.logger().Debug("message sent", "message_id", msg.ID, "queue", t.client.Queue)
+	return msg, nil
+}
+
+// serialize は、リクエストをメッセージの内容にシリアライズし、許可されたヘッダーなどのメッセージ属性を付与します。
+func (t *Transport) serialize(req *http.Request) (string, error) {
+	header := allowlistedHeaders(req.Header, t.HeaderAllowlist)
+	if t.SourceID != "" {
+		header.Set(SourceHeader, t.SourceID)
+	}
+	if t.GroupIDHeader != "" {
+		if id := req.Header.Get(t.GroupIDHeader); id != "" {
+			header.Set(t.GroupIDHeader, id)
+		}
+	}
+	if t.ReplyQueue != nil {
+		if id := req.Header.Get(CorrelationIDHeader); id != "" {
+			header.Set(CorrelationIDHeader, id)
+		}
+	}
+	serializer := t.serializer()
+	content, err := serializeWithAttributes(serializer, req, header)
+	if err != nil {
+		return "", err
+	}
+	// メッセージ属性を含めた内容が、シリアライザの上限に収まることを確認する
+	if len(content) > contentSizeLimit(serializer) {
+		return "", ErrTooLarge
+	}
+	return content, nil
+}
+
+// response は、送信の結果から RoundTrip が返すレスポンスを組み立てます。
+// err が simplemq.APIError の場合はそのステータスコードのレスポンスを、それ以外のエラーの場合はエラーを返します。
+func (t *Transport) response(req *http.Request, msg *simplemq.Message, err error) (*http.Response, error) {
 	var builder strings.Builder
 	if err != nil {
 		var apiErr *simplemq.APIError
 		if !errors.As(err, &apiErr) {
 			return nil, err
 		}
+		contentType, body, err := t.errorResponseBody(apiErr)
+		if err != nil {
+			return nil, err
+		}
 		builder.WriteString(fmt.Sprintf("HTTP/1.1 %d %s\r\n", apiErr.Code, http.StatusText(apiErr.Code)))
 		headers := http.Header{
-			"Content-Type":        []string{"text/plain"},
-			"Content-Length":      []string{strconv.Itoa(len(apiErr.Message))},
-			"SimpleMQ-Queue-Name": []string{t.client.Queue},
+			"Content-Type":   []string{contentType},
+			"Content-Length": []string{strconv.Itoa(len(body))},
 		}
+		headers.Set(t.header("Queue-Name"), t.client.Queue)
 		headers.Write(&builder)
 		builder.WriteString("\r\n")
-		builder.WriteString(apiErr.Message)
+		builder.WriteString(body)
 	} else {
 		builder.WriteString(fmt.Sprintf("HTTP/1.1 %d %s\r\n", http.StatusAccepted, http.StatusText(http.StatusAccepted)))
 		headers := http.Header{
-			"Content-Type":             []string{"text/plain"},
-			"Content-Length":           []string{"0"},
-			"SimpleMQ-Queue-Name":      []string{t.client.Queue},
-			"SimpleMQ-Message-ID":      []string{msg.ID},
-			"SimpleMQ-Message-Created": []string{msg.CreatedTime().Format(time.RFC3339)},
+			"Content-Type":   []string{"text/plain"},
+			"Content-Length": []string{"0"},
+		}
+		headers.Set(t.header("Queue-Name"), t.client.Queue)
+		if msg == nil {
+			// ローカルバッファに格納したメッセージは、まだ ID が割り当てられていない
+			headers.Set(t.header("Message-Buffered"), "true")
+		} else {
+			headers.Set(t.header("Message-ID"), msg.ID)
+			headers.Set(t.header("Message-Created"), msg.CreatedTime().Format(time.RFC3339))
+			if msg.ExpiresAt != 0 {
+				headers.Set(t.header("Message-Expires"), msg.ExpiresTime().Format(time.RFC3339))
+			}
 		}
 		headers.Write(&builder)
 		builder.WriteString("\r\n")
@@ -3,7 +3,9 @@ package simplemqhttp
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
@@ -11,7 +13,9 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/mashiike/simplemqhttp/simplemq"
 	"github.com/mashiike/simplemqhttp/stub"
@@ -257,3 +261,766 @@ func TestTransportHTTPClient(t *testing.T) {
 	queueSize := stubServer.GetQueueSize("test-queue")
 	assert.Equal(t, 1, queueSize, "One message should be in the queue")
 }
+
+func TestTransportConfirmWrites(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// テスト用のclientを作成
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	// 書き込み確認を有効にしたTransportの作成
+	transport := NewTransportWithClient(client)
+	transport.ConfirmWrites = true
+
+	t.Run("Content matches", func(t *testing.T) {
+		req, err := http.NewRequest("POST", "/test", strings.NewReader(`{"confirm":"ok"}`))
+		require.NoError(t, err)
+
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	})
+
+	t.Run("Content is corrupted", func(t *testing.T) {
+		// 保存される内容を書き換えるようにする
+		stubServer.SetSendContentFilter(func(content string) string {
+			return content + "corrupted"
+		})
+		defer stubServer.SetSendContentFilter(nil)
+
+		req, err := http.NewRequest("POST", "/test", strings.NewReader(`{"confirm":"ng"}`))
+		require.NoError(t, err)
+
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "write confirmation failed")
+	})
+}
+
+func TestTransportJSONErrorResponse(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// 不正なAPI Keyでclientを作成（認証エラーを発生させる）
+	client := simplemq.NewClient("invalid-api-key", "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	// エラーレスポンスをJSONで返すTransportの作成
+	transport := NewTransportWithClient(client)
+	transport.ErrorResponseContentType = "application/json"
+
+	req, err := http.NewRequest("GET", "/test", nil)
+	require.NoError(t, err)
+
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	// レスポンスボディがAPIErrorとして読み込めることを確認
+	var apiErr simplemq.APIError
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&apiErr))
+	assert.Equal(t, http.StatusUnauthorized, apiErr.Code)
+	assert.Equal(t, "unauthorized", apiErr.Message)
+}
+
+func TestTransportHeaderAllowlist(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// テスト用のclientを作成
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	// 許可したヘッダーのみを送信するTransportの作成
+	transport := NewTransportWithClient(client)
+	transport.HeaderAllowlist = []string{"Content-Type", "x-tenant-id"}
+
+	req, err := http.NewRequest("POST", "/test", strings.NewReader(`{"header":"allowlist"}`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tenant-Id", "tenant-a")
+	req.Header.Set("X-Secret", "should-not-be-sent")
+
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	// Listenerで受信したリクエストにヘッダーが復元されること
+	headerCh := make(chan http.Header, 1)
+	bodyCh := make(chan string, 1)
+	listener := NewListenerWithClient(client)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			bs, _ := io.ReadAll(r.Body)
+			headerCh <- r.Header.Clone()
+			bodyCh <- string(bs)
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	select {
+	case header := <-headerCh:
+		assert.Equal(t, "application/json", header.Get("Content-Type"))
+		assert.Equal(t, "tenant-a", header.Get("X-Tenant-Id"))
+		assert.Empty(t, header.Get("X-Secret"))
+		assert.Equal(t, `{"header":"allowlist"}`, <-bodyCh)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message should be delivered")
+	}
+
+	t.Run("With EncryptingSerializer", func(t *testing.T) {
+		// メッセージ属性も暗号化され、平文で残らないこと
+		serializer := &EncryptingSerializer{Keys: []EncryptionKey{testEncryptionKey("k1", 1)}}
+		transport := NewTransportWithClient(client.Clone("encrypted-queue"))
+		transport.HeaderAllowlist = []string{"X-Tenant-Id"}
+		transport.SourceID = "producer-1"
+		transport.Serializer = serializer
+		req, err := http.NewRequest("POST", "/test", strings.NewReader(`{"header":"encrypted"}`))
+		require.NoError(t, err)
+		req.Header.Set("X-Tenant-Id", "tenant-a")
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+		stored := stubServer.GetMessage("encrypted-queue", resp.Header.Get("SimpleMQ-Message-ID"))
+		require.NotNil(t, stored)
+		assert.True(t, strings.HasPrefix(stored.Content, encryptedPrefix))
+		assert.NotContains(t, stored.Content, "tenant-a")
+		assert.NotContains(t, stored.Content, attributesPrefix)
+
+		// 復号するとメッセージ属性が復元されること
+		restored, attributes, err := deserializeWithAttributes(serializer, stored.Content)
+		require.NoError(t, err)
+		assert.Equal(t, "tenant-a", attributes.Get("X-Tenant-Id"))
+		assert.Equal(t, "producer-1", attributes.Get(SourceHeader))
+		body, err := io.ReadAll(restored.Body)
+		require.NoError(t, err)
+		assert.Equal(t, `{"header":"encrypted"}`, string(body))
+	})
+
+	t.Run("With JSONSerializer", func(t *testing.T) {
+		// メッセージ属性は attributes に格納され、内容は JSON のまま読めること
+		transport := NewTransportWithClient(client.Clone("json-queue"))
+		transport.HeaderAllowlist = []string{"X-Tenant-Id"}
+		transport.SourceID = "producer-1"
+		transport.Serializer = &JSONSerializer{}
+		req, err := http.NewRequest("POST", "/test", strings.NewReader(`{"header":"json"}`))
+		require.NoError(t, err)
+		req.Header.Set("X-Tenant-Id", "tenant-a")
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+		stored := stubServer.GetMessage("json-queue", resp.Header.Get("SimpleMQ-Message-ID"))
+		require.NotNil(t, stored)
+		var r jsonRequest
+		require.NoError(t, json.Unmarshal([]byte(stored.Content), &r))
+		assert.Equal(t, "producer-1", http.Header(r.Attributes).Get(SourceHeader))
+		assert.Equal(t, "tenant-a", http.Header(r.Attributes).Get("X-Tenant-Id"))
+	})
+
+	t.Run("With EnvelopeSerializer", func(t *testing.T) {
+		// メッセージ属性はエンベロープの attributes に格納されること
+		transport := NewTransportWithClient(client.Clone("envelope-queue"))
+		transport.SourceID = "producer-1"
+		transport.Serializer = &EnvelopeSerializer{}
+		req, err := http.NewRequest("POST", "/test", strings.NewReader(`{"header":"envelope"}`))
+		require.NoError(t, err)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+		stored := stubServer.GetMessage("envelope-queue", resp.Header.Get("SimpleMQ-Message-ID"))
+		require.NotNil(t, stored)
+		var env envelope
+		require.NoError(t, json.Unmarshal([]byte(stored.Content), &env))
+		assert.Equal(t, "producer-1", env.Attributes.Get(SourceHeader))
+	})
+
+	t.Run("Serializer size limit", func(t *testing.T) {
+		// メッセージ属性を含めた内容が、シリアライザの MaxContentSize を超える場合は 413 を返すこと
+		transport := NewTransportWithClient(client.Clone("limit-queue"))
+		transport.HeaderAllowlist = []string{"X-Tenant-Id"}
+		transport.Serializer = &BodyOnlySerializer{MaxContentSize: 1024}
+		req, err := http.NewRequest("POST", "/test", strings.NewReader(strings.Repeat("a", 700)))
+		require.NoError(t, err)
+		req.Header.Set("X-Tenant-Id", strings.Repeat("t", 200))
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		assert.Equal(t, 0, stubServer.GetQueueSize("limit-queue"))
+	})
+}
+
+func TestTransportSourceID(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// テスト用のclientを作成
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	// 送信元を付与するTransportの作成
+	t.Setenv("POD_NAME", "producer-pod-1")
+	transport := NewTransportWithClient(client)
+	transport.SourceID = DefaultSourceID()
+	require.Equal(t, "producer-pod-1", transport.SourceID)
+
+	req, err := http.NewRequest("POST", "/test", strings.NewReader(`{"source":"id"}`))
+	require.NoError(t, err)
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	// Listenerで受信したリクエストに送信元が復元されること
+	headerCh := make(chan http.Header, 1)
+	listener := NewListenerWithClient(client)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			headerCh <- r.Header.Clone()
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	select {
+	case header := <-headerCh:
+		assert.Equal(t, "producer-pod-1", header.Get(SourceHeader))
+	case <-time.After(5 * time.Second):
+		t.Fatal("message should be delivered")
+	}
+}
+
+// sendFailureTransport は、指定回数の送信を指定したステータスで失敗させるトランスポートです。
+type sendFailureTransport struct {
+	status     int
+	retryAfter string
+	failures   atomic.Int32
+	sends      atomic.Int32
+}
+
+func (f *sendFailureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	f.sends.Add(1)
+	if f.failures.Add(-1) >= 0 {
+		header := http.Header{"Content-Type": []string{"application/json"}}
+		if f.retryAfter != "" {
+			header.Set("Retry-After", f.retryAfter)
+		}
+		body := fmt.Sprintf(`{"code":%d,"message":"injected"}`, f.status)
+		return &http.Response{
+			StatusCode: f.status,
+			Header:     header,
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestTransportRetry(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	newTransport := func(failure *sendFailureTransport) *Transport {
+		client := simplemq.NewClient(apiKey, "test-queue")
+		client.Endpoint = stubServer.URL()
+		client.HTTPClient = &http.Client{Transport: failure}
+		transport := NewTransportWithClient(client)
+		transport.MaxRetries = 3
+		transport.RetryBackoff = func(int) time.Duration { return 10 * time.Millisecond }
+		return transport
+	}
+	newRequest := func(ctx context.Context) *http.Request {
+		req, err := http.NewRequestWithContext(ctx, "POST", "/test", strings.NewReader(`{"retry":true}`))
+		require.NoError(t, err)
+		return req
+	}
+
+	t.Run("Retry 5xx until success", func(t *testing.T) {
+		failure := &sendFailureTransport{status: http.StatusServiceUnavailable}
+		failure.failures.Store(2)
+		resp, err := newTransport(failure).RoundTrip(newRequest(context.Background()))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+		assert.EqualValues(t, 3, failure.sends.Load())
+	})
+
+	t.Run("Give up after MaxRetries", func(t *testing.T) {
+		failure := &sendFailureTransport{status: http.StatusInternalServerError}
+		failure.failures.Store(10)
+		resp, err := newTransport(failure).RoundTrip(newRequest(context.Background()))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		assert.EqualValues(t, 4, failure.sends.Load())
+	})
+
+	t.Run("Do not retry 4xx", func(t *testing.T) {
+		failure := &sendFailureTransport{status: http.StatusBadRequest}
+		failure.failures.Store(1)
+		resp, err := newTransport(failure).RoundTrip(newRequest(context.Background()))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.EqualValues(t, 1, failure.sends.Load())
+	})
+
+	t.Run("Wait Retry-After on 429", func(t *testing.T) {
+		failure := &sendFailureTransport{status: http.StatusTooManyRequests, retryAfter: "1"}
+		failure.failures.Store(1)
+		start := time.Now()
+		resp, err := newTransport(failure).RoundTrip(newRequest(context.Background()))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+		assert.EqualValues(t, 2, failure.sends.Load())
+		assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	})
+
+	t.Run("Stop retrying when context is canceled", func(t *testing.T) {
+		failure := &sendFailureTransport{status: http.StatusServiceUnavailable}
+		failure.failures.Store(10)
+		transport := newTransport(failure)
+		transport.RetryBackoff = func(int) time.Duration { return time.Minute }
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := transport.RoundTrip(newRequest(ctx))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.EqualValues(t, 1, failure.sends.Load())
+	})
+}
+
+func TestTransportRetryWithInjectedErrors(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	transport := NewTransportWithClient(client)
+	transport.MaxRetries = 2
+	transport.RetryBackoff = func(int) time.Duration { return 10 * time.Millisecond }
+
+	t.Run("Recover from injected 5xx", func(t *testing.T) {
+		defer stubServer.Reset()
+		// 送信を2回だけ失敗させる
+		stubServer.InjectError(http.MethodPost, `/messages$`, http.StatusServiceUnavailable, simplemq.APIError{Code: 503, Message: "injected"}, 2)
+
+		req, err := http.NewRequest("POST", "/test", strings.NewReader(`{"inject":"error"}`))
+		require.NoError(t, err)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+		assert.Equal(t, 1, stubServer.GetQueueSize("test-queue"))
+	})
+
+	t.Run("Persistent injected error", func(t *testing.T) {
+		defer stubServer.Reset()
+		// 送信を常に失敗させる
+		stubServer.InjectError(http.MethodPost, `/messages$`, http.StatusBadGateway, simplemq.APIError{Code: 502, Message: "injected"}, 0)
+
+		req, err := http.NewRequest("POST", "/test", strings.NewReader(`{"inject":"error"}`))
+		require.NoError(t, err)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		assert.Equal(t, 0, stubServer.GetQueueSize("test-queue"))
+	})
+
+	t.Run("Injected latency", func(t *testing.T) {
+		defer stubServer.Reset()
+		stubServer.InjectLatency(200 * time.Millisecond)
+
+		req, err := http.NewRequest("POST", "/test", strings.NewReader(`{"inject":"latency"}`))
+		require.NoError(t, err)
+		start := time.Now()
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+		assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	})
+}
+
+func TestTransportLocalBuffer(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	transport := NewTransportWithClient(client)
+	transport.EnableLocalBuffer = true
+	transport.BufferSize = 1
+	transport.RetryBackoff = func(int) time.Duration { return 10 * time.Millisecond }
+
+	send := func(body string) *http.Response {
+		req, err := http.NewRequest("POST", "/test", strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("Buffered retry", func(t *testing.T) {
+		defer stubServer.Reset()
+		// 送信を3回失敗させる
+		stubServer.InjectError(http.MethodPost, `/messages$`, http.StatusServiceUnavailable, simplemq.APIError{Code: 503, Message: "injected"}, 3)
+
+		// 送信に失敗してもバッファに格納され、202 Accepted が返ること
+		resp := send(`{"buffered":"retry"}`)
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+		assert.Equal(t, "true", resp.Header.Get("SimpleMQ-Message-Buffered"))
+		assert.Empty(t, resp.Header.Get("SimpleMQ-Message-ID"))
+
+		// バックグラウンドで再送信されること
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, transport.Flush(ctx))
+		msg, ok := stubServer.WaitForMessage("test-queue", time.Second)
+		require.True(t, ok)
+		assert.Equal(t, base64.StdEncoding.EncodeToString([]byte(`{"buffered":"retry"}`)), msg.Content)
+	})
+
+	t.Run("Buffer is full", func(t *testing.T) {
+		defer stubServer.Reset()
+		// 送信を常に失敗させる
+		stubServer.InjectError(http.MethodPost, `/messages$`, http.StatusServiceUnavailable, simplemq.APIError{Code: 503, Message: "injected"}, 0)
+
+		assert.Equal(t, http.StatusAccepted, send(`{"buffered":"first"}`).StatusCode)
+		// バッファが一杯の場合は、送信のエラーが返ること
+		assert.Equal(t, http.StatusServiceUnavailable, send(`{"buffered":"second"}`).StatusCode)
+
+		// 送信できない間は、Flush が ctx の終了で戻ること
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, transport.Flush(ctx), context.DeadlineExceeded)
+
+		// API が復旧すると、バッファのメッセージが送信されること
+		stubServer.Reset()
+		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, transport.Flush(ctx))
+		assert.Equal(t, 1, stubServer.GetQueueSize("test-queue"))
+	})
+
+	t.Run("Permanent error is not buffered", func(t *testing.T) {
+		defer stubServer.Reset()
+		stubServer.InjectError(http.MethodPost, `/messages$`, http.StatusBadRequest, simplemq.APIError{Code: 400, Message: "injected"}, 1)
+		assert.Equal(t, http.StatusBadRequest, send(`{"buffered":"bad"}`).StatusCode)
+		require.NoError(t, transport.Flush(context.Background()))
+	})
+
+	t.Run("Idempotency key", func(t *testing.T) {
+		defer stubServer.Reset()
+		transport := NewTransportWithClient(client)
+		transport.EnableLocalBuffer = true
+		transport.IdempotencyWindow = time.Minute
+		transport.RetryBackoff = func(int) time.Duration { return 10 * time.Millisecond }
+		defer transport.Close()
+		stubServer.InjectError(http.MethodPost, `/messages$`, http.StatusServiceUnavailable, simplemq.APIError{Code: 503, Message: "injected"}, 1)
+
+		// 同じ冪等性キーのリクエストは、バッファに格納された送信の重複として扱われること
+		for range 2 {
+			req, err := http.NewRequest("POST", "/test", strings.NewReader(`{"buffered":"idempotent"}`))
+			require.NoError(t, err)
+			req.Header.Set(IdempotencyKeyHeader, "buffered-key")
+			resp, err := transport.RoundTrip(req)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+			assert.Equal(t, "true", resp.Header.Get("SimpleMQ-Message-Buffered"))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, transport.Flush(ctx))
+		assert.Equal(t, 1, stubServer.GetQueueSize("test-queue"))
+	})
+
+	t.Run("Confirmation failure is not buffered", func(t *testing.T) {
+		defer stubServer.Reset()
+		transport := NewTransportWithClient(client)
+		transport.EnableLocalBuffer = true
+		transport.ConfirmWrites = true
+		transport.MaxRetries = 3
+		transport.RetryBackoff = func(int) time.Duration { return 10 * time.Millisecond }
+		defer transport.Close()
+		stubServer.SetSendContentFilter(func(content string) string {
+			return content + "corrupted"
+		})
+		defer stubServer.SetSendContentFilter(nil)
+
+		// 既に保存されたメッセージは、再試行もバッファへの格納もされないこと
+		req, err := http.NewRequest("POST", "/test", strings.NewReader(`{"buffered":"confirm"}`))
+		require.NoError(t, err)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("SimpleMQ-Message-Buffered"))
+		require.NoError(t, transport.Flush(context.Background()))
+		assert.Equal(t, 1, stubServer.GetQueueSize("test-queue"))
+	})
+}
+
+func TestTransportClose(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	transport := NewTransportWithClient(client)
+	transport.EnableLocalBuffer = true
+	transport.RetryBackoff = func(int) time.Duration { return 10 * time.Millisecond }
+
+	// 送信を常に失敗させる
+	stubServer.InjectError(http.MethodPost, `/messages$`, http.StatusServiceUnavailable, simplemq.APIError{Code: 503, Message: "injected"}, 0)
+	req, err := http.NewRequest("POST", "/test", strings.NewReader(`{"buffered":"close"}`))
+	require.NoError(t, err)
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "true", resp.Header.Get("SimpleMQ-Message-Buffered"))
+
+	// Close は再送信を止め、送信できなかったメッセージの数をエラーで返すこと
+	done := make(chan error, 1)
+	go func() { done <- transport.Close() }()
+	select {
+	case err := <-done:
+		assert.ErrorContains(t, err, "1 buffered messages were not sent")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close should stop resending buffered messages")
+	}
+	require.NoError(t, transport.Flush(context.Background()))
+
+	// Close の後はバッファに格納されず、送信のエラーが返ること
+	req, err = http.NewRequest("POST", "/test", strings.NewReader(`{"buffered":"after-close"}`))
+	require.NoError(t, err)
+	resp, err = transport.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.NoError(t, transport.Close())
+}
+
+func TestTransportTooLarge(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	large := strings.Repeat("a", 256*1024+1)
+
+	t.Run("Synthesize 413 response", func(t *testing.T) {
+		httpClient := &http.Client{Transport: NewTransportWithClient(client)}
+		resp, err := httpClient.Post("http://example.com/", "text/plain", strings.NewReader(large))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, ErrTooLarge.Error(), string(body))
+		// メッセージは送信されないこと
+		assert.Equal(t, 0, stubServer.GetQueueSize("test-queue"))
+	})
+
+	t.Run("Raw error", func(t *testing.T) {
+		transport := NewTransportWithClient(client)
+		transport.RawTooLargeError = true
+		httpClient := &http.Client{Transport: transport}
+		_, err := httpClient.Post("http://example.com/", "text/plain", strings.NewReader(large))
+		assert.ErrorIs(t, err, ErrTooLarge)
+	})
+}
+
+func TestHeaderPrefix(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	// Transportのレスポンスに接頭辞付きのヘッダーが付与されること
+	transport := NewTransportWithClient(client)
+	transport.HeaderPrefix = "X-MyApp-"
+	req, err := http.NewRequest("POST", "/test", strings.NewReader(`{"header":"prefix"}`))
+	require.NoError(t, err)
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	messageID := resp.Header.Get("X-MyApp-Message-ID")
+	require.NotEmpty(t, messageID)
+	assert.Equal(t, "test-queue", resp.Header.Get("X-MyApp-Queue-Name"))
+	assert.Empty(t, resp.Header.Get("SimpleMQ-Message-ID"))
+
+	// Listenerで受信したリクエストにも同じ接頭辞のヘッダーが付与されること
+	headerCh := make(chan http.Header, 1)
+	listener := NewListenerWithClient(client)
+	listener.HeaderPrefix = "X-MyApp-"
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			headerCh <- r.Header.Clone()
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	select {
+	case header := <-headerCh:
+		assert.Equal(t, messageID, header.Get("X-MyApp-Message-ID"))
+		assert.Equal(t, "test-queue", header.Get("X-MyApp-Queue-Name"))
+		assert.NotEmpty(t, header.Get("X-MyApp-Queue-Wait-Ms"))
+		assert.Empty(t, header.Get("SimpleMQ-Message-ID"))
+	case <-time.After(5 * time.Second):
+		t.Fatal("message should be delivered")
+	}
+}
+
+func TestTransportMessageTTL(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+	transport := NewTransportWithClient(client)
+	transport.Serializer = &JSONSerializer{}
+
+	req, err := http.NewRequest("POST", "/test", strings.NewReader(`{"ttl":true}`))
+	require.NoError(t, err)
+	req.Header.Set(MessageTTLHeader, "1")
+	before := time.Now()
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	// 有効期限がレスポンスのヘッダーで返されること
+	expires, err := time.Parse(time.RFC3339, resp.Header.Get("SimpleMQ-Message-Expires"))
+	require.NoError(t, err)
+	assert.WithinDuration(t, before.Add(time.Second), expires, 2*time.Second)
+
+	// 有効期限のヘッダーはメッセージの内容に含まれないこと
+	msg := stubServer.GetMessage("test-queue", resp.Header.Get("SimpleMQ-Message-ID"))
+	require.NotNil(t, msg)
+	assert.NotContains(t, msg.Content, MessageTTLHeader)
+
+	// 有効期限を過ぎたメッセージは受信されないこと
+	time.Sleep(1100 * time.Millisecond)
+	msgs, err := client.ReceiveMessages(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, msgs)
+	assert.Equal(t, 0, stubServer.GetQueueSize("test-queue"))
+
+	// 不正な値の場合はエラーになること
+	req, err = http.NewRequest("POST", "/test", strings.NewReader(`{"ttl":"invalid"}`))
+	require.NoError(t, err)
+	req.Header.Set(MessageTTLHeader, "soon")
+	_, err = transport.RoundTrip(req)
+	assert.Error(t, err)
+}
+
+func TestTransportLogger(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	var buf syncBuffer
+	transport := NewTransportWithClient(client)
+	transport.Logger = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	logs := func() []map[string]any {
+		var entries []map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var entry map[string]any
+			require.NoError(t, json.Unmarshal([]byte(line), &entry))
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	req, err := http.NewRequest("POST", "/test", strings.NewReader(`{"log":true}`))
+	require.NoError(t, err)
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	// 送信に成功した場合は、Conn と同じフィールド名でメッセージ ID とキューを記録すること
+	entries := logs()
+	require.Len(t, entries, 2)
+	assert.Equal(t, "serialized request", entries[0]["msg"])
+	assert.Equal(t, "test-queue", entries[0]["queue"])
+	assert.Equal(t, "message sent", entries[1]["msg"])
+	assert.Equal(t, resp.Header.Get("SimpleMQ-Message-ID"), entries[1]["message_id"])
+	assert.Equal(t, "test-queue", entries[1]["queue"])
+
+	// 送信に失敗した場合は、エラーを記録すること
+	stubServer.InjectError(http.MethodPost, `/messages$`, http.StatusBadRequest, simplemq.APIError{Code: 400, Message: "injected"}, 1)
+	req, err = http.NewRequest("POST", "/test", strings.NewReader(`{"log":false}`))
+	require.NoError(t, err)
+	resp, err = transport.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	entries = logs()
+	last := entries[len(entries)-1]
+	assert.Equal(t, "failed to send message", last["msg"])
+	assert.Equal(t, "ERROR", last["level"])
+	assert.Contains(t, last["err"], "injected")
+}
+
+func TestClientAccessor(t *testing.T) {
+	client := simplemq.NewClient("test-api-key", "test-queue")
+
+	// Transport と Listener が同じクライアントを返すこと
+	assert.Same(t, client, NewTransportWithClient(client).Client())
+	assert.Same(t, client, NewListenerWithClient(client).Client())
+
+	// NewTransport と NewListener で作成したクライアントも参照できること
+	transport := NewTransport("test-api-key", "another-queue")
+	require.NotNil(t, transport.Client())
+	assert.Equal(t, "another-queue", transport.Client().Queue)
+	listener := NewListener("test-api-key", "another-queue")
+	require.NotNil(t, listener.Client())
+	assert.Equal(t, "another-queue", listener.Client().Queue)
+}
@@ -0,0 +1,144 @@
+package simplemqhttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// WebhookPayload は、WebhookResponseHandler が送信する処理結果のサマリーです。
+type WebhookPayload struct {
+	MessageID  string `json:"message_id"`
+	QueueName  string `json:"queue_name"`
+	StatusCode int    `json:"status_code"`
+	Success    bool   `json:"success"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// WebhookResponseHandler は、メッセージの処理結果を JSON で Webhook に POST する ResponseHandler 実装です。
+// Webhook は処理結果の通知に過ぎないため、送信に失敗してもログに記録するだけで、メッセージの削除や再配信には影響しません。
+// Success は、Listener.AckStatusCodes が指定されている場合はその判定に従い、未指定の場合は 2xx を成功とします。
+type WebhookResponseHandler struct {
+	// URL は、処理結果を送信する Webhook の URL です。
+	URL string
+	// Client は、Webhook の送信に使用する HTTP クライアントです。
+	// 未指定の場合は、http.DefaultClient が使用されます。
+	Client *http.Client
+	// MaxRetries は、送信に失敗した場合の最大再試行回数です。
+	MaxRetries int
+	// RetryInterval は、再試行までの待機時間です。
+	// 未指定の場合は、1秒が使用されます。
+	RetryInterval time.Duration
+	// Timeout は、再試行を含めた送信全体の制限時間です。
+	// 未指定の場合は、DefaultWebhookTimeout が使用されます。
+	Timeout time.Duration
+	// Logger は、送信に失敗した場合のログの出力先です。
+	// 未指定の場合は、slog.Default() が使用されます。
+	Logger *slog.Logger
+}
+
+// DefaultWebhookTimeout は、WebhookResponseHandler.Timeout の既定値です。
+const DefaultWebhookTimeout = 10 * time.Second
+
+var _ ResponseHandler = &WebhookResponseHandler{}
+
+func (h *WebhookResponseHandler) client() *http.Client {
+	if h.Client != nil {
+		return h.Client
+	}
+	return http.DefaultClient
+}
+
+func (h *WebhookResponseHandler) retryInterval() time.Duration {
+	if h.RetryInterval > 0 {
+		return h.RetryInterval
+	}
+	return time.Second
+}
+
+func (h *WebhookResponseHandler) timeout() time.Duration {
+	if h.Timeout > 0 {
+		return h.Timeout
+	}
+	return DefaultWebhookTimeout
+}
+
+func (h *WebhookResponseHandler) logger() *slog.Logger {
+	if h.Logger != nil {
+		return h.Logger
+	}
+	return slog.Default()
+}
+
+// HandleResponse は、処理結果を Webhook に送信します。
+// 送信はリクエストのコンテキストと Timeout で打ち切られ、失敗した場合もエラーを返さずに DefaultDisposition を返します。
+func (h *WebhookResponseHandler) HandleResponse(resp *http.Response, req *http.Request) (Disposition, error) {
+	payload := WebhookPayload{
+		MessageID:  req.Header.Get("SimpleMQ-Message-ID"),
+		QueueName:  req.Header.Get("SimpleMQ-Queue-Name"),
+		StatusCode: resp.StatusCode,
+		Success:    resp.StatusCode >= 200 && resp.StatusCode < 300,
+	}
+	if conn, ok := connFromContext(req.Context()); ok {
+		// HeaderPrefix が変更されていてもメッセージを特定できるよう、接続の情報を優先する
+		payload.MessageID = conn.msg.ID
+		payload.QueueName = conn.client.Queue
+		payload.DurationMs = conn.ProcessingDuration().Milliseconds()
+		payload.Success = conn.shouldAck(resp.StatusCode)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		h.logger().Error("failed to marshal webhook payload", "err", err, "message_id", payload.MessageID)
+		return DefaultDisposition, nil
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), h.timeout())
+	defer cancel()
+	if err := h.postWithRetry(ctx, body); err != nil {
+		h.logger().Warn("failed to post webhook", "err", err, "message_id", payload.MessageID, "queue", payload.QueueName)
+	}
+	return DefaultDisposition, nil
+}
+
+// postWithRetry は、MaxRetries まで再試行しながら Webhook に送信します。ctx が終了した場合は待機を打ち切ります。
+func (h *WebhookResponseHandler) postWithRetry(ctx context.Context, body []byte) error {
+	var lastErr error
+	for attempt := 0; attempt <= h.MaxRetries; attempt++ {
+		if attempt > 0 {
+			if ctx.Err() != nil {
+				return lastErr
+			}
+			timer := time.NewTimer(h.retryInterval())
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return fmt.Errorf("%w (last error: %w)", ctx.Err(), lastErr)
+			}
+		}
+		if lastErr = h.post(ctx, body); lastErr == nil {
+			return nil
+		}
+	}
+	return lastErr
+}
+
+func (h *WebhookResponseHandler) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected webhook status: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package simplemqhttp
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mashiike/simplemqhttp/simplemq"
+	"github.com/mashiike/simplemqhttp/stub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookResponseHandler(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	// テスト用のclientを作成
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	// 最初の送信は失敗させ、再試行されることを確認する
+	var webhookCalls atomic.Int32
+	payloadCh := make(chan WebhookPayload, 2)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if webhookCalls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload WebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		payloadCh <- payload
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer webhook.Close()
+
+	listener := NewListenerWithClient(client)
+	listener.ResponseHandler = &WebhookResponseHandler{
+		URL:           webhook.URL,
+		Client:        webhook.Client(),
+		MaxRetries:    2,
+		RetryInterval: 10 * time.Millisecond,
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			bs, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if string(bs) == `{"result":"fail"}` {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	testCases := []struct {
+		name           string
+		content        string
+		expectedStatus int
+		expectedOK     bool
+	}{
+		{
+			name:           "Success outcome",
+			content:        `{"result":"ok"}`,
+			expectedStatus: http.StatusOK,
+			expectedOK:     true,
+		},
+		{
+			name:           "Failure outcome",
+			content:        `{"result":"fail"}`,
+			expectedStatus: http.StatusInternalServerError,
+			expectedOK:     false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := stubServer.AddMessage("test-queue", tc.content)
+			select {
+			case payload := <-payloadCh:
+				assert.Equal(t, msg.ID, payload.MessageID)
+				assert.Equal(t, "test-queue", payload.QueueName)
+				assert.Equal(t, tc.expectedStatus, payload.StatusCode)
+				assert.Equal(t, tc.expectedOK, payload.Success)
+				assert.GreaterOrEqual(t, payload.DurationMs, int64(0))
+			case <-time.After(5 * time.Second):
+				t.Fatal("webhook should be called")
+			}
+		})
+	}
+	assert.Equal(t, int32(3), webhookCalls.Load())
+}
+
+func TestWebhookResponseHandlerFailure(t *testing.T) {
+	// stubサーバーの作成
+	apiKey := "test-api-key"
+	stubServer := stub.NewServer(apiKey)
+	defer stubServer.Close()
+
+	client := simplemq.NewClient(apiKey, "test-queue")
+	client.Endpoint = stubServer.URL()
+
+	// 応答しない Webhook
+	release := make(chan struct{})
+	var webhookCalls atomic.Int32
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		webhookCalls.Add(1)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer webhook.Close()
+	defer close(release)
+
+	payloadCh := make(chan WebhookPayload, 1)
+	listener := NewListenerWithClient(client)
+	// 409 も処理済みとして扱う
+	listener.AckStatusCodes = func(code int) bool {
+		return code == http.StatusConflict || (code >= 200 && code < 300)
+	}
+	listener.ResponseHandler = &WebhookResponseHandler{
+		URL:           webhook.URL,
+		Client:        webhook.Client(),
+		MaxRetries:    100,
+		RetryInterval: time.Hour,
+		Timeout:       100 * time.Millisecond,
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusConflict)
+		}),
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Logf("HTTP server error: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	// Webhook の送信が失敗しても、制限時間で打ち切られてメッセージは削除されること
+	start := time.Now()
+	msg := stubServer.AddMessage("test-queue", `{"webhook":"down"}`)
+	require.True(t, stubServer.WaitForDeletion("test-queue", msg.ID, 5*time.Second))
+	assert.Less(t, time.Since(start), 3*time.Second)
+	assert.Equal(t, int32(1), webhookCalls.Load())
+
+	// Success は AckStatusCodes の判定に従うこと
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload WebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err == nil {
+			payloadCh <- payload
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+	handler := &WebhookResponseHandler{URL: receiver.URL, Client: receiver.Client()}
+	req, err := http.NewRequest(http.MethodPost, "/", nil)
+	require.NoError(t, err)
+	conn := &Conn{msg: simplemq.Message{ID: "message-1"}, client: client, ackStatus: listener.AckStatusCodes}
+	req = req.WithContext(context.WithValue(req.Context(), connContextKey{}, conn))
+	d, err := handler.HandleResponse(&http.Response{StatusCode: http.StatusConflict}, req)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultDisposition, d)
+	payload := <-payloadCh
+	assert.Equal(t, "message-1", payload.MessageID)
+	assert.True(t, payload.Success)
+}